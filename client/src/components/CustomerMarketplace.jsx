@@ -15,7 +15,8 @@ import {
 
 const CustomerMarketplace = () => {
   const [products, setProducts] = useState([]);
-  const [filteredProducts, setFilteredProducts] = useState([]);
+  const [total, setTotal] = useState(0);
+  const [nextCursor, setNextCursor] = useState(null);
   const [loading, setLoading] = useState(false);
   const [searchTerm, setSearchTerm] = useState('');
   const [selectedCategory, setSelectedCategory] = useState('all');
@@ -44,62 +45,37 @@ const CustomerMarketplace = () => {
   ];
 
   useEffect(() => {
-    fetchProducts();
     loadFavorites();
   }, []);
 
-  const filterAndSortProducts = useCallback(() => {
-    let filtered = products.filter(product => {
-      const matchesSearch = product.name.toLowerCase().includes(searchTerm.toLowerCase()) ||
-                           product.description.toLowerCase().includes(searchTerm.toLowerCase()) ||
-                           product.farmer?.name?.toLowerCase().includes(searchTerm.toLowerCase());
-      
-      const matchesCategory = selectedCategory === 'all' || 
-                             product.category.toLowerCase() === selectedCategory.toLowerCase();
-      
-      const matchesPrice = product.price >= priceRange[0] && product.price <= priceRange[1];
-      
-      return matchesSearch && matchesCategory && matchesPrice;
-    });
-
-    // Sort products
-    filtered.sort((a, b) => {
-      switch (sortBy) {
-        case 'price_low':
-          return a.price - b.price;
-        case 'price_high':
-          return b.price - a.price;
-        case 'rating':
-          return (b.rating || 0) - (a.rating || 0);
-        case 'popular':
-          return (b.orders || 0) - (a.orders || 0);
-        case 'newest':
-        default:
-          return new Date(b.createdAt || 0) - new Date(a.createdAt || 0);
-      }
-    });
-
-    setFilteredProducts(filtered);
-  }, [products, searchTerm, selectedCategory, priceRange, sortBy]);
-
-  useEffect(() => {
-    filterAndSortProducts();
-  }, [filterAndSortProducts]);
+  // Searching, filtering and sorting happen on the server, one page at a time
+  const fetchProducts = useCallback(async (cursor) => {
+    const params = new URLSearchParams({ sort: sortBy });
+    if (searchTerm.trim()) params.append('q', searchTerm.trim());
+    if (selectedCategory !== 'all') params.append('category', selectedCategory);
+    params.append('minPrice', priceRange[0]);
+    params.append('maxPrice', priceRange[1]);
+    if (cursor) params.append('cursor', cursor);
 
-  const fetchProducts = async () => {
     try {
       setLoading(true);
-      const response = await fetch('/api/products');
+      const response = await fetch(`/api/products?${params}`);
       if (response.ok) {
         const data = await response.json();
-        setProducts(data);
+        setProducts(prev => (cursor ? [...prev, ...data.products] : data.products));
+        setTotal(data.total);
+        setNextCursor(data.nextCursor || null);
       }
     } catch (error) {
       console.error('Error fetching products:', error);
     } finally {
       setLoading(false);
     }
-  };
+  }, [searchTerm, selectedCategory, priceRange, sortBy]);
+
+  useEffect(() => {
+    fetchProducts();
+  }, [fetchProducts]);
 
   const loadFavorites = () => {
     const savedFavorites = JSON.parse(localStorage.getItem('favorites') || '[]');
@@ -115,7 +91,8 @@ const CustomerMarketplace = () => {
     localStorage.setItem('favorites', JSON.stringify(newFavorites));
   };
 
-  const addToCart = async (product) => {
+  // Products with variants are added in the given variant
+  const addToCart = async (product, variant) => {
     try {
       const response = await fetch('/api/cart/add', {
         method: 'POST',
@@ -125,6 +102,7 @@ const CustomerMarketplace = () => {
         },
         body: JSON.stringify({
           productId: product._id,
+          variantId: variant?._id,
           quantity: 1
         })
       });
@@ -207,13 +185,13 @@ const CustomerMarketplace = () => {
         <div className="flex items-center justify-between">
           <div>
             <span className="text-xl font-bold text-primary-600">
-              ${product.price}
+              ${product.price}{product.maxPrice && ` - $${product.maxPrice}`}
             </span>
-            <span className="text-gray-500 text-sm">/{product.unit}</span>
+            {!product.variants?.length && <span className="text-gray-500 text-sm">/{product.unit}</span>}
           </div>
           
           <Button
-            onClick={() => addToCart(product)}
+            onClick={() => addToCart(product, product.variants?.find(v => v.stock > 0))}
             disabled={product.stock === 0}
             className="bg-primary-500 hover:bg-primary-600"
           >
@@ -347,7 +325,7 @@ const CustomerMarketplace = () => {
             <div className="flex items-center justify-between mb-6">
               <div className="flex items-center space-x-4">
                 <p className="text-gray-600">
-                  {filteredProducts.length} products found
+                  {total} products found
                 </p>
                 <button
                   onClick={() => setShowFilters(!showFilters)}
@@ -375,16 +353,16 @@ const CustomerMarketplace = () => {
             </div>
 
             {/* Products Grid/List */}
-            {loading ? (
+            {loading && products.length === 0 ? (
               <div className="flex items-center justify-center py-12">
                 <div className="spinner"></div>
               </div>
-            ) : filteredProducts.length > 0 ? (
+            ) : products.length > 0 ? (
               <div className={viewMode === 'grid' 
                 ? 'grid grid-cols-1 md:grid-cols-2 lg:grid-cols-3 gap-6' 
                 : 'space-y-4'
               }>
-                {filteredProducts.map(product => (
+                {products.map(product => (
                   <ProductCard 
                     key={product._id} 
                     product={product} 
@@ -401,6 +379,14 @@ const CustomerMarketplace = () => {
                 </p>
               </div>
             )}
+
+            {nextCursor && (
+              <div className="flex justify-center mt-8">
+                <Button onClick={() => fetchProducts(nextCursor)} disabled={loading}>
+                  {loading ? 'Loading...' : 'Load more'}
+                </Button>
+              </div>
+            )}
           </div>
         </div>
       </div>
@@ -7,6 +7,8 @@ const EnhancedProductManager = () => {
   const [showAddModal, setShowAddModal] = useState(false);
   const [editingProduct, setEditingProduct] = useState(null);
   const [loading, setLoading] = useState(false);
+  // Files picked in the form, uploaded once the product is saved
+  const [pendingImages, setPendingImages] = useState([]);
 
   const [formData, setFormData] = useState({
     name: '',
@@ -34,7 +36,11 @@ const EnhancedProductManager = () => {
   const fetchProducts = async () => {
     try {
       setLoading(true);
-      const response = await fetch('/api/products');
+      const response = await fetch('/api/products/farmer', {
+        headers: {
+          'Authorization': `Bearer ${localStorage.getItem('token')}`
+        }
+      });
       const data = await response.json();
       setProducts(data);
     } catch (error) {
@@ -61,6 +67,9 @@ const EnhancedProductManager = () => {
       });
 
       if (response.ok) {
+        const data = await response.json();
+        const productId = editingProduct ? editingProduct._id : data.product._id;
+        await uploadPendingImages(productId);
         fetchProducts();
         resetForm();
         setShowAddModal(false);
@@ -97,7 +106,8 @@ const EnhancedProductManager = () => {
     setFormData({
       name: product.name,
       description: product.description,
-      price: product.price,
+      // Saving restores the regular price of a marked down product
+      price: product.markdown ? product.markdown.regularPrice : product.price,
       category: product.category,
       stock: product.stock,
       unit: product.unit,
@@ -125,20 +135,59 @@ const EnhancedProductManager = () => {
   };
 
   const handleImageUpload = (e) => {
-    const files = Array.from(e.target.files);
-    // In a real app, you'd upload these to a server
-    const imageUrls = files.map(file => URL.createObjectURL(file));
-    setFormData(prev => ({
-      ...prev,
-      images: [...prev.images, ...imageUrls]
+    const files = Array.from(e.target.files).map(file => ({
+      file,
+      preview: URL.createObjectURL(file)
     }));
+    setPendingImages(prev => [...prev, ...files]);
   };
 
-  const removeImage = (index) => {
-    setFormData(prev => ({
-      ...prev,
-      images: prev.images.filter((_, i) => i !== index)
-    }));
+  const removePendingImage = (index) => {
+    setPendingImages(prev => {
+      URL.revokeObjectURL(prev[index].preview);
+      return prev.filter((_, i) => i !== index);
+    });
+  };
+
+  // The server checks, resizes and stores each image
+  const uploadPendingImages = async (productId) => {
+    for (const { file, preview } of pendingImages) {
+      const body = new FormData();
+      body.append('image', file);
+      const response = await fetch(`/api/products/${productId}/images`, {
+        method: 'POST',
+        headers: {
+          'Authorization': `Bearer ${localStorage.getItem('token')}`
+        },
+        body
+      });
+      if (!response.ok) {
+        const data = await response.json().catch(() => ({}));
+        console.error(`Error uploading ${file.name}:`, data.error);
+      }
+      URL.revokeObjectURL(preview);
+    }
+    setPendingImages([]);
+  };
+
+  const removeUploadedImage = async (imageId) => {
+    try {
+      const response = await fetch(`/api/products/${editingProduct._id}/images/${imageId}`, {
+        method: 'DELETE',
+        headers: {
+          'Authorization': `Bearer ${localStorage.getItem('token')}`
+        }
+      });
+      if (response.ok) {
+        setEditingProduct(prev => ({
+          ...prev,
+          photos: prev.photos.filter(photo => photo._id !== imageId)
+        }));
+        fetchProducts();
+      }
+    } catch (error) {
+      console.error('Error deleting image:', error);
+    }
   };
 
   const getStockStatus = (stock) => {
@@ -170,9 +219,9 @@ const EnhancedProductManager = () => {
           return (
             <div key={product._id} className="product-card">
               <div className="relative">
-                {product.images && product.images.length > 0 ? (
+                {product.photos?.length > 0 || product.images?.length > 0 ? (
                   <img 
-                    src={product.images[0]} 
+                    src={product.photos?.[0]?.urls.medium || product.images[0]} 
                     alt={product.name}
                     className="w-full h-48 object-cover"
                   />
@@ -198,6 +247,14 @@ const EnhancedProductManager = () => {
                   {product.description}
                 </p>
                 
+                {product.expiryDate && new Date(product.expiryDate) <= new Date() ? (
+                  <p className="text-sm text-red-600 mb-3">Expired, hidden from customers</p>
+                ) : product.markdown && (
+                  <p className="text-sm text-orange-600 mb-3">
+                    {product.markdown.percent}% off until it expires, regular price ${product.markdown.regularPrice}
+                  </p>
+                )}
+
                 <div className="flex items-center justify-between mb-3">
                   <span className="text-sm text-gray-500">Stock: {product.stock} {product.unit}</span>
                   <span className="text-sm bg-gray-100 px-2 py-1 rounded">
@@ -351,7 +408,7 @@ const EnhancedProductManager = () => {
                     <input
                       type="file"
                       multiple
-                      accept="image/*"
+                      accept="image/jpeg,image/png,image/gif"
                       onChange={handleImageUpload}
                       className="hidden"
                       id="image-upload"
@@ -363,18 +420,34 @@ const EnhancedProductManager = () => {
                       </div>
                     </label>
                     
-                    {formData.images.length > 0 && (
+                    {(editingProduct?.photos?.length > 0 || pendingImages.length > 0) && (
                       <div className="grid grid-cols-3 gap-2 mt-4">
-                        {formData.images.map((image, index) => (
-                          <div key={index} className="relative">
+                        {(editingProduct?.photos || []).map(photo => (
+                          <div key={photo._id} className="relative">
+                            <img 
+                              src={photo.urls.thumb} 
+                              alt="Product"
+                              className="w-full h-20 object-cover rounded"
+                            />
+                            <button
+                              type="button"
+                              onClick={() => removeUploadedImage(photo._id)}
+                              className="absolute -top-2 -right-2 bg-red-500 text-white rounded-full w-6 h-6 flex items-center justify-center text-xs"
+                            >
+                              ×
+                            </button>
+                          </div>
+                        ))}
+                        {pendingImages.map((image, index) => (
+                          <div key={image.preview} className="relative">
                             <img 
-                              src={image} 
-                              alt={`Product ${index + 1}`}
+                              src={image.preview} 
+                              alt={`New image ${index + 1}`}
                               className="w-full h-20 object-cover rounded"
                             />
                             <button
                               type="button"
-                              onClick={() => removeImage(index)}
+                              onClick={() => removePendingImage(index)}
                               className="absolute -top-2 -right-2 bg-red-500 text-white rounded-full w-6 h-6 flex items-center justify-center text-xs"
                             >
                               ×
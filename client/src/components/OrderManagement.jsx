@@ -52,7 +52,30 @@ const OrderManagement = () => {
     }
   };
 
+  // Lines sold by weight are charged by what was packed, asked for when the
+  // order becomes ready
+  const askWeights = (order) => {
+    const weights = [];
+    for (const item of order.items || []) {
+      if (!item.catchWeight || item.catchWeight.total) continue;
+      const answer = window.prompt(
+        `Packed weight in grams of ${item.quantity} x ${item.name} (about ${item.catchWeight.estimatedGrams} g)`
+      );
+      const grams = parseInt(answer, 10);
+      if (!grams || grams <= 0) return null;
+      weights.push({ productId: item.productId, variantId: item.variantId, actualGrams: grams });
+    }
+    return weights;
+  };
+
   const updateOrderStatus = async (orderId, newStatus) => {
+    const body = { status: newStatus };
+    if (newStatus === 'ready') {
+      const weights = askWeights(orders.find(o => o._id === orderId) || {});
+      if (weights === null) return;
+      if (weights.length > 0) body.weights = weights;
+    }
+
     try {
       const response = await fetch(`/api/orders/${orderId}/status`, {
         method: 'PUT',
@@ -60,7 +83,7 @@ const OrderManagement = () => {
           'Content-Type': 'application/json',
           'Authorization': `Bearer ${localStorage.getItem('token')}`
         },
-        body: JSON.stringify({ status: newStatus })
+        body: JSON.stringify(body)
       });
 
       if (response.ok) {
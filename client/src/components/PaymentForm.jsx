@@ -51,9 +51,8 @@ const CheckoutForm = ({ order, onPaymentSuccess, onPaymentError }) => {
           'Content-Type': 'application/json',
           'Authorization': `Bearer ${localStorage.getItem('token')}`,
         },
+        // The server charges the stored order total
         body: JSON.stringify({
-          amount: Math.round(order.totalAmount * 100), // Convert to cents
-          currency: 'usd',
           order_id: order._id,
         }),
       });
@@ -7,6 +7,8 @@ import toast from 'react-hot-toast';
 const ProductCard = ({ product }) => {
   const { addToCart } = useCart();
 
+  const hasVariants = product.variants?.length > 0;
+
   const handleAddToCart = () => {
     addToCart(product, 1);
     toast.success(`${product.name} added to cart!`);
@@ -19,9 +21,9 @@ const ProductCard = ({ product }) => {
   return (
     <div className="card hover:shadow-lg transition-shadow">
       <div className="relative">
-        {product.images && product.images.length > 0 ? (
+        {product.photos?.length > 0 || product.images?.length > 0 ? (
           <img
-            src={`/uploads/${product.images[0]}`}
+            src={product.photos?.[0]?.urls.medium || `/uploads/${product.images[0]}`}
             alt={product.name}
             className="w-full h-48 object-cover rounded-t-lg"
           />
@@ -45,7 +47,7 @@ const ProductCard = ({ product }) => {
 
         <div className="flex items-center text-sm text-gray-500 mb-2">
           <MapPin size={16} className="mr-1" />
-          <span>{product.farmer?.farmInfo?.farmName || product.farmer?.name}</span>
+          <span>{product.farm?.name || product.farmer?.farmInfo?.farmName || product.farmer?.name}</span>
         </div>
 
         {product.harvestDate && (
@@ -59,8 +61,17 @@ const ProductCard = ({ product }) => {
           <div>
             <span className="text-xl font-bold text-green-600">
               ${product.price.toFixed(2)}
+              {product.maxPrice && ` - $${product.maxPrice.toFixed(2)}`}
             </span>
-            <span className="text-gray-500 text-sm">/{product.unit}</span>
+            {!hasVariants && <span className="text-gray-500 text-sm">/{product.unit}</span>}
+            {product.markdown && (
+              <div className="text-sm">
+                <span className="text-gray-400 line-through mr-2">
+                  ${product.markdown.regularPrice.toFixed(2)}
+                </span>
+                <span className="text-red-600 font-medium">{product.markdown.percent}% off, expires soon</span>
+              </div>
+            )}
           </div>
           <span className="text-sm text-gray-500">
             {product.quantity} {product.unit} available
@@ -74,13 +85,16 @@ const ProductCard = ({ product }) => {
           >
             View Details
           </Link>
-          <button
-            onClick={handleAddToCart}
-            className="btn btn-primary btn-sm"
-            disabled={product.quantity === 0}
-          >
-            <ShoppingCart size={16} />
-          </button>
+          {/* Variants are chosen on the product page */}
+          {!hasVariants && (
+            <button
+              onClick={handleAddToCart}
+              className="btn btn-primary btn-sm"
+              disabled={product.quantity === 0}
+            >
+              <ShoppingCart size={16} />
+            </button>
+          )}
         </div>
 
         {product.tags && product.tags.length > 0 && (
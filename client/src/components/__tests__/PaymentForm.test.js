@@ -97,8 +97,6 @@ describe('PaymentForm', () => {
           'Authorization': 'Bearer null',
         },
         body: JSON.stringify({
-          amount: 2599, // $25.99 in cents
-          currency: 'usd',
           order_id: mockOrder._id,
         }),
       });
@@ -24,23 +24,70 @@ export const AuthProvider = ({ children }) => {
     }
   }, []);
 
+  const storeSession = (data) => {
+    localStorage.setItem('token', data.token);
+    if (data.refreshToken) {
+      localStorage.setItem('refreshToken', data.refreshToken);
+    }
+  };
+
+  const clearSession = () => {
+    localStorage.removeItem('token');
+    localStorage.removeItem('refreshToken');
+  };
+
+  // Exchange the refresh token for a new access token; returns the new
+  // access token or null when the session is gone.
+  const refreshSession = async () => {
+    const refreshToken = localStorage.getItem('refreshToken');
+    if (!refreshToken) {
+      return null;
+    }
+
+    const response = await fetch('/api/auth/refresh', {
+      method: 'POST',
+      headers: {
+        'Content-Type': 'application/json',
+      },
+      body: JSON.stringify({ refreshToken }),
+    });
+    if (!response.ok) {
+      return null;
+    }
+
+    const data = await response.json();
+    storeSession(data);
+    return data.token;
+  };
+
   const fetchUserProfile = async (token) => {
     try {
-      const response = await fetch('/api/auth/profile', {
+      let response = await fetch('/api/auth/profile', {
         headers: {
           'Authorization': `Bearer ${token}`,
         },
       });
 
+      if (response.status === 401) {
+        const refreshed = await refreshSession();
+        if (refreshed) {
+          response = await fetch('/api/auth/profile', {
+            headers: {
+              'Authorization': `Bearer ${refreshed}`,
+            },
+          });
+        }
+      }
+
       if (response.ok) {
         const userData = await response.json();
         setUser(userData);
       } else {
-        localStorage.removeItem('token');
+        clearSession();
       }
     } catch (error) {
       console.error('Error fetching user profile:', error);
-      localStorage.removeItem('token');
+      clearSession();
     } finally {
       setLoading(false);
     }
@@ -58,7 +105,17 @@ export const AuthProvider = ({ children }) => {
 
       if (response.ok) {
         const data = await response.json();
-        localStorage.setItem('token', data.token);
+        // A second factor is needed first; the caller continues with
+        // verifyMfa, or sets up 2FA with the returned mfaToken
+        if (data.mfaRequired || data.mfaSetupRequired) {
+          return {
+            success: false,
+            mfaRequired: !!data.mfaRequired,
+            mfaSetupRequired: !!data.mfaSetupRequired,
+            mfaToken: data.mfaToken,
+          };
+        }
+        storeSession(data);
         setUser(data.user);
         return { success: true };
       } else {
@@ -70,6 +127,28 @@ export const AuthProvider = ({ children }) => {
     }
   };
 
+  const verifyMfa = async (mfaToken, code) => {
+    try {
+      const response = await fetch('/api/auth/mfa/verify', {
+        method: 'POST',
+        headers: {
+          'Content-Type': 'application/json',
+        },
+        body: JSON.stringify({ mfaToken, code }),
+      });
+
+      const data = await response.json();
+      if (response.ok) {
+        storeSession(data);
+        setUser(data.user);
+        return { success: true };
+      }
+      return { success: false, error: data.error };
+    } catch (error) {
+      return { success: false, error: 'Network error' };
+    }
+  };
+
   const register = async (userData) => {
     try {
       const response = await fetch('/api/auth/register', {
@@ -82,7 +161,7 @@ export const AuthProvider = ({ children }) => {
 
       if (response.ok) {
         const data = await response.json();
-        localStorage.setItem('token', data.token);
+        storeSession(data);
         setUser(data.user);
         return { success: true };
       } else {
@@ -94,16 +173,32 @@ export const AuthProvider = ({ children }) => {
     }
   };
 
-  const logout = () => {
-    localStorage.removeItem('token');
+  const logout = async () => {
+    const token = localStorage.getItem('token');
+    clearSession();
     setUser(null);
+
+    if (token) {
+      try {
+        await fetch('/api/auth/logout', {
+          method: 'POST',
+          headers: {
+            'Authorization': `Bearer ${token}`,
+          },
+        });
+      } catch (error) {
+        console.error('Error logging out:', error);
+      }
+    }
   };
 
   const value = {
     user,
     login,
+    verifyMfa,
     register,
     logout,
+    refreshSession,
     loading,
   };
 
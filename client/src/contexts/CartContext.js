@@ -31,35 +31,59 @@ export const CartProvider = ({ children }) => {
     localStorage.setItem('cart', JSON.stringify(cartItems));
   }, [cartItems]);
 
-  const addToCart = (product, quantity = 1) => {
+  // A cart line is a product, or one variant of it. Lines of variants carry
+  // the variant's price and unit and are told apart by lineId.
+  const lineIdOf = (item) => item.lineId || item._id;
+
+  const addToCart = (product, quantity = 1, variant = null) => {
+    const line = variant
+      ? {
+          ...product,
+          lineId: `${product._id}:${variant._id}`,
+          variantId: variant._id,
+          variantName: variant.name,
+          sku: variant.sku,
+          price: variant.price,
+          unit: variant.unit,
+        }
+      : { ...product };
+
+    // Products sold by weight cost about their price per kg times the weight
+    // of a unit; the final price follows packing
+    if (product.catchWeight) {
+      const grams = variant ? variant.weightGrams : product.estimatedWeightGrams;
+      line.price = Math.round(line.price * grams / 10) / 100;
+      line.estimated = true;
+    }
+
     setCartItems(prevItems => {
-      const existingItem = prevItems.find(item => item._id === product._id);
+      const existingItem = prevItems.find(item => lineIdOf(item) === lineIdOf(line));
       
       if (existingItem) {
         return prevItems.map(item =>
-          item._id === product._id
+          lineIdOf(item) === lineIdOf(line)
             ? { ...item, quantity: item.quantity + quantity }
             : item
         );
       } else {
-        return [...prevItems, { ...product, quantity }];
+        return [...prevItems, { ...line, quantity }];
       }
     });
   };
 
-  const removeFromCart = (productId) => {
-    setCartItems(prevItems => prevItems.filter(item => item._id !== productId));
+  const removeFromCart = (lineId) => {
+    setCartItems(prevItems => prevItems.filter(item => lineIdOf(item) !== lineId));
   };
 
-  const updateQuantity = (productId, quantity) => {
+  const updateQuantity = (lineId, quantity) => {
     if (quantity <= 0) {
-      removeFromCart(productId);
+      removeFromCart(lineId);
       return;
     }
 
     setCartItems(prevItems =>
       prevItems.map(item =>
-        item._id === productId
+        lineIdOf(item) === lineId
           ? { ...item, quantity }
           : item
       )
@@ -51,6 +51,7 @@ const Checkout = () => {
         body: JSON.stringify({
           items: cartItems.map(item => ({
             productId: item._id,
+            variantId: item.variantId,
             quantity: item.quantity,
             price: item.price
           })),
@@ -270,10 +271,14 @@ const Checkout = () => {
               <CardContent>
                 <div className="space-y-3">
                   {cartItems.map((item) => (
-                    <div key={item._id} className="flex justify-between items-center py-2 border-b last:border-b-0">
+                    <div key={item.lineId || item._id} className="flex justify-between items-center py-2 border-b last:border-b-0">
                       <div className="flex-1">
-                        <p className="font-medium text-sm">{item.name}</p>
-                        <p className="text-xs text-gray-600">Qty: {item.quantity}</p>
+                        <p className="font-medium text-sm">
+                          {item.name}{item.variantName && ` - ${item.variantName}`}
+                        </p>
+                        <p className="text-xs text-gray-600">
+                          Qty: {item.quantity}{item.estimated && ' (estimated, charged by packed weight)'}
+                        </p>
                       </div>
                       <p className="font-semibold text-sm">${(item.price * item.quantity).toFixed(2)}</p>
                     </div>
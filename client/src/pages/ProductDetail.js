@@ -10,6 +10,7 @@ const ProductDetail = () => {
   const { id } = useParams();
   const [quantity, setQuantity] = useState(1);
   const [selectedImage, setSelectedImage] = useState(0);
+  const [variantId, setVariantId] = useState(null);
   const { addToCart } = useCart();
 
   const { data: product, isLoading, error } = useQuery(
@@ -20,13 +21,20 @@ const ProductDetail = () => {
     }
   );
 
+  const variants = product?.variants || [];
+  const variant = variants.find(v => v._id === variantId) || variants[0] || null;
+  const price = variant ? variant.price : product?.price;
+  const regularPrice = variant ? variant.regularPrice : product?.markdown?.regularPrice;
+  const unit = variant ? variant.unit : product?.unit;
+  const available = variant ? variant.stock : product?.quantity;
+
   const handleAddToCart = () => {
-    if (quantity > product.quantity) {
+    if (quantity > available) {
       toast.error('Not enough stock available');
       return;
     }
-    addToCart(product, quantity);
-    toast.success(`${quantity} ${product.unit} of ${product.name} added to cart!`);
+    addToCart(product, quantity, variant);
+    toast.success(`${quantity} ${unit} of ${product.name} added to cart!`);
   };
 
   const formatDate = (date) => {
@@ -51,15 +59,21 @@ const ProductDetail = () => {
     );
   }
 
+  // Uploaded photos come in several sizes; older products link to one file
+  const gallery = [
+    ...(product.photos || []).map(photo => ({ large: photo.urls.large, thumb: photo.urls.thumb })),
+    ...(product.images || []).map(image => ({ large: `/uploads/${image}`, thumb: `/uploads/${image}` }))
+  ];
+
   return (
     <div className="container py-8">
       <div className="grid grid-cols-1 lg:grid-cols-2 gap-8">
         {/* Product Images */}
         <div>
           <div className="mb-4">
-            {product.images && product.images.length > 0 ? (
+            {gallery.length > 0 ? (
               <img
-                src={`/uploads/${product.images[selectedImage]}`}
+                src={gallery[selectedImage].large}
                 alt={product.name}
                 className="w-full h-96 object-cover rounded-lg"
               />
@@ -71,9 +85,9 @@ const ProductDetail = () => {
           </div>
 
           {/* Image Thumbnails */}
-          {product.images && product.images.length > 1 && (
+          {gallery.length > 1 && (
             <div className="flex space-x-2 overflow-x-auto">
-              {product.images.map((image, index) => (
+              {gallery.map((image, index) => (
                 <button
                   key={index}
                   onClick={() => setSelectedImage(index)}
@@ -82,7 +96,7 @@ const ProductDetail = () => {
                   }`}
                 >
                   <img
-                    src={`/uploads/${image}`}
+                    src={image.thumb}
                     alt={`${product.name} ${index + 1}`}
                     className="w-full h-full object-cover"
                   />
@@ -106,10 +120,44 @@ const ProductDetail = () => {
 
           <div className="flex items-center mb-4">
             <span className="text-3xl font-bold text-green-600">
-              ${product.price.toFixed(2)}
+              ${price.toFixed(2)}
             </span>
-            <span className="text-gray-500 text-lg ml-2">per {product.unit}</span>
+            <span className="text-gray-500 text-lg ml-2">
+              {product.catchWeight ? 'per kg' : `per ${unit}`}
+            </span>
+            {regularPrice && (
+              <span className="text-gray-400 text-lg line-through ml-3">${regularPrice.toFixed(2)}</span>
+            )}
           </div>
+          {product.markdown && (
+            <p className="text-sm text-red-600 mb-4">
+              {product.markdown.percent}% off: best before {new Date(product.expiryDate).toLocaleDateString()}
+            </p>
+          )}
+          {product.catchWeight && (
+            <p className="text-sm text-gray-600 mb-4">
+              Sold by weight: a {unit} weighs about {variant ? variant.weightGrams : product.estimatedWeightGrams} g.
+              You are charged for the weight actually packed.
+            </p>
+          )}
+
+          {variants.length > 0 && (
+            <div className="mb-4">
+              <h3 className="text-lg font-semibold mb-2">Options</h3>
+              <div className="flex flex-wrap gap-2">
+                {variants.map(v => (
+                  <button
+                    key={v._id}
+                    onClick={() => { setVariantId(v._id); setQuantity(1); }}
+                    disabled={v.stock === 0}
+                    className={`btn btn-sm ${v._id === variant._id ? 'btn-primary' : 'btn-outline'}`}
+                  >
+                    {v.name} - ${v.price.toFixed(2)}
+                  </button>
+                ))}
+              </div>
+            </div>
+          )}
 
           <div className="flex items-center text-gray-600 mb-4">
             <MapPin size={16} className="mr-2" />
@@ -140,20 +188,20 @@ const ProductDetail = () => {
                 </button>
                 <span className="px-4 py-2 font-semibold">{quantity}</span>
                 <button
-                  onClick={() => setQuantity(Math.min(product.quantity, quantity + 1))}
+                  onClick={() => setQuantity(Math.min(available, quantity + 1))}
                   className="p-2 hover:bg-gray-100"
                 >
                   <Plus size={16} />
                 </button>
               </div>
               <span className="text-gray-600">
-                {product.quantity} {product.unit} available
+                {available} {unit} available
               </span>
             </div>
 
             <button
               onClick={handleAddToCart}
-              disabled={product.quantity === 0}
+              disabled={available === 0}
               className="btn btn-primary w-full"
             >
               <ShoppingCart size={20} />
@@ -6,11 +6,14 @@ import ProductCard from '../components/ProductCard';
 
 const Products = () => {
   const [filters, setFilters] = useState({
-    search: '',
+    q: '',
     category: '',
     isOrganic: '',
-    page: 1
+    harvestedWithin: '',
+    cursor: ''
   });
+  // Cursors of the pages before the current one
+  const [previousCursors, setPreviousCursors] = useState([]);
 
   const { data, isLoading, error } = useQuery(
     ['products', filters],
@@ -30,21 +33,30 @@ const Products = () => {
   const handleSearchChange = (e) => {
     setFilters(prev => ({
       ...prev,
-      search: e.target.value,
-      page: 1
+      q: e.target.value,
+      cursor: ''
     }));
+    setPreviousCursors([]);
   };
 
   const handleFilterChange = (key, value) => {
     setFilters(prev => ({
       ...prev,
       [key]: value,
-      page: 1
+      cursor: ''
     }));
+    setPreviousCursors([]);
   };
 
-  const handlePageChange = (page) => {
-    setFilters(prev => ({ ...prev, page }));
+  const handleNextPage = () => {
+    setPreviousCursors(prev => [...prev, filters.cursor]);
+    setFilters(prev => ({ ...prev, cursor: data.nextCursor }));
+  };
+
+  const handlePreviousPage = () => {
+    const cursor = previousCursors[previousCursors.length - 1];
+    setPreviousCursors(prev => prev.slice(0, -1));
+    setFilters(prev => ({ ...prev, cursor }));
   };
 
   const categories = [
@@ -80,7 +92,7 @@ const Products = () => {
 
       {/* Filters */}
       <div className="card mb-8">
-        <div className="grid grid-cols-1 md:grid-cols-4 gap-4">
+        <div className="grid grid-cols-1 md:grid-cols-5 gap-4">
           {/* Search */}
           <div className="relative">
             <Search className="absolute left-3 top-1/2 transform -translate-y-1/2 text-gray-400" size={20} />
@@ -88,7 +100,7 @@ const Products = () => {
               type="text"
               placeholder="Search products..."
               className="form-input pl-10"
-              value={filters.search}
+              value={filters.q}
               onChange={handleSearchChange}
             />
           </div>
@@ -117,9 +129,26 @@ const Products = () => {
             <option value="false">Non-Organic</option>
           </select>
 
+          {/* Harvest Freshness, with the number of matches */}
+          <select
+            className="form-select"
+            value={filters.harvestedWithin}
+            onChange={(e) => handleFilterChange('harvestedWithin', e.target.value)}
+          >
+            <option value="">Any Harvest Date</option>
+            {data?.facets?.harvestedWithin?.map(facet => (
+              <option key={facet.days} value={facet.days}>
+                Harvested in the last {facet.days === 1 ? 'day' : `${facet.days} days`} ({facet.count})
+              </option>
+            ))}
+          </select>
+
           {/* Clear Filters */}
           <button
-            onClick={() => setFilters({ search: '', category: '', isOrganic: '', page: 1 })}
+            onClick={() => {
+              setFilters({ q: '', category: '', isOrganic: '', harvestedWithin: '', cursor: '' });
+              setPreviousCursors([]);
+            }}
             className="btn btn-outline"
           >
             <Filter size={16} />
@@ -139,7 +168,7 @@ const Products = () => {
           <div className="flex items-center justify-between mb-6">
             <p className="text-gray-600">
               {data?.total || 0} products found
-              {filters.search && ` for "${filters.search}"`}
+              {filters.q && ` for "${filters.q}"`}
             </p>
           </div>
 
@@ -158,22 +187,23 @@ const Products = () => {
           )}
 
           {/* Pagination */}
-          {data?.totalPages > 1 && (
+          {(previousCursors.length > 0 || data?.nextCursor) && (
             <div className="flex justify-center mt-8">
               <div className="flex space-x-2">
-                {Array.from({ length: data.totalPages }, (_, i) => i + 1).map(page => (
-                  <button
-                    key={page}
-                    onClick={() => handlePageChange(page)}
-                    className={`px-4 py-2 rounded ${
-                      page === filters.page
-                        ? 'bg-green-600 text-white'
-                        : 'bg-white border border-gray-300 text-gray-600 hover:bg-gray-50'
-                    }`}
-                  >
-                    {page}
-                  </button>
-                ))}
+                <button
+                  onClick={handlePreviousPage}
+                  disabled={previousCursors.length === 0}
+                  className="px-4 py-2 rounded bg-white border border-gray-300 text-gray-600 hover:bg-gray-50 disabled:opacity-50"
+                >
+                  Previous
+                </button>
+                <button
+                  onClick={handleNextPage}
+                  disabled={!data?.nextCursor}
+                  className="px-4 py-2 rounded bg-white border border-gray-300 text-gray-600 hover:bg-gray-50 disabled:opacity-50"
+                >
+                  Next
+                </button>
               </div>
             </div>
           )}
@@ -6,21 +6,70 @@ db.createCollection('users');
 db.createCollection('products');
 db.createCollection('orders');
 db.createCollection('payments');
+db.createCollection('stripe_events');
+db.createCollection('payment_history');
+db.createCollection('refresh_tokens');
+db.createCollection('revoked_sessions');
+db.createCollection('account_tokens');
+db.createCollection('login_attempts');
+db.createCollection('audit_log');
+db.createCollection('mfa_challenges');
+db.createCollection('farms');
+db.createCollection('farm_members');
+db.createCollection('farm_invites');
+db.createCollection('api_keys');
 
 // Create indexes for better performance
 db.users.createIndex({ "email": 1 }, { unique: true });
 db.users.createIndex({ "role": 1 });
 
 db.products.createIndex({ "farmer_id": 1 });
+db.products.createIndex({ "farmId": 1 });
 db.products.createIndex({ "category": 1 });
 db.products.createIndex({ "name": "text", "description": "text" });
+db.products.createIndex({ "createdAt": -1, "_id": -1 });
+db.products.createIndex({ "price.amount": 1, "_id": 1 });
+db.products.createIndex({ "expiryDate": 1 });
+db.products.createIndex({ "harvestDate": -1 });
+db.products.createIndex(
+  { "farmId": 1, "variants.sku": 1 },
+  { unique: true, partialFilterExpression: { "variants.sku": { $exists: true } } }
+);
 
 db.orders.createIndex({ "customer_id": 1 });
 db.orders.createIndex({ "farmer_id": 1 });
 db.orders.createIndex({ "status": 1 });
 db.orders.createIndex({ "created_at": -1 });
+db.orders.createIndex({ "items.farmId": 1, "createdAt": -1 });
 
 db.payments.createIndex({ "order_id": 1 });
 db.payments.createIndex({ "stripe_payment_intent_id": 1 });
+db.payments.createIndex({ "payment_intent_id": 1 }, { unique: true, sparse: true });
+db.payment_history.createIndex({ "payment_id": 1, "created_at": 1 });
+
+db.refresh_tokens.createIndex({ "tokenHash": 1 }, { unique: true });
+db.refresh_tokens.createIndex({ "familyId": 1 });
+db.refresh_tokens.createIndex({ "userId": 1 });
+db.refresh_tokens.createIndex({ "expiresAt": 1 }, { expireAfterSeconds: 0 });
+db.revoked_sessions.createIndex({ "expiresAt": 1 }, { expireAfterSeconds: 0 });
+
+db.account_tokens.createIndex({ "tokenHash": 1 }, { unique: true });
+db.account_tokens.createIndex({ "userId": 1, "purpose": 1 });
+db.account_tokens.createIndex({ "expiresAt": 1 }, { expireAfterSeconds: 0 });
+
+db.login_attempts.createIndex({ "expiresAt": 1 }, { expireAfterSeconds: 0 });
+db.audit_log.createIndex({ "type": 1, "createdAt": -1 });
+db.audit_log.createIndex({ "userId": 1, "createdAt": -1 });
+
+db.mfa_challenges.createIndex({ "expiresAt": 1 }, { expireAfterSeconds: 0 });
+
+db.farms.createIndex({ "ownerId": 1 });
+db.farm_members.createIndex({ "userId": 1 }, { unique: true });
+db.farm_members.createIndex({ "farmId": 1 });
+db.farm_invites.createIndex({ "tokenHash": 1 }, { unique: true });
+db.farm_invites.createIndex({ "farmId": 1, "email": 1 });
+
+db.api_keys.createIndex({ "keyHash": 1 }, { unique: true });
+db.api_keys.createIndex({ "userId": 1, "createdAt": -1 });
 
 print('Database initialized successfully');
\ No newline at end of file
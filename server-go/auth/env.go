@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// Key configuration:
+//
+//	JWT_KEYS         comma-separated kid:ALG:path entries, e.g.
+//	                 "2026-10:EdDSA:/run/secrets/jwt-2026-10.pem,2026-07:HS256:/run/secrets/jwt-2026-07"
+//	JWT_SIGNING_KID  the key that signs new tokens (default: the first of JWT_KEYS)
+//	JWT_SECRET       a single HS256 secret, used with kid "default"
+//
+// To rotate, add the new key to JWT_KEYS, make it the signing key and keep the
+// old one listed until the tokens it signed have expired.
+const defaultKeyID = "default"
+
+var ErrNoKeys = errors.New("no JWT signing key configured: set JWT_KEYS or JWT_SECRET")
+
+// LoadKeyringFromEnv builds the keyring from the environment. Without any
+// configured key it fails when required is set, and otherwise falls back to a
+// random secret so that development servers still start; tokens signed with
+// it do not survive a restart.
+func LoadKeyringFromEnv(required bool) (*Keyring, error) {
+	keys, err := parseKeyList(os.Getenv("JWT_KEYS"), os.ReadFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if secret := os.Getenv("JWT_SECRET"); secret != "" {
+		key, err := NewHMACKey(defaultKeyID, []byte(secret))
+		if err != nil {
+			return nil, fmt.Errorf("JWT_SECRET: %w", err)
+		}
+		keys = append(keys, key)
+	}
+
+	if len(keys) == 0 {
+		if required {
+			return nil, ErrNoKeys
+		}
+		log.Println("WARNING: no JWT key configured, using a random secret; tokens will not survive a restart")
+		return ephemeralKeyring()
+	}
+
+	signingID := os.Getenv("JWT_SIGNING_KID")
+	if signingID == "" {
+		signingID = keys[0].ID
+	}
+	return NewKeyring(signingID, keys...)
+}
+
+func parseKeyList(list string, readFile func(string) ([]byte, error)) ([]*Key, error) {
+	var keys []*Key
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) != 3 || parts[0] == "" || parts[2] == "" {
+			return nil, fmt.Errorf("JWT_KEYS: entry %q is not kid:ALG:path", entry)
+		}
+
+		data, err := readFile(parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("JWT_KEYS: key %q: %w", parts[0], err)
+		}
+		if parts[1] == "HS256" {
+			data = []byte(strings.TrimRight(string(data), "\r\n"))
+		}
+
+		key, err := ParseKey(parts[0], parts[1], data)
+		if err != nil {
+			return nil, fmt.Errorf("JWT_KEYS: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func ephemeralKeyring() (*Keyring, error) {
+	secret := make([]byte, MinHMACKeySize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	key, err := NewHMACKey("ephemeral", secret)
+	if err != nil {
+		return nil, err
+	}
+	return NewKeyring(key.ID, key)
+}
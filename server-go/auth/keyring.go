@@ -0,0 +1,202 @@
+// Package auth holds the keys used to sign and verify access tokens.
+//
+// Every token names its signing key in the "kid" header. A keyring can hold
+// several keys at once, so a new key can be introduced for signing while
+// tokens signed with the previous one stay valid until they expire.
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// MinHMACKeySize is the shortest HS256 secret accepted, matching the size of
+// the SHA-256 output as RFC 7518 requires.
+const MinHMACKeySize = 32
+
+var (
+	ErrMissingKeyID      = errors.New("token has no kid header")
+	ErrUnknownKey        = errors.New("token is signed with an unknown key")
+	ErrAlgorithmMismatch = errors.New("token algorithm does not match its key")
+	ErrMissingExpiration = errors.New("token has no expiration")
+)
+
+// Key is a named signing key. Keys loaded from a public key file can only
+// verify tokens.
+type Key struct {
+	ID     string
+	Method jwt.SigningMethod
+
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+// CanSign reports whether the key holds private material.
+func (k *Key) CanSign() bool {
+	return k.signKey != nil
+}
+
+// NewHMACKey returns an HS256 key for secret.
+func NewHMACKey(id string, secret []byte) (*Key, error) {
+	if id == "" {
+		return nil, errors.New("key id is required")
+	}
+	if len(secret) < MinHMACKeySize {
+		return nil, fmt.Errorf("key %q: HS256 secret must be at least %d bytes", id, MinHMACKeySize)
+	}
+	return &Key{ID: id, Method: jwt.SigningMethodHS256, signKey: secret, verifyKey: secret}, nil
+}
+
+// ParseKey builds a key from the contents of a key file. HS256 files hold the
+// raw secret; RS256 and EdDSA files hold a PEM private key (sign and verify)
+// or public key (verify only).
+func ParseKey(id, alg string, data []byte) (*Key, error) {
+	switch alg {
+	case jwt.SigningMethodHS256.Alg():
+		return NewHMACKey(id, data)
+	case jwt.SigningMethodRS256.Alg():
+		return parseRSAKey(id, data)
+	case jwt.SigningMethodEdDSA.Alg():
+		return parseEdDSAKey(id, data)
+	default:
+		return nil, fmt.Errorf("key %q: unsupported algorithm %q", id, alg)
+	}
+}
+
+func parseRSAKey(id string, data []byte) (*Key, error) {
+	key := &Key{ID: id, Method: jwt.SigningMethodRS256}
+
+	var public *rsa.PublicKey
+	if private, err := jwt.ParseRSAPrivateKeyFromPEM(data); err == nil {
+		key.signKey = private
+		public = &private.PublicKey
+	} else if public, err = jwt.ParseRSAPublicKeyFromPEM(data); err != nil {
+		return nil, fmt.Errorf("key %q: not an RSA private or public key in PEM format", id)
+	}
+
+	if public.N.BitLen() < 2048 {
+		return nil, fmt.Errorf("key %q: RSA keys must be at least 2048 bits", id)
+	}
+	key.verifyKey = public
+	return key, nil
+}
+
+func parseEdDSAKey(id string, data []byte) (*Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("key %q: not a PEM encoded key", id)
+	}
+
+	if parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		private, ok := parsed.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("key %q: not an Ed25519 private key", id)
+		}
+		return &Key{ID: id, Method: jwt.SigningMethodEdDSA, signKey: private, verifyKey: private.Public()}, nil
+	}
+
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("key %q: not an Ed25519 private or public key", id)
+	}
+	public, ok := parsed.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("key %q: not an Ed25519 public key", id)
+	}
+	return &Key{ID: id, Method: jwt.SigningMethodEdDSA, verifyKey: public}, nil
+}
+
+// Keyring signs tokens with one key and verifies them with any of its keys. A
+// nil Keyring refuses to sign or verify anything.
+type Keyring struct {
+	keys    map[string]*Key
+	signing *Key
+	methods []string
+}
+
+// NewKeyring returns a keyring that signs with the key named signingID.
+func NewKeyring(signingID string, keys ...*Key) (*Keyring, error) {
+	ring := &Keyring{keys: make(map[string]*Key, len(keys))}
+	methods := make(map[string]bool)
+
+	for _, key := range keys {
+		if _, exists := ring.keys[key.ID]; exists {
+			return nil, fmt.Errorf("duplicate key id %q", key.ID)
+		}
+		ring.keys[key.ID] = key
+		methods[key.Method.Alg()] = true
+	}
+	for method := range methods {
+		ring.methods = append(ring.methods, method)
+	}
+	sort.Strings(ring.methods)
+
+	ring.signing = ring.keys[signingID]
+	if ring.signing == nil {
+		return nil, fmt.Errorf("signing key %q is not configured", signingID)
+	}
+	if !ring.signing.CanSign() {
+		return nil, fmt.Errorf("signing key %q has no private key", signingID)
+	}
+	return ring, nil
+}
+
+// SigningKeyID returns the kid put on new tokens.
+func (r *Keyring) SigningKeyID() string {
+	return r.signing.ID
+}
+
+// Sign issues a token for claims with the signing key.
+func (r *Keyring) Sign(claims jwt.Claims) (string, error) {
+	if r == nil {
+		return "", ErrNoKeys
+	}
+	token := jwt.NewWithClaims(r.signing.Method, claims)
+	token.Header["kid"] = r.signing.ID
+	return token.SignedString(r.signing.signKey)
+}
+
+// Parse verifies a token and decodes it into claims. The key is chosen by the
+// kid header and the token must use that key's algorithm, so a token cannot
+// pick its own verification method. Tokens without an expiration are refused.
+func (r *Keyring) Parse(tokenString string, claims jwt.Claims) (*jwt.Token, error) {
+	if r == nil {
+		return nil, ErrNoKeys
+	}
+	token, err := jwt.ParseWithClaims(tokenString, claims, r.verificationKey, jwt.WithValidMethods(r.methods))
+	if err != nil {
+		return nil, err
+	}
+
+	exp, err := token.Claims.GetExpirationTime()
+	if err != nil {
+		return nil, err
+	}
+	if exp == nil {
+		return nil, ErrMissingExpiration
+	}
+	return token, nil
+}
+
+func (r *Keyring) verificationKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		return nil, ErrMissingKeyID
+	}
+
+	key := r.keys[kid]
+	if key == nil {
+		return nil, ErrUnknownKey
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, ErrAlgorithmMismatch
+	}
+	return key.verifyKey, nil
+}
@@ -0,0 +1,165 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testClaims() jwt.MapClaims {
+	return jwt.MapClaims{"userID": "507f1f77bcf86cd799439012", "exp": time.Now().Add(time.Hour).Unix()}
+}
+
+func testEdDSAKeys(t *testing.T, id string) (private, public *Key) {
+	t.Helper()
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	privDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	require.NoError(t, err)
+	pubDER, err := x509.MarshalPKIXPublicKey(pub)
+	require.NoError(t, err)
+
+	private, err = ParseKey(id, "EdDSA", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER}))
+	require.NoError(t, err)
+	public, err = ParseKey(id, "EdDSA", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}))
+	require.NoError(t, err)
+	return private, public
+}
+
+func TestKeyringRotation(t *testing.T) {
+	old, err := NewHMACKey("2026-07", []byte("an-old-secret-that-is-32-bytes-long"))
+	require.NoError(t, err)
+	current, _ := testEdDSAKeys(t, "2026-10")
+
+	before, err := NewKeyring(old.ID, old)
+	require.NoError(t, err)
+	oldToken, err := before.Sign(testClaims())
+	require.NoError(t, err)
+
+	after, err := NewKeyring(current.ID, current, old)
+	require.NoError(t, err)
+	newToken, err := after.Sign(testClaims())
+	require.NoError(t, err)
+
+	// Tokens of the retiring key still verify next to the new ones
+	_, err = after.Parse(oldToken, jwt.MapClaims{})
+	assert.NoError(t, err)
+	token, err := after.Parse(newToken, jwt.MapClaims{})
+	require.NoError(t, err)
+	assert.Equal(t, "2026-10", token.Header["kid"])
+	assert.Equal(t, "EdDSA", token.Method.Alg())
+
+	// The old keyring does not know the new key
+	_, err = before.Parse(newToken, jwt.MapClaims{})
+	assert.Error(t, err)
+}
+
+func TestKeyringPinsAlgorithm(t *testing.T) {
+	private, public := testEdDSAKeys(t, "ed")
+	hmac, err := NewHMACKey("hs", []byte("a-shared-secret-that-is-32-bytes-long"))
+	require.NoError(t, err)
+	ring, err := NewKeyring(hmac.ID, hmac, public)
+	require.NoError(t, err)
+
+	// An HS256 token claiming to be signed by the Ed25519 key
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, testClaims())
+	forged.Header["kid"] = "ed"
+	tokenString, err := forged.SignedString([]byte(public.verifyKey.(ed25519.PublicKey)))
+	require.NoError(t, err)
+	_, err = ring.Parse(tokenString, jwt.MapClaims{})
+	assert.ErrorIs(t, err, ErrAlgorithmMismatch)
+
+	// Unsigned tokens
+	none := jwt.NewWithClaims(jwt.SigningMethodNone, testClaims())
+	none.Header["kid"] = "hs"
+	tokenString, err = none.SignedString(jwt.UnsafeAllowNoneSignatureType)
+	require.NoError(t, err)
+	_, err = ring.Parse(tokenString, jwt.MapClaims{})
+	assert.Error(t, err)
+
+	// Tokens without a kid or an expiration
+	signer, err := NewKeyring(private.ID, private)
+	require.NoError(t, err)
+	bare := jwt.NewWithClaims(jwt.SigningMethodEdDSA, testClaims())
+	tokenString, err = bare.SignedString(private.signKey)
+	require.NoError(t, err)
+	_, err = signer.Parse(tokenString, jwt.MapClaims{})
+	assert.ErrorIs(t, err, ErrMissingKeyID)
+
+	tokenString, err = signer.Sign(jwt.MapClaims{"userID": "507f1f77bcf86cd799439012"})
+	require.NoError(t, err)
+	_, err = signer.Parse(tokenString, jwt.MapClaims{})
+	assert.ErrorIs(t, err, ErrMissingExpiration)
+}
+
+func TestNewKeyring(t *testing.T) {
+	_, public := testEdDSAKeys(t, "ed")
+	_, err := NewKeyring("ed", public)
+	assert.Error(t, err, "public keys cannot sign")
+
+	_, err = NewKeyring("missing", public)
+	assert.Error(t, err)
+
+	_, err = NewHMACKey("short", []byte("too-short"))
+	assert.Error(t, err)
+
+	var nilRing *Keyring
+	_, err = nilRing.Sign(testClaims())
+	assert.ErrorIs(t, err, ErrNoKeys)
+}
+
+func TestParseKeyList(t *testing.T) {
+	files := map[string][]byte{
+		"/keys/current": []byte("a-current-secret-that-is-32-bytes\n"),
+	}
+	readFile := func(path string) ([]byte, error) {
+		if data, ok := files[path]; ok {
+			return data, nil
+		}
+		return nil, os.ErrNotExist
+	}
+
+	keys, err := parseKeyList(" current:HS256:/keys/current ,", readFile)
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	assert.Equal(t, "current", keys[0].ID)
+	assert.Equal(t, []byte("a-current-secret-that-is-32-bytes"), keys[0].signKey)
+
+	_, err = parseKeyList("current:/keys/current", readFile)
+	assert.Error(t, err)
+	_, err = parseKeyList("current:HS512:/keys/current", readFile)
+	assert.Error(t, err)
+	_, err = parseKeyList("missing:HS256:/keys/missing", readFile)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestLoadKeyringFromEnv(t *testing.T) {
+	t.Setenv("JWT_KEYS", "")
+	t.Setenv("JWT_SIGNING_KID", "")
+	t.Setenv("JWT_SECRET", "")
+
+	_, err := LoadKeyringFromEnv(true)
+	assert.ErrorIs(t, err, ErrNoKeys)
+
+	ring, err := LoadKeyringFromEnv(false)
+	require.NoError(t, err)
+	assert.Equal(t, "ephemeral", ring.SigningKeyID())
+
+	t.Setenv("JWT_SECRET", "your-secret-key")
+	_, err = LoadKeyringFromEnv(true)
+	assert.Error(t, err, "short secrets are refused")
+
+	t.Setenv("JWT_SECRET", "a-long-enough-secret-for-production-use")
+	ring, err = LoadKeyringFromEnv(true)
+	require.NoError(t, err)
+	assert.Equal(t, "default", ring.SigningKeyID())
+}
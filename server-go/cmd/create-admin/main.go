@@ -0,0 +1,92 @@
+// Command create-admin bootstraps the first admin account, which cannot be
+// obtained through self-registration. Later admins are created by an existing
+// admin with POST /api/admin/users.
+//
+//	ADMIN_PASSWORD=... create-admin -email admin@example.com -name "Site Admin"
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/crypto/bcrypt"
+
+	"farmer-marketplace/config"
+	"farmer-marketplace/models"
+)
+
+func main() {
+	email := flag.String("email", "", "email address of the admin account")
+	name := flag.String("name", "Administrator", "display name of the admin account")
+	force := flag.Bool("force", false, "create the account even if an admin already exists")
+	flag.Parse()
+
+	if *email == "" {
+		log.Fatal("-email is required")
+	}
+
+	if err := godotenv.Load(); err != nil {
+		log.Println("No .env file found")
+	}
+
+	password := os.Getenv("ADMIN_PASSWORD")
+	if password == "" {
+		fmt.Print("Password: ")
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil {
+			log.Fatal("Failed to read password: ", err)
+		}
+		password = strings.TrimSpace(line)
+	}
+	if len(password) < 6 {
+		log.Fatal("Password must be at least 6 characters")
+	}
+
+	config.ConnectDB()
+	collection := config.GetCollection("users")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	admins, err := collection.CountDocuments(ctx, bson.M{"role": models.RoleAdmin, "deletedAt": bson.M{"$exists": false}})
+	if err != nil {
+		log.Fatal("Failed to count admins: ", err)
+	}
+	if admins > 0 && !*force {
+		log.Fatal("An admin already exists; use POST /api/admin/users or pass -force")
+	}
+
+	if err := collection.FindOne(ctx, bson.M{"email": *email}).Err(); err == nil {
+		log.Fatalf("A user with email %s already exists", *email)
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		log.Fatal("Failed to hash password: ", err)
+	}
+
+	now := time.Now()
+	user := models.User{
+		ID:        primitive.NewObjectID(),
+		Name:      *name,
+		Email:     *email,
+		Password:  string(hashedPassword),
+		Role:      models.RoleAdmin,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if _, err := collection.InsertOne(ctx, user); err != nil {
+		log.Fatal("Failed to create admin: ", err)
+	}
+
+	log.Printf("Created admin %s (%s)", user.Email, user.ID.Hex())
+}
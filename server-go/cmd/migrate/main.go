@@ -0,0 +1,49 @@
+// Command migrate runs the data migrations against the database configured
+// through MONGODB_URI.
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/joho/godotenv"
+
+	"farmer-marketplace/config"
+	"farmer-marketplace/migrations"
+)
+
+func main() {
+	if err := godotenv.Load(); err != nil {
+		log.Println("No .env file found")
+	}
+
+	config.ConnectDB()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	result, err := migrations.MigrateMoney(ctx, config.DB)
+	for collection, modified := range result {
+		log.Printf("money: migrated %d document(s) in %s", modified, collection)
+	}
+	if err != nil {
+		log.Fatal("Money migration failed: ", err)
+	}
+
+	farms, err := migrations.MigrateFarms(ctx, config.DB)
+	for collection, modified := range farms {
+		log.Printf("farms: migrated %d document(s) in %s", modified, collection)
+	}
+	if err != nil {
+		log.Fatal("Farm migration failed: ", err)
+	}
+
+	reserved, err := migrations.MigrateStock(ctx, config.DB)
+	log.Printf("stock: marked the stock of %d legacy order(s) as reserved", reserved)
+	if err != nil {
+		log.Fatal("Stock migration failed: ", err)
+	}
+
+	log.Println("Migrations completed")
+}
@@ -0,0 +1,183 @@
+// Package images turns uploaded photos into JPEG renditions of fixed sizes.
+// Re-encoding drops EXIF and any other metadata of the upload, such as the
+// location a photo was taken at.
+package images
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"net/http"
+
+	// Decoders for the accepted upload types
+	_ "image/gif"
+	_ "image/png"
+)
+
+// MaxPixels bounds the size of a decoded upload, so that a small file that
+// claims huge dimensions cannot exhaust memory.
+const MaxPixels = 25_000_000
+
+const jpegQuality = 85
+
+var (
+	ErrUnsupportedType = errors.New("unsupported image type")
+	ErrTooLarge        = errors.New("image dimensions are too large")
+)
+
+// Size is a rendition whose longest side is at most MaxSide pixels.
+type Size struct {
+	Name    string
+	MaxSide int
+}
+
+// Sizes lists the renditions made of every upload, largest first.
+var Sizes = []Size{
+	{Name: "large", MaxSide: 1920},
+	{Name: "medium", MaxSide: 960},
+	{Name: "small", MaxSide: 480},
+	{Name: "thumb", MaxSide: 160},
+}
+
+// ContentType is the type of every rendition.
+const ContentType = "image/jpeg"
+
+// Rendition is an encoded image of one of Sizes.
+type Rendition struct {
+	Name   string
+	Width  int
+	Height int
+	Data   []byte
+}
+
+// Sniff returns the type of an upload from its content, which unlike the
+// file name or the declared type cannot lie. Only JPEG, PNG and GIF are
+// accepted.
+func Sniff(data []byte) (string, error) {
+	contentType := http.DetectContentType(data)
+	switch contentType {
+	case "image/jpeg", "image/png", "image/gif":
+		return contentType, nil
+	}
+	return "", ErrUnsupportedType
+}
+
+// Process decodes an upload, turns it upright according to its EXIF
+// orientation and renders it in every one of Sizes. Images are never
+// enlarged; transparent areas become white.
+func Process(data []byte) ([]Rendition, error) {
+	contentType, err := Sniff(data)
+	if err != nil {
+		return nil, err
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrUnsupportedType
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > MaxPixels {
+		return nil, ErrTooLarge
+	}
+
+	decoded, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrUnsupportedType
+	}
+
+	img := flatten(decoded)
+	if contentType == "image/jpeg" {
+		img = orient(img, jpegOrientation(data))
+	}
+
+	renditions := make([]Rendition, 0, len(Sizes))
+	source := img
+	for _, size := range Sizes {
+		width, height := fit(img.Bounds().Dx(), img.Bounds().Dy(), size.MaxSide)
+		// Sizes go from large to small, so each one is made from the last
+		source = resize(source, width, height)
+
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, source, &jpeg.Options{Quality: jpegQuality}); err != nil {
+			return nil, err
+		}
+		renditions = append(renditions, Rendition{Name: size.Name, Width: width, Height: height, Data: buf.Bytes()})
+	}
+	return renditions, nil
+}
+
+// fit scales width and height down so that neither exceeds maxSide.
+func fit(width, height, maxSide int) (int, int) {
+	longest := width
+	if height > longest {
+		longest = height
+	}
+	if longest <= maxSide {
+		return width, height
+	}
+
+	scaled := func(n int) int {
+		s := (n*maxSide + longest/2) / longest
+		if s < 1 {
+			return 1
+		}
+		return s
+	}
+	return scaled(width), scaled(height)
+}
+
+// flatten draws img over a white background.
+func flatten(img image.Image) *image.RGBA {
+	bounds := img.Bounds()
+	out := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(out, out.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(out, out.Bounds(), img, bounds.Min, draw.Over)
+	return out
+}
+
+// resize scales src to width by height by averaging the source pixels each
+// target pixel covers, which suits the downscaling done here.
+func resize(src *image.RGBA, width, height int) *image.RGBA {
+	srcW, srcH := src.Bounds().Dx(), src.Bounds().Dy()
+	if srcW == width && srcH == height {
+		return src
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := y * srcH / height
+		y1 := (y + 1) * srcH / height
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < width; x++ {
+			x0 := x * srcW / width
+			x1 := (x + 1) * srcW / width
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+
+			var r, g, b, a, n int
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					p := row[sx*4 : sx*4+4]
+					r += int(p[0])
+					g += int(p[1])
+					b += int(p[2])
+					a += int(p[3])
+					n++
+				}
+			}
+
+			i := y*dst.Stride + x*4
+			dst.Pix[i] = uint8(r / n)
+			dst.Pix[i+1] = uint8(g / n)
+			dst.Pix[i+2] = uint8(b / n)
+			dst.Pix[i+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
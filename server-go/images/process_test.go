@@ -0,0 +1,125 @@
+package images
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testPNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.NRGBA{R: 200, G: 40, B: 40, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, img))
+	return buf.Bytes()
+}
+
+// testJPEG encodes a width by height JPEG whose left half is black and
+// right half white, with an EXIF segment carrying orientation.
+func testJPEG(t *testing.T, width, height, orientation int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := color.RGBA{A: 255}
+			if x >= width/2 {
+				c = color.RGBA{R: 255, G: 255, B: 255, A: 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	require.NoError(t, jpeg.Encode(&buf, img, nil))
+	encoded := buf.Bytes()
+
+	// Big-endian TIFF with one IFD entry: orientation, SHORT, count 1
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01")
+	tiff = append(tiff, byte(orientation>>8), byte(orientation), 0, 0, 0, 0, 0, 0)
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	app1 := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(app1[2:], uint16(len(segment)+2))
+	app1 = append(app1, segment...)
+
+	return append(append(append([]byte{}, encoded[:2]...), app1...), encoded[2:]...)
+}
+
+func TestProcess(t *testing.T) {
+	renditions, err := Process(testPNG(t, 2400, 1200))
+	require.NoError(t, err)
+	require.Len(t, renditions, len(Sizes))
+
+	expected := map[string][2]int{"large": {1920, 960}, "medium": {960, 480}, "small": {480, 240}, "thumb": {160, 80}}
+	for _, r := range renditions {
+		assert.Equal(t, expected[r.Name], [2]int{r.Width, r.Height}, r.Name)
+
+		config, format, err := image.DecodeConfig(bytes.NewReader(r.Data))
+		require.NoError(t, err)
+		assert.Equal(t, "jpeg", format)
+		assert.Equal(t, r.Width, config.Width)
+	}
+}
+
+func TestProcessDoesNotEnlarge(t *testing.T) {
+	renditions, err := Process(testPNG(t, 300, 200))
+	require.NoError(t, err)
+	for _, r := range renditions {
+		if r.Name == "thumb" {
+			assert.Equal(t, [2]int{160, 107}, [2]int{r.Width, r.Height})
+		} else {
+			assert.Equal(t, [2]int{300, 200}, [2]int{r.Width, r.Height}, r.Name)
+		}
+	}
+}
+
+func TestProcessRefusesOtherContent(t *testing.T) {
+	_, err := Process([]byte("<svg xmlns=\"http://www.w3.org/2000/svg\"></svg>"))
+	assert.ErrorIs(t, err, ErrUnsupportedType)
+
+	// A valid PNG header claiming huge dimensions
+	data := testPNG(t, 1, 1)
+	binary.BigEndian.PutUint32(data[16:], 100000)
+	binary.BigEndian.PutUint32(data[20:], 100000)
+	binary.BigEndian.PutUint32(data[29:], crc32.ChecksumIEEE(data[12:29]))
+	_, err = Process(data)
+	assert.ErrorIs(t, err, ErrTooLarge)
+}
+
+func TestProcessAppliesOrientation(t *testing.T) {
+	data := testJPEG(t, 40, 20, 6)
+	assert.Equal(t, 6, jpegOrientation(data))
+	assert.Contains(t, string(data), "Exif")
+
+	renditions, err := Process(data)
+	require.NoError(t, err)
+	thumb := renditions[len(renditions)-1]
+	assert.Equal(t, [2]int{20, 40}, [2]int{thumb.Width, thumb.Height})
+	assert.NotContains(t, string(thumb.Data), "Exif")
+
+	// Turned clockwise, the black left half of the stored image is on top
+	img, err := jpeg.Decode(bytes.NewReader(thumb.Data))
+	require.NoError(t, err)
+	top, _, _, _ := img.At(10, 5).RGBA()
+	bottom, _, _, _ := img.At(10, 35).RGBA()
+	assert.Less(t, top, uint32(0x4000))
+	assert.Greater(t, bottom, uint32(0xC000))
+}
+
+func TestJPEGOrientationWithoutEXIF(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 8, 8)), nil))
+	assert.Equal(t, 1, jpegOrientation(buf.Bytes()))
+	assert.Equal(t, 1, jpegOrientation([]byte("not a jpeg")))
+}
@@ -0,0 +1,66 @@
+// Package mail sends transactional email through SMTP in production and an
+// outbox in tests and local runs.
+package mail
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+)
+
+var ErrNotConfigured = errors.New("mailer is not configured")
+
+// Message is a plain-text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers messages.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// FromEnv returns an SMTP mailer when SMTP_HOST is set. Otherwise messages go
+// to an outbox, written to MAIL_OUTBOX_DIR when it is set so that links can
+// be picked up during local runs.
+func FromEnv() (Mailer, error) {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		dir := os.Getenv("MAIL_OUTBOX_DIR")
+		if dir == "" {
+			log.Println("SMTP_HOST is not set, keeping outgoing email in memory")
+		} else {
+			log.Printf("SMTP_HOST is not set, writing outgoing email to %s", dir)
+		}
+		return NewOutbox(dir), nil
+	}
+
+	port := 587
+	if value := os.Getenv("SMTP_PORT"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, errors.New("SMTP_PORT must be a number")
+		}
+		port = parsed
+	}
+
+	from := os.Getenv("SMTP_FROM")
+	if from == "" {
+		from = os.Getenv("SMTP_USER")
+	}
+	if from == "" {
+		return nil, errors.New("SMTP_FROM or SMTP_USER must be set")
+	}
+
+	return &SMTPMailer{
+		Host:     host,
+		Port:     port,
+		Username: os.Getenv("SMTP_USER"),
+		Password: os.Getenv("SMTP_PASS"),
+		From:     from,
+	}, nil
+}
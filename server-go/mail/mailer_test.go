@@ -0,0 +1,59 @@
+package mail
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutbox(t *testing.T) {
+	dir := t.TempDir()
+	outbox := NewOutbox(dir)
+
+	require.NoError(t, outbox.Send(context.Background(), Message{To: "a@example.com", Subject: "First", Body: "one"}))
+	require.NoError(t, outbox.Send(context.Background(), Message{To: "b@example.com", Subject: "Second", Body: "two"}))
+	require.NoError(t, outbox.Send(context.Background(), Message{To: "a@example.com", Subject: "Third", Body: "three"}))
+
+	assert.Len(t, outbox.Messages(), 3)
+
+	last, ok := outbox.Last("a@example.com")
+	require.True(t, ok)
+	assert.Equal(t, "Third", last.Subject)
+
+	_, ok = outbox.Last("c@example.com")
+	assert.False(t, ok)
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.txt"))
+	require.NoError(t, err)
+	require.Len(t, files, 3)
+	content, err := os.ReadFile(files[0])
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "To: a@example.com")
+}
+
+func TestSMTPMessageFormat(t *testing.T) {
+	m := &SMTPMailer{Host: "smtp.example.com", Port: 587, From: "Farmer Help <noreply@example.com>"}
+
+	data := string(m.format(Message{
+		To:      "a@example.com",
+		Subject: "Hello\r\nBcc: victim@example.com",
+		Body:    "line one\nline two",
+	}, time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)))
+
+	headers, body, found := strings.Cut(data, "\r\n\r\n")
+	require.True(t, found)
+
+	// Newlines in header values cannot inject headers
+	for _, line := range strings.Split(headers, "\r\n") {
+		assert.False(t, strings.HasPrefix(line, "Bcc:"), line)
+	}
+	assert.Contains(t, headers, "From: Farmer Help <noreply@example.com>")
+	assert.Contains(t, headers, "Date: Sat, 17 Oct 2026 12:00:00 +0000")
+	assert.Equal(t, "line one\r\nline two", body)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"os"
@@ -9,6 +10,13 @@ import (
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
+
+	"farmer-marketplace/auth"
+	"farmer-marketplace/config"
+	"farmer-marketplace/mail"
+	"farmer-marketplace/payments"
+	"farmer-marketplace/routes"
+	"farmer-marketplace/storage"
 )
 
 func main() {
@@ -24,6 +32,16 @@ func main() {
 	}
 	gin.SetMode(ginMode)
 
+	// Refuse to start without a token signing key in release mode
+	keys, err := auth.LoadKeyringFromEnv(gin.Mode() == gin.ReleaseMode)
+	if err != nil {
+		log.Fatal("Failed to load JWT keys: ", err)
+	}
+	log.Printf("Signing access tokens with key %q", keys.SigningKeyID())
+
+	// Connect to MongoDB
+	config.ConnectDB()
+
 	// Create Gin router
 	r := gin.Default()
 
@@ -69,6 +87,22 @@ func main() {
 		})
 	}
 
+	mailer, err := mail.FromEnv()
+	if err != nil {
+		log.Fatal("Failed to configure mail: ", err)
+	}
+
+	store, err := storage.FromEnv()
+	if err != nil {
+		log.Fatal("Failed to configure file storage: ", err)
+	}
+
+	provider := payments.NewStripeProvider(os.Getenv("STRIPE_SECRET_KEY"), os.Getenv("STRIPE_WEBHOOK_SECRET"))
+	routes.SetupRoutes(r, provider, keys, mailer, store)
+
+	// Warn farms about expiring products and mark them down in the background
+	go routes.RunExpiryScheduler(context.Background(), mailer)
+
 	// Get port from environment or use default
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -0,0 +1,301 @@
+package migrations
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"farmer-marketplace/models"
+)
+
+// FarmsResult counts the documents written per collection.
+type FarmsResult map[string]int64
+
+// MigrateFarms moves catalogs and orders from farmers to farms. Every farmer
+// gets a farm they own, with the farmer's own ID as farm ID so that the
+// farmerId of products, order lines and fulfillments can be carried over as
+// farmId unchanged; order lines older than that get the farm of their product.
+// Staff accounts that worked for a farmer join the farmer's farm keeping the
+// permissions they were given. Running it again is a no-op.
+func MigrateFarms(ctx context.Context, db *mongo.Database) (FarmsResult, error) {
+	result := FarmsResult{}
+
+	cursor, err := db.Collection("users").Find(ctx, bson.M{
+		"role":      models.RoleFarmer,
+		"deletedAt": bson.M{"$exists": false},
+	})
+	if err != nil {
+		return result, err
+	}
+	defer cursor.Close(ctx)
+
+	now := time.Now()
+	upsert := options.Update().SetUpsert(true)
+
+	for cursor.Next(ctx) {
+		var farmer models.User
+		if err := cursor.Decode(&farmer); err != nil {
+			return result, err
+		}
+
+		res, err := db.Collection("farms").UpdateOne(ctx,
+			bson.M{"_id": farmer.ID},
+			bson.M{"$setOnInsert": models.Farm{
+				Name:      farmer.Name,
+				Location:  farmer.Location,
+				OwnerID:   farmer.ID,
+				CreatedAt: farmer.CreatedAt,
+				UpdatedAt: now,
+			}},
+			upsert,
+		)
+		if err != nil {
+			return result, err
+		}
+		result["farms"] += res.UpsertedCount
+
+		res, err = db.Collection("farm_members").UpdateOne(ctx,
+			bson.M{"userId": farmer.ID},
+			bson.M{"$setOnInsert": bson.M{
+				"farmId":   farmer.ID,
+				"role":     models.FarmRoleOwner,
+				"joinedAt": farmer.CreatedAt,
+			}},
+			upsert,
+		)
+		if err != nil {
+			return result, err
+		}
+		result["farm_members"] += res.UpsertedCount
+	}
+	if err := cursor.Err(); err != nil {
+		return result, err
+	}
+
+	modified, err := migrateStaffMembers(ctx, db, now)
+	result["farm_members"] += modified
+	if err != nil {
+		return result, err
+	}
+
+	steps := []struct {
+		collection string
+		filter     bson.M
+		pipeline   mongo.Pipeline
+	}{
+		{
+			collection: "products",
+			filter:     bson.M{"farmerId": bson.M{"$exists": true}},
+			pipeline: mongo.Pipeline{
+				{{Key: "$set", Value: bson.M{"farmId": "$farmerId"}}},
+				{{Key: "$unset", Value: "farmerId"}},
+			},
+		},
+		{
+			collection: "orders",
+			filter: bson.M{"$or": bson.A{
+				bson.M{"items.farmerId": bson.M{"$exists": true}},
+				bson.M{"fulfillments.farmerId": bson.M{"$exists": true}},
+			}},
+			pipeline: mongo.Pipeline{
+				{{Key: "$set", Value: bson.M{
+					"items":        renameFarmerIDs("$items"),
+					"fulfillments": renameFarmerIDs("$fulfillments"),
+				}}},
+				{{Key: "$unset", Value: bson.A{"items.farmerId", "fulfillments.farmerId"}}},
+			},
+		},
+	}
+
+	for _, step := range steps {
+		res, err := db.Collection(step.collection).UpdateMany(ctx, step.filter, step.pipeline)
+		if err != nil {
+			return result, err
+		}
+		result[step.collection] = res.ModifiedCount
+	}
+
+	modified, err = backfillItemFarms(ctx, db)
+	result["orders"] += modified
+	return result, err
+}
+
+// backfillItemFarms sets the farmId of order lines placed before lines
+// carried one, taking it from the product. Lines whose product was deleted
+// keep no farm.
+func backfillItemFarms(ctx context.Context, db *mongo.Database) (int64, error) {
+	orders := db.Collection("orders")
+	cursor, err := orders.Find(ctx, bson.M{"items": bson.M{"$elemMatch": bson.M{"farmId": bson.M{"$exists": false}}}})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	farms := map[primitive.ObjectID]primitive.ObjectID{}
+	var modified int64
+	for cursor.Next(ctx) {
+		var order struct {
+			ID    primitive.ObjectID `bson:"_id"`
+			Items []bson.M           `bson:"items"`
+		}
+		if err := cursor.Decode(&order); err != nil {
+			return modified, err
+		}
+
+		var missing []primitive.ObjectID
+		for _, item := range order.Items {
+			if id, ok := item["productId"].(primitive.ObjectID); ok {
+				if _, known := farms[id]; !known {
+					missing = append(missing, id)
+				}
+			}
+		}
+		if err := loadProductFarms(ctx, db, missing, farms); err != nil {
+			return modified, err
+		}
+
+		if !setItemFarms(order.Items, farms) {
+			continue
+		}
+		if _, err := orders.UpdateOne(ctx,
+			bson.M{"_id": order.ID},
+			bson.M{"$set": bson.M{"items": order.Items}},
+		); err != nil {
+			return modified, err
+		}
+		modified++
+	}
+	return modified, cursor.Err()
+}
+
+// loadProductFarms adds the farm of each product in ids to farms.
+func loadProductFarms(ctx context.Context, db *mongo.Database, ids []primitive.ObjectID, farms map[primitive.ObjectID]primitive.ObjectID) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	cursor, err := db.Collection("products").Find(ctx,
+		bson.M{"_id": bson.M{"$in": ids}},
+		options.Find().SetProjection(bson.M{"farmId": 1}),
+	)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var product struct {
+			ID     primitive.ObjectID `bson:"_id"`
+			FarmID primitive.ObjectID `bson:"farmId"`
+		}
+		if err := cursor.Decode(&product); err != nil {
+			return err
+		}
+		farms[product.ID] = product.FarmID
+	}
+	return cursor.Err()
+}
+
+// setItemFarms sets the farmId of lines without one from their product's
+// farm, reporting whether it set any.
+func setItemFarms(items []bson.M, farms map[primitive.ObjectID]primitive.ObjectID) bool {
+	changed := false
+	for _, item := range items {
+		if _, ok := item["farmId"]; ok {
+			continue
+		}
+		productID, _ := item["productId"].(primitive.ObjectID)
+		if farmID, ok := farms[productID]; ok && !farmID.IsZero() {
+			item["farmId"] = farmID
+			changed = true
+		}
+	}
+	return changed
+}
+
+// renameFarmerIDs copies farmerId to farmId in every element of an array
+// field, leaving a missing field missing.
+func renameFarmerIDs(field string) bson.M {
+	return bson.M{"$cond": bson.A{
+		bson.M{"$isArray": field},
+		bson.M{"$map": bson.M{
+			"input": field,
+			"as":    "entry",
+			"in": bson.M{"$mergeObjects": bson.A{"$$entry", bson.M{
+				"farmId": bson.M{"$ifNull": bson.A{"$$entry.farmId", "$$entry.farmerId"}},
+			}}},
+		}},
+		"$$REMOVE",
+	}}
+}
+
+// migrateStaffMembers turns staff accounts that carry the farmerId of the
+// farmer they worked for into members of that farmer's farm.
+func migrateStaffMembers(ctx context.Context, db *mongo.Database, now time.Time) (int64, error) {
+	users := db.Collection("users")
+	cursor, err := users.Find(ctx, bson.M{
+		"role":      models.RoleStaff,
+		"farmerId":  bson.M{"$exists": true},
+		"deletedAt": bson.M{"$exists": false},
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var added int64
+	for cursor.Next(ctx) {
+		var staff struct {
+			ID          interface{} `bson:"_id"`
+			FarmerID    interface{} `bson:"farmerId"`
+			Permissions []string    `bson:"permissions"`
+		}
+		if err := cursor.Decode(&staff); err != nil {
+			return added, err
+		}
+
+		role, perms := staffMembership(staff.Permissions)
+		res, err := db.Collection("farm_members").UpdateOne(ctx,
+			bson.M{"userId": staff.ID},
+			bson.M{"$setOnInsert": bson.M{
+				"farmId":      staff.FarmerID,
+				"role":        role,
+				"permissions": perms,
+				"joinedAt":    now,
+			}},
+			options.Update().SetUpsert(true),
+		)
+		if err != nil {
+			return added, err
+		}
+		added += res.UpsertedCount
+
+		if _, err := users.UpdateOne(ctx,
+			bson.M{"_id": staff.ID},
+			bson.M{"$unset": bson.M{"farmerId": "", "permissions": ""}},
+		); err != nil {
+			return added, err
+		}
+	}
+	return added, cursor.Err()
+}
+
+// staffMembership picks the smallest farm role that covers the permissions a
+// staff account was given, narrowed to exactly those. Permissions no manager
+// holds are dropped, as they were never granted to staff, and a staff account
+// without permissions keeps none.
+func staffMembership(perms []string) (string, []string) {
+	if perms == nil {
+		perms = []string{}
+	}
+	granted := models.FarmMember{Role: models.FarmRoleManager, Permissions: perms}.GrantedPermissions()
+
+	packer := models.FarmMember{Role: models.FarmRolePacker, Permissions: granted}.GrantedPermissions()
+	if len(packer) == len(granted) {
+		return models.FarmRolePacker, granted
+	}
+	return models.FarmRoleManager, granted
+}
@@ -0,0 +1,51 @@
+package migrations
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"farmer-marketplace/models"
+)
+
+func TestStaffMembership(t *testing.T) {
+	role, perms := staffMembership([]string{models.PermOrderUpdateStatus, models.PermOrderRead})
+	assert.Equal(t, models.FarmRolePacker, role)
+	assert.Equal(t, []string{models.PermOrderRead, models.PermOrderUpdateStatus}, perms)
+
+	// Staff who could change products or refund need a manager's role
+	role, perms = staffMembership([]string{models.PermOrderRead, models.PermProductWrite})
+	assert.Equal(t, models.FarmRoleManager, role)
+	assert.Equal(t, []string{models.PermProductWrite, models.PermOrderRead}, perms)
+
+	// Nothing granted stays nothing granted
+	role, perms = staffMembership(nil)
+	assert.Equal(t, models.FarmRolePacker, role)
+	assert.Equal(t, []string{}, perms)
+
+	role, perms = staffMembership([]string{models.PermUserManage, models.PermNotificationSend})
+	assert.Equal(t, models.FarmRoleManager, role)
+	assert.Equal(t, []string{models.PermNotificationSend}, perms)
+}
+
+func TestSetItemFarms(t *testing.T) {
+	farmID, otherFarm := primitive.NewObjectID(), primitive.NewObjectID()
+	known, deleted := primitive.NewObjectID(), primitive.NewObjectID()
+	farms := map[primitive.ObjectID]primitive.ObjectID{known: farmID}
+
+	items := []bson.M{
+		{"productId": known, "quantity": 2},
+		{"productId": known, "farmId": otherFarm},
+		{"productId": deleted},
+	}
+	assert.True(t, setItemFarms(items, farms))
+	assert.Equal(t, farmID, items[0]["farmId"])
+	assert.Equal(t, 2, items[0]["quantity"])
+	assert.Equal(t, otherFarm, items[1]["farmId"])
+	assert.NotContains(t, items[2], "farmId")
+
+	// Lines that already have a farm, or whose product is gone, are left alone
+	assert.False(t, setItemFarms(items, farms))
+}
@@ -0,0 +1,169 @@
+// Package migrations holds one-off data migrations that are run with
+// cmd/migrate.
+package migrations
+
+import (
+	"context"
+	"math"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"farmer-marketplace/models"
+)
+
+// MoneyResult counts the documents rewritten per collection.
+type MoneyResult map[string]int64
+
+// MigrateMoney rewrites the float and integer amounts written before
+// models.Money was introduced into {amount, currency} documents. Product
+// prices and order amounts were float major units in DefaultCurrency; payment
+// amounts were integer minor units next to a lowercase currency field. The
+// migration only touches plain numbers, so running it again is a no-op.
+func MigrateMoney(ctx context.Context, db *mongo.Database) (MoneyResult, error) {
+	result := MoneyResult{}
+
+	steps := []struct {
+		collection string
+		filter     bson.M
+		pipeline   mongo.Pipeline
+	}{
+		{
+			collection: "products",
+			filter:     bson.M{"price": isNumber},
+			pipeline: mongo.Pipeline{
+				{{Key: "$set", Value: bson.M{"price": majorToMoney("$price")}}},
+			},
+		},
+		{
+			collection: "orders",
+			filter: bson.M{"$or": bson.A{
+				bson.M{"totalAmount": isNumber},
+				bson.M{"refundedAmount": isNumber},
+				bson.M{"items.price": isNumber},
+				bson.M{"items.refundedAmount": isNumber},
+			}},
+			pipeline: mongo.Pipeline{
+				{{Key: "$set", Value: bson.M{
+					"totalAmount":    majorToMoney("$totalAmount"),
+					"refundedAmount": majorToMoney("$refundedAmount"),
+					"items": bson.M{"$map": bson.M{
+						"input": bson.M{"$ifNull": bson.A{"$items", bson.A{}}},
+						"as":    "item",
+						"in": bson.M{"$mergeObjects": bson.A{"$$item", bson.M{
+							"price":          majorToMoney("$$item.price"),
+							"refundedAmount": majorToMoney("$$item.refundedAmount"),
+						}}},
+					}},
+				}}},
+			},
+		},
+		{
+			collection: "payments",
+			filter: bson.M{"$or": bson.A{
+				bson.M{"amount": isNumber},
+				bson.M{"amount_refunded": isNumber},
+			}},
+			pipeline: mongo.Pipeline{
+				{{Key: "$set", Value: bson.M{
+					"amount":          minorToMoney("$amount", "$currency"),
+					"amount_refunded": minorToMoney("$amount_refunded", "$currency"),
+				}}},
+				{{Key: "$unset", Value: "currency"}},
+			},
+		},
+	}
+
+	for _, step := range steps {
+		res, err := db.Collection(step.collection).UpdateMany(ctx, step.filter, step.pipeline)
+		if err != nil {
+			return result, err
+		}
+		result[step.collection] = res.ModifiedCount
+	}
+
+	// History entries carry no currency of their own; take it from their
+	// (already migrated) payment
+	modified, err := migratePaymentHistory(ctx, db)
+	result["payment_history"] = modified
+	return result, err
+}
+
+var isNumber = bson.M{"$type": "number"}
+
+// majorToMoney converts a major-unit field, integer or float, leaving anything
+// that is not a number untouched. models.Money reads unmigrated numbers the
+// same way.
+func majorToMoney(field string) bson.M {
+	scale := int64(math.Pow10(models.CurrencyExponent(models.DefaultCurrency)))
+	return bson.M{"$cond": bson.A{
+		bson.M{"$isNumber": field},
+		bson.M{
+			"amount":   bson.M{"$toLong": bson.M{"$round": bson.A{bson.M{"$multiply": bson.A{field, scale}}, 0}}},
+			"currency": models.DefaultCurrency,
+		},
+		field,
+	}}
+}
+
+// minorToMoney converts an integer minor-unit field with a sibling currency
+// field, leaving anything that is not a number untouched.
+func minorToMoney(field, currencyField string) bson.M {
+	return bson.M{"$cond": bson.A{
+		bson.M{"$isNumber": field},
+		bson.M{
+			"amount":   bson.M{"$toLong": field},
+			"currency": bson.M{"$toUpper": bson.M{"$ifNull": bson.A{currencyField, models.DefaultCurrency}}},
+		},
+		field,
+	}}
+}
+
+func migratePaymentHistory(ctx context.Context, db *mongo.Database) (int64, error) {
+	history := db.Collection("payment_history")
+	cursor, err := history.Find(ctx, bson.M{"amount": isNumber})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	currencies := make(map[primitive.ObjectID]string)
+	var modified int64
+
+	for cursor.Next(ctx) {
+		var entry struct {
+			ID        primitive.ObjectID `bson:"_id"`
+			PaymentID primitive.ObjectID `bson:"payment_id"`
+			Amount    int64              `bson:"amount"`
+		}
+		if err := cursor.Decode(&entry); err != nil {
+			return modified, err
+		}
+
+		currency, ok := currencies[entry.PaymentID]
+		if !ok {
+			var payment models.Payment
+			err := db.Collection("payments").FindOne(ctx, bson.M{"_id": entry.PaymentID}).Decode(&payment)
+			if err != nil && err != mongo.ErrNoDocuments {
+				return modified, err
+			}
+			currency = payment.Amount.Currency
+			if currency == "" {
+				currency = models.DefaultCurrency
+			}
+			currencies[entry.PaymentID] = currency
+		}
+
+		res, err := history.UpdateOne(ctx,
+			bson.M{"_id": entry.ID, "amount": isNumber},
+			bson.M{"$set": bson.M{"amount": models.NewMoney(entry.Amount, currency)}},
+		)
+		if err != nil {
+			return modified, err
+		}
+		modified += res.ModifiedCount
+	}
+
+	return modified, cursor.Err()
+}
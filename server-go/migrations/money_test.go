@@ -0,0 +1,127 @@
+package migrations
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"farmer-marketplace/models"
+)
+
+// evalExpr evaluates the aggregation operators used by majorToMoney and
+// minorToMoney against a document, the way MongoDB would.
+func evalExpr(t *testing.T, expr interface{}, doc bson.M) interface{} {
+	t.Helper()
+	number := func(v interface{}) float64 {
+		switch n := v.(type) {
+		case int32:
+			return float64(n)
+		case int64:
+			return float64(n)
+		case float64:
+			return n
+		}
+		t.Fatalf("not a number: %v", v)
+		return 0
+	}
+
+	switch e := expr.(type) {
+	case string:
+		if strings.HasPrefix(e, "$") {
+			return doc[strings.TrimPrefix(e, "$")]
+		}
+		return e
+	case bson.M:
+		if len(e) == 1 {
+			for op, arg := range e {
+				args, _ := arg.(bson.A)
+				switch op {
+				case "$cond":
+					if evalExpr(t, args[0], doc).(bool) {
+						return evalExpr(t, args[1], doc)
+					}
+					return evalExpr(t, args[2], doc)
+				case "$isNumber":
+					switch evalExpr(t, arg, doc).(type) {
+					case int32, int64, float64:
+						return true
+					}
+					return false
+				case "$multiply":
+					return number(evalExpr(t, args[0], doc)) * number(evalExpr(t, args[1], doc))
+				case "$round":
+					return math.RoundToEven(number(evalExpr(t, args[0], doc)))
+				case "$toLong":
+					return int64(number(evalExpr(t, arg, doc)))
+				case "$toUpper":
+					return strings.ToUpper(evalExpr(t, arg, doc).(string))
+				case "$ifNull":
+					if value := evalExpr(t, args[0], doc); value != nil {
+						return value
+					}
+					return evalExpr(t, args[1], doc)
+				}
+			}
+		}
+		fields := bson.M{}
+		for key, value := range e {
+			fields[key] = evalExpr(t, value, doc)
+		}
+		return fields
+	}
+	return expr
+}
+
+// decodeMoney reads a stored value the way the application does.
+func decodeMoney(t *testing.T, value interface{}) models.Money {
+	t.Helper()
+	data, err := bson.Marshal(bson.M{"price": value})
+	require.NoError(t, err)
+	var doc struct {
+		Price models.Money `bson:"price"`
+	}
+	require.NoError(t, bson.Unmarshal(data, &doc))
+	return doc.Price
+}
+
+func TestMajorToMoney(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		want  models.Money
+	}{
+		{"Float", 19.99, models.NewMoney(1999, "USD")},
+		{"Whole float", 5.0, models.NewMoney(500, "USD")},
+		{"Int32", int32(5), models.NewMoney(500, "USD")},
+		{"Int64", int64(25), models.NewMoney(2500, "USD")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			migrated := evalExpr(t, majorToMoney("$price"), bson.M{"price": tt.value})
+			assert.Equal(t, bson.M{"amount": tt.want.Amount, "currency": tt.want.Currency}, migrated)
+
+			// The application reads the number as the migration writes it
+			assert.Equal(t, tt.want, decodeMoney(t, tt.value))
+			assert.Equal(t, tt.want, decodeMoney(t, migrated))
+		})
+	}
+
+	t.Run("Leaves migrated amounts", func(t *testing.T) {
+		money := bson.M{"amount": int64(1999), "currency": "EUR"}
+		assert.Equal(t, money, evalExpr(t, majorToMoney("$price"), bson.M{"price": money}))
+		assert.Nil(t, evalExpr(t, majorToMoney("$price"), bson.M{}))
+	})
+}
+
+func TestMinorToMoney(t *testing.T) {
+	migrated := evalExpr(t, minorToMoney("$amount", "$currency"), bson.M{"amount": int64(2500), "currency": "eur"})
+	assert.Equal(t, bson.M{"amount": int64(2500), "currency": "EUR"}, migrated)
+
+	migrated = evalExpr(t, minorToMoney("$amount", "$currency"), bson.M{"amount": int32(999)})
+	assert.Equal(t, bson.M{"amount": int64(999), "currency": models.DefaultCurrency}, migrated)
+}
@@ -0,0 +1,40 @@
+package migrations
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"farmer-marketplace/models"
+)
+
+// legacyOpenOrders matches orders placed before stock was reserved per order.
+// Their stock was taken when they were placed, but they never carried the
+// stockReserved flag, so cancelling them would give nothing back. Orders
+// that were already cancelled, delivered or refunded are left alone: their
+// stock was never returned and the shelves have moved on since.
+var legacyOpenOrders = bson.M{
+	"stockReserved": bson.M{"$exists": false},
+	"fulfillments":  bson.M{"$exists": false},
+	"status": bson.M{"$in": bson.A{
+		models.OrderStatusPending,
+		models.OrderStatusConfirmed,
+		models.OrderStatusPreparing,
+		models.OrderStatusReady,
+		models.OrderStatusOutForDelivery,
+	}},
+}
+
+// MigrateStock marks the stock of legacy orders that can still be cancelled
+// as reserved, so that cancelling them gives their lines back to stock.
+// Running it again is a no-op.
+func MigrateStock(ctx context.Context, db *mongo.Database) (int64, error) {
+	res, err := db.Collection("orders").UpdateMany(ctx, legacyOpenOrders,
+		bson.M{"$set": bson.M{"stockReserved": true}},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.ModifiedCount, nil
+}
@@ -0,0 +1,52 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// APIKeyPrefix starts every API key, so that leaked keys are easy to spot.
+const APIKeyPrefix = "fhk_"
+
+// APIKeyPermissions lists the permissions an API key can carry. Managing the
+// farm, its members and its keys needs a signed-in session.
+var APIKeyPermissions = []string{
+	PermProductWrite,
+	PermOrderRead,
+	PermOrderUpdateStatus,
+}
+
+// IsAPIKeyPermission reports whether an API key can carry perm.
+func IsAPIKeyPermission(perm string) bool {
+	for _, p := range APIKeyPermissions {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// APIKey lets a farmer's own systems call the API on behalf of the farmer's
+// farm. Only a hash of the key is stored; Hint keeps its first characters so
+// that the farmer can tell keys apart.
+type APIKey struct {
+	ID          primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
+	UserID      primitive.ObjectID `json:"userId" bson:"userId"`
+	FarmID      primitive.ObjectID `json:"farmId" bson:"farmId"`
+	Label       string             `json:"label" bson:"label"`
+	Hint        string             `json:"hint" bson:"hint"`
+	KeyHash     string             `json:"-" bson:"keyHash"`
+	Permissions []string           `json:"permissions" bson:"permissions"`
+	ExpiresAt   time.Time          `json:"expiresAt" bson:"expiresAt"`
+	LastUsedAt  *time.Time         `json:"lastUsedAt,omitempty" bson:"lastUsedAt,omitempty"`
+	LastUsedIP  string             `json:"lastUsedIp,omitempty" bson:"lastUsedIp,omitempty"`
+	RevokedAt   *time.Time         `json:"revokedAt,omitempty" bson:"revokedAt,omitempty"`
+	CreatedAt   time.Time          `json:"createdAt" bson:"createdAt"`
+}
+
+type CreateAPIKeyRequest struct {
+	Label         string   `json:"label" binding:"required,max=100"`
+	Permissions   []string `json:"permissions" binding:"required,min=1"`
+	ExpiresInDays int      `json:"expiresInDays" binding:"required,min=1,max=365"`
+}
@@ -0,0 +1,36 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Audit event types.
+const (
+	AuditAccountLocked     = "account_locked"
+	AuditIPLocked          = "ip_locked"
+	AuditAccountUnlocked   = "account_unlocked"
+	AuditPasswordChanged   = "password_changed"
+	AuditAccountDeleted    = "account_deleted"
+	AuditMFAEnabled        = "mfa_enabled"
+	AuditMFADisabled       = "mfa_disabled"
+	AuditFarmInviteSent    = "farm_invite_sent"
+	AuditFarmMemberAdded   = "farm_member_added"
+	AuditFarmRoleChanged   = "farm_member_role_changed"
+	AuditFarmMemberRemoved = "farm_member_removed"
+	AuditAPIKeyCreated     = "api_key_created"
+	AuditAPIKeyRevoked     = "api_key_revoked"
+)
+
+// AuditEvent is an append-only record of a security-relevant event.
+type AuditEvent struct {
+	ID        primitive.ObjectID     `json:"_id,omitempty" bson:"_id,omitempty"`
+	Type      string                 `json:"type" bson:"type"`
+	ActorID   *primitive.ObjectID    `json:"actorId,omitempty" bson:"actorId,omitempty"` // who caused it, when not the system
+	UserID    *primitive.ObjectID    `json:"userId,omitempty" bson:"userId,omitempty"`   // account it is about
+	Email     string                 `json:"email,omitempty" bson:"email,omitempty"`
+	IP        string                 `json:"ip,omitempty" bson:"ip,omitempty"`
+	Details   map[string]interface{} `json:"details,omitempty" bson:"details,omitempty"`
+	CreatedAt time.Time              `json:"createdAt" bson:"createdAt"`
+}
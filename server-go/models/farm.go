@@ -0,0 +1,144 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Farm is a storefront. It owns the products and the order fulfillments, and
+// is run by its members.
+type Farm struct {
+	ID          primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
+	Name        string             `json:"name" bson:"name"`
+	Description string             `json:"description,omitempty" bson:"description,omitempty"`
+	Location    string             `json:"location,omitempty" bson:"location,omitempty"`
+	OwnerID     primitive.ObjectID `json:"ownerId" bson:"ownerId"`
+
+	// DeletedAt is set when the owner deleted their account; the farm stays
+	// for the orders that refer to it.
+	DeletedAt *time.Time `json:"deletedAt,omitempty" bson:"deletedAt,omitempty"`
+
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt" bson:"updatedAt"`
+}
+
+// Farm member roles.
+const (
+	FarmRoleOwner   = "owner"
+	FarmRoleManager = "manager"
+	FarmRolePacker  = "packer"
+)
+
+// FarmRolePermissions maps every farm member role to the permissions it
+// grants on the farm.
+var FarmRolePermissions = map[string][]string{
+	FarmRoleOwner: {
+		PermProductWrite,
+		PermOrderRead,
+		PermOrderUpdateStatus,
+		PermRefundIssue,
+		PermNotificationSend,
+		PermFarmManage,
+	},
+	FarmRoleManager: {
+		PermProductWrite,
+		PermOrderRead,
+		PermOrderUpdateStatus,
+		PermRefundIssue,
+		PermNotificationSend,
+	},
+	FarmRolePacker: {PermOrderRead, PermOrderUpdateStatus},
+}
+
+// FarmMember attaches a user to a farm. A user belongs to at most one farm,
+// and every farm has exactly one owner.
+type FarmMember struct {
+	ID     primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
+	FarmID primitive.ObjectID `json:"farmId" bson:"farmId"`
+	UserID primitive.ObjectID `json:"userId" bson:"userId"`
+	Role   string             `json:"role" bson:"role"`
+
+	// Permissions narrows a manager or packer to some of the permissions of
+	// their role. It is nil when the role applies in full; an empty list
+	// grants nothing.
+	Permissions []string `json:"permissions" bson:"permissions"`
+
+	InvitedBy *primitive.ObjectID `json:"invitedBy,omitempty" bson:"invitedBy,omitempty"`
+	User      *User               `json:"user,omitempty" bson:"user,omitempty"`
+	JoinedAt  time.Time           `json:"joinedAt" bson:"joinedAt"`
+}
+
+// GrantedPermissions returns the permissions the member holds on the farm:
+// those of their role, narrowed to Permissions when set. The owner always
+// holds every permission of their role.
+func (m FarmMember) GrantedPermissions() []string {
+	perms := FarmRolePermissions[m.Role]
+	if m.Permissions == nil || m.Role == FarmRoleOwner {
+		return perms
+	}
+
+	allowed := make(map[string]bool, len(m.Permissions))
+	for _, perm := range m.Permissions {
+		allowed[perm] = true
+	}
+	granted := []string{}
+	for _, perm := range perms {
+		if allowed[perm] {
+			granted = append(granted, perm)
+		}
+	}
+	return granted
+}
+
+// FarmInvite asks someone to join a farm. The invitee gets the raw token by
+// email; only its hash is stored.
+type FarmInvite struct {
+	ID         primitive.ObjectID  `json:"_id,omitempty" bson:"_id,omitempty"`
+	FarmID     primitive.ObjectID  `json:"farmId" bson:"farmId"`
+	Email      string              `json:"email" bson:"email"`
+	Role       string              `json:"role" bson:"role"`
+	TokenHash  string              `json:"-" bson:"tokenHash"`
+	InvitedBy  primitive.ObjectID  `json:"invitedBy" bson:"invitedBy"`
+	ExpiresAt  time.Time           `json:"expiresAt" bson:"expiresAt"`
+	AcceptedAt *time.Time          `json:"acceptedAt,omitempty" bson:"acceptedAt,omitempty"`
+	AcceptedBy *primitive.ObjectID `json:"acceptedBy,omitempty" bson:"acceptedBy,omitempty"`
+	RevokedAt  *time.Time          `json:"revokedAt,omitempty" bson:"revokedAt,omitempty"`
+	CreatedAt  time.Time           `json:"createdAt" bson:"createdAt"`
+}
+
+// UpdateFarmRequest changes the fields that are present.
+type UpdateFarmRequest struct {
+	Name        *string `json:"name,omitempty" binding:"omitempty,max=100"`
+	Description *string `json:"description,omitempty" binding:"omitempty,max=2000"`
+	Location    *string `json:"location,omitempty" binding:"omitempty,max=200"`
+}
+
+// CreateFarmInviteRequest invites someone by email. Ownership cannot be
+// handed out by invitation.
+type CreateFarmInviteRequest struct {
+	Email string `json:"email" binding:"required,email"`
+	Role  string `json:"role" binding:"required,oneof=manager packer"`
+}
+
+// AcceptFarmInviteRequest accepts an invitation with the signed-in account.
+type AcceptFarmInviteRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
+// RegisterFarmInviteRequest accepts an invitation by creating a staff account
+// for the invited email address.
+type RegisterFarmInviteRequest struct {
+	Token    string `json:"token" binding:"required"`
+	Name     string `json:"name" binding:"required"`
+	Password string `json:"password" binding:"required,min=6"`
+	Phone    string `json:"phone,omitempty"`
+}
+
+// UpdateFarmMemberRequest changes the role of a member. Permissions narrows
+// the member to some of the permissions of the role; leaving it out grants
+// all of them.
+type UpdateFarmMemberRequest struct {
+	Role        string   `json:"role" binding:"required,oneof=manager packer"`
+	Permissions []string `json:"permissions"`
+}
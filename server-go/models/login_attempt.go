@@ -0,0 +1,14 @@
+package models
+
+import "time"
+
+// LoginCounter counts recent failed logins for one email address or one
+// client IP. It lives in Mongo so that every API replica sees the same
+// counts; a TTL index on ExpiresAt removes idle counters.
+type LoginCounter struct {
+	ID            string     `json:"id" bson:"_id"` // "email:<address>" or "ip:<address>"
+	Failures      int        `json:"failures" bson:"failures"`
+	LastFailureAt time.Time  `json:"lastFailureAt" bson:"lastFailureAt"`
+	LockedUntil   *time.Time `json:"lockedUntil,omitempty" bson:"lockedUntil,omitempty"`
+	ExpiresAt     time.Time  `json:"expiresAt" bson:"expiresAt"`
+}
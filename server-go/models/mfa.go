@@ -0,0 +1,56 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MFASettings holds a user's TOTP second factor. Only Enabled is shown to
+// clients.
+type MFASettings struct {
+	Enabled   bool       `json:"enabled" bson:"enabled"`
+	EnabledAt *time.Time `json:"enabledAt,omitempty" bson:"enabledAt,omitempty"`
+
+	Secret        string   `json:"-" bson:"secret,omitempty"`
+	PendingSecret string   `json:"-" bson:"pendingSecret,omitempty"` // generated, not confirmed yet
+	RecoveryCodes []string `json:"-" bson:"recoveryCodes,omitempty"` // hashes of the unused codes
+	LastUsedStep  int64    `json:"-" bson:"lastUsedStep,omitempty"`  // refuses replayed codes
+}
+
+// MFA challenge purposes.
+const (
+	MFAChallengeVerify = "verify" // enter a code to finish logging in
+	MFAChallengeEnroll = "enroll" // the role requires 2FA; set it up to log in
+)
+
+// MFAChallenge is the half-finished login of a user who still has to provide
+// a second factor. The client holds the raw token; only its hash is stored.
+type MFAChallenge struct {
+	ID            string             `json:"-" bson:"_id"` // token hash
+	UserID        primitive.ObjectID `json:"userId" bson:"userId"`
+	Purpose       string             `json:"purpose" bson:"purpose"`
+	Attempts      int                `json:"attempts" bson:"attempts"`
+	PendingSecret string             `json:"-" bson:"pendingSecret,omitempty"`
+	ExpiresAt     time.Time          `json:"expiresAt" bson:"expiresAt"`
+	CreatedAt     time.Time          `json:"createdAt" bson:"createdAt"`
+}
+
+type MFACodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+type MFAChallengeRequest struct {
+	MFAToken string `json:"mfaToken" binding:"required"`
+}
+
+// MFAVerifyRequest finishes a login; Code is a TOTP code or a recovery code.
+type MFAVerifyRequest struct {
+	MFAToken string `json:"mfaToken" binding:"required"`
+	Code     string `json:"code" binding:"required"`
+}
+
+type MFADisableRequest struct {
+	Password string `json:"password" binding:"required"`
+	Code     string `json:"code" binding:"required"`
+}
@@ -0,0 +1,341 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+// DefaultCurrency is the currency the marketplace trades in. Amounts that
+// arrive without a currency, over JSON or from legacy documents, are in it.
+const DefaultCurrency = "USD"
+
+var (
+	ErrCurrencyMismatch = errors.New("currency mismatch")
+	ErrMoneyOverflow    = errors.New("money amount overflows")
+	ErrInvalidMoney     = errors.New("invalid money amount")
+)
+
+// currencyExponents lists the ISO 4217 currencies that do not use two
+// decimal places.
+var currencyExponents = map[string]int{
+	"JPY": 0, "KRW": 0, "VND": 0, "CLP": 0, "ISK": 0, "UGX": 0,
+	"BHD": 3, "JOD": 3, "KWD": 3, "OMR": 3, "TND": 3,
+}
+
+// CurrencyExponent returns the number of decimal places of a currency.
+func CurrencyExponent(currency string) int {
+	if exp, ok := currencyExponents[strings.ToUpper(currency)]; ok {
+		return exp
+	}
+	return 2
+}
+
+// Money is an amount in the minor unit of its ISO 4217 currency, e.g. cents.
+//
+// In MongoDB it is stored as {amount, currency}. Over JSON an amount in
+// DefaultCurrency is the decimal amount in major units, e.g. 25.99, which is
+// what API clients have always exchanged; any other currency is written as
+// {amount, currency} with the amount in minor units, so it is not lost.
+type Money struct {
+	Amount   int64  `json:"amount" bson:"amount"`
+	Currency string `json:"currency" bson:"currency"`
+}
+
+// NewMoney returns minor units of currency.
+func NewMoney(minor int64, currency string) Money {
+	return Money{Amount: minor, Currency: strings.ToUpper(currency)}
+}
+
+// MoneyFromFloat converts a legacy float amount in major units, rounding to
+// the nearest minor unit.
+func MoneyFromFloat(major float64, currency string) Money {
+	scale := math.Pow10(CurrencyExponent(currency))
+	return NewMoney(int64(math.Round(major*scale)), currency)
+}
+
+// ParseMoney parses a decimal amount in major units, such as "25.99", without
+// going through floating point.
+func ParseMoney(s, currency string) (Money, error) {
+	s = strings.TrimSpace(s)
+	exp := CurrencyExponent(currency)
+
+	negative := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+
+	whole, frac, _ := strings.Cut(s, ".")
+	if whole == "" && frac == "" {
+		return Money{}, ErrInvalidMoney
+	}
+	if len(frac) > exp {
+		// Only trailing zeros may go beyond the currency's precision
+		if strings.Trim(frac[exp:], "0") != "" {
+			return Money{}, fmt.Errorf("%w: %q has more than %d decimals", ErrInvalidMoney, s, exp)
+		}
+		frac = frac[:exp]
+	}
+	frac += strings.Repeat("0", exp-len(frac))
+
+	digits := whole + frac
+	if digits == "" || strings.Trim(digits, "0123456789") != "" {
+		return Money{}, fmt.Errorf("%w: %q", ErrInvalidMoney, s)
+	}
+
+	minor, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil {
+		return Money{}, ErrMoneyOverflow
+	}
+	if negative {
+		minor = -minor
+	}
+	return NewMoney(minor, currency), nil
+}
+
+func (m Money) IsZero() bool {
+	return m.Amount == 0 && m.Currency == ""
+}
+
+func (m Money) IsPositive() bool {
+	return m.Amount > 0
+}
+
+func (m Money) IsNegative() bool {
+	return m.Amount < 0
+}
+
+// sameCurrency checks that m and o can be combined. A zero Money without a
+// currency takes on the currency of the other operand, so sums can start
+// from Money{}.
+func (m Money) sameCurrency(o Money) (string, error) {
+	switch {
+	case m.Currency == o.Currency:
+		return m.Currency, nil
+	case m.IsZero():
+		return o.Currency, nil
+	case o.IsZero():
+		return m.Currency, nil
+	}
+	return "", fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, m.Currency, o.Currency)
+}
+
+func (m Money) Add(o Money) (Money, error) {
+	currency, err := m.sameCurrency(o)
+	if err != nil {
+		return Money{}, err
+	}
+	sum := m.Amount + o.Amount
+	if (o.Amount > 0 && sum < m.Amount) || (o.Amount < 0 && sum > m.Amount) {
+		return Money{}, ErrMoneyOverflow
+	}
+	return Money{Amount: sum, Currency: currency}, nil
+}
+
+func (m Money) Sub(o Money) (Money, error) {
+	if o.Amount == math.MinInt64 {
+		return Money{}, ErrMoneyOverflow
+	}
+	return m.Add(Money{Amount: -o.Amount, Currency: o.Currency})
+}
+
+// Mul multiplies the amount by a quantity.
+func (m Money) Mul(n int64) (Money, error) {
+	if m.Amount == 0 || n == 0 {
+		return Money{Amount: 0, Currency: m.Currency}, nil
+	}
+	product := m.Amount * n
+	if product/n != m.Amount || (m.Amount == -1 && n == math.MinInt64) || (n == -1 && m.Amount == math.MinInt64) {
+		return Money{}, ErrMoneyOverflow
+	}
+	return Money{Amount: product, Currency: m.Currency}, nil
+}
+
+// MulRatio multiplies the amount by num/den, rounding half away from zero to
+// the minor unit, e.g. a price per kilogram times grams/1000.
+func (m Money) MulRatio(num, den int64) (Money, error) {
+	if den == 0 {
+		return Money{}, ErrInvalidMoney
+	}
+	product := new(big.Int).Mul(big.NewInt(m.Amount), big.NewInt(num))
+	divisor := big.NewInt(den)
+	quotient, remainder := new(big.Int).QuoRem(product, divisor, new(big.Int))
+
+	// Round away from zero when at least half of the divisor remains
+	twice := new(big.Int).Abs(remainder)
+	twice.Lsh(twice, 1)
+	if twice.Cmp(new(big.Int).Abs(divisor)) >= 0 {
+		quotient.Add(quotient, big.NewInt(int64(product.Sign()*divisor.Sign())))
+	}
+
+	if !quotient.IsInt64() {
+		return Money{}, ErrMoneyOverflow
+	}
+	return Money{Amount: quotient.Int64(), Currency: m.Currency}, nil
+}
+
+// Cmp returns -1, 0 or 1 as m is less than, equal to or greater than o.
+func (m Money) Cmp(o Money) (int, error) {
+	if _, err := m.sameCurrency(o); err != nil {
+		return 0, err
+	}
+	switch {
+	case m.Amount < o.Amount:
+		return -1, nil
+	case m.Amount > o.Amount:
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// Decimal formats the amount in major units, e.g. "25.99".
+func (m Money) Decimal() string {
+	exp := CurrencyExponent(m.Currency)
+	sign := ""
+	amount := m.Amount
+	if amount < 0 {
+		sign = "-"
+	}
+
+	digits := strconv.FormatUint(absInt64(amount), 10)
+	if exp == 0 {
+		return sign + digits
+	}
+	if len(digits) <= exp {
+		digits = strings.Repeat("0", exp-len(digits)+1) + digits
+	}
+	return sign + digits[:len(digits)-exp] + "." + digits[len(digits)-exp:]
+}
+
+func (m Money) String() string {
+	currency := m.Currency
+	if currency == "" {
+		currency = DefaultCurrency
+	}
+	return m.Decimal() + " " + currency
+}
+
+func absInt64(v int64) uint64 {
+	if v < 0 {
+		return uint64(-(v + 1)) + 1
+	}
+	return uint64(v)
+}
+
+// MarshalJSON writes the decimal amount in major units, or the minor-unit
+// amount and the currency if it is not DefaultCurrency.
+func (m Money) MarshalJSON() ([]byte, error) {
+	if m.Currency != "" && m.Currency != DefaultCurrency {
+		return json.Marshal(struct {
+			Amount   int64  `json:"amount"`
+			Currency string `json:"currency"`
+		}{m.Amount, m.Currency})
+	}
+	return []byte(m.Decimal()), nil
+}
+
+// UnmarshalJSON accepts a decimal number or string in major units, e.g. 25.99
+// or "25.99", or an object with the minor-unit amount and the currency.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+
+	if len(data) > 0 && data[0] == '{' {
+		var raw struct {
+			Amount   int64  `json:"amount"`
+			Currency string `json:"currency"`
+		}
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return err
+		}
+		if raw.Currency == "" {
+			raw.Currency = DefaultCurrency
+		}
+		*m = NewMoney(raw.Amount, raw.Currency)
+		return nil
+	}
+
+	s := string(data)
+	if len(data) > 0 && data[0] == '"' {
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+	}
+	if strings.ContainsAny(s, "eE") {
+		return fmt.Errorf("%w: exponent notation is not supported", ErrInvalidMoney)
+	}
+
+	parsed, err := ParseMoney(s, DefaultCurrency)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+// MarshalBSONValue stores Money as an embedded {amount, currency} document.
+func (m Money) MarshalBSONValue() (bsontype.Type, []byte, error) {
+	return bson.MarshalValue(bson.D{
+		{Key: "amount", Value: m.Amount},
+		{Key: "currency", Value: m.Currency},
+	})
+}
+
+// UnmarshalBSONValue reads the embedded document. It also reads the plain
+// numbers of documents written before Money was introduced, so that they can
+// be served until the money migration has run. Like the migration, it takes
+// every plain number, integer or not, for major units of DefaultCurrency, as
+// prices and order totals were float dollars. Legacy payment amounts were
+// integer cents; only the migration, which knows their collection, converts
+// those correctly.
+func (m *Money) UnmarshalBSONValue(t bsontype.Type, data []byte) error {
+	raw := bson.RawValue{Type: t, Value: data}
+
+	switch t {
+	case bsontype.Null, bsontype.Undefined:
+		*m = Money{}
+		return nil
+	case bsontype.Double:
+		*m = MoneyFromFloat(raw.Double(), DefaultCurrency)
+		return nil
+	case bsontype.Int32:
+		return m.setMajor(int64(raw.Int32()))
+	case bsontype.Int64:
+		return m.setMajor(raw.Int64())
+	case bsontype.EmbeddedDocument:
+		var doc struct {
+			Amount   int64  `bson:"amount"`
+			Currency string `bson:"currency"`
+		}
+		if err := raw.Unmarshal(&doc); err != nil {
+			return err
+		}
+		// Amounts created by $inc on a missing field have no currency
+		if doc.Currency == "" {
+			doc.Currency = DefaultCurrency
+		}
+		*m = NewMoney(doc.Amount, doc.Currency)
+		return nil
+	}
+
+	return fmt.Errorf("cannot decode %s into Money", t)
+}
+
+// setMajor sets a whole amount in major units of DefaultCurrency.
+func (m *Money) setMajor(major int64) error {
+	scale := int64(math.Pow10(CurrencyExponent(DefaultCurrency)))
+	money, err := NewMoney(major, DefaultCurrency).Mul(scale)
+	if err != nil {
+		return err
+	}
+	*m = money
+	return nil
+}
@@ -0,0 +1,161 @@
+package models
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		input    string
+		currency string
+		want     int64
+		wantErr  bool
+	}{
+		{input: "25.99", currency: "USD", want: 2599},
+		{input: "0.1", currency: "USD", want: 10},
+		{input: "7", currency: "USD", want: 700},
+		{input: "-3.50", currency: "USD", want: -350},
+		{input: "12.500", currency: "USD", want: 1250},
+		{input: "1200", currency: "JPY", want: 1200},
+		{input: "1.234", currency: "KWD", want: 1234},
+		{input: "1.999", currency: "USD", wantErr: true},
+		{input: "abc", currency: "USD", wantErr: true},
+		{input: "", currency: "USD", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input+" "+tt.currency, func(t *testing.T) {
+			got, err := ParseMoney(tt.input, tt.currency)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, NewMoney(tt.want, tt.currency), got)
+		})
+	}
+}
+
+func TestMoneyArithmetic(t *testing.T) {
+	price := NewMoney(450, "usd")
+	assert.Equal(t, "USD", price.Currency)
+
+	total, err := price.Mul(3)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1350), total.Amount)
+
+	sum, err := Money{}.Add(total)
+	require.NoError(t, err)
+	assert.Equal(t, total, sum)
+
+	diff, err := sum.Sub(NewMoney(350, "USD"))
+	require.NoError(t, err)
+	assert.Equal(t, "10.00", diff.Decimal())
+
+	_, err = price.Add(NewMoney(100, "EUR"))
+	assert.ErrorIs(t, err, ErrCurrencyMismatch)
+
+	_, err = NewMoney(math.MaxInt64, "USD").Add(NewMoney(1, "USD"))
+	assert.ErrorIs(t, err, ErrMoneyOverflow)
+
+	_, err = NewMoney(math.MaxInt64/2+1, "USD").Mul(2)
+	assert.ErrorIs(t, err, ErrMoneyOverflow)
+
+	cmp, err := price.Cmp(NewMoney(500, "USD"))
+	require.NoError(t, err)
+	assert.Equal(t, -1, cmp)
+
+	// 18.99 per kg for 455 g is 8.64045
+	weighed, err := NewMoney(1899, "USD").MulRatio(455, 1000)
+	require.NoError(t, err)
+	assert.Equal(t, NewMoney(864, "USD"), weighed)
+
+	half, err := NewMoney(-5, "USD").MulRatio(1, 2)
+	require.NoError(t, err)
+	assert.Equal(t, int64(-3), half.Amount)
+
+	_, err = NewMoney(math.MaxInt64, "USD").MulRatio(3, 2)
+	assert.ErrorIs(t, err, ErrMoneyOverflow)
+	_, err = price.MulRatio(1, 0)
+	assert.ErrorIs(t, err, ErrInvalidMoney)
+}
+
+func TestMoneyDecimal(t *testing.T) {
+	assert.Equal(t, "0.05", NewMoney(5, "USD").Decimal())
+	assert.Equal(t, "-0.05", NewMoney(-5, "USD").Decimal())
+	assert.Equal(t, "1200", NewMoney(1200, "JPY").Decimal())
+	assert.Equal(t, "1.234", NewMoney(1234, "KWD").Decimal())
+	assert.Equal(t, "25.99 USD", NewMoney(2599, "USD").String())
+}
+
+func TestMoneyJSON(t *testing.T) {
+	var product struct {
+		Price Money `json:"price"`
+	}
+
+	require.NoError(t, json.Unmarshal([]byte(`{"price": 25.99}`), &product))
+	assert.Equal(t, NewMoney(2599, "USD"), product.Price)
+
+	require.NoError(t, json.Unmarshal([]byte(`{"price": "0.30"}`), &product))
+	assert.Equal(t, NewMoney(30, "USD"), product.Price)
+
+	require.NoError(t, json.Unmarshal([]byte(`{"price": {"amount": 900, "currency": "eur"}}`), &product))
+	assert.Equal(t, NewMoney(900, "EUR"), product.Price)
+
+	assert.Error(t, json.Unmarshal([]byte(`{"price": 1e3}`), &product))
+
+	product.Price = NewMoney(2599, "USD")
+	data, err := json.Marshal(product)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"price": 25.99}`, string(data))
+
+	// Other currencies keep their currency through a round trip
+	product.Price = NewMoney(1200, "JPY")
+	data, err = json.Marshal(product)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"price": {"amount": 1200, "currency": "JPY"}}`, string(data))
+	product.Price = Money{}
+	require.NoError(t, json.Unmarshal(data, &product))
+	assert.Equal(t, NewMoney(1200, "JPY"), product.Price)
+}
+
+func TestMoneyBSON(t *testing.T) {
+	type doc struct {
+		Price Money `bson:"price"`
+	}
+
+	data, err := bson.Marshal(doc{Price: NewMoney(2599, "EUR")})
+	require.NoError(t, err)
+
+	var raw bson.M
+	require.NoError(t, bson.Unmarshal(data, &raw))
+	assert.Equal(t, bson.M{"amount": int64(2599), "currency": "EUR"}, raw["price"])
+
+	var decoded doc
+	require.NoError(t, bson.Unmarshal(data, &decoded))
+	assert.Equal(t, NewMoney(2599, "EUR"), decoded.Price)
+
+	t.Run("Legacy numbers", func(t *testing.T) {
+		legacy, err := bson.Marshal(bson.M{"price": 19.99})
+		require.NoError(t, err)
+		require.NoError(t, bson.Unmarshal(legacy, &decoded))
+		assert.Equal(t, NewMoney(1999, "USD"), decoded.Price)
+
+		// Whole numbers are major units too, as the migration reads them
+		legacy, err = bson.Marshal(bson.M{"price": int64(25)})
+		require.NoError(t, err)
+		require.NoError(t, bson.Unmarshal(legacy, &decoded))
+		assert.Equal(t, NewMoney(2500, "USD"), decoded.Price)
+
+		legacy, err = bson.Marshal(bson.M{"price": int32(5)})
+		require.NoError(t, err)
+		require.NoError(t, bson.Unmarshal(legacy, &decoded))
+		assert.Equal(t, NewMoney(500, "USD"), decoded.Price)
+	})
+}
@@ -6,11 +6,78 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+const (
+	OrderStatusPending        = "pending"
+	OrderStatusConfirmed      = "confirmed"
+	OrderStatusPreparing      = "preparing"
+	OrderStatusReady          = "ready"
+	OrderStatusOutForDelivery = "out_for_delivery"
+	OrderStatusDelivered      = "delivered"
+	OrderStatusCancelled      = "cancelled"
+	OrderStatusPaymentFailed  = "payment_failed"
+
+	OrderStatusRefunded          = "refunded"
+	OrderStatusPartiallyRefunded = "partially_refunded"
+)
+
 type OrderItem struct {
-	ProductID primitive.ObjectID `json:"productId" bson:"productId"`
-	Product   *Product           `json:"product,omitempty" bson:"product,omitempty"`
-	Quantity  int                `json:"quantity" bson:"quantity"`
-	Price     float64            `json:"price" bson:"price"`
+	ProductID primitive.ObjectID  `json:"productId" bson:"productId"`
+	VariantID *primitive.ObjectID `json:"variantId,omitempty" bson:"variantId,omitempty"`
+	Product   *Product            `json:"product,omitempty" bson:"product,omitempty"`
+	Quantity  int                 `json:"quantity" bson:"quantity"`
+	Price     Money               `json:"price" bson:"price"` // unit price snapshotted from the catalog at checkout
+	Name      string              `json:"name,omitempty" bson:"name,omitempty"`
+	Unit      string              `json:"unit,omitempty" bson:"unit,omitempty"`
+	SKU       string              `json:"sku,omitempty" bson:"sku,omitempty"`
+	FarmID    primitive.ObjectID  `json:"farmId,omitempty" bson:"farmId,omitempty"`
+	// WeightGrams is the weight of one unit; CatchWeight is set on lines
+	// charged by the weight actually packed.
+	WeightGrams int          `json:"weightGrams,omitempty" bson:"weightGrams,omitempty"`
+	CatchWeight *CatchWeight `json:"catchWeight,omitempty" bson:"catchWeight,omitempty"`
+
+	RefundedQuantity int   `json:"refundedQuantity,omitempty" bson:"refundedQuantity,omitempty"`
+	RefundedAmount   Money `json:"refundedAmount,omitempty" bson:"refundedAmount,omitempty"`
+
+	// StockReleased is how much of the quantity has been given back to stock
+	StockReleased int `json:"-" bson:"stockReleased,omitempty"`
+}
+
+// CatchWeight prices an order line by the weight actually packed. Until the
+// farm records that weight the line's Price is the estimated price of one
+// unit; afterwards Total is what the whole line costs.
+type CatchWeight struct {
+	PricePerKg     Money      `json:"pricePerKg" bson:"pricePerKg"`
+	EstimatedGrams int        `json:"estimatedGrams" bson:"estimatedGrams"` // of the whole line
+	MaxTotal       Money      `json:"maxTotal" bson:"maxTotal"`             // the estimate plus the authorization buffer
+	ActualGrams    int        `json:"actualGrams,omitempty" bson:"actualGrams,omitempty"`
+	Total          *Money     `json:"total,omitempty" bson:"total,omitempty"`
+	WeighedAt      *time.Time `json:"weighedAt,omitempty" bson:"weighedAt,omitempty"`
+}
+
+// IsWeighed reports whether the line's price is final: it is not sold by
+// weight, or its actual weight was recorded.
+func (i OrderItem) IsWeighed() bool {
+	return i.CatchWeight == nil || i.CatchWeight.Total != nil
+}
+
+// Total returns what the line costs: its weighed total, or the unit price
+// times the quantity.
+func (i OrderItem) Total() (Money, error) {
+	if i.CatchWeight != nil && i.CatchWeight.Total != nil {
+		return *i.CatchWeight.Total, nil
+	}
+	return i.Price.Mul(int64(i.Quantity))
+}
+
+// AmountFor returns the share of the line's total that quantity units cost.
+func (i OrderItem) AmountFor(quantity int) (Money, error) {
+	if i.CatchWeight == nil || i.CatchWeight.Total == nil {
+		return i.Price.Mul(int64(quantity))
+	}
+	if quantity == i.Quantity {
+		return *i.CatchWeight.Total, nil
+	}
+	return i.CatchWeight.Total.MulRatio(int64(quantity), int64(i.Quantity))
 }
 
 type DeliveryAddress struct {
@@ -26,26 +93,102 @@ type Order struct {
 	CustomerID      primitive.ObjectID `json:"customerId" bson:"customerId"`
 	Customer        *User              `json:"customer,omitempty" bson:"customer,omitempty"`
 	Items           []OrderItem        `json:"items" bson:"items"`
-	TotalAmount     float64            `json:"totalAmount" bson:"totalAmount"`
-	Status          string             `json:"status" bson:"status"` // pending, confirmed, preparing, ready, out_for_delivery, delivered, cancelled
+	TotalAmount     Money              `json:"totalAmount" bson:"totalAmount"`
+	Status          string             `json:"status" bson:"status"` // pending, confirmed, preparing, ready, out_for_delivery, delivered, cancelled, payment_failed, refunded, partially_refunded
+	StatusHistory   []OrderStatusChange `json:"statusHistory,omitempty" bson:"statusHistory"`
+	Fulfillments    []Fulfillment      `json:"fulfillments,omitempty" bson:"fulfillments,omitempty"`
 	DeliveryAddress DeliveryAddress    `json:"deliveryAddress" bson:"deliveryAddress"`
 	PaymentMethod   string             `json:"paymentMethod,omitempty" bson:"paymentMethod"`
 	PaymentStatus   string             `json:"paymentStatus,omitempty" bson:"paymentStatus"`
 	PaymentIntentID string             `json:"paymentIntentId,omitempty" bson:"paymentIntentId"`
+	RefundedAmount  Money              `json:"refundedAmount,omitempty" bson:"refundedAmount,omitempty"`
 	TrackingNumber  string             `json:"trackingNumber,omitempty" bson:"trackingNumber"`
 	EstimatedDelivery time.Time        `json:"estimatedDelivery,omitempty" bson:"estimatedDelivery"`
 	Notes           string             `json:"notes,omitempty" bson:"notes"`
+	StockReserved   bool               `json:"-" bson:"stockReserved"` // legacy orders without fulfillments
 	CreatedAt       time.Time          `json:"createdAt" bson:"createdAt"`
 	UpdatedAt       time.Time          `json:"updatedAt" bson:"updatedAt"`
+	// AuthorizedAmount is held on the card for orders with catch-weight lines,
+	// above TotalAmount until every line is weighed.
+	AuthorizedAmount *Money `json:"authorizedAmount,omitempty" bson:"authorizedAmount,omitempty"`
 }
 
+// CreateOrderRequest only carries product references and quantities; prices,
+// names and units are always taken from the product catalog.
 type CreateOrderRequest struct {
-	Items           []OrderItem     `json:"items" binding:"required"`
-	DeliveryAddress DeliveryAddress `json:"deliveryAddress" binding:"required"`
-	PaymentMethod   string          `json:"paymentMethod,omitempty"`
-	Notes           string          `json:"notes,omitempty"`
+	Items           []OrderItemRequest `json:"items" binding:"required,min=1"`
+	DeliveryAddress DeliveryAddress    `json:"deliveryAddress" binding:"required"`
+	PaymentMethod   string             `json:"paymentMethod,omitempty"`
+	Notes           string             `json:"notes,omitempty"`
+}
+
+// OrderItemRequest orders Quantity of a product, or of one of its variants.
+// VariantID is required for products that have variants.
+type OrderItemRequest struct {
+	ProductID string `json:"productId" binding:"required"`
+	VariantID string `json:"variantId,omitempty"`
+	Quantity  int    `json:"quantity" binding:"required"`
+}
+
+// Fulfillment is the part of an order handled by a single farm. Each farm
+// progresses its own fulfillment; the parent order status is derived from
+// the statuses of all its fulfillments.
+type Fulfillment struct {
+	ID                primitive.ObjectID  `json:"_id" bson:"_id"`
+	FarmID            primitive.ObjectID  `json:"farmId" bson:"farmId"`
+	Status            string              `json:"status" bson:"status"`
+	StatusHistory     []OrderStatusChange `json:"statusHistory,omitempty" bson:"statusHistory"`
+	TrackingNumber    string              `json:"trackingNumber,omitempty" bson:"trackingNumber,omitempty"`
+	EstimatedDelivery *time.Time          `json:"estimatedDelivery,omitempty" bson:"estimatedDelivery,omitempty"`
+	StockReserved     bool                `json:"-" bson:"stockReserved"`
+	UpdatedAt         time.Time           `json:"updatedAt" bson:"updatedAt"`
 }
 
+// OrderStatusChange records one accepted status transition of an order.
+type OrderStatusChange struct {
+	From      string             `json:"from" bson:"from"`
+	To        string             `json:"to" bson:"to"`
+	ChangedBy primitive.ObjectID `json:"changedBy,omitempty" bson:"changedBy,omitempty"`
+	Role      string             `json:"role" bson:"role"`
+	Note      string             `json:"note,omitempty" bson:"note,omitempty"`
+	ChangedAt time.Time          `json:"changedAt" bson:"changedAt"`
+}
+
+// UpdateOrderStatusRequest moves an order, or a farm's fulfillment of it, to
+// Status. Weights record the packed weight of catch-weight lines and are only
+// accepted, and then required, when a fulfillment becomes ready.
 type UpdateOrderStatusRequest struct {
-	Status string `json:"status" binding:"required"`
-}
\ No newline at end of file
+	Status  string              `json:"status" binding:"required"`
+	Note    string              `json:"note,omitempty"`
+	Weights []LineWeightRequest `json:"weights,omitempty" binding:"omitempty,dive"`
+}
+
+// LineWeightRequest is the total weight packed for the order line of a
+// product, or of one of its variants.
+type LineWeightRequest struct {
+	ProductID   string `json:"productId" binding:"required"`
+	VariantID   string `json:"variantId,omitempty"`
+	ActualGrams int    `json:"actualGrams" binding:"required,min=1"`
+}
+
+type UpdateFulfillmentTrackingRequest struct {
+	TrackingNumber    string     `json:"trackingNumber"`
+	EstimatedDelivery *time.Time `json:"estimatedDelivery,omitempty"`
+}
+
+// RefundRequest refunds the listed lines, or every refundable line the caller
+// may act on when Items is empty.
+type RefundRequest struct {
+	Items  []RefundItemRequest `json:"items,omitempty"`
+	Reason string              `json:"reason,omitempty"`
+}
+
+// RefundItemRequest refunds and restocks Quantity units of a line. Amount
+// defaults to what Quantity units of the line cost and may be lowered for
+// partial goodwill refunds.
+type RefundItemRequest struct {
+	ProductID string `json:"productId" binding:"required"`
+	VariantID string `json:"variantId,omitempty"`
+	Quantity  int    `json:"quantity" binding:"required"`
+	Amount    *Money `json:"amount,omitempty"`
+}
@@ -9,12 +9,12 @@ type Payment struct {
 	ID                primitive.ObjectID `json:"id" bson:"_id,omitempty"`
 	OrderID           primitive.ObjectID `json:"order_id" bson:"order_id"`
 	UserID            primitive.ObjectID `json:"user_id" bson:"user_id"`
-	Amount            int64              `json:"amount" bson:"amount"`
-	Currency          string             `json:"currency" bson:"currency"`
+	Amount            Money              `json:"amount" bson:"amount"`
 	PaymentIntentID   string             `json:"payment_intent_id" bson:"payment_intent_id"`
-	Status            string             `json:"status" bson:"status"` // pending, processing, completed, failed
+	Status            string             `json:"status" bson:"status"` // pending, processing, completed, failed, refunded, partially_refunded, disputed
 	PaymentMethod     string             `json:"payment_method" bson:"payment_method"`
 	StripeChargeID    string             `json:"stripe_charge_id" bson:"stripe_charge_id,omitempty"`
+	AmountRefunded    Money              `json:"amount_refunded,omitempty" bson:"amount_refunded,omitempty"`
 	CreatedAt         time.Time          `json:"created_at" bson:"created_at"`
 	UpdatedAt         time.Time          `json:"updated_at" bson:"updated_at"`
 }
@@ -24,5 +24,14 @@ type PaymentHistory struct {
 	PaymentID primitive.ObjectID `json:"payment_id" bson:"payment_id"`
 	Status    string             `json:"status" bson:"status"`
 	Message   string             `json:"message" bson:"message"`
+	Amount    Money              `json:"amount,omitempty" bson:"amount,omitempty"`
+	RefundID  string             `json:"refund_id,omitempty" bson:"refund_id,omitempty"`
 	CreatedAt time.Time          `json:"created_at" bson:"created_at"`
+}
+
+// WebhookEvent marks a Stripe event as processed so redeliveries are ignored.
+type WebhookEvent struct {
+	ID         string    `json:"id" bson:"_id"`
+	Type       string    `json:"type" bson:"type"`
+	ReceivedAt time.Time `json:"received_at" bson:"received_at"`
 }
\ No newline at end of file
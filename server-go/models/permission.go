@@ -0,0 +1,38 @@
+package models
+
+// Permissions name the actions an account may take. Account roles grant a
+// fixed set; farm permissions come from the role of the account's farm
+// membership, see FarmRolePermissions.
+const (
+	PermCartManage        = "cart:manage"
+	PermOrderCreate       = "order:create"
+	PermOrderRead         = "order:read"
+	PermOrderUpdateStatus = "order:update_status"
+	PermRefundIssue       = "refund:issue"
+	PermProductWrite      = "product:write"
+	PermNotificationSend  = "notification:send"
+	PermFarmManage        = "farm:manage"
+	PermUserManage        = "user:manage"
+)
+
+// Permissions lists every permission.
+var Permissions = []string{
+	PermCartManage,
+	PermOrderCreate,
+	PermOrderRead,
+	PermOrderUpdateStatus,
+	PermRefundIssue,
+	PermProductWrite,
+	PermNotificationSend,
+	PermFarmManage,
+	PermUserManage,
+}
+
+// RolePermissions maps every account role to the permissions it grants.
+// Farmers and staff get theirs from their farm membership.
+var RolePermissions = map[string][]string{
+	RoleCustomer: {PermCartManage, PermOrderCreate, PermOrderRead},
+	RoleFarmer:   {},
+	RoleStaff:    {},
+	RoleAdmin:    Permissions,
+}
@@ -10,31 +10,121 @@ type Product struct {
 	ID          primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
 	Name        string             `json:"name" bson:"name" binding:"required"`
 	Description string             `json:"description" bson:"description" binding:"required"`
-	Price       float64            `json:"price" bson:"price" binding:"required"`
+	Price       Money              `json:"price" bson:"price" binding:"required"`        // the lowest variant price when it has variants
+	MaxPrice    *Money             `json:"maxPrice,omitempty" bson:"maxPrice,omitempty"` // the highest variant price
 	Category    string             `json:"category" bson:"category" binding:"required"`
-	Stock       int                `json:"stock" bson:"stock" binding:"required"`
+	Stock       int                `json:"stock" bson:"stock" binding:"required"` // the sum of the variant stocks when it has variants
 	Unit        string             `json:"unit" bson:"unit" binding:"required"`
+	Variants    []ProductVariant   `json:"variants,omitempty" bson:"variants,omitempty"`
 	Images      []string           `json:"images,omitempty" bson:"images"`
+	Photos      []ProductImage     `json:"photos,omitempty" bson:"photos,omitempty"` // uploaded, see ProductImage
 	IsOrganic   bool               `json:"isOrganic" bson:"isOrganic"`
 	HarvestDate *time.Time         `json:"harvestDate,omitempty" bson:"harvestDate"`
 	ExpiryDate  *time.Time         `json:"expiryDate,omitempty" bson:"expiryDate"`
-	FarmerID    primitive.ObjectID `json:"farmerId" bson:"farmerId"`
-	Farmer      *User              `json:"farmer,omitempty" bson:"farmer,omitempty"`
+	FarmID      primitive.ObjectID `json:"farmId" bson:"farmId"` // the farm that sells it
+	Farm        *Farm              `json:"farm,omitempty" bson:"farm,omitempty"`
+	Farmer      *User              `json:"farmer,omitempty" bson:"farmer,omitempty"` // the farm owner
 	Rating      float64            `json:"rating,omitempty" bson:"rating"`
 	Orders      int                `json:"orders,omitempty" bson:"orders"`
 	CreatedAt   time.Time          `json:"createdAt" bson:"createdAt"`
 	UpdatedAt   time.Time          `json:"updatedAt" bson:"updatedAt"`
+	// CatchWeight products are priced per kilogram and charged by the weight
+	// actually packed; a unit weighs about EstimatedWeightGrams, or the
+	// variant's WeightGrams.
+	CatchWeight          bool `json:"catchWeight,omitempty" bson:"catchWeight,omitempty"`
+	EstimatedWeightGrams int  `json:"estimatedWeightGrams,omitempty" bson:"estimatedWeightGrams,omitempty"`
+	// Markdown is the freshness discount applied to the prices shortly
+	// before the product expires.
+	Markdown *Markdown `json:"markdown,omitempty" bson:"markdown,omitempty"`
+	// ExpiryNoticeFor is the expiry date the farm was last warned about.
+	ExpiryNoticeFor *time.Time `json:"-" bson:"expiryNoticeFor,omitempty"`
 }
 
+// CreateProductRequest describes a product sold either at a single price,
+// unit and stock, or as Variants that each have their own.
 type CreateProductRequest struct {
-	Name        string     `json:"name" binding:"required"`
-	Description string     `json:"description" binding:"required"`
-	Price       float64    `json:"price" binding:"required"`
-	Category    string     `json:"category" binding:"required"`
-	Stock       int        `json:"stock" binding:"required"`
-	Unit        string     `json:"unit" binding:"required"`
-	Images      []string   `json:"images,omitempty"`
-	IsOrganic   bool       `json:"isOrganic"`
-	HarvestDate *time.Time `json:"harvestDate,omitempty"`
-	ExpiryDate  *time.Time `json:"expiryDate,omitempty"`
-}
\ No newline at end of file
+	Name        string                  `json:"name" binding:"required"`
+	Description string                  `json:"description" binding:"required"`
+	Price       Money                   `json:"price" binding:"required_without=Variants"`
+	Category    string                  `json:"category" binding:"required"`
+	Stock       int                     `json:"stock" binding:"required_without=Variants"`
+	Unit        string                  `json:"unit" binding:"required_without=Variants"`
+	Variants    []ProductVariantRequest `json:"variants,omitempty" binding:"omitempty,max=50,dive"`
+	CatchWeight bool                    `json:"catchWeight"`
+	Images      []string                `json:"images,omitempty"`
+	IsOrganic   bool                    `json:"isOrganic"`
+	HarvestDate *time.Time              `json:"harvestDate,omitempty"`
+	ExpiryDate  *time.Time              `json:"expiryDate,omitempty"`
+	// EstimatedWeightGrams is the expected weight of one unit of a catch-weight
+	// product without variants
+	EstimatedWeightGrams int `json:"estimatedWeightGrams,omitempty" binding:"min=0"`
+}
+
+// ProductVariant is one pack size of a product, such as a dozen eggs, with
+// its own SKU, price and stock.
+type ProductVariant struct {
+	ID          primitive.ObjectID `json:"_id" bson:"_id"`
+	SKU         string             `json:"sku" bson:"sku"` // unique within the farm
+	Name        string             `json:"name" bson:"name"`
+	Unit        string             `json:"unit" bson:"unit"`
+	Price       Money              `json:"price" bson:"price"`
+	Stock       int                `json:"stock" bson:"stock"`
+	WeightGrams int                `json:"weightGrams,omitempty" bson:"weightGrams,omitempty"`
+	// RegularPrice is the price before the product's markdown.
+	RegularPrice *Money `json:"regularPrice,omitempty" bson:"regularPrice,omitempty"`
+}
+
+// Markdown records a percentage taken off the prices of a product that is
+// about to expire. The regular prices come back when the farmer saves the
+// product.
+type Markdown struct {
+	Percent         int64     `json:"percent" bson:"percent"`
+	RegularPrice    Money     `json:"regularPrice" bson:"regularPrice"`
+	RegularMaxPrice *Money    `json:"regularMaxPrice,omitempty" bson:"regularMaxPrice,omitempty"`
+	AppliedAt       time.Time `json:"appliedAt" bson:"appliedAt"`
+}
+
+// ProductVariantRequest creates a variant, or updates the one with ID.
+type ProductVariantRequest struct {
+	ID          string `json:"_id,omitempty"`
+	SKU         string `json:"sku" binding:"required,max=64"`
+	Name        string `json:"name" binding:"required,max=100"`
+	Unit        string `json:"unit" binding:"required"`
+	Price       Money  `json:"price" binding:"required"`
+	Stock       int    `json:"stock" binding:"min=0"`
+	WeightGrams int    `json:"weightGrams,omitempty" binding:"min=0"`
+}
+
+// UnitWeightGrams returns the expected weight of one unit of the product, or
+// of its variant when variant is not nil.
+func (p *Product) UnitWeightGrams(variant *ProductVariant) int {
+	if variant != nil {
+		return variant.WeightGrams
+	}
+	return p.EstimatedWeightGrams
+}
+
+// IsExpired reports whether the product is past its expiry date at now.
+func (p *Product) IsExpired(now time.Time) bool {
+	return p.ExpiryDate != nil && !p.ExpiryDate.After(now)
+}
+
+// Variant returns the variant with id, if the product has it.
+func (p *Product) Variant(id primitive.ObjectID) (*ProductVariant, bool) {
+	for i := range p.Variants {
+		if p.Variants[i].ID == id {
+			return &p.Variants[i], true
+		}
+	}
+	return nil, false
+}
+
+// ProductImage is a photo uploaded for a product, stored as renditions of
+// several sizes. Images holds links to photos hosted elsewhere.
+type ProductImage struct {
+	ID        primitive.ObjectID `json:"_id" bson:"_id"`
+	Width     int                `json:"width" bson:"width"` // of the largest rendition
+	Height    int                `json:"height" bson:"height"`
+	URLs      map[string]string  `json:"urls" bson:"urls"` // by size name
+	CreatedAt time.Time          `json:"createdAt" bson:"createdAt"`
+}
@@ -0,0 +1,43 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// RefreshToken is one link in a chain of rotated refresh tokens. Every login
+// starts a new family; each refresh marks the presented token used and issues
+// the next one in the same family. Only a hash of the token is stored.
+type RefreshToken struct {
+	ID        primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
+	UserID    primitive.ObjectID `json:"userId" bson:"userId"`
+	FamilyID  string             `json:"familyId" bson:"familyId"`
+	TokenHash string             `json:"-" bson:"tokenHash"`
+	UserAgent string             `json:"userAgent,omitempty" bson:"userAgent,omitempty"`
+	IP        string             `json:"ip,omitempty" bson:"ip,omitempty"`
+	ExpiresAt time.Time          `json:"expiresAt" bson:"expiresAt"`
+	UsedAt    *time.Time         `json:"usedAt,omitempty" bson:"usedAt,omitempty"`
+	RevokedAt *time.Time         `json:"revokedAt,omitempty" bson:"revokedAt,omitempty"`
+	CreatedAt time.Time          `json:"createdAt" bson:"createdAt"`
+}
+
+// RevokedSession lists a token family whose access tokens must be refused
+// before they expire. Entries are removed by a TTL index on ExpiresAt once
+// every access token of the family has expired anyway.
+type RevokedSession struct {
+	ID        string             `json:"id" bson:"_id"` // token family ID
+	UserID    primitive.ObjectID `json:"userId" bson:"userId"`
+	Reason    string             `json:"reason" bson:"reason"`
+	RevokedAt time.Time          `json:"revokedAt" bson:"revokedAt"`
+	ExpiresAt time.Time          `json:"expiresAt" bson:"expiresAt"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refreshToken" binding:"required"`
+}
+
+type LogoutRequest struct {
+	// AllSessions signs the user out on every device.
+	AllSessions bool `json:"allSessions,omitempty"`
+}
@@ -6,17 +6,48 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+// User roles.
+const (
+	RoleCustomer = "customer"
+	RoleFarmer   = "farmer"
+	RoleStaff    = "staff" // works for a farm without selling on their own
+	RoleAdmin    = "admin"
+)
+
+// Roles lists every valid user role.
+var Roles = []string{RoleCustomer, RoleFarmer, RoleStaff, RoleAdmin}
+
+// IsValidRole reports whether role is one of Roles.
+func IsValidRole(role string) bool {
+	for _, r := range Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
 type User struct {
 	ID        primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
 	Name      string             `json:"name" bson:"name" binding:"required"`
 	Email     string             `json:"email" bson:"email" binding:"required,email"`
 	Password  string             `json:"password,omitempty" bson:"password" binding:"required"`
-	Role      string             `json:"role" bson:"role" binding:"required"` // "farmer" or "customer"
+	Role      string             `json:"role" bson:"role" binding:"required"` // one of Roles
 	Phone     string             `json:"phone,omitempty" bson:"phone"`
 	Location  string             `json:"location,omitempty" bson:"location"`
 	Avatar    string             `json:"avatar,omitempty" bson:"avatar"`
-	CreatedAt time.Time          `json:"createdAt" bson:"createdAt"`
-	UpdatedAt time.Time          `json:"updatedAt" bson:"updatedAt"`
+
+	EmailVerified   bool       `json:"emailVerified" bson:"emailVerified"`
+	EmailVerifiedAt *time.Time `json:"emailVerifiedAt,omitempty" bson:"emailVerifiedAt,omitempty"`
+
+	MFA MFASettings `json:"mfa" bson:"mfa"`
+
+	// DeletedAt is set when the account was deleted; its personal data has
+	// been anonymized and only the ID remains for the orders that refer to it.
+	DeletedAt *time.Time `json:"deletedAt,omitempty" bson:"deletedAt,omitempty"`
+
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt" bson:"updatedAt"`
 }
 
 type LoginRequest struct {
@@ -24,11 +55,42 @@ type LoginRequest struct {
 	Password string `json:"password" binding:"required"`
 }
 
+// RegisterRequest is used for self-registration, which is limited to
+// customers and farmers. Admins are created by other admins or with
+// cmd/create-admin.
 type RegisterRequest struct {
 	Name     string `json:"name" binding:"required"`
 	Email    string `json:"email" binding:"required,email"`
 	Password string `json:"password" binding:"required,min=6"`
-	Role     string `json:"role" binding:"required"`
+	Role     string `json:"role" binding:"required,oneof=customer farmer"`
+	Phone    string `json:"phone,omitempty"`
+	Location string `json:"location,omitempty"`
+}
+
+// CreateUserRequest is used by admins to create accounts of any role.
+type CreateUserRequest struct {
+	Name     string `json:"name" binding:"required"`
+	Email    string `json:"email" binding:"required,email"`
+	Password string `json:"password" binding:"required,min=6"`
+	Role     string `json:"role" binding:"required,oneof=customer farmer admin"`
 	Phone    string `json:"phone,omitempty"`
 	Location string `json:"location,omitempty"`
-}
\ No newline at end of file
+}
+
+// UpdateProfileRequest changes the fields that are present; an empty phone,
+// location or avatar clears it.
+type UpdateProfileRequest struct {
+	Name     *string `json:"name,omitempty" binding:"omitempty,max=100"`
+	Phone    *string `json:"phone,omitempty" binding:"omitempty,max=30"`
+	Location *string `json:"location,omitempty" binding:"omitempty,max=200"`
+	Avatar   *string `json:"avatar,omitempty" binding:"omitempty,max=2048"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"currentPassword" binding:"required"`
+	NewPassword     string `json:"newPassword" binding:"required,min=6"`
+}
+
+type DeleteAccountRequest struct {
+	Password string `json:"password" binding:"required"`
+}
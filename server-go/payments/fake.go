@@ -0,0 +1,225 @@
+package payments
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// FakeProvider is a deterministic in-memory Provider for tests and offline
+// development. Intents are created with NextStatus and can be moved to any
+// status with SetIntentStatus; FailNext makes the next call return an error.
+type FakeProvider struct {
+	mu            sync.Mutex
+	seq           int
+	intents       map[string]*Intent
+	idempotent    map[string]string
+	refunded      map[string]int64
+	manual        map[string]bool
+	refunds       []Refund
+	refundKeys    map[string]int // index into refunds
+	failNext      error
+	NextStatus    string
+	WebhookSecret string
+}
+
+func NewFakeProvider() *FakeProvider {
+	return &FakeProvider{
+		intents:       make(map[string]*Intent),
+		idempotent:    make(map[string]string),
+		refunded:      make(map[string]int64),
+		refundKeys:    make(map[string]int),
+		manual:        make(map[string]bool),
+		NextStatus:    StatusRequiresPaymentMethod,
+		WebhookSecret: "whsec_fake",
+	}
+}
+
+// FailNext makes the next provider call fail with err.
+func (p *FakeProvider) FailNext(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.failNext = err
+}
+
+// SetIntentStatus simulates the customer or the bank moving an intent on,
+// e.g. to StatusSucceeded, StatusProcessing or StatusRequiresPaymentMethod.
+// Intents created with ManualCapture go to StatusRequiresCapture instead of
+// StatusSucceeded.
+func (p *FakeProvider) SetIntentStatus(id, status string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	intent, ok := p.intents[id]
+	if !ok {
+		return ErrIntentNotFound
+	}
+	if status == StatusSucceeded && p.manual[id] {
+		status = StatusRequiresCapture
+	}
+	intent.Status = status
+	if status == StatusSucceeded {
+		intent.AmountReceived = intent.Amount
+	}
+	if (status == StatusSucceeded || status == StatusRequiresCapture) && intent.ChargeID == "" {
+		p.seq++
+		intent.ChargeID = fmt.Sprintf("ch_fake_%d", p.seq)
+	}
+	if status == StatusRequiresPaymentMethod {
+		intent.LastError = "Your card was declined."
+	}
+	return nil
+}
+
+// Refunds returns every refund issued so far.
+func (p *FakeProvider) Refunds() []Refund {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]Refund(nil), p.refunds...)
+}
+
+func (p *FakeProvider) takeFailure() error {
+	err := p.failNext
+	p.failNext = nil
+	return err
+}
+
+func (p *FakeProvider) CreateIntent(ctx context.Context, params IntentParams) (*Intent, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.takeFailure(); err != nil {
+		return nil, err
+	}
+
+	if id, ok := p.idempotent[params.IdempotencyKey]; ok {
+		copied := *p.intents[id]
+		return &copied, nil
+	}
+
+	p.seq++
+	id := fmt.Sprintf("pi_fake_%d", p.seq)
+	intent := &Intent{
+		ID:           id,
+		ClientSecret: id + "_secret",
+		Amount:       params.Amount,
+		Currency:     params.Currency,
+		Status:       p.NextStatus,
+		Metadata:     params.Metadata,
+	}
+	p.intents[id] = intent
+	p.manual[id] = params.ManualCapture
+	if params.IdempotencyKey != "" {
+		p.idempotent[params.IdempotencyKey] = id
+	}
+
+	copied := *intent
+	return &copied, nil
+}
+
+func (p *FakeProvider) GetIntent(ctx context.Context, id string) (*Intent, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.takeFailure(); err != nil {
+		return nil, err
+	}
+
+	intent, ok := p.intents[id]
+	if !ok {
+		return nil, ErrIntentNotFound
+	}
+
+	copied := *intent
+	return &copied, nil
+}
+
+func (p *FakeProvider) Capture(ctx context.Context, intentID string, amount int64) (*Intent, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.takeFailure(); err != nil {
+		return nil, err
+	}
+
+	intent, ok := p.intents[intentID]
+	if !ok {
+		return nil, ErrIntentNotFound
+	}
+	if intent.Status != StatusRequiresCapture {
+		return nil, errors.New("payment intent is not awaiting capture")
+	}
+	if amount <= 0 || amount > intent.Amount {
+		return nil, errors.New("capture amount exceeds the authorized amount")
+	}
+
+	intent.Status = StatusSucceeded
+	intent.AmountReceived = amount
+
+	copied := *intent
+	return &copied, nil
+}
+
+func (p *FakeProvider) Refund(ctx context.Context, intentID string, amount int64, reason, idempotencyKey string) (*Refund, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.takeFailure(); err != nil {
+		return nil, err
+	}
+	if i, ok := p.refundKeys[idempotencyKey]; ok && idempotencyKey != "" {
+		refund := p.refunds[i]
+		return &refund, nil
+	}
+
+	intent, ok := p.intents[intentID]
+	if !ok {
+		return nil, ErrIntentNotFound
+	}
+	if intent.Status != StatusSucceeded {
+		return nil, errors.New("payment intent has not succeeded")
+	}
+	if amount <= 0 || p.refunded[intentID]+amount > intent.AmountReceived {
+		return nil, errors.New("refund amount exceeds the captured amount")
+	}
+
+	p.seq++
+	p.refunded[intentID] += amount
+	refund := Refund{ID: fmt.Sprintf("re_fake_%d", p.seq), Amount: amount, Status: "succeeded"}
+	p.refunds = append(p.refunds, refund)
+	if idempotencyKey != "" {
+		p.refundKeys[idempotencyKey] = len(p.refunds) - 1
+	}
+	return &refund, nil
+}
+
+// Sign returns the signature VerifyWebhook expects for payload.
+func (p *FakeProvider) Sign(payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(p.WebhookSecret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignedEvent encodes an event as a webhook payload and signs it.
+func (p *FakeProvider) SignedEvent(event Event) (payload []byte, signature string) {
+	payload, _ = json.Marshal(event)
+	return payload, p.Sign(payload)
+}
+
+// VerifyWebhook accepts payloads produced by SignedEvent.
+func (p *FakeProvider) VerifyWebhook(payload []byte, signature string) (*Event, error) {
+	if !hmac.Equal([]byte(signature), []byte(p.Sign(payload))) {
+		return nil, ErrInvalidSignature
+	}
+
+	var event Event
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
@@ -0,0 +1,104 @@
+package payments
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFakeProviderLifecycle(t *testing.T) {
+	ctx := context.Background()
+	provider := NewFakeProvider()
+
+	intent, err := provider.CreateIntent(ctx, IntentParams{
+		Amount:   2500,
+		Currency: "usd",
+		Metadata: map[string]string{"order_id": "507f1f77bcf86cd799439011"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, StatusRequiresPaymentMethod, intent.Status)
+	assert.NotEmpty(t, intent.ClientSecret)
+	assert.True(t, intent.IsOpen())
+
+	_, err = provider.Refund(ctx, intent.ID, 500, "", "")
+	assert.Error(t, err, "cannot refund before the payment succeeded")
+
+	require.NoError(t, provider.SetIntentStatus(intent.ID, StatusSucceeded))
+	got, err := provider.GetIntent(ctx, intent.ID)
+	require.NoError(t, err)
+	assert.Equal(t, StatusSucceeded, got.Status)
+	assert.NotEmpty(t, got.ChargeID)
+	assert.Equal(t, "507f1f77bcf86cd799439011", got.Metadata["order_id"])
+
+	refund, err := provider.Refund(ctx, intent.ID, 2000, "damaged", "refund-1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2000), refund.Amount)
+
+	// Retrying with the same key returns the first refund
+	retried, err := provider.Refund(ctx, intent.ID, 2000, "damaged", "refund-1")
+	require.NoError(t, err)
+	assert.Equal(t, refund.ID, retried.ID)
+
+	_, err = provider.Refund(ctx, intent.ID, 1000, "", "")
+	assert.Error(t, err, "cannot refund more than was captured")
+	assert.Len(t, provider.Refunds(), 1)
+
+	_, err = provider.GetIntent(ctx, "pi_unknown")
+	assert.ErrorIs(t, err, ErrIntentNotFound)
+
+	boom := errors.New("boom")
+	provider.FailNext(boom)
+	_, err = provider.GetIntent(ctx, intent.ID)
+	assert.ErrorIs(t, err, boom)
+	_, err = provider.GetIntent(ctx, intent.ID)
+	assert.NoError(t, err)
+}
+
+func TestFakeProviderIdempotency(t *testing.T) {
+	ctx := context.Background()
+	provider := NewFakeProvider()
+	params := IntentParams{Amount: 1000, Currency: "usd", IdempotencyKey: "order-1"}
+
+	first, err := provider.CreateIntent(ctx, params)
+	require.NoError(t, err)
+	second, err := provider.CreateIntent(ctx, params)
+	require.NoError(t, err)
+	assert.Equal(t, first.ID, second.ID)
+
+	params.IdempotencyKey = "order-2"
+	third, err := provider.CreateIntent(ctx, params)
+	require.NoError(t, err)
+	assert.NotEqual(t, first.ID, third.ID)
+}
+
+func TestFakeProviderManualCapture(t *testing.T) {
+	ctx := context.Background()
+	provider := NewFakeProvider()
+
+	intent, err := provider.CreateIntent(ctx, IntentParams{Amount: 3000, Currency: "usd", ManualCapture: true})
+	require.NoError(t, err)
+
+	_, err = provider.Capture(ctx, intent.ID, 2500)
+	assert.Error(t, err, "cannot capture before the customer authorized")
+
+	require.NoError(t, provider.SetIntentStatus(intent.ID, StatusSucceeded))
+	got, err := provider.GetIntent(ctx, intent.ID)
+	require.NoError(t, err)
+	assert.Equal(t, StatusRequiresCapture, got.Status)
+
+	_, err = provider.Capture(ctx, intent.ID, 3500)
+	assert.Error(t, err, "cannot capture more than was authorized")
+
+	captured, err := provider.Capture(ctx, intent.ID, 2500)
+	require.NoError(t, err)
+	assert.Equal(t, StatusSucceeded, captured.Status)
+	assert.Equal(t, int64(2500), captured.AmountReceived)
+
+	_, err = provider.Refund(ctx, intent.ID, 2600, "", "")
+	assert.Error(t, err, "cannot refund more than was captured")
+	_, err = provider.Refund(ctx, intent.ID, 2500, "", "")
+	assert.NoError(t, err)
+}
@@ -0,0 +1,114 @@
+// Package payments abstracts the payment service provider so that handlers
+// can run against Stripe in production and an in-memory fake in tests.
+package payments
+
+import (
+	"context"
+	"errors"
+)
+
+// Intent statuses, using Stripe's vocabulary.
+const (
+	StatusRequiresPaymentMethod = "requires_payment_method"
+	StatusRequiresConfirmation  = "requires_confirmation"
+	StatusRequiresAction        = "requires_action"
+	StatusProcessing            = "processing"
+	StatusRequiresCapture       = "requires_capture"
+	StatusSucceeded             = "succeeded"
+	StatusCanceled              = "canceled"
+)
+
+var (
+	ErrNotConfigured    = errors.New("payment provider is not configured")
+	ErrIntentNotFound   = errors.New("payment intent not found")
+	ErrInvalidSignature = errors.New("invalid webhook signature")
+)
+
+// Intent is a provider-neutral view of a payment intent.
+type Intent struct {
+	ID           string            `json:"id"`
+	ClientSecret string            `json:"client_secret,omitempty"`
+	Amount       int64             `json:"amount"`
+	Currency     string            `json:"currency"`
+	Status       string            `json:"status"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+	// AmountReceived is what was captured, which for intents captured
+	// manually may be less than Amount
+	AmountReceived int64  `json:"amount_received,omitempty"`
+	ChargeID       string `json:"charge_id,omitempty"`
+	LastError      string `json:"last_error,omitempty"`
+}
+
+// IsOpen reports whether the intent is still waiting for the customer and can
+// be handed out again instead of creating a new one.
+func (i *Intent) IsOpen() bool {
+	switch i.Status {
+	case StatusRequiresPaymentMethod, StatusRequiresConfirmation, StatusRequiresAction:
+		return true
+	}
+	return false
+}
+
+type IntentParams struct {
+	Amount   int64
+	Currency string
+	Metadata map[string]string
+	// ManualCapture only authorizes Amount; the intent then waits in
+	// StatusRequiresCapture until Capture charges all or part of it.
+	ManualCapture bool
+	// IdempotencyKey makes retried or concurrent creations with the same key
+	// return the same intent.
+	IdempotencyKey string
+}
+
+type Refund struct {
+	ID     string `json:"id"`
+	Amount int64  `json:"amount"`
+	Status string `json:"status"`
+}
+
+// Webhook event types handled by the application.
+const (
+	EventIntentSucceeded  = "payment_intent.succeeded"
+	EventIntentAuthorized = "payment_intent.amount_capturable_updated"
+	EventIntentFailed     = "payment_intent.payment_failed"
+	EventChargeRefunded   = "charge.refunded"
+	EventDisputeCreated   = "charge.dispute.created"
+)
+
+type Charge struct {
+	ID             string `json:"id"`
+	IntentID       string `json:"intent_id"`
+	Amount         int64  `json:"amount"`
+	AmountRefunded int64  `json:"amount_refunded"`
+	Refunded       bool   `json:"refunded"`
+}
+
+type Dispute struct {
+	ID       string `json:"id"`
+	ChargeID string `json:"charge_id"`
+	IntentID string `json:"intent_id"`
+	Amount   int64  `json:"amount"`
+	Reason   string `json:"reason"`
+}
+
+// Event is a verified webhook event. Depending on Type, one of Intent,
+// Charge or Dispute is set.
+type Event struct {
+	ID      string   `json:"id"`
+	Type    string   `json:"type"`
+	Intent  *Intent  `json:"intent,omitempty"`
+	Charge  *Charge  `json:"charge,omitempty"`
+	Dispute *Dispute `json:"dispute,omitempty"`
+}
+
+// Provider is implemented by every payment service provider.
+type Provider interface {
+	CreateIntent(ctx context.Context, params IntentParams) (*Intent, error)
+	GetIntent(ctx context.Context, id string) (*Intent, error)
+	Capture(ctx context.Context, intentID string, amount int64) (*Intent, error)
+	// Refund returns the refund already made with idempotencyKey, if any,
+	// instead of refunding again.
+	Refund(ctx context.Context, intentID string, amount int64, reason, idempotencyKey string) (*Refund, error)
+	VerifyWebhook(payload []byte, signature string) (*Event, error)
+}
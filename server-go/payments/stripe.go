@@ -0,0 +1,203 @@
+package payments
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/paymentintent"
+	"github.com/stripe/stripe-go/v76/refund"
+	"github.com/stripe/stripe-go/v76/webhook"
+)
+
+// StripeProvider talks to the Stripe API with its own key instead of the
+// package-level stripe.Key.
+type StripeProvider struct {
+	intents       *paymentintent.Client
+	refunds       *refund.Client
+	webhookSecret string
+}
+
+func NewStripeProvider(secretKey, webhookSecret string) *StripeProvider {
+	p := &StripeProvider{webhookSecret: webhookSecret}
+	if secretKey != "" {
+		backend := stripe.GetBackend(stripe.APIBackend)
+		p.intents = &paymentintent.Client{B: backend, Key: secretKey}
+		p.refunds = &refund.Client{B: backend, Key: secretKey}
+	}
+	return p
+}
+
+func (p *StripeProvider) CreateIntent(ctx context.Context, params IntentParams) (*Intent, error) {
+	if p.intents == nil {
+		return nil, ErrNotConfigured
+	}
+
+	sp := &stripe.PaymentIntentParams{
+		Amount:   stripe.Int64(params.Amount),
+		Currency: stripe.String(params.Currency),
+	}
+	sp.Context = ctx
+	if params.ManualCapture {
+		sp.CaptureMethod = stripe.String(string(stripe.PaymentIntentCaptureMethodManual))
+	}
+	if params.IdempotencyKey != "" {
+		sp.SetIdempotencyKey(params.IdempotencyKey)
+	}
+	for key, value := range params.Metadata {
+		sp.AddMetadata(key, value)
+	}
+
+	pi, err := p.intents.New(sp)
+	if err != nil {
+		return nil, err
+	}
+	return intentFromStripe(pi), nil
+}
+
+func (p *StripeProvider) GetIntent(ctx context.Context, id string) (*Intent, error) {
+	if p.intents == nil {
+		return nil, ErrNotConfigured
+	}
+
+	sp := &stripe.PaymentIntentParams{}
+	sp.Context = ctx
+
+	pi, err := p.intents.Get(id, sp)
+	if err != nil {
+		var stripeErr *stripe.Error
+		if errors.As(err, &stripeErr) && stripeErr.Code == stripe.ErrorCodeResourceMissing {
+			return nil, ErrIntentNotFound
+		}
+		return nil, err
+	}
+	return intentFromStripe(pi), nil
+}
+
+func (p *StripeProvider) Capture(ctx context.Context, intentID string, amount int64) (*Intent, error) {
+	if p.intents == nil {
+		return nil, ErrNotConfigured
+	}
+
+	sp := &stripe.PaymentIntentCaptureParams{AmountToCapture: stripe.Int64(amount)}
+	sp.Context = ctx
+	// Retrying the same capture must not fail on the first one's success
+	sp.SetIdempotencyKey(fmt.Sprintf("capture-%s-%d", intentID, amount))
+
+	pi, err := p.intents.Capture(intentID, sp)
+	if err != nil {
+		return nil, err
+	}
+	return intentFromStripe(pi), nil
+}
+
+func (p *StripeProvider) Refund(ctx context.Context, intentID string, amount int64, reason, idempotencyKey string) (*Refund, error) {
+	if p.refunds == nil {
+		return nil, ErrNotConfigured
+	}
+
+	sp := &stripe.RefundParams{
+		PaymentIntent: stripe.String(intentID),
+		Amount:        stripe.Int64(amount),
+		Reason:        stripe.String(string(stripe.RefundReasonRequestedByCustomer)),
+	}
+	sp.Context = ctx
+	if idempotencyKey != "" {
+		sp.SetIdempotencyKey(idempotencyKey)
+	}
+	if reason != "" {
+		sp.AddMetadata("reason", reason)
+	}
+
+	re, err := p.refunds.New(sp)
+	if err != nil {
+		return nil, err
+	}
+	return &Refund{ID: re.ID, Amount: re.Amount, Status: string(re.Status)}, nil
+}
+
+func (p *StripeProvider) VerifyWebhook(payload []byte, signature string) (*Event, error) {
+	if p.webhookSecret == "" {
+		return nil, ErrNotConfigured
+	}
+
+	event, err := webhook.ConstructEventWithOptions(payload, signature, p.webhookSecret, webhook.ConstructEventOptions{
+		IgnoreAPIVersionMismatch: true,
+	})
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
+
+	e := &Event{ID: event.ID, Type: string(event.Type)}
+	if event.Data == nil {
+		return e, nil
+	}
+
+	switch e.Type {
+	case EventIntentSucceeded, EventIntentAuthorized, EventIntentFailed:
+		var pi stripe.PaymentIntent
+		if err := json.Unmarshal(event.Data.Raw, &pi); err != nil {
+			return nil, err
+		}
+		e.Intent = intentFromStripe(&pi)
+
+	case EventChargeRefunded:
+		var charge stripe.Charge
+		if err := json.Unmarshal(event.Data.Raw, &charge); err != nil {
+			return nil, err
+		}
+		e.Charge = &Charge{
+			ID:             charge.ID,
+			Amount:         charge.Amount,
+			AmountRefunded: charge.AmountRefunded,
+			Refunded:       charge.Refunded,
+		}
+		if charge.PaymentIntent != nil {
+			e.Charge.IntentID = charge.PaymentIntent.ID
+		}
+
+	case EventDisputeCreated:
+		var dispute stripe.Dispute
+		if err := json.Unmarshal(event.Data.Raw, &dispute); err != nil {
+			return nil, err
+		}
+		e.Dispute = &Dispute{
+			ID:     dispute.ID,
+			Amount: dispute.Amount,
+			Reason: string(dispute.Reason),
+		}
+		if dispute.Charge != nil {
+			e.Dispute.ChargeID = dispute.Charge.ID
+			if dispute.Charge.PaymentIntent != nil {
+				e.Dispute.IntentID = dispute.Charge.PaymentIntent.ID
+			}
+		}
+		if dispute.PaymentIntent != nil {
+			e.Dispute.IntentID = dispute.PaymentIntent.ID
+		}
+	}
+
+	return e, nil
+}
+
+func intentFromStripe(pi *stripe.PaymentIntent) *Intent {
+	intent := &Intent{
+		ID:           pi.ID,
+		ClientSecret: pi.ClientSecret,
+		Amount:       pi.Amount,
+		Currency:     string(pi.Currency),
+		Status:       string(pi.Status),
+		Metadata:     pi.Metadata,
+
+		AmountReceived: pi.AmountReceived,
+	}
+	if pi.LatestCharge != nil {
+		intent.ChargeID = pi.LatestCharge.ID
+	}
+	if pi.LastPaymentError != nil {
+		intent.LastError = pi.LastPaymentError.Msg
+	}
+	return intent
+}
@@ -0,0 +1,294 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/crypto/bcrypt"
+
+	"farmer-marketplace/config"
+	"farmer-marketplace/mail"
+	"farmer-marketplace/models"
+)
+
+const (
+	verifyEmailTokenTTL   = 48 * time.Hour
+	resetPasswordTokenTTL = time.Hour
+)
+
+var ErrAccountTokenInvalid = errors.New("invalid or expired token")
+
+// appURL is the base URL of the web client that the links in emails open.
+func appURL() string {
+	if base := os.Getenv("APP_URL"); base != "" {
+		return strings.TrimRight(base, "/")
+	}
+	return "http://localhost:3000"
+}
+
+// issueAccountToken invalidates the user's outstanding tokens for purpose and
+// stores a new one, returning the raw token to be mailed.
+func issueAccountToken(ctx context.Context, user *models.User, purpose string, ttl time.Duration) (string, error) {
+	raw, err := newOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	collection := config.GetCollection("account_tokens")
+	now := time.Now()
+
+	_, err = collection.UpdateMany(ctx,
+		bson.M{"userId": user.ID, "purpose": purpose, "usedAt": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"usedAt": now}},
+	)
+	if err != nil {
+		return "", err
+	}
+
+	token := models.AccountToken{
+		ID:        primitive.NewObjectID(),
+		UserID:    user.ID,
+		Purpose:   purpose,
+		Email:     user.Email,
+		TokenHash: hashToken(raw),
+		ExpiresAt: now.Add(ttl),
+		CreatedAt: now,
+	}
+	if _, err := collection.InsertOne(ctx, token); err != nil {
+		return "", err
+	}
+	return raw, nil
+}
+
+// consumeAccountToken marks an unused, unexpired token as used and returns
+// it. Claiming and checking happen in one update so a token works only once.
+func consumeAccountToken(ctx context.Context, raw, purpose string) (*models.AccountToken, error) {
+	now := time.Now()
+
+	var token models.AccountToken
+	err := config.GetCollection("account_tokens").FindOneAndUpdate(ctx,
+		bson.M{
+			"tokenHash": hashToken(raw),
+			"purpose":   purpose,
+			"usedAt":    bson.M{"$exists": false},
+			"expiresAt": bson.M{"$gt": now},
+		},
+		bson.M{"$set": bson.M{"usedAt": now}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&token)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrAccountTokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+func verificationMessage(user *models.User, token string) mail.Message {
+	link := appURL() + "/verify-email?token=" + url.QueryEscape(token)
+	return mail.Message{
+		To:      user.Email,
+		Subject: "Confirm your email address",
+		Body: fmt.Sprintf("Hi %s,\n\nPlease confirm your email address by opening this link:\n\n%s\n\n"+
+			"The link expires in %d hours. If you did not create an account, you can ignore this email.\n",
+			user.Name, link, int(verifyEmailTokenTTL/time.Hour)),
+	}
+}
+
+func passwordResetMessage(user *models.User, token string) mail.Message {
+	link := appURL() + "/reset-password?token=" + url.QueryEscape(token)
+	return mail.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\nSomeone asked to reset the password of your account. To choose a new password, open this link:\n\n%s\n\n"+
+			"The link expires in %d minutes and can be used once. If you did not ask for this, you can ignore this email.\n",
+			user.Name, link, int(resetPasswordTokenTTL/time.Minute)),
+	}
+}
+
+// sendVerificationEmail issues a verification token and mails it.
+func sendVerificationEmail(ctx context.Context, mailer mail.Mailer, user *models.User) error {
+	token, err := issueAccountToken(ctx, user, models.TokenPurposeVerifyEmail, verifyEmailTokenTTL)
+	if err != nil {
+		return err
+	}
+
+	mailCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return mailer.Send(mailCtx, verificationMessage(user, token))
+}
+
+func verifyEmail(c *gin.Context) {
+	var req models.VerifyEmailRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	token, err := consumeAccountToken(ctx, req.Token, models.TokenPurposeVerifyEmail)
+	if errors.Is(err, ErrAccountTokenInvalid) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired verification token"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify email"})
+		return
+	}
+
+	// The token only vouches for the address it was sent to
+	now := time.Now()
+	result, err := config.GetCollection("users").UpdateOne(ctx,
+		bson.M{"_id": token.UserID, "email": token.Email},
+		bson.M{"$set": bson.M{"emailVerified": true, "emailVerifiedAt": now, "updatedAt": now}},
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify email"})
+		return
+	}
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired verification token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Email verified successfully"})
+}
+
+func resendVerification(mailer mail.Mailer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, err := primitive.ObjectIDFromHex(c.GetString("userID"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		var user models.User
+		if err := config.GetCollection("users").FindOne(ctx, bson.M{"_id": userID}).Decode(&user); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		if user.EmailVerified {
+			c.JSON(http.StatusConflict, gin.H{"error": "Email is already verified"})
+			return
+		}
+
+		if err := sendVerificationEmail(ctx, mailer, &user); err != nil {
+			log.Printf("Failed to send verification email to user %s: %v", user.ID.Hex(), err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send verification email"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Verification email sent"})
+	}
+}
+
+func forgotPassword(mailer mail.Mailer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req models.ForgotPasswordRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		// The response is the same whether or not the account exists, so
+		// that this endpoint cannot be used to look up email addresses
+		response := gin.H{"message": "If an account exists for this email, a password reset link has been sent"}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		var user models.User
+		err := config.GetCollection("users").FindOne(ctx, bson.M{"email": req.Email}).Decode(&user)
+		if err == mongo.ErrNoDocuments {
+			c.JSON(http.StatusOK, response)
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process request"})
+			return
+		}
+
+		token, err := issueAccountToken(ctx, &user, models.TokenPurposeResetPassword, resetPasswordTokenTTL)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process request"})
+			return
+		}
+
+		mailCtx, cancelMail := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancelMail()
+		if err := mailer.Send(mailCtx, passwordResetMessage(&user, token)); err != nil {
+			log.Printf("Failed to send password reset email to user %s: %v", user.ID.Hex(), err)
+		}
+
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+func resetPassword(c *gin.Context) {
+	var req models.ResetPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	token, err := consumeAccountToken(ctx, req.Token, models.TokenPurposeResetPassword)
+	if errors.Is(err, ErrAccountTokenInvalid) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired reset token"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset password"})
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset password"})
+		return
+	}
+
+	result, err := config.GetCollection("users").UpdateOne(ctx,
+		bson.M{"_id": token.UserID, "email": token.Email},
+		bson.M{"$set": bson.M{"password": string(hashedPassword), "updatedAt": time.Now()}},
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset password"})
+		return
+	}
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired reset token"})
+		return
+	}
+
+	// Whoever knew the old password must not stay signed in, and the owner
+	// is no longer locked out by failures made with it
+	if err := revokeUserSessions(ctx, token.UserID, "password reset"); err != nil {
+		log.Printf("Failed to revoke sessions of user %s after password reset: %v", token.UserID.Hex(), err)
+	}
+	if _, err := clearLoginFailures(ctx, token.Email); err != nil {
+		log.Printf("Failed to clear login failures of user %s after password reset: %v", token.UserID.Hex(), err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password has been reset, please log in again"})
+}
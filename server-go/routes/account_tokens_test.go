@@ -0,0 +1,35 @@
+package routes
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"farmer-marketplace/mail"
+	"farmer-marketplace/models"
+)
+
+func TestAccountTokenMessages(t *testing.T) {
+	t.Setenv("APP_URL", "https://shop.example.com/")
+	user := &models.User{Name: "Ada", Email: "ada@example.com"}
+
+	messages := map[string]mail.Message{
+		"/verify-email":   verificationMessage(user, "tok+en/1"),
+		"/reset-password": passwordResetMessage(user, "tok+en/1"),
+	}
+	for path, msg := range messages {
+		assert.Equal(t, "ada@example.com", msg.To)
+
+		start := strings.Index(msg.Body, "https://")
+		require.GreaterOrEqual(t, start, 0)
+		link, err := url.Parse(strings.Fields(msg.Body[start:])[0])
+		require.NoError(t, err)
+
+		assert.Equal(t, "shop.example.com", link.Host)
+		assert.Equal(t, path, link.Path)
+		assert.Equal(t, "tok+en/1", link.Query().Get("token"))
+	}
+}
@@ -0,0 +1,91 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"farmer-marketplace/config"
+	"farmer-marketplace/models"
+)
+
+func AdminRoutes(router *gin.RouterGroup) {
+	admin := router.Group("/admin")
+	{
+		admin.POST("/users", authMiddleware(), requirePermission(models.PermUserManage), createUserAsAdmin)
+		admin.POST("/users/:id/unlock", authMiddleware(), requirePermission(models.PermUserManage), unlockUser)
+	}
+}
+
+// createUserAsAdmin creates an account of any role, including admins, which
+// cannot be obtained through self-registration.
+func createUserAsAdmin(c *gin.Context) {
+	var req models.CreateUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user := models.User{
+		Name:     req.Name,
+		Email:    req.Email,
+		Role:     req.Role,
+		Phone:    req.Phone,
+		Location: req.Location,
+	}
+	if err := insertUser(ctx, &user, req.Password); err != nil {
+		respondInsertUserError(c, err)
+		return
+	}
+
+	// Remove password from response
+	user.Password = ""
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "User created successfully",
+		"user":    user,
+	})
+}
+
+// unlockUser lifts a login lockout of an account before it runs out.
+func unlockUser(c *gin.Context) {
+	userID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var user models.User
+	if err := config.GetCollection("users").FindOne(ctx, bson.M{"_id": userID}).Decode(&user); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	cleared, err := clearLoginFailures(ctx, user.Email)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unlock user"})
+		return
+	}
+
+	if cleared {
+		recordAudit(ctx, models.AuditEvent{
+			Type:    models.AuditAccountUnlocked,
+			ActorID: auditActor(c),
+			UserID:  &user.ID,
+			Email:   user.Email,
+			IP:      c.ClientIP(),
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "User unlocked", "hadFailures": cleared})
+}
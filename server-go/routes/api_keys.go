@@ -0,0 +1,282 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"farmer-marketplace/config"
+	"farmer-marketplace/models"
+)
+
+const maxAPIKeysPerUser = 10
+
+func APIKeyRoutes(router *gin.RouterGroup) {
+	keys := router.Group("/api-keys")
+	keys.Use(authMiddleware(), requireSession(), requireRole(models.RoleFarmer))
+	{
+		keys.GET("", listAPIKeys)
+		keys.POST("", createAPIKey)
+		keys.DELETE("/:id", revokeAPIKey)
+	}
+}
+
+// requireSession refuses requests authenticated with an API key, for
+// endpoints that manage the account itself. It must run after
+// authMiddleware.
+func requireSession() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetString("sessionID") == "" {
+			c.JSON(http.StatusForbidden, gin.H{"error": "This endpoint requires signing in"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// authenticateAPIKey is the part of authMiddleware for API keys. A key acts
+// for its farmer on the farm it was created for, with the permissions it was
+// given that the farmer still holds there.
+func authenticateAPIKey(c *gin.Context, raw string) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+	defer cancel()
+
+	key, err := useAPIKey(ctx, hashToken(raw), c.ClientIP())
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Failed to verify API key"})
+		c.Abort()
+		return
+	}
+	if key == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key"})
+		c.Abort()
+		return
+	}
+
+	userID := key.UserID.Hex()
+	grant, err := resolveAccess(ctx, userID, models.RoleFarmer)
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Failed to load permissions"})
+		c.Abort()
+		return
+	}
+	if grant.FarmID != key.FarmID.Hex() {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key"})
+		c.Abort()
+		return
+	}
+
+	c.Set("userID", userID)
+	c.Set("role", models.RoleFarmer)
+	c.Set("apiKeyID", key.ID.Hex())
+	c.Set("permissions", intersectPermissions(key.Permissions, grant.Permissions))
+	c.Set("farmID", grant.FarmID)
+	c.Set("farmRole", grant.FarmRole)
+	c.Next()
+}
+
+// intersectPermissions returns the permissions of want that are also in have.
+func intersectPermissions(want, have []string) []string {
+	perms := []string{}
+	for _, perm := range want {
+		for _, held := range have {
+			if perm == held {
+				perms = append(perms, perm)
+				break
+			}
+		}
+	}
+	return perms
+}
+
+// useAPIKey returns the live API key with the given hash, or nil, and records
+// that it was used. It is a variable so that handler tests can run without a
+// database.
+var useAPIKey = func(ctx context.Context, keyHash, ip string) (*models.APIKey, error) {
+	now := time.Now()
+
+	var key models.APIKey
+	err := config.GetCollection("api_keys").FindOneAndUpdate(ctx,
+		bson.M{
+			"keyHash":   keyHash,
+			"revokedAt": bson.M{"$exists": false},
+			"expiresAt": bson.M{"$gt": now},
+		},
+		bson.M{"$set": bson.M{"lastUsedAt": now, "lastUsedIp": ip}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&key)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+func listAPIKeys(c *gin.Context) {
+	userID, err := primitive.ObjectIDFromHex(c.GetString("userID"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}})
+	cursor, err := config.GetCollection("api_keys").Find(ctx, bson.M{"userId": userID}, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch API keys"})
+		return
+	}
+	defer cursor.Close(ctx)
+
+	keys := []models.APIKey{}
+	if err := cursor.All(ctx, &keys); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode API keys"})
+		return
+	}
+
+	c.JSON(http.StatusOK, keys)
+}
+
+// createAPIKey issues a key for the farmer's farm. A key can only carry
+// permissions that the farmer holds; the key itself is shown once.
+func createAPIKey(c *gin.Context) {
+	var req models.CreateAPIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	perms := []string{}
+	seen := map[string]bool{}
+	for _, perm := range req.Permissions {
+		if !models.IsAPIKeyPermission(perm) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "API keys cannot carry permission: " + perm})
+			return
+		}
+		if !hasPermission(c, perm) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Missing permission: " + perm})
+			return
+		}
+		if !seen[perm] {
+			seen[perm] = true
+			perms = append(perms, perm)
+		}
+	}
+
+	userID, err := primitive.ObjectIDFromHex(c.GetString("userID"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+	farmID, ok := actingFarmID(c)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	collection := config.GetCollection("api_keys")
+	live, err := collection.CountDocuments(ctx, bson.M{
+		"userId":    userID,
+		"revokedAt": bson.M{"$exists": false},
+		"expiresAt": bson.M{"$gt": now},
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+		return
+	}
+	if live >= maxAPIKeysPerUser {
+		c.JSON(http.StatusConflict, gin.H{"error": "Too many API keys, revoke one first"})
+		return
+	}
+
+	token, err := newOpaqueToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+		return
+	}
+	raw := models.APIKeyPrefix + token
+
+	key := models.APIKey{
+		ID:          primitive.NewObjectID(),
+		UserID:      userID,
+		FarmID:      farmID,
+		Label:       req.Label,
+		Hint:        raw[:len(models.APIKeyPrefix)+6],
+		KeyHash:     hashToken(raw),
+		Permissions: perms,
+		ExpiresAt:   now.Add(time.Duration(req.ExpiresInDays) * 24 * time.Hour),
+		CreatedAt:   now,
+	}
+	if _, err := collection.InsertOne(ctx, key); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+		return
+	}
+
+	recordAudit(ctx, models.AuditEvent{
+		Type:    models.AuditAPIKeyCreated,
+		ActorID: &userID,
+		UserID:  &userID,
+		IP:      c.ClientIP(),
+		Details: bson.M{"apiKeyId": key.ID, "farmId": farmID, "permissions": perms},
+	})
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "API key created, store it now as it will not be shown again",
+		"key":     raw,
+		"apiKey":  key,
+	})
+}
+
+func revokeAPIKey(c *gin.Context) {
+	keyID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid API key ID"})
+		return
+	}
+
+	userID, err := primitive.ObjectIDFromHex(c.GetString("userID"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := config.GetCollection("api_keys").UpdateOne(ctx,
+		bson.M{"_id": keyID, "userId": userID, "revokedAt": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revokedAt": time.Now()}},
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke API key"})
+		return
+	}
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return
+	}
+
+	recordAudit(ctx, models.AuditEvent{
+		Type:    models.AuditAPIKeyRevoked,
+		ActorID: &userID,
+		UserID:  &userID,
+		IP:      c.ClientIP(),
+		Details: bson.M{"apiKeyId": keyID},
+	})
+
+	c.JSON(http.StatusOK, gin.H{"message": "API key revoked"})
+}
@@ -0,0 +1,93 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"farmer-marketplace/models"
+)
+
+func TestAPIKeyAuthentication(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	farmID := primitive.NewObjectID()
+	ownerID := primitive.NewObjectID()
+	raw := models.APIKeyPrefix + "test-key"
+	key := &models.APIKey{
+		ID:          primitive.NewObjectID(),
+		UserID:      ownerID,
+		FarmID:      farmID,
+		Permissions: []string{models.PermProductWrite, models.PermOrderRead},
+		ExpiresAt:   time.Now().Add(time.Hour),
+	}
+
+	used := 0
+	originalUse, originalMembership := useAPIKey, loadFarmMembership
+	t.Cleanup(func() { useAPIKey, loadFarmMembership = originalUse, originalMembership })
+	useAPIKey = func(ctx context.Context, keyHash, ip string) (*models.APIKey, error) {
+		if keyHash != hashToken(raw) {
+			return nil, nil
+		}
+		used++
+		return key, nil
+	}
+	memberRole := models.FarmRoleOwner
+	loadFarmMembership = func(ctx context.Context, userID string) (*models.FarmMember, error) {
+		if userID != ownerID.Hex() || memberRole == "" {
+			return nil, nil
+		}
+		return &models.FarmMember{FarmID: farmID, UserID: ownerID, Role: memberRole}, nil
+	}
+
+	router := gin.New()
+	router.GET("/products", authMiddleware(), func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"permissions": c.GetStringSlice("permissions"), "farmID": c.GetString("farmID")})
+	})
+	router.GET("/account", authMiddleware(), requireSession(), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	request := func(path, header string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", header)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request("/products", "ApiKey "+raw)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"permissions":["product:write","order:read"],"farmID":"`+farmID.Hex()+`"}`, w.Body.String())
+	assert.Equal(t, 1, used)
+
+	t.Run("Narrows to what the farmer still holds", func(t *testing.T) {
+		memberRole = models.FarmRolePacker
+		defer func() { memberRole = models.FarmRoleOwner }()
+
+		w := request("/products", "ApiKey "+raw)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"permissions":["order:read"]`)
+	})
+
+	t.Run("Refuses keys of farmers who left the farm", func(t *testing.T) {
+		memberRole = ""
+		defer func() { memberRole = models.FarmRoleOwner }()
+
+		assert.Equal(t, http.StatusUnauthorized, request("/products", "ApiKey "+raw).Code)
+	})
+
+	t.Run("Refuses unknown keys", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnauthorized, request("/products", "ApiKey "+models.APIKeyPrefix+"other").Code)
+	})
+
+	t.Run("Keeps keys out of account endpoints", func(t *testing.T) {
+		assert.Equal(t, http.StatusForbidden, request("/account", "ApiKey "+raw).Code)
+	})
+}
@@ -0,0 +1,35 @@
+package routes
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"farmer-marketplace/config"
+	"farmer-marketplace/models"
+)
+
+// recordAudit appends an event to the audit log. A failed write is logged
+// rather than failing the request that caused the event.
+func recordAudit(ctx context.Context, event models.AuditEvent) {
+	event.ID = primitive.NewObjectID()
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now()
+	}
+
+	if _, err := config.GetCollection("audit_log").InsertOne(ctx, event); err != nil {
+		log.Printf("Failed to write audit event %s: %v", event.Type, err)
+	}
+}
+
+// auditActor returns the ID of the authenticated user as an audit actor.
+func auditActor(c *gin.Context) *primitive.ObjectID {
+	id, err := primitive.ObjectIDFromHex(c.GetString("userID"))
+	if err != nil {
+		return nil
+	}
+	return &id
+}
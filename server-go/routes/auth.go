@@ -2,89 +2,159 @@ package routes
 
 import (
 	"context"
+	"errors"
+	"log"
+	"math"
 	"net/http"
-	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 	"golang.org/x/crypto/bcrypt"
 
 	"farmer-marketplace/config"
+	"farmer-marketplace/mail"
 	"farmer-marketplace/models"
 )
 
-func AuthRoutes(router *gin.RouterGroup) {
+func AuthRoutes(router *gin.RouterGroup, mailer mail.Mailer) {
 	auth := router.Group("/auth")
 	{
-		auth.POST("/register", register)
+		auth.POST("/register", register(mailer))
 		auth.POST("/login", login)
+		auth.POST("/refresh", refreshSession)
+		auth.POST("/logout", authMiddleware(), requireSession(), logout)
 		auth.GET("/me", authMiddleware(), getMe)
+		auth.GET("/profile", authMiddleware(), getMe)
+		auth.PUT("/profile", authMiddleware(), requireSession(), updateProfile)
+		auth.PUT("/password", authMiddleware(), requireSession(), changePassword)
+		auth.DELETE("/account", authMiddleware(), requireSession(), deleteAccount)
+
+		auth.POST("/mfa/verify", verifyMFA)
+		auth.POST("/mfa/enroll", enrollMFA)
+		auth.POST("/mfa/enroll/confirm", confirmMFAEnrollment)
+		auth.POST("/mfa/setup", authMiddleware(), requireSession(), setupMFA)
+		auth.POST("/mfa/confirm", authMiddleware(), requireSession(), confirmMFA)
+		auth.POST("/mfa/disable", authMiddleware(), requireSession(), disableMFA)
+		auth.POST("/mfa/recovery-codes", authMiddleware(), requireSession(), regenerateRecoveryCodes)
+		auth.POST("/verify", verifyEmail)
+		auth.POST("/resend-verification", authMiddleware(), requireSession(), resendVerification(mailer))
+		auth.POST("/forgot-password", forgotPassword(mailer))
+		auth.POST("/reset-password", resetPassword)
 	}
 }
 
-func register(c *gin.Context) {
-	var req models.RegisterRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
+func register(mailer mail.Mailer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req models.RegisterRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		user := models.User{
+			Name:     req.Name,
+			Email:    req.Email,
+			Role:     req.Role,
+			Phone:    req.Phone,
+			Location: req.Location,
+		}
+		if err := insertUser(ctx, &user, req.Password); err != nil {
+			respondInsertUserError(c, err)
+			return
+		}
+
+		// A failed email is not fatal; the user can ask for another one
+		if err := sendVerificationEmail(ctx, mailer, &user); err != nil {
+			log.Printf("Failed to send verification email to user %s: %v", user.ID.Hex(), err)
+		}
+
+		// Roles that require 2FA set it up before getting a session
+		var response gin.H
+		var err error
+		if mfaRequired(user.Role) {
+			response, err = startMFAChallenge(ctx, &user, models.MFAChallengeEnroll)
+		} else {
+			response, err = startSession(ctx, c, &user)
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+			return
+		}
+
+		// Remove password from response
+		user.Password = ""
+
+		response["message"] = "User created successfully"
+		response["user"] = user
+		c.JSON(http.StatusCreated, response)
+	}
+}
+
+var (
+	ErrUserExists  = errors.New("user already exists")
+	ErrInvalidRole = errors.New("invalid role")
+)
+
+// insertUser hashes the password and stores a new user with a valid role.
+// Farmers get a farm of their own right away.
+func insertUser(ctx context.Context, user *models.User, password string) error {
+	if !models.IsValidRole(user.Role) {
+		return ErrInvalidRole
 	}
 
-	// Check if user already exists
 	collection := config.GetCollection("users")
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
 
+	// Check if user already exists
 	var existingUser models.User
-	err := collection.FindOne(ctx, bson.M{"email": req.Email}).Decode(&existingUser)
+	err := collection.FindOne(ctx, bson.M{"email": user.Email}).Decode(&existingUser)
 	if err == nil {
-		c.JSON(http.StatusConflict, gin.H{"error": "User already exists"})
-		return
+		return ErrUserExists
 	}
 
 	// Hash password
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
-		return
+		return err
 	}
 
-	// Create user
-	user := models.User{
-		ID:        primitive.NewObjectID(),
-		Name:      req.Name,
-		Email:     req.Email,
-		Password:  string(hashedPassword),
-		Role:      req.Role,
-		Phone:     req.Phone,
-		Location:  req.Location,
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
-	}
+	now := time.Now()
+	user.ID = primitive.NewObjectID()
+	user.Password = string(hashedPassword)
+	user.CreatedAt = now
+	user.UpdatedAt = now
 
 	_, err = collection.InsertOne(ctx, user)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
-		return
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrUserExists
 	}
-
-	// Generate JWT token
-	token, err := generateJWT(user.ID.Hex(), user.Role)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
-		return
+		return err
 	}
 
-	// Remove password from response
-	user.Password = ""
+	if user.Role == models.RoleFarmer {
+		_, err = createFarm(ctx, user)
+	}
+	return err
+}
 
-	c.JSON(http.StatusCreated, gin.H{
-		"message": "User created successfully",
-		"token":   token,
-		"user":    user,
-	})
+func respondInsertUserError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, ErrUserExists):
+		c.JSON(http.StatusConflict, gin.H{"error": "User already exists"})
+	case errors.Is(err, ErrInvalidRole):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
+	}
 }
 
 func login(c *gin.Context) {
@@ -94,27 +164,82 @@ func login(c *gin.Context) {
 		return
 	}
 
-	// Find user
-	collection := config.GetCollection("users")
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
+	// Refuse early, before spending a bcrypt comparison, while the account
+	// or the client is backing off or locked out
+	if !checkLoginThrottle(ctx, c, req.Email) {
+		return
+	}
+
+	// Find user
+	collection := config.GetCollection("users")
+
 	var user models.User
 	err := collection.FindOne(ctx, bson.M{"email": req.Email}).Decode(&user)
 	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+		failLogin(ctx, c, req.Email, c.ClientIP(), nil)
 		return
 	}
 
 	// Check password
 	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password))
 	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+		failLogin(ctx, c, req.Email, c.ClientIP(), &user)
+		return
+	}
+
+	// A second factor is still needed, or has to be set up first
+	purpose := ""
+	switch {
+	case user.MFA.Enabled:
+		purpose = models.MFAChallengeVerify
+	case mfaRequired(user.Role):
+		purpose = models.MFAChallengeEnroll
+	}
+	if purpose != "" {
+		response, err := startMFAChallenge(ctx, &user, purpose)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start two-factor authentication"})
+			return
+		}
+		c.JSON(http.StatusOK, response)
 		return
 	}
 
-	// Generate JWT token
-	token, err := generateJWT(user.ID.Hex(), user.Role)
+	completeLogin(ctx, c, &user, http.StatusOK, "Login successful", nil)
+}
+
+// checkLoginThrottle writes a 429 response and returns false while logins
+// for email or from the client's IP are backing off or locked out.
+func checkLoginThrottle(ctx context.Context, c *gin.Context, email string) bool {
+	wait, err := loginRetryAfter(ctx, email, c.ClientIP())
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Failed to check login attempts"})
+		return false
+	}
+	if wait > 0 {
+		seconds := int64(math.Ceil(wait.Seconds()))
+		c.Header("Retry-After", strconv.FormatInt(seconds, 10))
+		c.JSON(http.StatusTooManyRequests, gin.H{
+			"error":      "Too many failed login attempts, please try again later",
+			"retryAfter": seconds,
+		})
+		return false
+	}
+	return true
+}
+
+// completeLogin starts a session for a user who passed every login check and
+// writes the response, with extra fields added.
+func completeLogin(ctx context.Context, c *gin.Context, user *models.User, status int, message string, extra gin.H) {
+	if _, err := clearLoginFailures(ctx, user.Email); err != nil {
+		log.Printf("Failed to clear login failures of user %s: %v", user.ID.Hex(), err)
+	}
+
+	// Start a session with an access and a refresh token
+	response, err := startSession(ctx, c, user)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
 		return
@@ -123,11 +248,19 @@ func login(c *gin.Context) {
 	// Remove password from response
 	user.Password = ""
 
-	c.JSON(http.StatusOK, gin.H{
-		"message": "Login successful",
-		"token":   token,
-		"user":    user,
-	})
+	for key, value := range extra {
+		response[key] = value
+	}
+	response["message"] = message
+	response["user"] = user
+	c.JSON(status, response)
+}
+
+func failLogin(ctx context.Context, c *gin.Context, email, ip string, user *models.User) {
+	if err := recordLoginFailure(ctx, email, ip, user); err != nil {
+		log.Printf("Failed to record login failure from %s: %v", ip, err)
+	}
+	c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
 }
 
 func getMe(c *gin.Context) {
@@ -156,21 +289,25 @@ func getMe(c *gin.Context) {
 	c.JSON(http.StatusOK, user)
 }
 
-func generateJWT(userID, role string) (string, error) {
+// generateAccessToken issues a short-lived access token for a session.
+func generateAccessToken(userID, role, sessionID string) (string, error) {
+	jti, err := newOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
 	claims := jwt.MapClaims{
 		"userID": userID,
 		"role":   role,
-		"exp":    time.Now().Add(time.Hour * 24 * 7).Unix(), // 7 days
+		"sid":    sessionID,
+		"typ":    "access",
+		"jti":    jti,
+		"iat":    now.Unix(),
+		"exp":    now.Add(accessTokenTTL).Unix(),
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	
-	jwtSecret := os.Getenv("JWT_SECRET")
-	if jwtSecret == "" {
-		jwtSecret = "your-secret-key"
-	}
-	
-	return token.SignedString([]byte(jwtSecret))
+	return tokenKeys.Sign(claims)
 }
 
 func authMiddleware() gin.HandlerFunc {
@@ -182,20 +319,18 @@ func authMiddleware() gin.HandlerFunc {
 			return
 		}
 
+		// API keys are looked up rather than verified
+		if raw, ok := strings.CutPrefix(tokenString, "ApiKey "); ok {
+			authenticateAPIKey(c, raw)
+			return
+		}
+
 		// Remove "Bearer " prefix
 		if len(tokenString) > 7 && tokenString[:7] == "Bearer " {
 			tokenString = tokenString[7:]
 		}
 
-		jwtSecret := os.Getenv("JWT_SECRET")
-		if jwtSecret == "" {
-			jwtSecret = "your-secret-key"
-		}
-
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			return []byte(jwtSecret), nil
-		})
-
+		token, err := tokenKeys.Parse(tokenString, jwt.MapClaims{})
 		if err != nil || !token.Valid {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
 			c.Abort()
@@ -209,8 +344,45 @@ func authMiddleware() gin.HandlerFunc {
 			return
 		}
 
-		c.Set("userID", claims["userID"])
-		c.Set("role", claims["role"])
+		// Only access tokens are accepted, and only while their session
+		// has not been revoked
+		sessionID, _ := claims["sid"].(string)
+		if claims["typ"] != "access" || sessionID == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+			c.Abort()
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+		defer cancel()
+
+		revoked, err := isSessionRevoked(ctx, sessionID)
+		if err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Failed to verify session"})
+			c.Abort()
+			return
+		}
+		if revoked {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Session has been revoked"})
+			c.Abort()
+			return
+		}
+
+		userID, _ := claims["userID"].(string)
+		role, _ := claims["role"].(string)
+		grant, err := resolveAccess(ctx, userID, role)
+		if err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Failed to load permissions"})
+			c.Abort()
+			return
+		}
+
+		c.Set("userID", userID)
+		c.Set("role", role)
+		c.Set("sessionID", sessionID)
+		c.Set("permissions", grant.Permissions)
+		c.Set("farmID", grant.FarmID)
+		c.Set("farmRole", grant.FarmRole)
 		c.Next()
 	}
 }
\ No newline at end of file
@@ -0,0 +1,194 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"farmer-marketplace/auth"
+	"farmer-marketplace/models"
+)
+
+const testTokenSecret = "test-secret-that-is-at-least-32-bytes"
+
+// testAccessToken issues an access token for a fresh session and replaces the
+// revocation lookup with one that only knows the given revoked sessions, and
+// the farm membership lookup with one that finds none.
+func testAccessToken(t *testing.T, userID, role string, revoked ...string) string {
+	t.Helper()
+
+	key, err := auth.NewHMACKey("test", []byte(testTokenSecret))
+	require.NoError(t, err)
+	keys, err := auth.NewKeyring(key.ID, key)
+	require.NoError(t, err)
+
+	original, originalKeys, originalMembership := isSessionRevoked, tokenKeys, loadFarmMembership
+	t.Cleanup(func() { isSessionRevoked, tokenKeys, loadFarmMembership = original, originalKeys, originalMembership })
+	tokenKeys = keys
+	loadFarmMembership = func(ctx context.Context, userID string) (*models.FarmMember, error) {
+		return nil, nil
+	}
+	isSessionRevoked = func(ctx context.Context, sessionID string) (bool, error) {
+		for _, id := range revoked {
+			if id == sessionID {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	token, err := generateAccessToken(userID, role, "session-"+t.Name())
+	require.NoError(t, err)
+	return token
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	router.GET("/protected", authMiddleware(), func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"userID": c.GetString("userID"), "sessionID": c.GetString("sessionID")})
+	})
+
+	request := func(token string) int {
+		req, _ := http.NewRequest("GET", "/protected", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	t.Run("Accepts a live session", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, request(testAccessToken(t, "507f1f77bcf86cd799439012", "customer")))
+	})
+
+	t.Run("Refuses a revoked session", func(t *testing.T) {
+		token := testAccessToken(t, "507f1f77bcf86cd799439012", "customer", "session-"+t.Name())
+		assert.Equal(t, http.StatusUnauthorized, request(token))
+	})
+
+	t.Run("Refuses tokens without a session", func(t *testing.T) {
+		testAccessToken(t, "507f1f77bcf86cd799439012", "customer")
+
+		legacy := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+			"userID": "507f1f77bcf86cd799439012",
+			"role":   "customer",
+			"exp":    time.Now().Add(time.Hour).Unix(),
+		})
+		legacy.Header["kid"] = "test"
+		token, err := legacy.SignedString([]byte(testTokenSecret))
+		require.NoError(t, err)
+
+		assert.Equal(t, http.StatusUnauthorized, request(token))
+	})
+
+	t.Run("Refuses tokens without a known kid", func(t *testing.T) {
+		testAccessToken(t, "507f1f77bcf86cd799439012", "customer")
+
+		for _, kid := range []interface{}{nil, "other"} {
+			unsigned := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+				"userID": "507f1f77bcf86cd799439012",
+				"role":   "customer",
+				"sid":    "session-" + t.Name(),
+				"typ":    "access",
+				"exp":    time.Now().Add(time.Hour).Unix(),
+			})
+			if kid != nil {
+				unsigned.Header["kid"] = kid
+			}
+			token, err := unsigned.SignedString([]byte(testTokenSecret))
+			require.NoError(t, err)
+
+			assert.Equal(t, http.StatusUnauthorized, request(token))
+		}
+	})
+}
+
+func TestHashToken(t *testing.T) {
+	token, err := newOpaqueToken()
+	require.NoError(t, err)
+	other, err := newOpaqueToken()
+	require.NoError(t, err)
+
+	assert.NotEqual(t, token, other)
+	assert.Equal(t, hashToken(token), hashToken(token))
+	assert.NotEqual(t, hashToken(token), hashToken(other))
+	assert.NotContains(t, hashToken(token), token)
+}
+
+func TestRequireRole(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	router.GET("/farmers", authMiddleware(), requireRole(models.RoleFarmer, models.RoleAdmin), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	request := func(role string) int {
+		req, _ := http.NewRequest("GET", "/farmers", nil)
+		req.Header.Set("Authorization", "Bearer "+testAccessToken(t, "507f1f77bcf86cd799439012", role))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, request(models.RoleFarmer))
+	assert.Equal(t, http.StatusOK, request(models.RoleAdmin))
+	assert.Equal(t, http.StatusForbidden, request(models.RoleCustomer))
+	assert.Equal(t, http.StatusForbidden, request("superuser"))
+}
+
+func TestRequirePermission(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	farmID := primitive.NewObjectID()
+	router := gin.New()
+	router.GET("/products", authMiddleware(), requirePermission(models.PermProductWrite), func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"farmID": c.GetString("farmID")})
+	})
+
+	roles := map[string]string{
+		"507f1f77bcf86cd799439012": models.FarmRoleOwner,
+		"507f1f77bcf86cd799439013": models.FarmRoleManager,
+		"507f1f77bcf86cd799439014": models.FarmRolePacker,
+	}
+	membership := func(ctx context.Context, userID string) (*models.FarmMember, error) {
+		role, ok := roles[userID]
+		if !ok {
+			return nil, nil
+		}
+		return &models.FarmMember{FarmID: farmID, Role: role}, nil
+	}
+
+	request := func(userID, role string) *httptest.ResponseRecorder {
+		token := testAccessToken(t, userID, role)
+		loadFarmMembership = membership
+
+		req, _ := http.NewRequest("GET", "/products", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request("507f1f77bcf86cd799439012", models.RoleFarmer)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), farmID.Hex())
+
+	// Members act for the farm with what their farm role grants
+	w = request("507f1f77bcf86cd799439013", models.RoleStaff)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), farmID.Hex())
+
+	assert.Equal(t, http.StatusForbidden, request("507f1f77bcf86cd799439014", models.RoleStaff).Code)
+	assert.Equal(t, http.StatusForbidden, request("507f1f77bcf86cd799439015", models.RoleFarmer).Code)
+	assert.Equal(t, http.StatusForbidden, request("507f1f77bcf86cd799439012", models.RoleCustomer).Code)
+}
@@ -17,6 +17,7 @@ type CartItem struct {
 	ID        primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
 	UserID    primitive.ObjectID `json:"userId" bson:"userId"`
 	ProductID primitive.ObjectID `json:"productId" bson:"productId"`
+	VariantID *primitive.ObjectID `json:"variantId,omitempty" bson:"variantId,omitempty"`
 	Product   *models.Product    `json:"product,omitempty" bson:"product,omitempty"`
 	Quantity  int                `json:"quantity" bson:"quantity"`
 	CreatedAt time.Time          `json:"createdAt" bson:"createdAt"`
@@ -25,6 +26,7 @@ type CartItem struct {
 
 type AddToCartRequest struct {
 	ProductID string `json:"productId" binding:"required"`
+	VariantID string `json:"variantId,omitempty"` // required for products with variants
 	Quantity  int    `json:"quantity" binding:"required,min=1"`
 }
 
@@ -35,11 +37,11 @@ type UpdateCartRequest struct {
 func CartRoutes(router *gin.RouterGroup) {
 	cart := router.Group("/cart")
 	{
-		cart.POST("/add", authMiddleware(), addToCart)
-		cart.GET("", authMiddleware(), getCart)
-		cart.PUT("/:id", authMiddleware(), updateCartItem)
-		cart.DELETE("/:id", authMiddleware(), removeFromCart)
-		cart.DELETE("/clear", authMiddleware(), clearCart)
+		cart.POST("/add", authMiddleware(), requirePermission(models.PermCartManage), addToCart)
+		cart.GET("", authMiddleware(), requirePermission(models.PermCartManage), getCart)
+		cart.PUT("/:id", authMiddleware(), requirePermission(models.PermCartManage), updateCartItem)
+		cart.DELETE("/:id", authMiddleware(), requirePermission(models.PermCartManage), removeFromCart)
+		cart.DELETE("/clear", authMiddleware(), requirePermission(models.PermCartManage), clearCart)
 	}
 }
 
@@ -51,13 +53,6 @@ func addToCart(c *gin.Context) {
 	}
 
 	userID := c.GetString("userID")
-	role := c.GetString("role")
-
-	if role != "customer" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Only customers can add items to cart"})
-		return
-	}
-
 	customerID, err := primitive.ObjectIDFromHex(userID)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid customer ID"})
@@ -70,12 +65,34 @@ func addToCart(c *gin.Context) {
 		return
 	}
 
-	collection := config.GetCollection("cart")
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
+	var product models.Product
+	err = config.GetCollection("products").FindOne(ctx, bson.M{"_id": productID}).Decode(&product)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+		return
+	}
+	if product.IsExpired(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Product has expired"})
+		return
+	}
+
+	var variantID *primitive.ObjectID
+	if len(product.Variants) > 0 || req.VariantID != "" {
+		variant, reason := lineVariant(&product, req.VariantID)
+		if reason != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid variant: " + reason})
+			return
+		}
+		variantID = &variant.ID
+	}
+
+	collection := config.GetCollection("cart")
+
 	// Check if item already exists in cart
-	filter := bson.M{"userId": customerID, "productId": productID}
+	filter := bson.M{"userId": customerID, "productId": productID, "variantId": variantID}
 	var existingItem CartItem
 	err = collection.FindOne(ctx, filter).Decode(&existingItem)
 
@@ -96,6 +113,7 @@ func addToCart(c *gin.Context) {
 			ID:        primitive.NewObjectID(),
 			UserID:    customerID,
 			ProductID: productID,
+			VariantID: variantID,
 			Quantity:  req.Quantity,
 			CreatedAt: time.Now(),
 			UpdatedAt: time.Now(),
@@ -113,13 +131,6 @@ func addToCart(c *gin.Context) {
 
 func getCart(c *gin.Context) {
 	userID := c.GetString("userID")
-	role := c.GetString("role")
-
-	if role != "customer" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Only customers can access cart"})
-		return
-	}
-
 	customerID, err := primitive.ObjectIDFromHex(userID)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid customer ID"})
@@ -183,13 +194,6 @@ func updateCartItem(c *gin.Context) {
 	}
 
 	userID := c.GetString("userID")
-	role := c.GetString("role")
-
-	if role != "customer" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Only customers can update cart items"})
-		return
-	}
-
 	customerID, err := primitive.ObjectIDFromHex(userID)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid customer ID"})
@@ -241,13 +245,6 @@ func removeFromCart(c *gin.Context) {
 	}
 
 	userID := c.GetString("userID")
-	role := c.GetString("role")
-
-	if role != "customer" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Only customers can remove cart items"})
-		return
-	}
-
 	customerID, err := primitive.ObjectIDFromHex(userID)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid customer ID"})
@@ -275,13 +272,6 @@ func removeFromCart(c *gin.Context) {
 
 func clearCart(c *gin.Context) {
 	userID := c.GetString("userID")
-	role := c.GetString("role")
-
-	if role != "customer" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Only customers can clear cart"})
-		return
-	}
-
 	customerID, err := primitive.ObjectIDFromHex(userID)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid customer ID"})
@@ -0,0 +1,299 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"farmer-marketplace/config"
+	"farmer-marketplace/models"
+	"farmer-marketplace/payments"
+)
+
+// Catch-weight products are priced per kilogram but only weighed when packed.
+// Checkout charges an estimate, the payment is authorized with a buffer on top
+// of it and captured once every catch-weight line has been weighed.
+
+const defaultCatchWeightBuffer = 15
+
+var ErrWeightsNotAccepted = errors.New("weights can only be recorded when the fulfillment becomes ready")
+
+// WeightIssue describes a catch-weight line whose weight cannot be recorded.
+type WeightIssue struct {
+	ProductID string `json:"productId"`
+	VariantID string `json:"variantId,omitempty"`
+	Reason    string `json:"reason"`
+}
+
+// WeightError lists every weight that is missing or does not fit a line.
+type WeightError struct {
+	Issues []WeightIssue `json:"issues"`
+}
+
+func (e *WeightError) Error() string {
+	return fmt.Sprintf("%d line weight(s) are invalid", len(e.Issues))
+}
+
+// catchWeightBuffer is how many percent the payment authorization exceeds
+// the estimate of catch-weight lines, CATCH_WEIGHT_BUFFER_PERCENT or 15.
+func catchWeightBuffer() int64 {
+	if value := os.Getenv("CATCH_WEIGHT_BUFFER_PERCENT"); value != "" {
+		if percent, err := strconv.Atoi(value); err == nil && percent >= 0 && percent <= 100 {
+			return int64(percent)
+		}
+	}
+	return defaultCatchWeightBuffer
+}
+
+// checkCatchWeight validates that every unit of a catch-weight product has
+// an estimated weight to charge at checkout.
+func checkCatchWeight(product *models.Product) error {
+	if !product.CatchWeight {
+		return nil
+	}
+	if len(product.Variants) == 0 {
+		if product.EstimatedWeightGrams <= 0 {
+			return errors.New("catch-weight products need an estimated weight per unit")
+		}
+		return nil
+	}
+	for _, variant := range product.Variants {
+		if variant.WeightGrams <= 0 {
+			return fmt.Errorf("variant %q of a catch-weight product needs a weight", variant.SKU)
+		}
+	}
+	return nil
+}
+
+// priceCatchWeight prices an order line of a catch-weight product at its
+// estimated weight, returning why it cannot be priced otherwise. The line's
+// Price is the price per kilogram until then.
+func priceCatchWeight(item *models.OrderItem, unitGrams int) string {
+	if unitGrams <= 0 {
+		return "product has no estimated weight"
+	}
+
+	pricePerKg := item.Price
+	unitPrice, err := pricePerKg.MulRatio(int64(unitGrams), 1000)
+	if err != nil {
+		return "line total is too large"
+	}
+	estimate, err := unitPrice.Mul(int64(item.Quantity))
+	if err != nil {
+		return "line total is too large"
+	}
+	maxTotal, err := estimate.MulRatio(100+catchWeightBuffer(), 100)
+	if err != nil {
+		return "line total is too large"
+	}
+
+	item.Price = unitPrice
+	item.CatchWeight = &models.CatchWeight{
+		PricePerKg:     pricePerKg,
+		EstimatedGrams: unitGrams * item.Quantity,
+		MaxTotal:       maxTotal,
+	}
+	return ""
+}
+
+// authorizationAmount is what to hold on the customer's card for an order
+// with catch-weight lines, or nil for orders that are charged at once.
+func authorizationAmount(items []models.OrderItem) (*models.Money, error) {
+	var total models.Money
+	weighed := false
+
+	for _, item := range items {
+		amount, err := item.Total()
+		if item.CatchWeight != nil {
+			amount, err = item.CatchWeight.MaxTotal, nil
+			weighed = true
+		}
+		if err == nil {
+			total, err = total.Add(amount)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !weighed {
+		return nil, nil
+	}
+	return &total, nil
+}
+
+// orderTotal sums the current totals of the order lines.
+func orderTotal(items []models.OrderItem) (models.Money, error) {
+	var total models.Money
+	for _, item := range items {
+		amount, err := item.Total()
+		if err == nil {
+			total, err = total.Add(amount)
+		}
+		if err != nil {
+			return models.Money{}, err
+		}
+	}
+	return total, nil
+}
+
+// weighFarmLines records the packed weights of the farm's catch-weight lines
+// on the order and returns the fields to save with the fulfillment. Every
+// catch-weight line of the farm must be weighed. A line never costs more than
+// its estimate plus the buffer, which is all the customer has authorized.
+func weighFarmLines(order *models.Order, farmID primitive.ObjectID, weights []models.LineWeightRequest) (bson.M, error) {
+	var issues []WeightIssue
+	weighed := make(map[int]int)
+
+	for _, weight := range weights {
+		idx := -1
+		for i, item := range order.Items {
+			if item.FarmID == farmID && item.CatchWeight != nil && isOrderLine(item, weight.ProductID, weight.VariantID) {
+				idx = i
+				break
+			}
+		}
+		switch {
+		case idx < 0:
+			issues = append(issues, WeightIssue{ProductID: weight.ProductID, VariantID: weight.VariantID, Reason: "no catch-weight line of your farm for this product"})
+		case weighed[idx] > 0:
+			issues = append(issues, WeightIssue{ProductID: weight.ProductID, VariantID: weight.VariantID, Reason: "weight is given more than once"})
+		default:
+			weighed[idx] = weight.ActualGrams
+		}
+	}
+
+	issues = append(issues, unweighedLines(order, &farmID, weighed)...)
+
+	if len(issues) > 0 {
+		return nil, &WeightError{Issues: issues}
+	}
+
+	set := bson.M{}
+	now := time.Now()
+	for i, grams := range weighed {
+		cw := *order.Items[i].CatchWeight
+		total, err := cw.PricePerKg.MulRatio(int64(grams), 1000)
+		if err != nil {
+			return nil, err
+		}
+		if cmp, err := total.Cmp(cw.MaxTotal); err != nil || cmp > 0 {
+			total = cw.MaxTotal
+		}
+
+		cw.ActualGrams = grams
+		cw.Total = &total
+		cw.WeighedAt = &now
+		order.Items[i].CatchWeight = &cw
+		set[fmt.Sprintf("items.%d.catchWeight", i)] = cw
+	}
+
+	if len(set) > 0 {
+		total, err := orderTotal(order.Items)
+		if err != nil {
+			return nil, err
+		}
+		order.TotalAmount = total
+		set["totalAmount"] = total
+	}
+
+	return set, nil
+}
+
+// unweighedLines lists the catch-weight lines of the farm, or of every farm
+// when farmID is nil, that still need their weight recorded. Lines about to
+// be weighed and lines of cancelled fulfillments are skipped.
+func unweighedLines(order *models.Order, farmID *primitive.ObjectID, weighed map[int]int) []WeightIssue {
+	cancelled := cancelledFarms(order)
+
+	var issues []WeightIssue
+	for i, item := range order.Items {
+		if item.IsWeighed() || weighed[i] > 0 || cancelled[item.FarmID] || (farmID != nil && item.FarmID != *farmID) {
+			continue
+		}
+		issue := WeightIssue{ProductID: item.ProductID.Hex(), Reason: "record the actual weight of this line"}
+		if item.VariantID != nil {
+			issue.VariantID = item.VariantID.Hex()
+		}
+		issues = append(issues, issue)
+	}
+	return issues
+}
+
+// cancelledFarms returns the farms whose fulfillment of the order is
+// cancelled.
+func cancelledFarms(order *models.Order) map[primitive.ObjectID]bool {
+	cancelled := make(map[primitive.ObjectID]bool)
+	for _, f := range order.Fulfillments {
+		if f.Status == models.OrderStatusCancelled {
+			cancelled[f.FarmID] = true
+		}
+	}
+	return cancelled
+}
+
+// captureWeighedPayment captures the authorized payment of an order once the
+// price of every line that is still to be delivered is final. Lines of
+// cancelled fulfillments are not charged.
+func captureWeighedPayment(ctx context.Context, provider payments.Provider, order *models.Order) error {
+	if order.AuthorizedAmount == nil || order.PaymentStatus != "authorized" {
+		return nil
+	}
+
+	cancelled := cancelledFarms(order)
+
+	var amount models.Money
+	for _, item := range order.Items {
+		if cancelled[item.FarmID] {
+			continue
+		}
+		if !item.IsWeighed() {
+			return nil
+		}
+		total, err := item.Total()
+		if err == nil {
+			amount, err = amount.Add(total)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if !amount.IsPositive() {
+		// Nothing is delivered; the authorization lapses
+		return nil
+	}
+	if cmp, err := amount.Cmp(*order.AuthorizedAmount); err != nil || cmp > 0 {
+		amount = *order.AuthorizedAmount
+	}
+
+	// Claim the capture so that concurrent updates capture only once
+	collection := config.GetCollection("orders")
+	result, err := collection.UpdateOne(ctx,
+		bson.M{"_id": order.ID, "paymentStatus": "authorized"},
+		bson.M{"$set": bson.M{"paymentStatus": "capturing"}},
+	)
+	if err != nil || result.MatchedCount == 0 {
+		return err
+	}
+
+	pi, err := provider.Capture(ctx, order.PaymentIntentID, amount.Amount)
+	if err != nil {
+		if _, rollbackErr := collection.UpdateOne(ctx,
+			bson.M{"_id": order.ID, "paymentStatus": "capturing"},
+			bson.M{"$set": bson.M{"paymentStatus": "authorized"}},
+		); rollbackErr != nil {
+			log.Printf("Failed to release capture claim of order %s: %v", order.ID.Hex(), rollbackErr)
+		}
+		return err
+	}
+
+	order.PaymentStatus = "completed"
+	return applyPaymentOutcome(ctx, pi, "completed", "", fmt.Sprintf("Captured %s for the weighed order", amount))
+}
@@ -0,0 +1,132 @@
+package routes
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"farmer-marketplace/models"
+)
+
+func TestCatchWeightPricing(t *testing.T) {
+	t.Setenv("CATCH_WEIGHT_BUFFER_PERCENT", "20")
+
+	farmID := primitive.NewObjectID()
+	steak := models.Product{
+		ID:                   primitive.NewObjectID(),
+		Name:                 "Ribeye",
+		Price:                models.NewMoney(3200, "USD"), // per kg
+		Unit:                 "steak",
+		FarmID:               farmID,
+		CatchWeight:          true,
+		EstimatedWeightGrams: 350,
+	}
+	honey := models.Product{ID: primitive.NewObjectID(), Name: "Honey", Price: models.NewMoney(900, "USD"), FarmID: farmID}
+	catalog := map[primitive.ObjectID]models.Product{steak.ID: steak, honey.ID: honey}
+
+	items, total, err := priceOrderItems([]models.OrderItemRequest{
+		{ProductID: steak.ID.Hex(), Quantity: 2},
+		{ProductID: honey.ID.Hex(), Quantity: 1},
+	}, catalog)
+	require.NoError(t, err)
+
+	// 350 g at 32.00 per kg is 11.20 a steak
+	require.NotNil(t, items[0].CatchWeight)
+	assert.Equal(t, models.NewMoney(1120, "USD"), items[0].Price)
+	assert.Equal(t, 700, items[0].CatchWeight.EstimatedGrams)
+	assert.Equal(t, models.NewMoney(2688, "USD"), items[0].CatchWeight.MaxTotal)
+	assert.Nil(t, items[1].CatchWeight)
+	assert.Equal(t, models.NewMoney(3140, "USD"), total)
+
+	authorized, err := authorizationAmount(items)
+	require.NoError(t, err)
+	require.NotNil(t, authorized)
+	assert.Equal(t, models.NewMoney(3588, "USD"), *authorized)
+
+	none, err := authorizationAmount(items[1:])
+	require.NoError(t, err)
+	assert.Nil(t, none)
+
+	steak.EstimatedWeightGrams = 0
+	catalog[steak.ID] = steak
+	_, _, err = priceOrderItems([]models.OrderItemRequest{{ProductID: steak.ID.Hex(), Quantity: 1}}, catalog)
+	var pricingErr *PricingError
+	require.True(t, errors.As(err, &pricingErr))
+	assert.Equal(t, "product has no estimated weight", pricingErr.Issues[0].Reason)
+}
+
+func TestWeighFarmLines(t *testing.T) {
+	alice := primitive.NewObjectID()
+	bob := primitive.NewObjectID()
+	steak := primitive.NewObjectID()
+	pork := primitive.NewObjectID()
+	honey := primitive.NewObjectID()
+
+	newOrder := func() *models.Order {
+		catchWeight := func(estimate int64) *models.CatchWeight {
+			return &models.CatchWeight{
+				PricePerKg:     models.NewMoney(3200, "USD"),
+				EstimatedGrams: 700,
+				MaxTotal:       models.NewMoney(estimate*115/100, "USD"),
+			}
+		}
+		return &models.Order{
+			Items: []models.OrderItem{
+				{ProductID: steak, Quantity: 2, Price: models.NewMoney(1120, "USD"), FarmID: alice, CatchWeight: catchWeight(2240)},
+				{ProductID: honey, Quantity: 1, Price: models.NewMoney(900, "USD"), FarmID: alice},
+				{ProductID: pork, Quantity: 2, Price: models.NewMoney(1120, "USD"), FarmID: bob, CatchWeight: catchWeight(2240)},
+			},
+			TotalAmount: models.NewMoney(5380, "USD"),
+		}
+	}
+
+	t.Run("Prices the line by its weight", func(t *testing.T) {
+		order := newOrder()
+		set, err := weighFarmLines(order, alice, []models.LineWeightRequest{{ProductID: steak.Hex(), ActualGrams: 655}})
+		require.NoError(t, err)
+
+		cw := order.Items[0].CatchWeight
+		assert.Equal(t, 655, cw.ActualGrams)
+		assert.Equal(t, models.NewMoney(2096, "USD"), *cw.Total)
+		assert.True(t, order.Items[0].IsWeighed())
+		assert.False(t, order.Items[2].IsWeighed())
+		assert.Equal(t, models.NewMoney(5236, "USD"), order.TotalAmount)
+		assert.Contains(t, set, "items.0.catchWeight")
+		assert.Equal(t, order.TotalAmount, set["totalAmount"])
+
+		// A refund of one of the two steaks gives back half the weighed total
+		amount, err := order.Items[0].AmountFor(1)
+		require.NoError(t, err)
+		assert.Equal(t, models.NewMoney(1048, "USD"), amount)
+	})
+
+	t.Run("Never charges more than was authorized", func(t *testing.T) {
+		order := newOrder()
+		_, err := weighFarmLines(order, alice, []models.LineWeightRequest{{ProductID: steak.Hex(), ActualGrams: 2000}})
+		require.NoError(t, err)
+		assert.Equal(t, models.NewMoney(2576, "USD"), *order.Items[0].CatchWeight.Total)
+	})
+
+	t.Run("Requires every line of the farm", func(t *testing.T) {
+		order := newOrder()
+		_, err := weighFarmLines(order, alice, []models.LineWeightRequest{
+			{ProductID: pork.Hex(), ActualGrams: 700},
+			{ProductID: honey.Hex(), ActualGrams: 500},
+		})
+		var weightErr *WeightError
+		require.True(t, errors.As(err, &weightErr))
+		require.Len(t, weightErr.Issues, 3)
+		assert.Equal(t, "no catch-weight line of your farm for this product", weightErr.Issues[0].Reason)
+		assert.Equal(t, "no catch-weight line of your farm for this product", weightErr.Issues[1].Reason)
+		assert.Equal(t, steak.Hex(), weightErr.Issues[2].ProductID)
+		assert.Nil(t, order.Items[0].CatchWeight.Total)
+
+		// Other farms' lines are left to them
+		assert.Len(t, unweighedLines(order, nil, nil), 2)
+		order.Fulfillments = []models.Fulfillment{{FarmID: bob, Status: models.OrderStatusCancelled}}
+		assert.Len(t, unweighedLines(order, nil, nil), 1)
+	})
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 
 	"farmer-marketplace/config"
@@ -28,7 +29,7 @@ func getFarmers(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	filter := bson.M{"role": "farmer"}
+	filter := bson.M{"role": "farmer", "deletedAt": bson.M{"$exists": false}}
 	opts := options.Find().SetProjection(bson.M{"password": 0}) // Exclude password
 
 	cursor, err := collection.Find(ctx, filter, opts)
@@ -59,7 +60,7 @@ func getFarmer(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	filter := bson.M{"_id": objectID, "role": "farmer"}
+	filter := bson.M{"_id": objectID, "role": "farmer", "deletedAt": bson.M{"$exists": false}}
 	projection := bson.M{"password": 0} // Exclude password
 
 	var farmer models.User
@@ -73,32 +74,35 @@ func getFarmer(c *gin.Context) {
 }
 
 func getFarmerProductsPublic(c *gin.Context) {
-	farmerID := c.Param("id")
-	objectID, err := primitive.ObjectIDFromHex(farmerID)
+	respondOwnedFarmProducts(c, c.Param("id"))
+}
+
+// respondOwnedFarmProducts lists the catalog of the farm a farmer owns.
+func respondOwnedFarmProducts(c *gin.Context, farmer string) {
+	farmerID, err := primitive.ObjectIDFromHex(farmer)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid farmer ID"})
 		return
 	}
 
-	collection := config.GetCollection("products")
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	filter := bson.M{"farmerId": objectID}
-	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}})
-
-	cursor, err := collection.Find(ctx, filter, opts)
+	farm, err := findOwnedFarm(ctx, farmerID)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Farmer not found"})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch products"})
 		return
 	}
-	defer cursor.Close(ctx)
 
-	var products []models.Product
-	if err = cursor.All(ctx, &products); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode products"})
+	products, err := findFarmProducts(ctx, farm.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch products"})
 		return
 	}
 
 	c.JSON(http.StatusOK, products)
-}
\ No newline at end of file
+}
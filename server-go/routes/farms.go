@@ -0,0 +1,811 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"farmer-marketplace/config"
+	"farmer-marketplace/mail"
+	"farmer-marketplace/models"
+)
+
+const farmInviteTTL = 7 * 24 * time.Hour
+
+var (
+	ErrFarmInviteInvalid = errors.New("invalid or expired invitation")
+	ErrAlreadyFarmMember = errors.New("user already belongs to a farm")
+)
+
+func FarmRoutes(router *gin.RouterGroup, mailer mail.Mailer) {
+	farms := router.Group("/farms")
+	{
+		farms.GET("/:id", getFarm)
+		farms.GET("/:id/products", getFarmProducts)
+	}
+
+	// The farm of the signed-in member
+	farm := router.Group("/farm")
+	{
+		farm.GET("", authMiddleware(), getMyFarm)
+		farm.PUT("", authMiddleware(), requirePermission(models.PermFarmManage), updateFarm)
+		farm.GET("/members", authMiddleware(), requirePermission(models.PermFarmManage), listFarmMembers)
+		farm.PUT("/members/:userId", authMiddleware(), requirePermission(models.PermFarmManage), updateFarmMember)
+		farm.DELETE("/members/:userId", authMiddleware(), requirePermission(models.PermFarmManage), removeFarmMember)
+		farm.POST("/leave", authMiddleware(), requireSession(), leaveFarm)
+		farm.GET("/invites", authMiddleware(), requirePermission(models.PermFarmManage), listFarmInvites)
+		farm.POST("/invites", authMiddleware(), requirePermission(models.PermFarmManage), createFarmInvite(mailer))
+		farm.DELETE("/invites/:id", authMiddleware(), requirePermission(models.PermFarmManage), revokeFarmInvite)
+		farm.POST("/invites/accept", authMiddleware(), requireSession(), acceptFarmInvite)
+		farm.POST("/invites/register", registerWithFarmInvite)
+	}
+}
+
+// createFarm opens a farm owned by a new farmer, named after them until they
+// choose a name.
+func createFarm(ctx context.Context, owner *models.User) (*models.Farm, error) {
+	now := time.Now()
+	farm := models.Farm{
+		ID:        primitive.NewObjectID(),
+		Name:      owner.Name,
+		Location:  owner.Location,
+		OwnerID:   owner.ID,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if _, err := config.GetCollection("farms").InsertOne(ctx, farm); err != nil {
+		return nil, err
+	}
+
+	if err := addFarmMember(ctx, farm.ID, owner.ID, models.FarmRoleOwner, nil); err != nil {
+		return nil, err
+	}
+	return &farm, nil
+}
+
+// addFarmMember attaches a user to a farm. The unique index on userId keeps
+// every user in at most one farm.
+func addFarmMember(ctx context.Context, farmID, userID primitive.ObjectID, role string, invitedBy *primitive.ObjectID) error {
+	member := models.FarmMember{
+		ID:        primitive.NewObjectID(),
+		FarmID:    farmID,
+		UserID:    userID,
+		Role:      role,
+		InvitedBy: invitedBy,
+		JoinedAt:  time.Now(),
+	}
+	_, err := config.GetCollection("farm_members").InsertOne(ctx, member)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrAlreadyFarmMember
+	}
+	return err
+}
+
+// findOwnedFarm returns the open farm owned by a farmer.
+func findOwnedFarm(ctx context.Context, ownerID primitive.ObjectID) (*models.Farm, error) {
+	var farm models.Farm
+	err := config.GetCollection("farms").FindOne(ctx, bson.M{
+		"ownerId":   ownerID,
+		"deletedAt": bson.M{"$exists": false},
+	}).Decode(&farm)
+	if err != nil {
+		return nil, err
+	}
+	return &farm, nil
+}
+
+// closeFarm shuts the farm of an owner who deleted their account. The farm
+// document stays for the orders that refer to it. Failures are logged; the
+// owner's account is already anonymized.
+func closeFarm(ctx context.Context, farmID primitive.ObjectID) {
+	now := time.Now()
+	if _, err := config.GetCollection("farms").UpdateOne(ctx,
+		bson.M{"_id": farmID},
+		bson.M{"$set": bson.M{"deletedAt": now, "updatedAt": now}},
+	); err != nil {
+		log.Printf("Failed to close farm %s: %v", farmID.Hex(), err)
+	}
+
+	products, err := findProductsWithPhotos(ctx, bson.M{"farmId": farmID})
+	if err != nil {
+		log.Printf("Failed to find product images of closed farm %s: %v", farmID.Hex(), err)
+	}
+
+	for _, collection := range []string{"products", "farm_members", "farm_invites", "api_keys"} {
+		if _, err := config.GetCollection(collection).DeleteMany(ctx, bson.M{"farmId": farmID}); err != nil {
+			log.Printf("Failed to remove %s of closed farm %s: %v", collection, farmID.Hex(), err)
+		}
+	}
+	deleteProductBlobs(ctx, products...)
+}
+
+// pendingInviteFilter matches invitations that can still be accepted.
+func pendingInviteFilter(now time.Time) bson.M {
+	return bson.M{
+		"acceptedAt": bson.M{"$exists": false},
+		"revokedAt":  bson.M{"$exists": false},
+		"expiresAt":  bson.M{"$gt": now},
+	}
+}
+
+// findFarmInvite returns the pending invitation a raw token stands for.
+func findFarmInvite(ctx context.Context, raw string) (*models.FarmInvite, error) {
+	filter := pendingInviteFilter(time.Now())
+	filter["tokenHash"] = hashToken(raw)
+
+	var invite models.FarmInvite
+	err := config.GetCollection("farm_invites").FindOne(ctx, filter).Decode(&invite)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrFarmInviteInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &invite, nil
+}
+
+// joinFarmWithInvite marks an invitation accepted by userID and adds the
+// user to the farm. Claiming happens first so that an invitation works only
+// once; it is released again if the user cannot join.
+func joinFarmWithInvite(ctx context.Context, invite *models.FarmInvite, userID primitive.ObjectID) error {
+	now := time.Now()
+	filter := pendingInviteFilter(now)
+	filter["_id"] = invite.ID
+
+	collection := config.GetCollection("farm_invites")
+	result, err := collection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"acceptedAt": now, "acceptedBy": userID}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrFarmInviteInvalid
+	}
+
+	if err := addFarmMember(ctx, invite.FarmID, userID, invite.Role, &invite.InvitedBy); err != nil {
+		if _, releaseErr := collection.UpdateOne(ctx,
+			bson.M{"_id": invite.ID},
+			bson.M{"$unset": bson.M{"acceptedAt": "", "acceptedBy": ""}},
+		); releaseErr != nil {
+			log.Printf("Failed to release farm invite %s: %v", invite.ID.Hex(), releaseErr)
+		}
+		return err
+	}
+	return nil
+}
+
+func farmInviteMessage(farm *models.Farm, invite *models.FarmInvite, token string) mail.Message {
+	link := appURL() + "/farm-invite?token=" + url.QueryEscape(token)
+	return mail.Message{
+		To:      invite.Email,
+		Subject: fmt.Sprintf("You are invited to join %s", farm.Name),
+		Body: fmt.Sprintf("Hi,\n\nYou have been invited to help run %s as a %s. To accept, open this link:\n\n%s\n\n"+
+			"The link expires in %d days. If you were not expecting this, you can ignore this email.\n",
+			farm.Name, invite.Role, link, int(farmInviteTTL/(24*time.Hour))),
+	}
+}
+
+func respondFarmJoinError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, ErrFarmInviteInvalid):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired invitation"})
+	case errors.Is(err, ErrAlreadyFarmMember):
+		c.JSON(http.StatusConflict, gin.H{"error": "You already belong to a farm"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to join farm"})
+	}
+}
+
+func getFarm(c *gin.Context) {
+	farmID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid farm ID"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var farm models.Farm
+	err = config.GetCollection("farms").FindOne(ctx, bson.M{"_id": farmID, "deletedAt": bson.M{"$exists": false}}).Decode(&farm)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Farm not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, farm)
+}
+
+func getFarmProducts(c *gin.Context) {
+	farmID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid farm ID"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	products, err := findFarmProducts(ctx, farmID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch products"})
+		return
+	}
+
+	c.JSON(http.StatusOK, products)
+}
+
+// findFarmProducts returns the catalog of a farm, newest first.
+func findFarmProducts(ctx context.Context, farmID primitive.ObjectID) ([]models.Product, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}})
+	cursor, err := config.GetCollection("products").Find(ctx, bson.M{"farmId": farmID}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	products := []models.Product{}
+	if err := cursor.All(ctx, &products); err != nil {
+		return nil, err
+	}
+	return products, nil
+}
+
+func getMyFarm(c *gin.Context) {
+	farmID, ok := actingFarmID(c)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var farm models.Farm
+	if err := config.GetCollection("farms").FindOne(ctx, bson.M{"_id": farmID}).Decode(&farm); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Farm not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"farm":        farm,
+		"role":        c.GetString("farmRole"),
+		"permissions": c.GetStringSlice("permissions"),
+	})
+}
+
+func updateFarm(c *gin.Context) {
+	var req models.UpdateFarmRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	set := bson.M{"updatedAt": time.Now()}
+	if req.Name != nil {
+		name := strings.TrimSpace(*req.Name)
+		if name == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Name cannot be empty"})
+			return
+		}
+		set["name"] = name
+	}
+	if req.Description != nil {
+		set["description"] = strings.TrimSpace(*req.Description)
+	}
+	if req.Location != nil {
+		set["location"] = strings.TrimSpace(*req.Location)
+	}
+
+	farmID, ok := actingFarmID(c)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var farm models.Farm
+	err := config.GetCollection("farms").FindOneAndUpdate(ctx,
+		bson.M{"_id": farmID, "deletedAt": bson.M{"$exists": false}},
+		bson.M{"$set": set},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&farm)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Farm not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update farm"})
+		return
+	}
+
+	c.JSON(http.StatusOK, farm)
+}
+
+func listFarmMembers(c *gin.Context) {
+	farmID, ok := actingFarmID(c)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	pipeline := []bson.M{
+		{"$match": bson.M{"farmId": farmID}},
+		{
+			"$lookup": bson.M{
+				"from":         "users",
+				"localField":   "userId",
+				"foreignField": "_id",
+				"as":           "user",
+			},
+		},
+		{
+			"$unwind": bson.M{
+				"path":                       "$user",
+				"preserveNullAndEmptyArrays": true,
+			},
+		},
+		{
+			"$project": bson.M{
+				"user.password": 0,
+			},
+		},
+		{
+			"$sort": bson.M{"joinedAt": 1},
+		},
+	}
+
+	cursor, err := config.GetCollection("farm_members").Aggregate(ctx, pipeline)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch members"})
+		return
+	}
+	defer cursor.Close(ctx)
+
+	members := []models.FarmMember{}
+	if err := cursor.All(ctx, &members); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode members"})
+		return
+	}
+
+	c.JSON(http.StatusOK, members)
+}
+
+// normalizeMemberPermissions checks that every permission belongs to role and
+// returns them without duplicates, in FarmRolePermissions order. Nil stays
+// nil, granting the role in full.
+func normalizeMemberPermissions(role string, perms []string) ([]string, error) {
+	if perms == nil {
+		return nil, nil
+	}
+
+	requested := make(map[string]bool, len(perms))
+	for _, perm := range perms {
+		requested[perm] = true
+	}
+	normalized := models.FarmMember{Role: role, Permissions: perms}.GrantedPermissions()
+	if len(normalized) < len(requested) {
+		return nil, fmt.Errorf("a %s can only be given %s", role, strings.Join(models.FarmRolePermissions[role], ", "))
+	}
+	return normalized, nil
+}
+
+// updateFarmMember changes the role of a member, and optionally narrows it to
+// some of the role's permissions. The owner's role is fixed. Like every
+// membership change it applies to the member's next request.
+func updateFarmMember(c *gin.Context) {
+	userID, err := primitive.ObjectIDFromHex(c.Param("userId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	var req models.UpdateFarmMemberRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	perms, err := normalizeMemberPermissions(req.Role, req.Permissions)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	farmID, ok := actingFarmID(c)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var member models.FarmMember
+	err = config.GetCollection("farm_members").FindOneAndUpdate(ctx,
+		bson.M{"farmId": farmID, "userId": userID, "role": bson.M{"$ne": models.FarmRoleOwner}},
+		bson.M{"$set": bson.M{"role": req.Role, "permissions": perms}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&member)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Member not found, or is the owner"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update member"})
+		return
+	}
+
+	recordAudit(ctx, models.AuditEvent{
+		Type:    models.AuditFarmRoleChanged,
+		ActorID: auditActor(c),
+		UserID:  &userID,
+		IP:      c.ClientIP(),
+		Details: bson.M{"farmId": farmID, "role": req.Role, "permissions": perms},
+	})
+
+	c.JSON(http.StatusOK, member)
+}
+
+func removeFarmMember(c *gin.Context) {
+	userID, err := primitive.ObjectIDFromHex(c.Param("userId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	farmID, ok := actingFarmID(c)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := config.GetCollection("farm_members").DeleteOne(ctx,
+		bson.M{"farmId": farmID, "userId": userID, "role": bson.M{"$ne": models.FarmRoleOwner}},
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove member"})
+		return
+	}
+	if result.DeletedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Member not found, or is the owner"})
+		return
+	}
+
+	recordAudit(ctx, models.AuditEvent{
+		Type:    models.AuditFarmMemberRemoved,
+		ActorID: auditActor(c),
+		UserID:  &userID,
+		IP:      c.ClientIP(),
+		Details: bson.M{"farmId": farmID},
+	})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Member removed"})
+}
+
+// leaveFarm lets a member other than the owner leave their farm.
+func leaveFarm(c *gin.Context) {
+	farmID, ok := actingFarmID(c)
+	if !ok {
+		return
+	}
+	if c.GetString("farmRole") == models.FarmRoleOwner {
+		c.JSON(http.StatusConflict, gin.H{"error": "The owner cannot leave the farm"})
+		return
+	}
+
+	userID, err := primitive.ObjectIDFromHex(c.GetString("userID"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err = config.GetCollection("farm_members").DeleteOne(ctx,
+		bson.M{"farmId": farmID, "userId": userID, "role": bson.M{"$ne": models.FarmRoleOwner}},
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to leave farm"})
+		return
+	}
+
+	recordAudit(ctx, models.AuditEvent{
+		Type:    models.AuditFarmMemberRemoved,
+		ActorID: &userID,
+		UserID:  &userID,
+		IP:      c.ClientIP(),
+		Details: bson.M{"farmId": farmID},
+	})
+
+	c.JSON(http.StatusOK, gin.H{"message": "You have left the farm"})
+}
+
+func listFarmInvites(c *gin.Context) {
+	farmID, ok := actingFarmID(c)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	filter := pendingInviteFilter(time.Now())
+	filter["farmId"] = farmID
+
+	cursor, err := config.GetCollection("farm_invites").Find(ctx, filter,
+		options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}}),
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch invitations"})
+		return
+	}
+	defer cursor.Close(ctx)
+
+	invites := []models.FarmInvite{}
+	if err := cursor.All(ctx, &invites); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode invitations"})
+		return
+	}
+
+	c.JSON(http.StatusOK, invites)
+}
+
+// createFarmInvite emails an invitation to join the farm. A new invitation
+// for the same address replaces the pending one.
+func createFarmInvite(mailer mail.Mailer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req models.CreateFarmInviteRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		farmID, ok := actingFarmID(c)
+		if !ok {
+			return
+		}
+		inviterID := auditActor(c)
+		if inviterID == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		var farm models.Farm
+		if err := config.GetCollection("farms").FindOne(ctx, bson.M{"_id": farmID, "deletedAt": bson.M{"$exists": false}}).Decode(&farm); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Farm not found"})
+			return
+		}
+
+		email := strings.TrimSpace(req.Email)
+		raw, err := newOpaqueToken()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create invitation"})
+			return
+		}
+
+		collection := config.GetCollection("farm_invites")
+		now := time.Now()
+
+		pending := pendingInviteFilter(now)
+		pending["farmId"] = farmID
+		pending["email"] = email
+		if _, err := collection.UpdateMany(ctx, pending, bson.M{"$set": bson.M{"revokedAt": now}}); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create invitation"})
+			return
+		}
+
+		invite := models.FarmInvite{
+			ID:        primitive.NewObjectID(),
+			FarmID:    farmID,
+			Email:     email,
+			Role:      req.Role,
+			TokenHash: hashToken(raw),
+			InvitedBy: *inviterID,
+			ExpiresAt: now.Add(farmInviteTTL),
+			CreatedAt: now,
+		}
+		if _, err := collection.InsertOne(ctx, invite); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create invitation"})
+			return
+		}
+
+		recordAudit(ctx, models.AuditEvent{
+			Type:    models.AuditFarmInviteSent,
+			ActorID: inviterID,
+			Email:   email,
+			IP:      c.ClientIP(),
+			Details: bson.M{"farmId": farmID, "role": req.Role},
+		})
+
+		mailCtx, cancelMail := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancelMail()
+		if err := mailer.Send(mailCtx, farmInviteMessage(&farm, &invite, raw)); err != nil {
+			log.Printf("Failed to send farm invite %s: %v", invite.ID.Hex(), err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Invitation created, but the email could not be sent"})
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"message": "Invitation sent",
+			"invite":  invite,
+		})
+	}
+}
+
+func revokeFarmInvite(c *gin.Context) {
+	inviteID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid invitation ID"})
+		return
+	}
+
+	farmID, ok := actingFarmID(c)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	filter := pendingInviteFilter(time.Now())
+	filter["_id"] = inviteID
+	filter["farmId"] = farmID
+
+	result, err := config.GetCollection("farm_invites").UpdateOne(ctx, filter, bson.M{"$set": bson.M{"revokedAt": time.Now()}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke invitation"})
+		return
+	}
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invitation not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Invitation revoked"})
+}
+
+// acceptFarmInvite joins the farm with the signed-in account, which must be
+// the one the invitation was sent to. Only staff accounts that do not work for
+// a farm yet can join one; farmers run their own. They are turned away before
+// the invitation is claimed, so that it stays usable.
+func acceptFarmInvite(c *gin.Context) {
+	var req models.AcceptFarmInviteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if c.GetString("role") != models.RoleStaff {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only staff accounts can join a farm"})
+		return
+	}
+	if c.GetString("farmID") != "" {
+		respondFarmJoinError(c, ErrAlreadyFarmMember)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	invite, err := findFarmInvite(ctx, req.Token)
+	if err != nil {
+		respondFarmJoinError(c, err)
+		return
+	}
+
+	user, ok := loadCurrentUser(ctx, c)
+	if !ok {
+		return
+	}
+	if !strings.EqualFold(user.Email, invite.Email) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "This invitation was sent to another email address"})
+		return
+	}
+	if err := joinFarmWithInvite(ctx, invite, user.ID); err != nil {
+		respondFarmJoinError(c, err)
+		return
+	}
+
+	recordAudit(ctx, models.AuditEvent{
+		Type:    models.AuditFarmMemberAdded,
+		ActorID: &user.ID,
+		UserID:  &user.ID,
+		IP:      c.ClientIP(),
+		Details: bson.M{"farmId": invite.FarmID, "role": invite.Role},
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "You have joined the farm",
+		"farmId":  invite.FarmID,
+		"role":    invite.Role,
+	})
+}
+
+// registerWithFarmInvite creates a staff account for the invited address and
+// joins the farm. Receiving the invitation proves the address, so it counts
+// as verified.
+func registerWithFarmInvite(c *gin.Context) {
+	var req models.RegisterFarmInviteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	invite, err := findFarmInvite(ctx, req.Token)
+	if err != nil {
+		respondFarmJoinError(c, err)
+		return
+	}
+
+	now := time.Now()
+	user := models.User{
+		Name:            req.Name,
+		Email:           invite.Email,
+		Role:            models.RoleStaff,
+		Phone:           req.Phone,
+		EmailVerified:   true,
+		EmailVerifiedAt: &now,
+	}
+	if err := insertUser(ctx, &user, req.Password); err != nil {
+		respondInsertUserError(c, err)
+		return
+	}
+
+	if err := joinFarmWithInvite(ctx, invite, user.ID); err != nil {
+		// Without the farm the account is of no use
+		if _, delErr := config.GetCollection("users").DeleteOne(ctx, bson.M{"_id": user.ID}); delErr != nil {
+			log.Printf("Failed to remove staff account %s after a failed join: %v", user.ID.Hex(), delErr)
+		}
+		respondFarmJoinError(c, err)
+		return
+	}
+
+	recordAudit(ctx, models.AuditEvent{
+		Type:    models.AuditFarmMemberAdded,
+		ActorID: &user.ID,
+		UserID:  &user.ID,
+		Email:   user.Email,
+		IP:      c.ClientIP(),
+		Details: bson.M{"farmId": invite.FarmID, "role": invite.Role},
+	})
+
+	// Roles that require 2FA set it up before getting a session
+	var response gin.H
+	if mfaRequired(user.Role) {
+		response, err = startMFAChallenge(ctx, &user, models.MFAChallengeEnroll)
+	} else {
+		response, err = startSession(ctx, c, &user)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	// Remove password from response
+	user.Password = ""
+
+	response["message"] = "Account created and farm joined"
+	response["user"] = user
+	c.JSON(http.StatusCreated, response)
+}
@@ -0,0 +1,107 @@
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"farmer-marketplace/models"
+)
+
+func TestMemberGrant(t *testing.T) {
+	farmID := primitive.NewObjectID()
+
+	base := accessGrant{Permissions: models.RolePermissions[models.RoleStaff]}
+	grant := memberGrant(base, &models.FarmMember{FarmID: farmID, Role: models.FarmRolePacker})
+	assert.Equal(t, farmID.Hex(), grant.FarmID)
+	assert.Equal(t, models.FarmRolePacker, grant.FarmRole)
+	assert.ElementsMatch(t, []string{models.PermOrderRead, models.PermOrderUpdateStatus}, grant.Permissions)
+	assert.Empty(t, base.Permissions)
+
+	// A member narrowed to some permissions of their role gets only those
+	grant = memberGrant(base, &models.FarmMember{
+		FarmID:      farmID,
+		Role:        models.FarmRoleManager,
+		Permissions: []string{models.PermOrderRead, models.PermRefundIssue, models.PermFarmManage},
+	})
+	assert.Equal(t, []string{models.PermOrderRead, models.PermRefundIssue}, grant.Permissions)
+
+	grant = memberGrant(base, &models.FarmMember{FarmID: farmID, Role: models.FarmRolePacker, Permissions: []string{}})
+	assert.Empty(t, grant.Permissions)
+	assert.Equal(t, farmID.Hex(), grant.FarmID)
+
+	// Only owners manage the farm
+	for role, perms := range models.FarmRolePermissions {
+		assert.Equal(t, role == models.FarmRoleOwner, contains(perms, models.PermFarmManage), role)
+	}
+}
+
+func TestNormalizeMemberPermissions(t *testing.T) {
+	perms, err := normalizeMemberPermissions(models.FarmRoleManager, []string{models.PermRefundIssue, models.PermProductWrite, models.PermRefundIssue})
+	require.NoError(t, err)
+	assert.Equal(t, []string{models.PermProductWrite, models.PermRefundIssue}, perms)
+
+	perms, err = normalizeMemberPermissions(models.FarmRolePacker, []string{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{}, perms)
+
+	// Without a list the role applies in full
+	perms, err = normalizeMemberPermissions(models.FarmRolePacker, nil)
+	require.NoError(t, err)
+	assert.Nil(t, perms)
+
+	// Members cannot be given more than their role, nor customer or admin permissions
+	for _, perm := range []string{models.PermProductWrite, models.PermFarmManage, models.PermUserManage, models.PermCartManage, "order:*"} {
+		_, err := normalizeMemberPermissions(models.FarmRolePacker, []string{models.PermOrderRead, perm})
+		assert.Error(t, err, perm)
+	}
+}
+
+func TestAcceptFarmInvite(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	accept := func(role, farmID string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("POST", "/farms/invites/accept", strings.NewReader(`{"token":"tok"}`))
+		c.Request.Header.Set("Content-Type", "application/json")
+		c.Set("role", role)
+		c.Set("farmID", farmID)
+		acceptFarmInvite(c)
+		return w
+	}
+
+	// Farmers own a farm already; both are turned away before the
+	// invitation is looked up, so it is not used up
+	assert.Equal(t, http.StatusForbidden, accept(models.RoleFarmer, primitive.NewObjectID().Hex()).Code)
+	assert.Equal(t, http.StatusForbidden, accept(models.RoleCustomer, "").Code)
+	assert.Equal(t, http.StatusConflict, accept(models.RoleStaff, primitive.NewObjectID().Hex()).Code)
+}
+
+func TestFarmInviteMessage(t *testing.T) {
+	t.Setenv("APP_URL", "https://shop.example.com/")
+
+	farm := &models.Farm{Name: "Green Acres"}
+	invite := &models.FarmInvite{Email: "packer@example.com", Role: models.FarmRolePacker}
+	msg := farmInviteMessage(farm, invite, "tok+en")
+
+	assert.Equal(t, "packer@example.com", msg.To)
+	assert.Contains(t, msg.Subject, "Green Acres")
+	assert.Contains(t, msg.Body, "https://shop.example.com/farm-invite?token=tok%2Ben")
+	assert.Contains(t, msg.Body, "packer")
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
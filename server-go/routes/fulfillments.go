@@ -0,0 +1,318 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"farmer-marketplace/config"
+	"farmer-marketplace/models"
+	"farmer-marketplace/payments"
+)
+
+// fulfillmentProgress ranks the statuses a fulfillment moves through. The
+// parent order is only as far along as its least advanced fulfillment.
+var fulfillmentProgress = map[string]int{
+	models.OrderStatusPending:        0,
+	models.OrderStatusConfirmed:      1,
+	models.OrderStatusPreparing:      2,
+	models.OrderStatusReady:          3,
+	models.OrderStatusOutForDelivery: 4,
+	models.OrderStatusDelivered:      5,
+}
+
+var (
+	ErrPaymentFailed = errors.New("order payment has failed")
+	ErrOrderRefunded = errors.New("order has been refunded")
+)
+
+// buildFulfillments groups order lines by farm and creates one pending
+// fulfillment per farm, in the order the farms first appear.
+func buildFulfillments(items []models.OrderItem, initial models.OrderStatusChange) []models.Fulfillment {
+	var fulfillments []models.Fulfillment
+	seen := make(map[primitive.ObjectID]bool)
+
+	for _, item := range items {
+		if seen[item.FarmID] {
+			continue
+		}
+		seen[item.FarmID] = true
+
+		fulfillments = append(fulfillments, models.Fulfillment{
+			ID:            primitive.NewObjectID(),
+			FarmID:        item.FarmID,
+			Status:        models.OrderStatusPending,
+			StatusHistory: []models.OrderStatusChange{initial},
+			StockReserved: true,
+			UpdatedAt:     initial.ChangedAt,
+		})
+	}
+
+	return fulfillments
+}
+
+// deriveOrderStatus computes the parent order status from its fulfillments:
+// cancelled when every fulfillment is cancelled, otherwise the least advanced
+// status among the remaining ones.
+func deriveOrderStatus(fulfillments []models.Fulfillment) string {
+	status := models.OrderStatusCancelled
+	rank := len(fulfillmentProgress)
+
+	for _, f := range fulfillments {
+		if f.Status == models.OrderStatusCancelled {
+			continue
+		}
+		if r, ok := fulfillmentProgress[f.Status]; ok && r < rank {
+			rank = r
+			status = f.Status
+		}
+	}
+
+	return status
+}
+
+func findFulfillment(order *models.Order, farmID primitive.ObjectID) int {
+	for i, f := range order.Fulfillments {
+		if f.FarmID == farmID {
+			return i
+		}
+	}
+	return -1
+}
+
+// farmItems returns the order lines that belong to the farm.
+func farmItems(order *models.Order, farmID primitive.ObjectID) []models.OrderItem {
+	var items []models.OrderItem
+	for _, item := range order.Items {
+		if item.FarmID == farmID {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// transitionFulfillmentStatus moves one farm's fulfillment to a new status
+// and re-derives the parent order status in the same update. Fields in
+// changes, such as recorded weights, are saved along with it.
+func transitionFulfillmentStatus(ctx context.Context, order *models.Order, idx int, to, role string, actorID primitive.ObjectID, note string, changes bson.M) error {
+	switch order.Status {
+	case models.OrderStatusPaymentFailed:
+		return ErrPaymentFailed
+	case models.OrderStatusRefunded:
+		return ErrOrderRefunded
+	}
+
+	f := &order.Fulfillments[idx]
+	if err := checkOrderTransition(f.Status, to, role); err != nil {
+		return err
+	}
+
+	change := models.OrderStatusChange{
+		From:      f.Status,
+		To:        to,
+		ChangedBy: actorID,
+		Role:      role,
+		Note:      note,
+		ChangedAt: time.Now(),
+	}
+
+	set := bson.M{
+		fmt.Sprintf("fulfillments.%d.status", idx):    to,
+		fmt.Sprintf("fulfillments.%d.updatedAt", idx): change.ChangedAt,
+	}
+	for key, value := range changes {
+		set[key] = value
+	}
+	push := bson.M{
+		fmt.Sprintf("fulfillments.%d.statusHistory", idx): change,
+	}
+
+	previous := f.Status
+	f.Status = to
+	derived := deriveOrderStatus(order.Fulfillments)
+	f.Status = previous
+
+	// A partially refunded order keeps that status while its fulfillments
+	// progress
+	var orderChange *models.OrderStatusChange
+	if derived != order.Status && !isPaymentOrderStatus(order.Status) {
+		orderChange = &models.OrderStatusChange{
+			From:      order.Status,
+			To:        derived,
+			ChangedBy: actorID,
+			Role:      role,
+			Note:      "derived from fulfillments",
+			ChangedAt: change.ChangedAt,
+		}
+		set["status"] = derived
+		push["statusHistory"] = *orderChange
+	}
+
+	if err := saveOrderChanges(ctx, order, set, push); err != nil {
+		return err
+	}
+
+	f.Status = to
+	f.StatusHistory = append(f.StatusHistory, change)
+	f.UpdatedAt = change.ChangedAt
+	if orderChange != nil {
+		order.Status = derived
+		order.StatusHistory = append(order.StatusHistory, *orderChange)
+	}
+
+	if to == models.OrderStatusCancelled {
+		return releaseFulfillmentStock(ctx, order.ID, f.FarmID)
+	}
+
+	return nil
+}
+
+// moveFulfillment moves the farm's fulfillment of an order as requested,
+// recording the weights of its catch-weight lines when it becomes ready, and
+// captures the payment once the order's price is final.
+func moveFulfillment(ctx context.Context, provider payments.Provider, order *models.Order, idx int, req models.UpdateOrderStatusRequest, role string, actorID primitive.ObjectID) error {
+	var changes bson.M
+	if req.Status == models.OrderStatusReady {
+		var err error
+		if changes, err = weighFarmLines(order, order.Fulfillments[idx].FarmID, req.Weights); err != nil {
+			return err
+		}
+	} else if len(req.Weights) > 0 {
+		return ErrWeightsNotAccepted
+	}
+
+	if err := transitionFulfillmentStatus(ctx, order, idx, req.Status, role, actorID, req.Note, changes); err != nil {
+		return err
+	}
+
+	// The status change stands even if the provider is unavailable; the
+	// capture is tried again on the next change
+	if err := captureWeighedPayment(ctx, provider, order); err != nil {
+		log.Printf("Failed to capture payment of order %s: %v", order.ID.Hex(), err)
+	}
+	return nil
+}
+
+// loadFarmFulfillment loads an order and locates the fulfillment of the
+// farm the caller works for, writing an error response and returning
+// ok=false on failure.
+func loadFarmFulfillment(ctx context.Context, c *gin.Context) (order models.Order, idx int, farmID primitive.ObjectID, ok bool) {
+	farmID, isFarm := actingFarmID(c)
+	if !isFarm {
+		return
+	}
+
+	orderID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid order ID"})
+		return
+	}
+
+	collection := config.GetCollection("orders")
+	if err = collection.FindOne(ctx, bson.M{"_id": orderID}).Decode(&order); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+		return
+	}
+
+	idx = findFulfillment(&order, farmID)
+	if idx < 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No fulfillment for your farm on this order"})
+		return
+	}
+
+	return order, idx, farmID, true
+}
+
+func getMyFulfillment(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	order, idx, farmID, ok := loadFarmFulfillment(ctx, c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"orderId":         order.ID,
+		"orderStatus":     order.Status,
+		"deliveryAddress": order.DeliveryAddress,
+		"fulfillment":     order.Fulfillments[idx],
+		"items":           farmItems(&order, farmID),
+	})
+}
+
+func updateFulfillmentStatus(provider payments.Provider) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req models.UpdateOrderStatusRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		order, idx, farmID, ok := loadFarmFulfillment(ctx, c)
+		if !ok {
+			return
+		}
+
+		actorID, err := primitive.ObjectIDFromHex(c.GetString("userID"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+			return
+		}
+
+		if err := moveFulfillment(ctx, provider, &order, idx, req, "farmer", actorID); err != nil {
+			respondTransitionError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message":     "Fulfillment status updated successfully",
+			"orderStatus": order.Status,
+			"fulfillment": order.Fulfillments[idx],
+			"items":       farmItems(&order, farmID),
+			"totalAmount": order.TotalAmount,
+		})
+	}
+}
+
+func updateFulfillmentTracking(c *gin.Context) {
+	var req models.UpdateFulfillmentTrackingRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	order, idx, _, ok := loadFarmFulfillment(ctx, c)
+	if !ok {
+		return
+	}
+
+	collection := config.GetCollection("orders")
+	update := bson.M{
+		"$set": bson.M{
+			fmt.Sprintf("fulfillments.%d.trackingNumber", idx):    req.TrackingNumber,
+			fmt.Sprintf("fulfillments.%d.estimatedDelivery", idx): req.EstimatedDelivery,
+			fmt.Sprintf("fulfillments.%d.updatedAt", idx):         time.Now(),
+		},
+	}
+
+	if _, err := collection.UpdateOne(ctx, bson.M{"_id": order.ID}, update); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update tracking information"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Tracking information updated successfully"})
+}
@@ -0,0 +1,212 @@
+package routes
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"farmer-marketplace/config"
+	"farmer-marketplace/models"
+)
+
+// throttlePolicy slows down and then locks out repeated login failures.
+// After FreeAttempts failures each further attempt has to wait BaseDelay,
+// doubling per failure up to MaxDelay; LockoutAfter failures lock the key
+// for LockoutDuration. Failures older than Window are forgotten.
+type throttlePolicy struct {
+	FreeAttempts    int
+	BaseDelay       time.Duration
+	MaxDelay        time.Duration
+	LockoutAfter    int
+	LockoutDuration time.Duration
+	Window          time.Duration
+}
+
+var (
+	accountLoginPolicy = throttlePolicy{
+		FreeAttempts:    3,
+		BaseDelay:       time.Second,
+		MaxDelay:        5 * time.Minute,
+		LockoutAfter:    10,
+		LockoutDuration: 15 * time.Minute,
+		Window:          time.Hour,
+	}
+
+	// One IP may carry many users behind a NAT, so it gets more room
+	ipLoginPolicy = throttlePolicy{
+		FreeAttempts:    20,
+		BaseDelay:       time.Second,
+		MaxDelay:        5 * time.Minute,
+		LockoutAfter:    100,
+		LockoutDuration: 30 * time.Minute,
+		Window:          time.Hour,
+	}
+)
+
+// retryAfter returns how long a key with counter must wait before it may try
+// again, or zero.
+func (p throttlePolicy) retryAfter(counter *models.LoginCounter, now time.Time) time.Duration {
+	if counter == nil {
+		return 0
+	}
+	if counter.LockedUntil != nil && counter.LockedUntil.After(now) {
+		return counter.LockedUntil.Sub(now)
+	}
+	if counter.Failures < p.FreeAttempts || now.Sub(counter.LastFailureAt) >= p.Window {
+		return 0
+	}
+
+	delay := p.MaxDelay
+	if shift := counter.Failures - p.FreeAttempts; shift < 32 {
+		if d := p.BaseDelay << uint(shift); d > 0 && d < p.MaxDelay {
+			delay = d
+		}
+	}
+
+	if next := counter.LastFailureAt.Add(delay); next.After(now) {
+		return next.Sub(now)
+	}
+	return 0
+}
+
+func accountCounterID(email string) string {
+	return "email:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipCounterID(ip string) string {
+	return "ip:" + ip
+}
+
+// loginRetryAfter returns how long a login for email from ip has to wait.
+func loginRetryAfter(ctx context.Context, email, ip string) (time.Duration, error) {
+	cursor, err := config.GetCollection("login_attempts").Find(ctx, bson.M{
+		"_id": bson.M{"$in": bson.A{accountCounterID(email), ipCounterID(ip)}},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var counters []models.LoginCounter
+	if err := cursor.All(ctx, &counters); err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	var wait time.Duration
+	for i := range counters {
+		policy := ipLoginPolicy
+		if counters[i].ID == accountCounterID(email) {
+			policy = accountLoginPolicy
+		}
+		if d := policy.retryAfter(&counters[i], now); d > wait {
+			wait = d
+		}
+	}
+	return wait, nil
+}
+
+// recordLoginFailure counts a failed login against the email and the IP and
+// locks whichever reached its limit. user is nil for unknown emails, which
+// are counted all the same so that responses do not reveal which exist.
+func recordLoginFailure(ctx context.Context, email, ip string, user *models.User) error {
+	now := time.Now()
+
+	account, err := bumpLoginCounter(ctx, accountCounterID(email), accountLoginPolicy, now)
+	if err != nil {
+		return err
+	}
+	if locked, err := lockLoginCounter(ctx, account, accountLoginPolicy, now); err != nil {
+		return err
+	} else if locked {
+		event := models.AuditEvent{
+			Type:    models.AuditAccountLocked,
+			Email:   email,
+			IP:      ip,
+			Details: bson.M{"failures": account.Failures, "lockedUntil": now.Add(accountLoginPolicy.LockoutDuration)},
+		}
+		if user != nil {
+			event.UserID = &user.ID
+		}
+		recordAudit(ctx, event)
+	}
+
+	address, err := bumpLoginCounter(ctx, ipCounterID(ip), ipLoginPolicy, now)
+	if err != nil {
+		return err
+	}
+	if locked, err := lockLoginCounter(ctx, address, ipLoginPolicy, now); err != nil {
+		return err
+	} else if locked {
+		recordAudit(ctx, models.AuditEvent{
+			Type:    models.AuditIPLocked,
+			IP:      ip,
+			Details: bson.M{"failures": address.Failures, "lockedUntil": now.Add(ipLoginPolicy.LockoutDuration)},
+		})
+	}
+	return nil
+}
+
+// bumpLoginCounter adds a failure, starting over when the previous one is
+// outside the policy window.
+func bumpLoginCounter(ctx context.Context, id string, policy throttlePolicy, now time.Time) (*models.LoginCounter, error) {
+	update := mongo.Pipeline{{{Key: "$set", Value: bson.M{
+		"failures": bson.M{"$cond": bson.A{
+			bson.M{"$gt": bson.A{"$lastFailureAt", now.Add(-policy.Window)}},
+			bson.M{"$add": bson.A{"$failures", 1}},
+			1,
+		}},
+		"lastFailureAt": now,
+		"expiresAt":     now.Add(policy.Window + policy.LockoutDuration),
+	}}}}
+
+	var counter models.LoginCounter
+	err := config.GetCollection("login_attempts").FindOneAndUpdate(ctx,
+		bson.M{"_id": id},
+		update,
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&counter)
+	if err != nil {
+		return nil, err
+	}
+	return &counter, nil
+}
+
+// lockLoginCounter locks a counter that reached the lockout threshold and is
+// not locked yet. It reports whether this call locked it, so that concurrent
+// failures produce a single audit event.
+func lockLoginCounter(ctx context.Context, counter *models.LoginCounter, policy throttlePolicy, now time.Time) (bool, error) {
+	if counter.Failures < policy.LockoutAfter {
+		return false, nil
+	}
+
+	lockedUntil := now.Add(policy.LockoutDuration)
+	result, err := config.GetCollection("login_attempts").UpdateOne(ctx,
+		bson.M{
+			"_id": counter.ID,
+			"$or": bson.A{
+				bson.M{"lockedUntil": bson.M{"$exists": false}},
+				bson.M{"lockedUntil": bson.M{"$lte": now}},
+			},
+		},
+		bson.M{"$set": bson.M{"lockedUntil": lockedUntil, "expiresAt": lockedUntil.Add(policy.Window)}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount == 1, nil
+}
+
+// clearLoginFailures forgets the failures of an email address, after a
+// successful login, a password reset or an admin unlock. It reports whether
+// there was anything to clear.
+func clearLoginFailures(ctx context.Context, email string) (bool, error) {
+	result, err := config.GetCollection("login_attempts").DeleteOne(ctx, bson.M{"_id": accountCounterID(email)})
+	if err != nil {
+		return false, err
+	}
+	return result.DeletedCount == 1, nil
+}
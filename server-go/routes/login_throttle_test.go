@@ -0,0 +1,56 @@
+package routes
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"farmer-marketplace/models"
+)
+
+func TestThrottlePolicyRetryAfter(t *testing.T) {
+	policy := throttlePolicy{
+		FreeAttempts:    3,
+		BaseDelay:       time.Second,
+		MaxDelay:        time.Minute,
+		LockoutAfter:    10,
+		LockoutDuration: 15 * time.Minute,
+		Window:          time.Hour,
+	}
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	counter := func(failures int, ago time.Duration) *models.LoginCounter {
+		return &models.LoginCounter{Failures: failures, LastFailureAt: now.Add(-ago)}
+	}
+
+	assert.Zero(t, policy.retryAfter(nil, now))
+	assert.Zero(t, policy.retryAfter(counter(2, 0), now), "free attempts")
+
+	// Exponential backoff from the last failure
+	assert.Equal(t, time.Second, policy.retryAfter(counter(3, 0), now))
+	assert.Equal(t, 4*time.Second, policy.retryAfter(counter(5, 0), now))
+	assert.Equal(t, 3*time.Second, policy.retryAfter(counter(5, time.Second), now))
+	assert.Zero(t, policy.retryAfter(counter(5, 5*time.Second), now))
+
+	// Capped, also where the shift would overflow
+	assert.Equal(t, time.Minute, policy.retryAfter(counter(9, 0), now))
+	assert.Equal(t, time.Minute, policy.retryAfter(counter(200, 0), now))
+
+	// Old failures are forgotten
+	assert.Zero(t, policy.retryAfter(counter(9, 2*time.Hour), now))
+
+	// Lockouts last until they run out
+	locked := counter(10, 10*time.Minute)
+	until := now.Add(5 * time.Minute)
+	locked.LockedUntil = &until
+	assert.Equal(t, 5*time.Minute, policy.retryAfter(locked, now))
+
+	expired := now.Add(-time.Minute)
+	locked.LockedUntil = &expired
+	assert.Zero(t, policy.retryAfter(locked, now))
+}
+
+func TestLoginCounterIDs(t *testing.T) {
+	assert.Equal(t, accountCounterID("Ada@Example.com "), accountCounterID("ada@example.com"))
+	assert.NotEqual(t, accountCounterID("203.0.113.7"), ipCounterID("203.0.113.7"))
+}
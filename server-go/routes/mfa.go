@@ -0,0 +1,561 @@
+package routes
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/crypto/bcrypt"
+
+	"farmer-marketplace/auth"
+	"farmer-marketplace/config"
+	"farmer-marketplace/models"
+)
+
+// Logging in with a second factor takes two requests: login checks the
+// password and answers with an MFA challenge token instead of a session, and
+// /auth/mfa/verify exchanges the token and a code for the session. Users
+// whose role requires 2FA but who have not set it up get an enrollment
+// challenge instead, which /auth/mfa/enroll and /auth/mfa/enroll/confirm use.
+const (
+	mfaChallengeTTL   = 5 * time.Minute
+	mfaMaxAttempts    = 5
+	mfaSkew           = 1 // accepted clock drift, in TOTP steps
+	recoveryCodeCount = 10
+)
+
+var (
+	ErrMFAChallengeInvalid = errors.New("invalid or expired MFA challenge")
+	ErrMFAAlreadyEnabled   = errors.New("two-factor authentication is already enabled")
+)
+
+var recoveryCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// mfaRequired reports whether the roles listed in MFA_REQUIRED_ROLES, e.g.
+// "farmer,admin", include role.
+func mfaRequired(role string) bool {
+	for _, required := range strings.Split(os.Getenv("MFA_REQUIRED_ROLES"), ",") {
+		if strings.TrimSpace(required) == role {
+			return true
+		}
+	}
+	return false
+}
+
+func mfaIssuer() string {
+	if issuer := os.Getenv("MFA_ISSUER"); issuer != "" {
+		return issuer
+	}
+	return "Farmer Help"
+}
+
+// generateRecoveryCodes returns new one-time codes, formatted xxxxx-xxxxx,
+// and the hashes to store.
+func generateRecoveryCodes() (codes, hashes []string, err error) {
+	for i := 0; i < recoveryCodeCount; i++ {
+		buf := make([]byte, 7)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(recoveryCodeEncoding.EncodeToString(buf))[:10]
+		codes = append(codes, code[:5]+"-"+code[5:])
+		hashes = append(hashes, hashToken(code))
+	}
+	return codes, hashes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+func isTOTPCode(code string) bool {
+	code = strings.TrimSpace(code)
+	if len(code) != auth.TOTPDigits {
+		return false
+	}
+	for _, r := range code {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// startMFAChallenge stores a challenge for the user and returns the response
+// fields that ask the client for the second factor.
+func startMFAChallenge(ctx context.Context, user *models.User, purpose string) (gin.H, error) {
+	raw, err := newOpaqueToken()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	challenge := models.MFAChallenge{
+		ID:        hashToken(raw),
+		UserID:    user.ID,
+		Purpose:   purpose,
+		ExpiresAt: now.Add(mfaChallengeTTL),
+		CreatedAt: now,
+	}
+	if _, err := config.GetCollection("mfa_challenges").InsertOne(ctx, challenge); err != nil {
+		return nil, err
+	}
+
+	response := gin.H{
+		"mfaToken":  raw,
+		"expiresIn": int64(mfaChallengeTTL / time.Second),
+	}
+	if purpose == models.MFAChallengeEnroll {
+		response["mfaSetupRequired"] = true
+		response["message"] = "Two-factor authentication is required for " + user.Role + " accounts; set it up to continue"
+	} else {
+		response["mfaRequired"] = true
+		response["message"] = "Enter the code from your authenticator app"
+	}
+	return response, nil
+}
+
+// claimMFAChallenge counts an attempt against a live challenge and returns
+// it. A challenge stops working after mfaMaxAttempts attempts.
+func claimMFAChallenge(ctx context.Context, raw, purpose string) (*models.MFAChallenge, error) {
+	var challenge models.MFAChallenge
+	err := config.GetCollection("mfa_challenges").FindOneAndUpdate(ctx,
+		bson.M{
+			"_id":       hashToken(raw),
+			"purpose":   purpose,
+			"attempts":  bson.M{"$lt": mfaMaxAttempts},
+			"expiresAt": bson.M{"$gt": time.Now()},
+		},
+		bson.M{"$inc": bson.M{"attempts": 1}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&challenge)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrMFAChallengeInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &challenge, nil
+}
+
+func deleteMFAChallenge(ctx context.Context, challenge *models.MFAChallenge) error {
+	_, err := config.GetCollection("mfa_challenges").DeleteOne(ctx, bson.M{"_id": challenge.ID})
+	return err
+}
+
+// checkSecondFactor accepts a TOTP code or an unused recovery code of an
+// enrolled user and uses it up, so neither works twice.
+func checkSecondFactor(ctx context.Context, user *models.User, code string) (bool, error) {
+	collection := config.GetCollection("users")
+
+	if isTOTPCode(code) {
+		step, ok := auth.ValidateTOTP(user.MFA.Secret, code, time.Now(), mfaSkew)
+		if !ok {
+			return false, nil
+		}
+		result, err := collection.UpdateOne(ctx,
+			bson.M{"_id": user.ID, "mfa.enabled": true, "mfa.lastUsedStep": bson.M{"$not": bson.M{"$gte": step}}},
+			bson.M{"$set": bson.M{"mfa.lastUsedStep": step}},
+		)
+		if err != nil {
+			return false, err
+		}
+		return result.ModifiedCount == 1, nil
+	}
+
+	hash := hashToken(normalizeRecoveryCode(code))
+	result, err := collection.UpdateOne(ctx,
+		bson.M{"_id": user.ID, "mfa.enabled": true, "mfa.recoveryCodes": hash},
+		bson.M{"$pull": bson.M{"mfa.recoveryCodes": hash}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount == 1, nil
+}
+
+// enableMFA turns on 2FA with a confirmed secret and returns fresh recovery
+// codes. step is the TOTP step of the confirmation code, which is used up.
+func enableMFA(ctx context.Context, c *gin.Context, user *models.User, secret string, step int64) ([]string, error) {
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	result, err := config.GetCollection("users").UpdateOne(ctx,
+		bson.M{"_id": user.ID, "mfa.enabled": bson.M{"$ne": true}},
+		bson.M{"$set": bson.M{
+			"mfa": models.MFASettings{
+				Enabled:       true,
+				EnabledAt:     &now,
+				Secret:        secret,
+				RecoveryCodes: hashes,
+				LastUsedStep:  step,
+			},
+			"updatedAt": now,
+		}},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if result.ModifiedCount == 0 {
+		return nil, ErrMFAAlreadyEnabled
+	}
+
+	user.MFA.Enabled = true
+	user.MFA.EnabledAt = &now
+	recordAudit(ctx, models.AuditEvent{
+		Type:   models.AuditMFAEnabled,
+		UserID: &user.ID,
+		IP:     c.ClientIP(),
+	})
+	return codes, nil
+}
+
+// findActiveUser loads a user that has not been deleted.
+func findActiveUser(ctx context.Context, filter bson.M) (*models.User, error) {
+	filter["deletedAt"] = bson.M{"$exists": false}
+	var user models.User
+	if err := config.GetCollection("users").FindOne(ctx, filter).Decode(&user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func respondMFAChallengeError(c *gin.Context, err error) {
+	if errors.Is(err, ErrMFAChallengeInvalid) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired MFA challenge, please log in again"})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify code"})
+}
+
+// verifyMFA finishes a login with a TOTP or recovery code.
+func verifyMFA(c *gin.Context) {
+	var req models.MFAVerifyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	challenge, err := claimMFAChallenge(ctx, req.MFAToken, models.MFAChallengeVerify)
+	if err != nil {
+		respondMFAChallengeError(c, err)
+		return
+	}
+
+	user, err := findActiveUser(ctx, bson.M{"_id": challenge.UserID})
+	if err != nil {
+		respondMFAChallengeError(c, ErrMFAChallengeInvalid)
+		return
+	}
+	if !checkLoginThrottle(ctx, c, user.Email) {
+		return
+	}
+
+	ok, err := checkSecondFactor(ctx, user, req.Code)
+	if err != nil {
+		respondMFAChallengeError(c, err)
+		return
+	}
+	if !ok {
+		// Wrong codes count like wrong passwords, so knowing the password
+		// does not allow guessing codes without limit
+		failLogin(ctx, c, user.Email, c.ClientIP(), user)
+		return
+	}
+
+	if err := deleteMFAChallenge(ctx, challenge); err != nil {
+		respondMFAChallengeError(c, err)
+		return
+	}
+	completeLogin(ctx, c, user, http.StatusOK, "Login successful", nil)
+}
+
+// enrollMFA generates the secret for a user who has to set up 2FA before
+// logging in.
+func enrollMFA(c *gin.Context) {
+	var req models.MFAChallengeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	challenge, err := claimMFAChallenge(ctx, req.MFAToken, models.MFAChallengeEnroll)
+	if err != nil {
+		respondMFAChallengeError(c, err)
+		return
+	}
+
+	user, err := findActiveUser(ctx, bson.M{"_id": challenge.UserID})
+	if err != nil {
+		respondMFAChallengeError(c, ErrMFAChallengeInvalid)
+		return
+	}
+
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set up two-factor authentication"})
+		return
+	}
+	_, err = config.GetCollection("mfa_challenges").UpdateOne(ctx,
+		bson.M{"_id": challenge.ID},
+		bson.M{"$set": bson.M{"pendingSecret": secret}},
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set up two-factor authentication"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"secret":     secret,
+		"otpauthUri": auth.TOTPURI(mfaIssuer(), user.Email, secret),
+	})
+}
+
+// confirmMFAEnrollment enables 2FA with the first code and logs the user in.
+func confirmMFAEnrollment(c *gin.Context) {
+	var req models.MFAVerifyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	challenge, err := claimMFAChallenge(ctx, req.MFAToken, models.MFAChallengeEnroll)
+	if err != nil {
+		respondMFAChallengeError(c, err)
+		return
+	}
+	if challenge.PendingSecret == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Two-factor setup has not been started"})
+		return
+	}
+
+	user, err := findActiveUser(ctx, bson.M{"_id": challenge.UserID})
+	if err != nil {
+		respondMFAChallengeError(c, ErrMFAChallengeInvalid)
+		return
+	}
+
+	step, ok := auth.ValidateTOTP(challenge.PendingSecret, req.Code, time.Now(), mfaSkew)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	codes, err := enableMFA(ctx, c, user, challenge.PendingSecret, step)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to enable two-factor authentication"})
+		return
+	}
+	if err := deleteMFAChallenge(ctx, challenge); err != nil {
+		respondMFAChallengeError(c, err)
+		return
+	}
+
+	completeLogin(ctx, c, user, http.StatusOK, "Two-factor authentication enabled", gin.H{"recoveryCodes": codes})
+}
+
+// setupMFA starts enrollment for a signed-in user.
+func setupMFA(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, ok := loadCurrentUser(ctx, c)
+	if !ok {
+		return
+	}
+	if user.MFA.Enabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+		return
+	}
+
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set up two-factor authentication"})
+		return
+	}
+	_, err = config.GetCollection("users").UpdateOne(ctx,
+		bson.M{"_id": user.ID},
+		bson.M{"$set": bson.M{"mfa.pendingSecret": secret}},
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set up two-factor authentication"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"secret":     secret,
+		"otpauthUri": auth.TOTPURI(mfaIssuer(), user.Email, secret),
+	})
+}
+
+// confirmMFA enables 2FA for a signed-in user and returns the recovery codes,
+// which are shown only this once.
+func confirmMFA(c *gin.Context) {
+	var req models.MFACodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, ok := loadCurrentUser(ctx, c)
+	if !ok {
+		return
+	}
+	if user.MFA.Enabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+		return
+	}
+	if user.MFA.PendingSecret == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Two-factor setup has not been started"})
+		return
+	}
+
+	step, valid := auth.ValidateTOTP(user.MFA.PendingSecret, req.Code, time.Now(), mfaSkew)
+	if !valid {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	codes, err := enableMFA(ctx, c, user, user.MFA.PendingSecret, step)
+	if errors.Is(err, ErrMFAAlreadyEnabled) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to enable two-factor authentication"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":       "Two-factor authentication enabled",
+		"recoveryCodes": codes,
+	})
+}
+
+func disableMFA(c *gin.Context) {
+	var req models.MFADisableRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, ok := loadCurrentUser(ctx, c)
+	if !ok {
+		return
+	}
+	if !user.MFA.Enabled {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Two-factor authentication is not enabled"})
+		return
+	}
+	if mfaRequired(user.Role) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Two-factor authentication is required for " + user.Role + " accounts"})
+		return
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Password is incorrect"})
+		return
+	}
+	valid, err := checkSecondFactor(ctx, user, req.Code)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to disable two-factor authentication"})
+		return
+	}
+	if !valid {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	_, err = config.GetCollection("users").UpdateOne(ctx,
+		bson.M{"_id": user.ID},
+		bson.M{"$set": bson.M{"mfa": models.MFASettings{}, "updatedAt": time.Now()}},
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to disable two-factor authentication"})
+		return
+	}
+
+	recordAudit(ctx, models.AuditEvent{
+		Type:    models.AuditMFADisabled,
+		ActorID: &user.ID,
+		UserID:  &user.ID,
+		IP:      c.ClientIP(),
+	})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication disabled"})
+}
+
+// regenerateRecoveryCodes replaces all recovery codes, e.g. after some were
+// used up or exposed.
+func regenerateRecoveryCodes(c *gin.Context) {
+	var req models.MFACodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, ok := loadCurrentUser(ctx, c)
+	if !ok {
+		return
+	}
+	if !user.MFA.Enabled {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Two-factor authentication is not enabled"})
+		return
+	}
+
+	valid, err := checkSecondFactor(ctx, user, req.Code)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to regenerate recovery codes"})
+		return
+	}
+	if !valid {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to regenerate recovery codes"})
+		return
+	}
+	_, err = config.GetCollection("users").UpdateOne(ctx,
+		bson.M{"_id": user.ID},
+		bson.M{"$set": bson.M{"mfa.recoveryCodes": hashes, "updatedAt": time.Now()}},
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to regenerate recovery codes"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"recoveryCodes": codes})
+}
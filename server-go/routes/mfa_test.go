@@ -0,0 +1,44 @@
+package routes
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"farmer-marketplace/models"
+)
+
+func TestMFARequired(t *testing.T) {
+	t.Setenv("MFA_REQUIRED_ROLES", "")
+	assert.False(t, mfaRequired(models.RoleFarmer))
+
+	t.Setenv("MFA_REQUIRED_ROLES", "farmer, admin")
+	assert.True(t, mfaRequired(models.RoleFarmer))
+	assert.True(t, mfaRequired(models.RoleAdmin))
+	assert.False(t, mfaRequired(models.RoleCustomer))
+	assert.False(t, mfaRequired(""))
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, hashes, err := generateRecoveryCodes()
+	require.NoError(t, err)
+	require.Len(t, codes, recoveryCodeCount)
+	require.Len(t, hashes, recoveryCodeCount)
+
+	seen := make(map[string]bool)
+	for i, code := range codes {
+		assert.Regexp(t, `^[a-z2-7]{5}-[a-z2-7]{5}$`, code)
+		assert.False(t, seen[code])
+		seen[code] = true
+
+		// Codes are accepted however the user types them
+		assert.Equal(t, hashes[i], hashToken(normalizeRecoveryCode(code)))
+		assert.Equal(t, hashes[i], hashToken(normalizeRecoveryCode(strings.ToUpper(strings.ReplaceAll(code, "-", " ")))))
+		assert.False(t, isTOTPCode(code))
+	}
+
+	assert.True(t, isTOTPCode(" 123456 "))
+	assert.False(t, isTOTPCode("12345a"))
+}
@@ -11,12 +11,13 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 
 	"farmer-marketplace/config"
+	"farmer-marketplace/models"
 )
 
 type Notification struct {
 	ID        primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
 	UserID    primitive.ObjectID `json:"userId" bson:"userId"`
-	Type      string             `json:"type" bson:"type"` // order_status, message, system
+	Type      string             `json:"type" bson:"type"` // order_status, product_expiry, message, system
 	Title     string             `json:"title" bson:"title"`
 	Message   string             `json:"message" bson:"message"`
 	Data      map[string]interface{} `json:"data,omitempty" bson:"data,omitempty"`
@@ -34,7 +35,7 @@ func NotificationRoutes(router *gin.RouterGroup) {
 	{
 		notifications.GET("", authMiddleware(), getNotifications)
 		notifications.PUT("/:id/read", authMiddleware(), markAsRead)
-		notifications.POST("/order-status", authMiddleware(), sendOrderStatusNotification)
+		notifications.POST("/order-status", authMiddleware(), requirePermission(models.PermNotificationSend), sendOrderStatusNotification)
 		notifications.DELETE("/:id", authMiddleware(), deleteNotification)
 	}
 }
@@ -114,12 +115,6 @@ func sendOrderStatusNotification(c *gin.Context) {
 		return
 	}
 
-	role := c.GetString("role")
-	if role != "farmer" && role != "admin" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Only farmers can send order status notifications"})
-		return
-	}
-
 	// Get order details
 	orderID, err := primitive.ObjectIDFromHex(req.OrderID)
 	if err != nil {
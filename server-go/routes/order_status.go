@@ -0,0 +1,269 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"farmer-marketplace/config"
+	"farmer-marketplace/models"
+)
+
+// roleSystem is used for transitions triggered by the server itself, e.g. in
+// response to payment events, rather than by an authenticated user.
+const roleSystem = "system"
+
+// orderTransitions lists, for every order status, the statuses it may move to
+// and the roles allowed to trigger each move.
+var orderTransitions = map[string]map[string][]string{
+	models.OrderStatusPending: {
+		models.OrderStatusConfirmed:     {"farmer", "admin", roleSystem},
+		models.OrderStatusCancelled:     {"customer", "farmer", "admin", roleSystem},
+		models.OrderStatusPaymentFailed: {roleSystem},
+	},
+	models.OrderStatusPaymentFailed: {
+		models.OrderStatusPending:   {roleSystem},
+		models.OrderStatusConfirmed: {roleSystem},
+		models.OrderStatusCancelled: {"customer", "admin", roleSystem},
+	},
+	models.OrderStatusConfirmed: {
+		models.OrderStatusPreparing:         {"farmer", "admin"},
+		models.OrderStatusCancelled:         {"customer", "farmer", "admin"},
+		models.OrderStatusRefunded:          refundRoles,
+		models.OrderStatusPartiallyRefunded: refundRoles,
+	},
+	models.OrderStatusPreparing: {
+		models.OrderStatusReady:             {"farmer", "admin"},
+		models.OrderStatusCancelled:         {"farmer", "admin"},
+		models.OrderStatusRefunded:          refundRoles,
+		models.OrderStatusPartiallyRefunded: refundRoles,
+	},
+	models.OrderStatusReady: {
+		models.OrderStatusOutForDelivery:    {"farmer", "admin"},
+		models.OrderStatusCancelled:         {"admin"},
+		models.OrderStatusRefunded:          refundRoles,
+		models.OrderStatusPartiallyRefunded: refundRoles,
+	},
+	models.OrderStatusOutForDelivery: {
+		models.OrderStatusDelivered:         {"farmer", "admin"},
+		models.OrderStatusRefunded:          refundRoles,
+		models.OrderStatusPartiallyRefunded: refundRoles,
+	},
+	models.OrderStatusDelivered: {
+		models.OrderStatusRefunded:          refundRoles,
+		models.OrderStatusPartiallyRefunded: refundRoles,
+	},
+	models.OrderStatusCancelled: {
+		models.OrderStatusRefunded:          refundRoles,
+		models.OrderStatusPartiallyRefunded: refundRoles,
+	},
+	// Cancelling a partially refunded order refunds the rest
+	models.OrderStatusPartiallyRefunded: {
+		models.OrderStatusRefunded:  refundRoles,
+		models.OrderStatusCancelled: {"admin"},
+	},
+}
+
+// refundRoles may move a paid order into one of the refund statuses.
+var refundRoles = []string{"farmer", "admin", roleSystem}
+
+var (
+	ErrUnknownOrderStatus = errors.New("unknown order status")
+	ErrStatusConflict     = errors.New("order status changed concurrently")
+)
+
+// TransitionError is returned when a status change is not allowed, either
+// because the state machine has no such edge or because the caller's role may
+// not trigger it.
+type TransitionError struct {
+	From      string
+	To        string
+	Role      string
+	Forbidden bool
+}
+
+func (e *TransitionError) Error() string {
+	if e.Forbidden {
+		return fmt.Sprintf("role %q may not change order status from %s to %s", e.Role, e.From, e.To)
+	}
+	return fmt.Sprintf("order status cannot change from %s to %s", e.From, e.To)
+}
+
+func isKnownOrderStatus(status string) bool {
+	switch status {
+	case models.OrderStatusPending, models.OrderStatusConfirmed, models.OrderStatusPreparing,
+		models.OrderStatusReady, models.OrderStatusOutForDelivery, models.OrderStatusDelivered,
+		models.OrderStatusCancelled, models.OrderStatusPaymentFailed,
+		models.OrderStatusRefunded, models.OrderStatusPartiallyRefunded:
+		return true
+	}
+	return false
+}
+
+// isPaymentOrderStatus reports whether the status describes the order's
+// payment rather than the progress of its fulfillments.
+func isPaymentOrderStatus(status string) bool {
+	switch status {
+	case models.OrderStatusPaymentFailed, models.OrderStatusRefunded, models.OrderStatusPartiallyRefunded:
+		return true
+	}
+	return false
+}
+
+// checkOrderTransition validates a status change against the state machine.
+func checkOrderTransition(from, to, role string) error {
+	if !isKnownOrderStatus(to) {
+		return ErrUnknownOrderStatus
+	}
+
+	roles, ok := orderTransitions[from][to]
+	if !ok {
+		return &TransitionError{From: from, To: to, Role: role}
+	}
+
+	for _, allowed := range roles {
+		if allowed == role {
+			return nil
+		}
+	}
+
+	return &TransitionError{From: from, To: to, Role: role, Forbidden: true}
+}
+
+// transitionOrderStatus moves an order to a new status and appends the change
+// to its status history. Fulfillments that were at the order's current status
+// move along with it; on cancellation every open fulfillment is cancelled and
+// must itself allow the transition. The update only applies if the order has
+// not been modified since it was loaded; otherwise ErrStatusConflict is
+// returned.
+func transitionOrderStatus(ctx context.Context, order *models.Order, to, role string, actorID primitive.ObjectID, note string) error {
+	if err := checkOrderTransition(order.Status, to, role); err != nil {
+		return err
+	}
+
+	change := models.OrderStatusChange{
+		From:      order.Status,
+		To:        to,
+		ChangedBy: actorID,
+		Role:      role,
+		Note:      note,
+		ChangedAt: time.Now(),
+	}
+
+	set := bson.M{"status": to}
+	push := bson.M{"statusHistory": change}
+
+	// Payment and refund states only concern the order as a whole, but a
+	// cancellation always reaches the fulfillments
+	cascade := to == models.OrderStatusCancelled || (!isPaymentOrderStatus(to) && !isPaymentOrderStatus(order.Status))
+	for i := range order.Fulfillments {
+		if !cascade {
+			break
+		}
+		f := &order.Fulfillments[i]
+		if f.Status == models.OrderStatusCancelled {
+			continue
+		}
+		if to != models.OrderStatusCancelled && f.Status != order.Status {
+			continue
+		}
+		if err := checkOrderTransition(f.Status, to, role); err != nil {
+			return err
+		}
+
+		fChange := change
+		fChange.From = f.Status
+		set[fmt.Sprintf("fulfillments.%d.status", i)] = to
+		set[fmt.Sprintf("fulfillments.%d.updatedAt", i)] = change.ChangedAt
+		push[fmt.Sprintf("fulfillments.%d.statusHistory", i)] = fChange
+
+		f.Status = to
+		f.StatusHistory = append(f.StatusHistory, fChange)
+		f.UpdatedAt = change.ChangedAt
+	}
+
+	if err := saveOrderChanges(ctx, order, set, push); err != nil {
+		return err
+	}
+
+	order.Status = to
+	order.StatusHistory = append(order.StatusHistory, change)
+
+	// Cancelled orders give their reserved stock back
+	if to == models.OrderStatusCancelled {
+		return releaseOrderStock(ctx, order.ID)
+	}
+
+	return nil
+}
+
+// saveOrderChanges applies $set and $push updates to an order, guarded by the
+// updatedAt value it was loaded with so concurrent writers cannot overwrite
+// each other's status changes. It is a variable so that handler tests can run
+// without a database.
+var saveOrderChanges = func(ctx context.Context, order *models.Order, set, push bson.M) error {
+	// Mongo stores milliseconds; keep the in-memory value comparable
+	now := time.Now().Truncate(time.Millisecond)
+	set["updatedAt"] = now
+
+	update := bson.M{"$set": set}
+	if len(push) > 0 {
+		update["$push"] = push
+	}
+
+	collection := config.GetCollection("orders")
+	filter := bson.M{"_id": order.ID, "updatedAt": order.UpdatedAt}
+
+	result, err := collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrStatusConflict
+	}
+
+	order.UpdatedAt = now
+	return nil
+}
+
+// respondTransitionError maps status transition failures to HTTP responses.
+func respondTransitionError(c *gin.Context, err error) {
+	var transitionErr *TransitionError
+	var weightErr *WeightError
+	switch {
+	case errors.As(err, &weightErr):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Some line weights are missing or invalid", "issues": weightErr.Issues})
+	case errors.Is(err, ErrWeightsNotAccepted):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Weights can only be recorded when a fulfillment becomes ready"})
+	case errors.Is(err, ErrUnknownOrderStatus):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown order status"})
+	case errors.As(err, &transitionErr) && transitionErr.Forbidden:
+		c.JSON(http.StatusForbidden, gin.H{"error": transitionErr.Error()})
+	case errors.As(err, &transitionErr):
+		c.JSON(http.StatusConflict, gin.H{"error": transitionErr.Error()})
+	case errors.Is(err, ErrStatusConflict):
+		c.JSON(http.StatusConflict, gin.H{"error": "Order was changed by someone else, please retry"})
+	case errors.Is(err, ErrPaymentFailed):
+		c.JSON(http.StatusConflict, gin.H{"error": "Order payment has failed"})
+	case errors.Is(err, ErrOrderRefunded):
+		c.JSON(http.StatusConflict, gin.H{"error": "Order has been refunded"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update order status"})
+	}
+}
+
+// orderHasFarm reports whether any line of the order belongs to the farm.
+func orderHasFarm(order *models.Order, farmID primitive.ObjectID) bool {
+	for _, item := range order.Items {
+		if item.FarmID == farmID {
+			return true
+		}
+	}
+	return false
+}
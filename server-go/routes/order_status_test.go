@@ -0,0 +1,66 @@
+package routes
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"farmer-marketplace/models"
+)
+
+func TestCheckOrderTransition(t *testing.T) {
+	tests := []struct {
+		name      string
+		from      string
+		to        string
+		role      string
+		wantErr   bool
+		forbidden bool
+	}{
+		{name: "Farmer confirms pending order", from: "pending", to: "confirmed", role: "farmer"},
+		{name: "Farmer moves through fulfillment", from: "ready", to: "out_for_delivery", role: "farmer"},
+		{name: "Customer cancels pending order", from: "pending", to: "cancelled", role: "customer"},
+		{name: "System marks payment failed", from: "pending", to: "payment_failed", role: roleSystem},
+		{name: "Customer cannot confirm", from: "pending", to: "confirmed", role: "customer", wantErr: true, forbidden: true},
+		{name: "Customer cannot cancel once preparing", from: "preparing", to: "cancelled", role: "customer", wantErr: true, forbidden: true},
+		{name: "Farmer cannot fake payment failure", from: "pending", to: "payment_failed", role: "farmer", wantErr: true, forbidden: true},
+		{name: "Cannot skip ahead", from: "pending", to: "delivered", role: "admin", wantErr: true},
+		{name: "Delivered is terminal", from: "delivered", to: "pending", role: "admin", wantErr: true},
+		{name: "Cancelled is terminal", from: "cancelled", to: "confirmed", role: "admin", wantErr: true},
+		{name: "Admin cancels partially refunded order", from: "partially_refunded", to: "cancelled", role: "admin"},
+		{name: "Farmer cannot cancel partially refunded order", from: "partially_refunded", to: "cancelled", role: "farmer", wantErr: true, forbidden: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkOrderTransition(tt.from, tt.to, tt.role)
+			if !tt.wantErr {
+				assert.NoError(t, err)
+				return
+			}
+
+			var transitionErr *TransitionError
+			if assert.True(t, errors.As(err, &transitionErr)) {
+				assert.Equal(t, tt.forbidden, transitionErr.Forbidden)
+			}
+		})
+	}
+
+	assert.ErrorIs(t, checkOrderTransition(models.OrderStatusPending, "shipped", "admin"), ErrUnknownOrderStatus)
+}
+
+func TestDeriveOrderStatus(t *testing.T) {
+	fulfillments := func(statuses ...string) []models.Fulfillment {
+		var fs []models.Fulfillment
+		for _, status := range statuses {
+			fs = append(fs, models.Fulfillment{Status: status})
+		}
+		return fs
+	}
+
+	assert.Equal(t, "confirmed", deriveOrderStatus(fulfillments("ready", "confirmed", "delivered")))
+	assert.Equal(t, "ready", deriveOrderStatus(fulfillments("ready", "cancelled")))
+	assert.Equal(t, "delivered", deriveOrderStatus(fulfillments("delivered", "delivered")))
+	assert.Equal(t, "cancelled", deriveOrderStatus(fulfillments("cancelled", "cancelled")))
+}
@@ -2,6 +2,8 @@ package routes
 
 import (
 	"context"
+	"errors"
+	"log"
 	"net/http"
 	"time"
 
@@ -12,17 +14,22 @@ import (
 
 	"farmer-marketplace/config"
 	"farmer-marketplace/models"
+	"farmer-marketplace/payments"
 )
 
-func OrderRoutes(router *gin.RouterGroup) {
+func OrderRoutes(router *gin.RouterGroup, provider payments.Provider) {
 	orders := router.Group("/orders")
 	{
-		orders.POST("", authMiddleware(), createOrder)
-		orders.GET("", authMiddleware(), getOrders)
-		orders.GET("/:id", authMiddleware(), getOrder)
-		orders.PUT("/:id/status", authMiddleware(), updateOrderStatus)
-		orders.GET("/farmer", authMiddleware(), getFarmerOrders)
-		orders.GET("/customer", authMiddleware(), getCustomerOrders)
+		orders.POST("", authMiddleware(), requirePermission(models.PermOrderCreate), createOrder)
+		orders.GET("", authMiddleware(), requirePermission(models.PermOrderRead), getOrders)
+		orders.GET("/:id", authMiddleware(), requirePermission(models.PermOrderRead), getOrder)
+		orders.PUT("/:id/status", authMiddleware(), updateOrderStatus(provider))
+		orders.GET("/:id/fulfillment", authMiddleware(), requirePermission(models.PermOrderRead), getMyFulfillment)
+		orders.PUT("/:id/fulfillment/status", authMiddleware(), requirePermission(models.PermOrderUpdateStatus), updateFulfillmentStatus(provider))
+		orders.PUT("/:id/fulfillment/tracking", authMiddleware(), requirePermission(models.PermOrderUpdateStatus), updateFulfillmentTracking)
+		orders.POST("/:id/refund", authMiddleware(), requirePermission(models.PermRefundIssue), refundOrder(provider))
+		orders.GET("/farmer", authMiddleware(), requirePermission(models.PermOrderRead), getFarmerOrders)
+		orders.GET("/customer", authMiddleware(), requireRole(models.RoleCustomer), getCustomerOrders)
 	}
 }
 
@@ -34,61 +41,112 @@ func createOrder(c *gin.Context) {
 	}
 
 	userID := c.GetString("userID")
-	role := c.GetString("role")
+	customerID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid customer ID"})
+		return
+	}
 
-	if role != "customer" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Only customers can create orders"})
+	collection := config.GetCollection("orders")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Price every line from the catalog; client-supplied prices are ignored
+	items, totalAmount, err := priceOrder(ctx, req.Items)
+	if err != nil {
+		var pricingErr *PricingError
+		if errors.As(err, &pricingErr) {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{
+				"error":  "Some order items are invalid",
+				"issues": pricingErr.Issues,
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to price order"})
 		return
 	}
 
-	customerID, err := primitive.ObjectIDFromHex(userID)
+	// Orders with catch-weight lines hold more than the estimate on the card
+	authorized, err := authorizationAmount(items)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid customer ID"})
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Order total is too large"})
 		return
 	}
 
-	// Calculate total amount
-	var totalAmount float64
-	for _, item := range req.Items {
-		totalAmount += item.Price * float64(item.Quantity)
+	now := time.Now().Truncate(time.Millisecond)
+	initial := models.OrderStatusChange{
+		To:        models.OrderStatusPending,
+		ChangedBy: customerID,
+		Role:      models.RoleCustomer,
+		ChangedAt: now,
 	}
 
 	order := models.Order{
-		ID:              primitive.NewObjectID(),
-		CustomerID:      customerID,
-		Items:           req.Items,
-		TotalAmount:     totalAmount,
-		Status:          "pending",
-		DeliveryAddress: req.DeliveryAddress,
-		PaymentMethod:   req.PaymentMethod,
-		PaymentStatus:   "pending",
-		Notes:           req.Notes,
-		CreatedAt:       time.Now(),
-		UpdatedAt:       time.Now(),
+		ID:               primitive.NewObjectID(),
+		CustomerID:       customerID,
+		Items:            items,
+		TotalAmount:      totalAmount,
+		AuthorizedAmount: authorized,
+		RefundedAmount:   models.NewMoney(0, totalAmount.Currency),
+		Status:           models.OrderStatusPending,
+		StatusHistory:    []models.OrderStatusChange{initial},
+		Fulfillments:     buildFulfillments(items, initial),
+		DeliveryAddress:  req.DeliveryAddress,
+		PaymentMethod:    req.PaymentMethod,
+		PaymentStatus:    "pending",
+		Notes:            req.Notes,
+		CreatedAt:        now,
+		UpdatedAt:        now,
+	}
+
+	// Reserve stock before persisting the order so we never oversell
+	if err := reserveStock(ctx, order.Items); err != nil {
+		var stockErr *StockError
+		if errors.As(err, &stockErr) {
+			c.JSON(http.StatusConflict, gin.H{
+				"error":     "Insufficient stock",
+				"shortages": stockErr.Shortages,
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reserve stock"})
+		return
 	}
 
-	collection := config.GetCollection("orders")
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
 	_, err = collection.InsertOne(ctx, order)
 	if err != nil {
+		releaseStockOrLog(ctx, order.Items)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create order"})
 		return
 	}
 
-	// Update product stock and order count
-	go updateProductStats(req.Items)
-
 	c.JSON(http.StatusCreated, gin.H{
 		"message": "Order created successfully",
 		"order":   order,
 	})
 }
 
+// canReadOrder reports whether the authenticated account may see an order:
+// admins see every order, farm members the orders containing their farm's
+// products and customers their own.
+func canReadOrder(c *gin.Context, order *models.Order) bool {
+	if !hasPermission(c, models.PermOrderRead) {
+		return false
+	}
+	if c.GetString("role") == models.RoleAdmin {
+		return true
+	}
+	if farmID, err := primitive.ObjectIDFromHex(c.GetString("farmID")); err == nil {
+		return orderHasFarm(order, farmID)
+	}
+	userID, err := primitive.ObjectIDFromHex(c.GetString("userID"))
+	return err == nil && order.CustomerID == userID
+}
+
 func getOrders(c *gin.Context) {
 	userID := c.GetString("userID")
 	role := c.GetString("role")
+	farm := c.GetString("farmID")
 
 	collection := config.GetCollection("orders")
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
@@ -102,36 +160,19 @@ func getOrders(c *gin.Context) {
 			return
 		}
 		filter = bson.M{"customerId": customerID}
-	} else if role == "farmer" {
-		// For farmers, we need to find orders containing their products
-		farmerID, err := primitive.ObjectIDFromHex(userID)
+	} else if farm != "" {
+		// For farm members, find the orders with a line sold by the farm
+		farmID, err := primitive.ObjectIDFromHex(farm)
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid farmer ID"})
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid farm ID"})
 			return
 		}
-		
-		// First get farmer's products
-		productCollection := config.GetCollection("products")
-		productCursor, err := productCollection.Find(ctx, bson.M{"farmerId": farmerID})
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch farmer products"})
-			return
-		}
-		
-		var products []models.Product
-		if err = productCursor.All(ctx, &products); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode products"})
-			return
-		}
-		
-		var productIDs []primitive.ObjectID
-		for _, product := range products {
-			productIDs = append(productIDs, product.ID)
-		}
-		
-		filter = bson.M{"items.productId": bson.M{"$in": productIDs}}
-	} else {
+		filter = bson.M{"items.farmId": farmID}
+	} else if role == models.RoleAdmin {
 		filter = bson.M{} // Admin can see all orders
+	} else {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Not allowed to list orders"})
+		return
 	}
 
 	// Aggregation pipeline to populate customer and product info
@@ -231,67 +272,136 @@ func getOrder(c *gin.Context) {
 		return
 	}
 
+	if !canReadOrder(c, &orders[0]) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Not allowed to view this order"})
+		return
+	}
+
 	c.JSON(http.StatusOK, orders[0])
 }
 
-func updateOrderStatus(c *gin.Context) {
-	id := c.Param("id")
-	objectID, err := primitive.ObjectIDFromHex(id)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid order ID"})
-		return
-	}
+func updateOrderStatus(provider payments.Provider) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("id")
+		objectID, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid order ID"})
+			return
+		}
 
-	var req models.UpdateOrderStatusRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
+		var req models.UpdateOrderStatusRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 
-	role := c.GetString("role")
-	if role != "farmer" && role != "admin" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Only farmers can update order status"})
-		return
-	}
+		userID := c.GetString("userID")
+		role := c.GetString("role")
 
-	collection := config.GetCollection("orders")
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+		actorID, err := primitive.ObjectIDFromHex(userID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+			return
+		}
 
-	filter := bson.M{"_id": objectID}
-	update := bson.M{
-		"$set": bson.M{
-			"status":    req.Status,
-			"updatedAt": time.Now(),
-		},
-	}
+		collection := config.GetCollection("orders")
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
 
-	result, err := collection.UpdateOne(ctx, filter, update)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update order status"})
-		return
-	}
+		var order models.Order
+		err = collection.FindOne(ctx, bson.M{"_id": objectID}).Decode(&order)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+			return
+		}
 
-	if result.MatchedCount == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
-		return
-	}
+		// Farm members may only act on orders containing their farm's
+		// products, customers only on their own orders
+		switch role {
+		case "admin":
+		case "farmer", models.RoleStaff:
+			if !hasPermission(c, models.PermOrderUpdateStatus) {
+				c.JSON(http.StatusForbidden, gin.H{"error": "Missing permission: " + models.PermOrderUpdateStatus})
+				return
+			}
+			farmID, ok := actingFarmID(c)
+			if !ok {
+				return
+			}
+			if !orderHasFarm(&order, farmID) {
+				c.JSON(http.StatusForbidden, gin.H{"error": "Order does not contain your products"})
+				return
+			}
+
+			// Farm members move orders with the farmer's rights; the history
+			// still records who did it
+			role = models.RoleFarmer
+
+			// Farms only ever move their own part of a multi-farm order
+			if idx := findFulfillment(&order, farmID); idx >= 0 {
+				err = moveFulfillment(ctx, provider, &order, idx, req, role, actorID)
+				if err != nil {
+					respondTransitionError(c, err)
+					return
+				}
+				c.JSON(http.StatusOK, gin.H{
+					"message": "Order status updated successfully",
+					"order":   order,
+				})
+				return
+			}
+		case "customer":
+			if order.CustomerID != actorID {
+				c.JSON(http.StatusForbidden, gin.H{"error": "Not your order"})
+				return
+			}
+		default:
+			c.JSON(http.StatusForbidden, gin.H{"error": "Not allowed to update order status"})
+			return
+		}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Order status updated successfully"})
-}
+		// Weights are recorded per farm; the whole order only becomes ready
+		// once every farm has weighed its lines
+		if len(req.Weights) > 0 {
+			respondTransitionError(c, ErrWeightsNotAccepted)
+			return
+		}
+		if req.Status == models.OrderStatusReady {
+			if issues := unweighedLines(&order, nil, nil); len(issues) > 0 {
+				respondTransitionError(c, &WeightError{Issues: issues})
+				return
+			}
+		}
 
-func getFarmerOrders(c *gin.Context) {
-	userID := c.GetString("userID")
-	role := c.GetString("role")
+		err = transitionOrderStatus(ctx, &order, req.Status, role, actorID, req.Note)
+		if err != nil {
+			respondTransitionError(c, err)
+			return
+		}
 
-	if role != "farmer" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Only farmers can access this endpoint"})
-		return
+		// Cancelling an order that was already charged, such as a confirmed
+		// order cancelled by its customer, gives the money back
+		if order.Status == models.OrderStatusCancelled {
+			if err := refundCancelledOrder(ctx, provider, &order, actorID, req.Note); err != nil {
+				log.Printf("Failed to refund cancelled order %s: %v", order.ID.Hex(), err)
+				c.JSON(http.StatusBadGateway, gin.H{
+					"error": "Order was cancelled, but refunding its payment failed",
+					"order": order,
+				})
+				return
+			}
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Order status updated successfully",
+			"order":   order,
+		})
 	}
+}
 
-	farmerID, err := primitive.ObjectIDFromHex(userID)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid farmer ID"})
+func getFarmerOrders(c *gin.Context) {
+	farmID, ok := actingFarmID(c)
+	if !ok {
 		return
 	}
 
@@ -299,28 +409,9 @@ func getFarmerOrders(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	// First get farmer's products
-	productCollection := config.GetCollection("products")
-	productCursor, err := productCollection.Find(ctx, bson.M{"farmerId": farmerID})
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch farmer products"})
-		return
-	}
-
-	var products []models.Product
-	if err = productCursor.All(ctx, &products); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode products"})
-		return
-	}
-
-	var productIDs []primitive.ObjectID
-	for _, product := range products {
-		productIDs = append(productIDs, product.ID)
-	}
-
-	// Aggregation pipeline to get orders with farmer's products
+	// Aggregation pipeline to get orders with a line sold by the farm
 	pipeline := []bson.M{
-		{"$match": bson.M{"items.productId": bson.M{"$in": productIDs}}},
+		{"$match": bson.M{"items.farmId": farmID}},
 		{
 			"$lookup": bson.M{
 				"from":         "users",
@@ -363,13 +454,6 @@ func getFarmerOrders(c *gin.Context) {
 
 func getCustomerOrders(c *gin.Context) {
 	userID := c.GetString("userID")
-	role := c.GetString("role")
-
-	if role != "customer" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Only customers can access this endpoint"})
-		return
-	}
-
 	customerID, err := primitive.ObjectIDFromHex(userID)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid customer ID"})
@@ -398,21 +482,3 @@ func getCustomerOrders(c *gin.Context) {
 
 	c.JSON(http.StatusOK, orders)
 }
-
-func updateProductStats(items []models.OrderItem) {
-	collection := config.GetCollection("products")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	for _, item := range items {
-		// Update stock and order count
-		filter := bson.M{"_id": item.ProductID}
-		update := bson.M{
-			"$inc": bson.M{
-				"stock":  -item.Quantity,
-				"orders": 1,
-			},
-		}
-		collection.UpdateOne(ctx, filter, update)
-	}
-}
\ No newline at end of file
@@ -1,182 +1,368 @@
 package routes
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
-	"os"
-	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/stripe/stripe-go/v76"
-	"github.com/stripe/stripe-go/v76/paymentintent"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"farm-to-table/models"
-	"farm-to-table/config"
+
+	"farmer-marketplace/models"
+	"farmer-marketplace/payments"
 )
 
+// PaymentRequest selects the order to pay. The amount and currency are always
+// taken from the stored order, never from the client.
 type PaymentRequest struct {
-	Amount   int64  `json:"amount"`
-	Currency string `json:"currency"`
-	OrderID  string `json:"order_id"`
+	OrderID string `json:"order_id" binding:"required"`
 }
 
 type PaymentResponse struct {
 	ClientSecret string `json:"client_secret"`
 	PaymentID    string `json:"payment_id"`
+	Amount       int64  `json:"amount"`
+	Currency     string `json:"currency"`
+}
+
+// paidPaymentStatuses are the order payment statuses for which no new payment
+// intent may be created.
+var paidPaymentStatuses = map[string]bool{
+	"processing":         true,
+	"authorized":         true,
+	"capturing":          true,
+	"completed":          true,
+	"partially_refunded": true,
+	"refunded":           true,
+	"disputed":           true,
 }
 
-func SetupPaymentRoutes(api *gin.RouterGroup) {
+func SetupPaymentRoutes(api *gin.RouterGroup, provider payments.Provider) {
 	payment := api.Group("/payment")
 	{
-		payment.POST("/create-intent", createPaymentIntent)
-		payment.POST("/confirm", confirmPayment)
-		payment.GET("/status/:payment_id", getPaymentStatus)
+		payment.POST("/create-intent", authMiddleware(), createPaymentIntent(provider))
+		payment.POST("/confirm", authMiddleware(), confirmPayment(provider))
+		payment.GET("/status/:payment_id", authMiddleware(), getPaymentStatus(provider))
+		payment.POST("/webhook", paymentWebhook(provider))
+		payment.GET("/history/:orderId", authMiddleware(), getPaymentHistory)
 	}
 }
 
-func createPaymentIntent(c *gin.Context) {
-	// Initialize Stripe
-	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
-	if stripe.Key == "" {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Stripe configuration missing"})
-		return
-	}
+// reusableIntent reports whether an existing intent can be handed out again
+// for an order that should be charged amount.
+func reusableIntent(intent *payments.Intent, amount models.Money) bool {
+	return intent.IsOpen() && intent.Amount == amount.Amount && strings.EqualFold(intent.Currency, amount.Currency)
+}
 
-	var req PaymentRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
+func createPaymentIntent(provider payments.Provider) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req PaymentRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 
-	// Validate order exists
-	orderID, err := primitive.ObjectIDFromHex(req.OrderID)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid order ID"})
-		return
-	}
+		orderID, err := primitive.ObjectIDFromHex(req.OrderID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid order ID"})
+			return
+		}
 
-	var order models.Order
-	collection := config.GetCollection("orders")
-	err = collection.FindOne(c, gin.H{"_id": orderID}).Decode(&order)
-	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
-		return
-	}
+		userID, err := primitive.ObjectIDFromHex(c.GetString("userID"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+			return
+		}
 
-	// Create payment intent
-	params := &stripe.PaymentIntentParams{
-		Amount:   stripe.Int64(req.Amount),
-		Currency: stripe.String(req.Currency),
-		Metadata: map[string]string{
-			"order_id": req.OrderID,
-		},
-	}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
 
-	pi, err := paymentintent.New(params)
-	if err != nil {
-		log.Printf("Payment intent creation failed: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create payment intent"})
-		return
-	}
+		order, err := paymentRecords.findOrder(ctx, orderID)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+			return
+		}
 
-	// Update order with payment intent ID
-	update := gin.H{
-		"$set": gin.H{
-			"payment_intent_id": pi.ID,
-			"payment_status":    "pending",
-		},
-	}
-	_, err = collection.UpdateOne(c, gin.H{"_id": orderID}, update)
-	if err != nil {
-		log.Printf("Failed to update order with payment intent: %v", err)
-	}
+		if order.CustomerID != userID {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Not your order"})
+			return
+		}
 
-	response := PaymentResponse{
-		ClientSecret: pi.ClientSecret,
-		PaymentID:    pi.ID,
+		if paidPaymentStatuses[order.PaymentStatus] {
+			c.JSON(http.StatusConflict, gin.H{"error": "Order is already paid"})
+			return
+		}
+		if order.Status != models.OrderStatusPending && order.Status != models.OrderStatusPaymentFailed {
+			c.JSON(http.StatusConflict, gin.H{"error": "Order can no longer be paid"})
+			return
+		}
+
+		// Orders with catch-weight lines are only authorized now and captured
+		// once weighed
+		amount := order.TotalAmount
+		manualCapture := order.AuthorizedAmount != nil
+		if manualCapture {
+			amount = *order.AuthorizedAmount
+		}
+		if !amount.IsPositive() {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Order has nothing to pay"})
+			return
+		}
+
+		// Hand out the existing intent while the customer has not finished
+		// paying it, so retries never charge an order twice
+		if order.PaymentIntentID != "" {
+			pi, err := provider.GetIntent(ctx, order.PaymentIntentID)
+			switch {
+			case err == nil && reusableIntent(pi, amount):
+				c.JSON(http.StatusOK, PaymentResponse{
+					ClientSecret: pi.ClientSecret,
+					PaymentID:    pi.ID,
+					Amount:       pi.Amount,
+					Currency:     pi.Currency,
+				})
+				return
+			case err == nil && !pi.IsOpen() && pi.Status != payments.StatusCanceled:
+				c.JSON(http.StatusConflict, gin.H{"error": "Order already has a payment in progress"})
+				return
+			case err != nil && !errors.Is(err, payments.ErrIntentNotFound):
+				log.Printf("Failed to retrieve payment intent %s: %v", order.PaymentIntentID, err)
+				c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to retrieve existing payment"})
+				return
+			}
+		}
+
+		pi, err := provider.CreateIntent(ctx, payments.IntentParams{
+			Amount:   amount.Amount,
+			Currency: strings.ToLower(amount.Currency),
+			Metadata: map[string]string{
+				"order_id": req.OrderID,
+			},
+			ManualCapture: manualCapture,
+			// Concurrent requests for the same order get the same intent
+			IdempotencyKey: fmt.Sprintf("order-%s-%d-%s", req.OrderID, amount.Amount, order.PaymentIntentID),
+		})
+		if errors.Is(err, payments.ErrNotConfigured) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Stripe configuration missing"})
+			return
+		}
+		if err != nil {
+			log.Printf("Payment intent creation failed: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create payment intent"})
+			return
+		}
+
+		// Only attach the intent if nobody attached another one meanwhile
+		attached, err := paymentRecords.attachIntent(ctx, orderID, order.PaymentIntentID, pi.ID)
+		if err != nil {
+			log.Printf("Failed to update order with payment intent: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update order"})
+			return
+		}
+		if !attached {
+			current, err := paymentRecords.findOrder(ctx, orderID)
+			if err != nil || current.PaymentIntentID != pi.ID {
+				c.JSON(http.StatusConflict, gin.H{"error": "Order payment changed concurrently, please retry"})
+				return
+			}
+		}
+
+		if attached {
+			payment := models.Payment{
+				OrderID:         orderID,
+				UserID:          order.CustomerID,
+				Amount:          models.NewMoney(pi.Amount, pi.Currency),
+				AmountRefunded:  models.NewMoney(0, pi.Currency),
+				PaymentIntentID: pi.ID,
+				Status:          "pending",
+				PaymentMethod:   order.PaymentMethod,
+			}
+			if err := createPaymentRecord(ctx, &payment, "Payment intent created"); err != nil {
+				log.Printf("Failed to record payment for intent %s: %v", pi.ID, err)
+			}
+		}
+
+		c.JSON(http.StatusOK, PaymentResponse{
+			ClientSecret: pi.ClientSecret,
+			PaymentID:    pi.ID,
+			Amount:       pi.Amount,
+			Currency:     pi.Currency,
+		})
 	}
+}
 
-	c.JSON(http.StatusOK, response)
+func confirmPayment(provider payments.Provider) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			PaymentIntentID string `json:"payment_intent_id" binding:"required"`
+			OrderID         string `json:"order_id"`
+		}
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		// Retrieve payment intent from the provider
+		pi, err := provider.GetIntent(c, req.PaymentIntentID)
+		if errors.Is(err, payments.ErrIntentNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Payment not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve payment"})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		// The intent itself names its order; the client cannot redirect it
+		order, err := findOrderForIntent(ctx, pi.ID, pi.Metadata["order_id"])
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+			return
+		}
+		if req.OrderID != "" && req.OrderID != order.ID.Hex() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Payment does not belong to this order"})
+			return
+		}
+		if !canAccessOrderPayment(c, order) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Not your order"})
+			return
+		}
+
+		// Update payment and order status based on the payment intent status
+		var paymentStatus, orderStatus string
+		switch pi.Status {
+		case payments.StatusSucceeded:
+			paymentStatus = "completed"
+			orderStatus = models.OrderStatusConfirmed
+		case payments.StatusRequiresCapture:
+			paymentStatus = "authorized"
+			orderStatus = models.OrderStatusConfirmed
+		case payments.StatusProcessing:
+			paymentStatus = "processing"
+		case payments.StatusRequiresPaymentMethod:
+			paymentStatus = "failed"
+			orderStatus = models.OrderStatusPaymentFailed
+		default:
+			paymentStatus = "pending"
+		}
+
+		// Confirming again after a capture, refund or dispute changes nothing
+		if paymentStatusBehind(order.PaymentStatus, paymentStatus) {
+			c.JSON(http.StatusOK, gin.H{
+				"status":         pi.Status,
+				"payment_status": order.PaymentStatus,
+				"order_status":   order.Status,
+			})
+			return
+		}
+
+		err = applyPaymentOutcome(ctx, pi, paymentStatus, orderStatus, "Payment status "+pi.Status+" (confirm)")
+		if err != nil {
+			log.Printf("Failed to update order status: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update order"})
+			return
+		}
+
+		if orderStatus == "" {
+			orderStatus = models.OrderStatusPending
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":         pi.Status,
+			"payment_status": paymentStatus,
+			"order_status":   orderStatus,
+		})
+	}
 }
 
-func confirmPayment(c *gin.Context) {
-	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
-	
-	var req struct {
-		PaymentIntentID string `json:"payment_intent_id"`
-		OrderID         string `json:"order_id"`
+func getPaymentStatus(provider payments.Provider) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		paymentID := c.Param("payment_id")
+
+		pi, err := provider.GetIntent(c, paymentID)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Payment not found"})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		order, err := findOrderForIntent(ctx, pi.ID, pi.Metadata["order_id"])
+		if err != nil || !canAccessOrderPayment(c, order) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Payment not found"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"id":     pi.ID,
+			"status": pi.Status,
+			"amount": pi.Amount,
+		})
 	}
+}
 
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
+// canAccessOrderPayment reports whether the authenticated user may act on the
+// payment of an order: its customer and admins.
+func canAccessOrderPayment(c *gin.Context, order *models.Order) bool {
+	if c.GetString("role") == "admin" {
+		return true
 	}
+	userID, err := primitive.ObjectIDFromHex(c.GetString("userID"))
+	return err == nil && order.CustomerID == userID
+}
 
-	// Retrieve payment intent from Stripe
-	pi, err := paymentintent.Get(req.PaymentIntentID, nil)
+// getPaymentHistory returns the payment records of an order together with
+// their full status history, to whoever may read the order.
+func getPaymentHistory(c *gin.Context) {
+	orderID, err := primitive.ObjectIDFromHex(c.Param("orderId"))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve payment"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid order ID"})
 		return
 	}
 
-	// Update order status based on payment status
-	orderID, _ := primitive.ObjectIDFromHex(req.OrderID)
-	collection := config.GetCollection("orders")
-	
-	var paymentStatus, orderStatus string
-	switch pi.Status {
-	case stripe.PaymentIntentStatusSucceeded:
-		paymentStatus = "completed"
-		orderStatus = "confirmed"
-	case stripe.PaymentIntentStatusProcessing:
-		paymentStatus = "processing"
-		orderStatus = "pending"
-	case stripe.PaymentIntentStatusRequiresPaymentMethod:
-		paymentStatus = "failed"
-		orderStatus = "payment_failed"
-	default:
-		paymentStatus = "pending"
-		orderStatus = "pending"
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	order, err := paymentRecords.findOrder(ctx, orderID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+		return
 	}
 
-	update := gin.H{
-		"$set": gin.H{
-			"payment_status": paymentStatus,
-			"status":         orderStatus,
-			"updated_at":     primitive.NewDateTimeFromTime(primitive.DateTime(0).Time()),
-		},
+	if !canReadOrder(c, order) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Not allowed to view payment history"})
+		return
 	}
 
-	_, err = collection.UpdateOne(c, gin.H{"_id": orderID}, update)
+	payments, err := paymentRecords.findPayments(ctx, orderID)
 	if err != nil {
-		log.Printf("Failed to update order status: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update order"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch payments"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"status":         pi.Status,
-		"payment_status": paymentStatus,
-		"order_status":   orderStatus,
-	})
-}
+	var paymentIDs []primitive.ObjectID
+	for _, payment := range payments {
+		paymentIDs = append(paymentIDs, payment.ID)
+	}
 
-func getPaymentStatus(c *gin.Context) {
-	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
-	
-	paymentID := c.Param("payment_id")
-	
-	pi, err := paymentintent.Get(paymentID, nil)
+	history, err := findPaymentHistory(ctx, paymentIDs)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Payment not found"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch payment history"})
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"id":     pi.ID,
-		"status": pi.Status,
-		"amount": pi.Amount,
+		"orderId":  orderID,
+		"payments": payments,
+		"history":  history,
 	})
-}
\ No newline at end of file
+}
@@ -0,0 +1,307 @@
+package routes
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"farmer-marketplace/config"
+	"farmer-marketplace/models"
+)
+
+// The payments repository keeps one models.Payment per payment intent and an
+// append-only models.PaymentHistory trail of every status change.
+
+// paymentRecords persists the payment side of orders, payments, their history
+// and processed webhook events. It is a variable so that handler tests can run
+// without a database.
+var paymentRecords paymentStore = mongoPaymentStore{}
+
+type paymentStore interface {
+	findOrder(ctx context.Context, id primitive.ObjectID) (*models.Order, error)
+	findOrderByIntent(ctx context.Context, intentID string) (*models.Order, error)
+	// setOrderPayment sets payment fields such as paymentStatus on an order.
+	setOrderPayment(ctx context.Context, orderID primitive.ObjectID, set bson.M) error
+	// claimRefund adds (sign 1) or removes (sign -1) the refunded quantities
+	// and amounts of the planned lines of an order. Claims are guarded by the
+	// quantities the plan was computed from and fail with ErrStatusConflict
+	// when those changed.
+	claimRefund(ctx context.Context, order *models.Order, lines []refundLine, sign int) error
+	// attachIntent makes intentID the pending payment of an order whose
+	// payment intent is still previous, reporting whether it did.
+	attachIntent(ctx context.Context, orderID primitive.ObjectID, previous, intentID string) (bool, error)
+
+	// claimEvent records a webhook event, reporting false if it was
+	// recorded before.
+	claimEvent(ctx context.Context, event models.WebhookEvent) (bool, error)
+	releaseEvent(ctx context.Context, id string) error
+
+	insertPayment(ctx context.Context, payment *models.Payment) error
+	// upsertPayment sets fields on the payment for an intent, creating it if
+	// needed, and returns its previous status and the updated payment.
+	upsertPayment(ctx context.Context, intentID string, set bson.M) (string, *models.Payment, error)
+	// addRefund adds amount to the refunded amount of the payment for an
+	// intent and sets its status.
+	addRefund(ctx context.Context, intentID, status string, amount models.Money) (*models.Payment, error)
+	insertHistory(ctx context.Context, entry models.PaymentHistory) error
+	// findPayments returns the payments of an order, oldest first.
+	findPayments(ctx context.Context, orderID primitive.ObjectID) ([]models.Payment, error)
+	// findHistory returns the history entries of payments, oldest first.
+	findHistory(ctx context.Context, paymentIDs []primitive.ObjectID) ([]models.PaymentHistory, error)
+}
+
+// createPaymentRecord stores a new payment and its initial history entry.
+func createPaymentRecord(ctx context.Context, payment *models.Payment, message string) error {
+	now := time.Now()
+	if payment.ID.IsZero() {
+		payment.ID = primitive.NewObjectID()
+	}
+	payment.CreatedAt = now
+	payment.UpdatedAt = now
+
+	if err := paymentRecords.insertPayment(ctx, payment); err != nil {
+		return err
+	}
+
+	return appendPaymentHistory(ctx, payment.ID, payment.Status, message)
+}
+
+// setPaymentStatus updates the payment for an intent, creating it if it does
+// not exist yet, and appends a history entry whenever the status changes.
+func setPaymentStatus(ctx context.Context, intentID, status, message string, fields bson.M) (*models.Payment, error) {
+	set := bson.M{"status": status, "updated_at": time.Now()}
+	for key, value := range fields {
+		set[key] = value
+	}
+
+	previous, payment, err := paymentRecords.upsertPayment(ctx, intentID, set)
+	if err != nil {
+		return nil, err
+	}
+
+	if previous != status {
+		if err := appendPaymentHistory(ctx, payment.ID, status, message); err != nil {
+			return nil, err
+		}
+	}
+
+	return payment, nil
+}
+
+// recordRefund adds a refund to the payment for an intent and always appends
+// a history entry carrying the refund ID and amount.
+func recordRefund(ctx context.Context, intentID, status, refundID string, amount models.Money, message string) error {
+	payment, err := paymentRecords.addRefund(ctx, intentID, status, amount)
+	if err != nil {
+		return err
+	}
+
+	return paymentRecords.insertHistory(ctx, models.PaymentHistory{
+		ID:        primitive.NewObjectID(),
+		PaymentID: payment.ID,
+		Status:    status,
+		Message:   message,
+		Amount:    amount,
+		RefundID:  refundID,
+		CreatedAt: time.Now(),
+	})
+}
+
+func appendPaymentHistory(ctx context.Context, paymentID primitive.ObjectID, status, message string) error {
+	return paymentRecords.insertHistory(ctx, models.PaymentHistory{
+		ID:        primitive.NewObjectID(),
+		PaymentID: paymentID,
+		Status:    status,
+		Message:   message,
+		CreatedAt: time.Now(),
+	})
+}
+
+// findPaymentHistory returns the history entries of the given payments,
+// oldest first.
+func findPaymentHistory(ctx context.Context, paymentIDs []primitive.ObjectID) ([]models.PaymentHistory, error) {
+	if len(paymentIDs) == 0 {
+		return []models.PaymentHistory{}, nil
+	}
+	return paymentRecords.findHistory(ctx, paymentIDs)
+}
+
+// mongoPaymentStore keeps payments in the orders, payments, payment_history
+// and stripe_events collections.
+type mongoPaymentStore struct{}
+
+func (mongoPaymentStore) findOrder(ctx context.Context, id primitive.ObjectID) (*models.Order, error) {
+	var order models.Order
+	if err := config.GetCollection("orders").FindOne(ctx, bson.M{"_id": id}).Decode(&order); err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+func (mongoPaymentStore) findOrderByIntent(ctx context.Context, intentID string) (*models.Order, error) {
+	var order models.Order
+	if err := config.GetCollection("orders").FindOne(ctx, bson.M{"paymentIntentId": intentID}).Decode(&order); err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+func (mongoPaymentStore) setOrderPayment(ctx context.Context, orderID primitive.ObjectID, set bson.M) error {
+	_, err := config.GetCollection("orders").UpdateOne(ctx, bson.M{"_id": orderID}, bson.M{"$set": set})
+	return err
+}
+
+func (mongoPaymentStore) attachIntent(ctx context.Context, orderID primitive.ObjectID, previous, intentID string) (bool, error) {
+	result, err := config.GetCollection("orders").UpdateOne(ctx, bson.M{
+		"_id":             orderID,
+		"paymentIntentId": previous,
+	}, bson.M{
+		"$set": bson.M{
+			"paymentIntentId": intentID,
+			"paymentStatus":   "pending",
+		},
+	})
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount > 0, nil
+}
+
+func (mongoPaymentStore) claimRefund(ctx context.Context, order *models.Order, lines []refundLine, sign int) error {
+	filter := bson.M{"_id": order.ID}
+	inc := bson.M{}
+	var total int64
+
+	for _, line := range lines {
+		qtyKey := fmt.Sprintf("items.%d.refundedQuantity", line.Index)
+		amountKey := fmt.Sprintf("items.%d.refundedAmount.amount", line.Index)
+
+		if sign > 0 {
+			if current := order.Items[line.Index].RefundedQuantity; current == 0 {
+				filter[qtyKey] = bson.M{"$in": bson.A{0, nil}}
+			} else {
+				filter[qtyKey] = current
+			}
+		}
+
+		if v, ok := inc[qtyKey].(int); ok {
+			inc[qtyKey] = v + sign*line.Quantity
+			inc[amountKey] = inc[amountKey].(int64) + int64(sign)*line.Amount.Amount
+		} else {
+			inc[qtyKey] = sign * line.Quantity
+			inc[amountKey] = int64(sign) * line.Amount.Amount
+		}
+		total += line.Amount.Amount
+	}
+	inc["refundedAmount.amount"] = int64(sign) * total
+
+	result, err := config.GetCollection("orders").UpdateOne(ctx, filter, bson.M{"$inc": inc})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrStatusConflict
+	}
+	return nil
+}
+
+func (mongoPaymentStore) claimEvent(ctx context.Context, event models.WebhookEvent) (bool, error) {
+	_, err := config.GetCollection("stripe_events").InsertOne(ctx, event)
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (mongoPaymentStore) releaseEvent(ctx context.Context, id string) error {
+	_, err := config.GetCollection("stripe_events").DeleteOne(ctx, bson.M{"_id": id})
+	return err
+}
+
+func (mongoPaymentStore) insertPayment(ctx context.Context, payment *models.Payment) error {
+	_, err := config.GetCollection("payments").InsertOne(ctx, payment)
+	return err
+}
+
+func (mongoPaymentStore) upsertPayment(ctx context.Context, intentID string, set bson.M) (string, *models.Payment, error) {
+	collection := config.GetCollection("payments")
+	filter := bson.M{"payment_intent_id": intentID}
+	update := bson.M{
+		"$set":         set,
+		"$setOnInsert": bson.M{"created_at": set["updated_at"]},
+	}
+	opts := options.FindOneAndUpdate().
+		SetUpsert(true).
+		SetReturnDocument(options.Before)
+
+	var previous models.Payment
+	err := collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&previous)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return "", nil, err
+	}
+
+	var payment models.Payment
+	if err := collection.FindOne(ctx, filter).Decode(&payment); err != nil {
+		return "", nil, err
+	}
+	return previous.Status, &payment, nil
+}
+
+func (mongoPaymentStore) addRefund(ctx context.Context, intentID, status string, amount models.Money) (*models.Payment, error) {
+	var payment models.Payment
+	err := config.GetCollection("payments").FindOneAndUpdate(ctx,
+		bson.M{"payment_intent_id": intentID},
+		bson.M{
+			"$set": bson.M{
+				"status":                   status,
+				"amount_refunded.currency": amount.Currency,
+				"updated_at":               time.Now(),
+			},
+			"$inc": bson.M{"amount_refunded.amount": amount.Amount},
+		},
+	).Decode(&payment)
+	if err != nil {
+		return nil, err
+	}
+	return &payment, nil
+}
+
+func (mongoPaymentStore) insertHistory(ctx context.Context, entry models.PaymentHistory) error {
+	_, err := config.GetCollection("payment_history").InsertOne(ctx, entry)
+	return err
+}
+
+func (mongoPaymentStore) findPayments(ctx context.Context, orderID primitive.ObjectID) ([]models.Payment, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}})
+	cursor, err := config.GetCollection("payments").Find(ctx, bson.M{"order_id": orderID}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var payments []models.Payment
+	if err = cursor.All(ctx, &payments); err != nil {
+		return nil, err
+	}
+	return payments, nil
+}
+
+func (mongoPaymentStore) findHistory(ctx context.Context, paymentIDs []primitive.ObjectID) ([]models.PaymentHistory, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}})
+	cursor, err := config.GetCollection("payment_history").Find(ctx, bson.M{"payment_id": bson.M{"$in": paymentIDs}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	history := []models.PaymentHistory{}
+	if err = cursor.All(ctx, &history); err != nil {
+		return nil, err
+	}
+	return history, nil
+}
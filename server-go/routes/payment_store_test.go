@@ -0,0 +1,251 @@
+package routes
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"farmer-marketplace/models"
+)
+
+// fakePaymentStore keeps orders, payments and their history in memory.
+type fakePaymentStore struct {
+	orders   map[primitive.ObjectID]*models.Order
+	payments map[string]*models.Payment // by payment intent
+	history  []models.PaymentHistory
+	events   map[string]bool
+}
+
+// useFakePayments swaps the payment store and order saving for an in-memory
+// store holding orders.
+func useFakePayments(t *testing.T, orders ...*models.Order) *fakePaymentStore {
+	t.Helper()
+	fake := &fakePaymentStore{
+		orders:   make(map[primitive.ObjectID]*models.Order),
+		payments: make(map[string]*models.Payment),
+		events:   make(map[string]bool),
+	}
+	for _, order := range orders {
+		fake.orders[order.ID] = order
+	}
+
+	originalStore, originalSave := paymentRecords, saveOrderChanges
+	paymentRecords, saveOrderChanges = fake, fake.saveOrderChanges
+	t.Cleanup(func() { paymentRecords, saveOrderChanges = originalStore, originalSave })
+	return fake
+}
+
+// applySet applies the top level fields of a $set to a document.
+func applySet(doc interface{}, set bson.M) {
+	raw, _ := bson.Marshal(doc)
+	fields := bson.M{}
+	_ = bson.Unmarshal(raw, &fields)
+	for key, value := range set {
+		if !strings.Contains(key, ".") {
+			fields[key] = value
+		}
+	}
+	raw, _ = bson.Marshal(fields)
+	_ = bson.Unmarshal(raw, doc)
+}
+
+// historyOf returns the statuses a payment went through.
+func (s *fakePaymentStore) historyOf(paymentID primitive.ObjectID) []string {
+	var statuses []string
+	for _, entry := range s.history {
+		if entry.PaymentID == paymentID {
+			statuses = append(statuses, entry.Status)
+		}
+	}
+	return statuses
+}
+
+func (s *fakePaymentStore) saveOrderChanges(ctx context.Context, order *models.Order, set, push bson.M) error {
+	stored := s.orders[order.ID]
+	if stored == nil || !stored.UpdatedAt.Equal(order.UpdatedAt) {
+		return ErrStatusConflict
+	}
+	applySet(stored, set)
+	if change, ok := push["statusHistory"].(models.OrderStatusChange); ok {
+		stored.StatusHistory = append(stored.StatusHistory, change)
+	}
+	stored.Fulfillments = append([]models.Fulfillment(nil), order.Fulfillments...)
+
+	now := time.Now().Truncate(time.Millisecond)
+	stored.UpdatedAt, order.UpdatedAt = now, now
+	return nil
+}
+
+func (s *fakePaymentStore) findOrder(ctx context.Context, id primitive.ObjectID) (*models.Order, error) {
+	stored, ok := s.orders[id]
+	if !ok {
+		return nil, mongo.ErrNoDocuments
+	}
+	order := *stored
+	order.Items = append([]models.OrderItem(nil), stored.Items...)
+	order.Fulfillments = append([]models.Fulfillment(nil), stored.Fulfillments...)
+	order.StatusHistory = append([]models.OrderStatusChange(nil), stored.StatusHistory...)
+	return &order, nil
+}
+
+func (s *fakePaymentStore) findOrderByIntent(ctx context.Context, intentID string) (*models.Order, error) {
+	for id, order := range s.orders {
+		if order.PaymentIntentID == intentID {
+			return s.findOrder(ctx, id)
+		}
+	}
+	return nil, mongo.ErrNoDocuments
+}
+
+func (s *fakePaymentStore) setOrderPayment(ctx context.Context, orderID primitive.ObjectID, set bson.M) error {
+	if order, ok := s.orders[orderID]; ok {
+		applySet(order, set)
+	}
+	return nil
+}
+
+func (s *fakePaymentStore) claimRefund(ctx context.Context, order *models.Order, lines []refundLine, sign int) error {
+	stored := s.orders[order.ID]
+	if stored == nil {
+		return ErrStatusConflict
+	}
+	for _, line := range lines {
+		if sign > 0 && stored.Items[line.Index].RefundedQuantity != order.Items[line.Index].RefundedQuantity {
+			return ErrStatusConflict
+		}
+	}
+	for _, line := range lines {
+		item := &stored.Items[line.Index]
+		item.RefundedQuantity += sign * line.Quantity
+		item.RefundedAmount = models.NewMoney(item.RefundedAmount.Amount+int64(sign)*line.Amount.Amount, line.Amount.Currency)
+		stored.RefundedAmount = models.NewMoney(stored.RefundedAmount.Amount+int64(sign)*line.Amount.Amount, line.Amount.Currency)
+	}
+	return nil
+}
+
+func (s *fakePaymentStore) attachIntent(ctx context.Context, orderID primitive.ObjectID, previous, intentID string) (bool, error) {
+	order, ok := s.orders[orderID]
+	if !ok || order.PaymentIntentID != previous {
+		return false, nil
+	}
+	order.PaymentIntentID = intentID
+	order.PaymentStatus = "pending"
+	return true, nil
+}
+
+func (s *fakePaymentStore) claimEvent(ctx context.Context, event models.WebhookEvent) (bool, error) {
+	if s.events[event.ID] {
+		return false, nil
+	}
+	s.events[event.ID] = true
+	return true, nil
+}
+
+func (s *fakePaymentStore) releaseEvent(ctx context.Context, id string) error {
+	delete(s.events, id)
+	return nil
+}
+
+func (s *fakePaymentStore) insertPayment(ctx context.Context, payment *models.Payment) error {
+	stored := *payment
+	s.payments[payment.PaymentIntentID] = &stored
+	return nil
+}
+
+func (s *fakePaymentStore) upsertPayment(ctx context.Context, intentID string, set bson.M) (string, *models.Payment, error) {
+	payment, ok := s.payments[intentID]
+	if !ok {
+		payment = &models.Payment{ID: primitive.NewObjectID(), PaymentIntentID: intentID, CreatedAt: time.Now()}
+		s.payments[intentID] = payment
+	}
+	previous := payment.Status
+	applySet(payment, set)
+	updated := *payment
+	return previous, &updated, nil
+}
+
+func (s *fakePaymentStore) addRefund(ctx context.Context, intentID, status string, amount models.Money) (*models.Payment, error) {
+	payment, ok := s.payments[intentID]
+	if !ok {
+		return nil, mongo.ErrNoDocuments
+	}
+	payment.Status = status
+	payment.AmountRefunded = models.NewMoney(payment.AmountRefunded.Amount+amount.Amount, amount.Currency)
+	updated := *payment
+	return &updated, nil
+}
+
+func (s *fakePaymentStore) insertHistory(ctx context.Context, entry models.PaymentHistory) error {
+	s.history = append(s.history, entry)
+	return nil
+}
+
+func (s *fakePaymentStore) findPayments(ctx context.Context, orderID primitive.ObjectID) ([]models.Payment, error) {
+	var payments []models.Payment
+	for _, payment := range s.payments {
+		if payment.OrderID == orderID {
+			payments = append(payments, *payment)
+		}
+	}
+	sort.Slice(payments, func(i, j int) bool { return payments[i].CreatedAt.Before(payments[j].CreatedAt) })
+	return payments, nil
+}
+
+func (s *fakePaymentStore) findHistory(ctx context.Context, paymentIDs []primitive.ObjectID) ([]models.PaymentHistory, error) {
+	history := []models.PaymentHistory{}
+	for _, entry := range s.history {
+		for _, id := range paymentIDs {
+			if entry.PaymentID == id {
+				history = append(history, entry)
+			}
+		}
+	}
+	return history, nil
+}
+
+func TestSetPaymentStatus(t *testing.T) {
+	ctx := context.Background()
+	fake := useFakePayments(t)
+	orderID := primitive.NewObjectID()
+
+	// The first status creates the payment
+	payment, err := setPaymentStatus(ctx, "pi_1", "processing", "Processing", bson.M{
+		"order_id": orderID,
+		"amount":   models.NewMoney(2500, "USD"),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, orderID, payment.OrderID)
+	assert.Equal(t, models.NewMoney(2500, "USD"), payment.Amount)
+	assert.Equal(t, "processing", payment.Status)
+
+	// Repeating a status updates the payment without a history entry
+	payment, err = setPaymentStatus(ctx, "pi_1", "processing", "Processing again", bson.M{"stripe_charge_id": "ch_1"})
+	require.NoError(t, err)
+	assert.Equal(t, "ch_1", payment.StripeChargeID)
+	assert.Equal(t, []string{"processing"}, fake.historyOf(payment.ID))
+
+	_, err = setPaymentStatus(ctx, "pi_1", "completed", "Payment succeeded", nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"processing", "completed"}, fake.historyOf(payment.ID))
+	assert.Len(t, fake.payments, 1)
+
+	// Every refund is recorded, with its ID and amount
+	for _, id := range []string{"re_1", "re_2"} {
+		require.NoError(t, recordRefund(ctx, "pi_1", "partially_refunded", id, models.NewMoney(500, "USD"), "Refunded"))
+	}
+	assert.Equal(t, models.NewMoney(1000, "USD"), fake.payments["pi_1"].AmountRefunded)
+	assert.Equal(t, []string{"processing", "completed", "partially_refunded", "partially_refunded"}, fake.historyOf(payment.ID))
+	last := fake.history[len(fake.history)-1]
+	assert.Equal(t, "re_2", last.RefundID)
+	assert.Equal(t, models.NewMoney(500, "USD"), last.Amount)
+
+	assert.Error(t, recordRefund(ctx, "pi_unknown", "refunded", "re_3", models.NewMoney(500, "USD"), "Refunded"))
+}
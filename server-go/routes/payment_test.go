@@ -2,6 +2,7 @@ package routes
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
@@ -9,48 +10,44 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"farmer-marketplace/models"
+	"farmer-marketplace/payments"
 )
 
 func TestCreatePaymentIntent(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 	
-	// Set up test environment variables
-	t.Setenv("STRIPE_SECRET_KEY", "sk_test_123")
-	
+	provider := payments.NewFakeProvider()
 	router := gin.New()
 	api := router.Group("/api")
-	SetupPaymentRoutes(api)
+	SetupPaymentRoutes(api, provider)
+
+	token := testAccessToken(t, "507f1f77bcf86cd799439012", "customer")
 
 	tests := []struct {
 		name           string
-		payload        PaymentRequest
+		payload        map[string]interface{}
+		token          string
 		expectedStatus int
-		setupMock      func()
 	}{
 		{
-			name: "Valid payment request",
-			payload: PaymentRequest{
-				Amount:   2500,
-				Currency: "usd",
-				OrderID:  "507f1f77bcf86cd799439011",
-			},
-			expectedStatus: http.StatusOK,
+			name:           "Unauthenticated request",
+			payload:        map[string]interface{}{"order_id": "507f1f77bcf86cd799439011"},
+			expectedStatus: http.StatusUnauthorized,
 		},
 		{
-			name: "Invalid order ID",
-			payload: PaymentRequest{
-				Amount:   2500,
-				Currency: "usd",
-				OrderID:  "invalid-id",
-			},
+			name:           "Invalid order ID",
+			payload:        map[string]interface{}{"order_id": "invalid-id"},
+			token:          token,
 			expectedStatus: http.StatusBadRequest,
 		},
 		{
-			name: "Missing amount",
-			payload: PaymentRequest{
-				Currency: "usd",
-				OrderID:  "507f1f77bcf86cd799439011",
-			},
+			name:           "Missing order ID",
+			payload:        map[string]interface{}{"amount": 2500, "currency": "usd"},
+			token:          token,
 			expectedStatus: http.StatusBadRequest,
 		},
 	}
@@ -60,7 +57,9 @@ func TestCreatePaymentIntent(t *testing.T) {
 			jsonPayload, _ := json.Marshal(tt.payload)
 			req, _ := http.NewRequest("POST", "/api/payment/create-intent", bytes.NewBuffer(jsonPayload))
 			req.Header.Set("Content-Type", "application/json")
-			req.Header.Set("Authorization", "Bearer test-token")
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
 
 			w := httptest.NewRecorder()
 			router.ServeHTTP(w, req)
@@ -68,16 +67,51 @@ func TestCreatePaymentIntent(t *testing.T) {
 			assert.Equal(t, tt.expectedStatus, w.Code)
 		})
 	}
+
+	t.Run("Creates an intent for the order total", func(t *testing.T) {
+		customerID, _ := primitive.ObjectIDFromHex("507f1f77bcf86cd799439012")
+		order := &models.Order{
+			ID:          primitive.NewObjectID(),
+			CustomerID:  customerID,
+			Status:      models.OrderStatusPending,
+			TotalAmount: models.NewMoney(2500, "USD"),
+		}
+		fake := useFakePayments(t, order)
+
+		jsonPayload, _ := json.Marshal(map[string]string{"order_id": order.ID.Hex()})
+		req, _ := http.NewRequest("POST", "/api/payment/create-intent", bytes.NewBuffer(jsonPayload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		require.Equal(t, http.StatusOK, w.Code)
+		var resp PaymentResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		pi, err := provider.GetIntent(context.Background(), resp.PaymentID)
+		require.NoError(t, err)
+		assert.Equal(t, pi.ClientSecret, resp.ClientSecret)
+		assert.NotEmpty(t, resp.ClientSecret)
+		assert.Equal(t, order.ID.Hex(), pi.Metadata["order_id"])
+		assert.Equal(t, int64(2500), resp.Amount)
+		assert.Equal(t, "usd", resp.Currency)
+
+		assert.Equal(t, resp.PaymentID, order.PaymentIntentID)
+		assert.Equal(t, "pending", order.PaymentStatus)
+		require.Contains(t, fake.payments, resp.PaymentID)
+		assert.Equal(t, order.TotalAmount, fake.payments[resp.PaymentID].Amount)
+	})
 }
 
 func TestConfirmPayment(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 	
-	t.Setenv("STRIPE_SECRET_KEY", "sk_test_123")
-	
 	router := gin.New()
 	api := router.Group("/api")
-	SetupPaymentRoutes(api)
+	SetupPaymentRoutes(api, payments.NewFakeProvider())
+
+	token := testAccessToken(t, "507f1f77bcf86cd799439012", "customer")
 
 	payload := map[string]string{
 		"payment_intent_id": "pi_test_123",
@@ -87,23 +121,62 @@ func TestConfirmPayment(t *testing.T) {
 	jsonPayload, _ := json.Marshal(payload)
 	req, _ := http.NewRequest("POST", "/api/payment/confirm", bytes.NewBuffer(jsonPayload))
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer test-token")
+	req.Header.Set("Authorization", "Bearer "+token)
 
 	w := httptest.NewRecorder()
 	router.ServeHTTP(w, req)
 
-	// Should return error in test environment due to invalid Stripe key
-	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	// The provider does not know this payment intent
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestConfirmRefundedPayment(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	provider := payments.NewFakeProvider()
+	router := gin.New()
+	SetupPaymentRoutes(router.Group("/api"), provider)
+
+	customerID := primitive.NewObjectID()
+	pi, err := provider.CreateIntent(context.Background(), payments.IntentParams{Amount: 2500, Currency: "usd"})
+	require.NoError(t, err)
+	require.NoError(t, provider.SetIntentStatus(pi.ID, payments.StatusSucceeded))
+
+	order := &models.Order{
+		ID:              primitive.NewObjectID(),
+		CustomerID:      customerID,
+		Status:          models.OrderStatusRefunded,
+		PaymentStatus:   "refunded",
+		PaymentIntentID: pi.ID,
+		TotalAmount:     models.NewMoney(2500, "USD"),
+	}
+	fake := useFakePayments(t, order)
+	payment := &models.Payment{OrderID: order.ID, PaymentIntentID: pi.ID, Amount: order.TotalAmount, Status: "refunded"}
+	require.NoError(t, createPaymentRecord(context.Background(), payment, "Refunded"))
+
+	body, _ := json.Marshal(map[string]string{"payment_intent_id": pi.ID})
+	req, _ := http.NewRequest("POST", "/api/payment/confirm", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+testAccessToken(t, customerID.Hex(), "customer"))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	// The intent still reads succeeded, but the refund stands
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"payment_status":"refunded"`)
+	assert.Equal(t, "refunded", order.PaymentStatus)
+	assert.Equal(t, models.OrderStatusRefunded, order.Status)
+	assert.Equal(t, "refunded", fake.payments[pi.ID].Status)
+	assert.Equal(t, []string{"refunded"}, fake.historyOf(payment.ID))
 }
 
 func TestGetPaymentStatus(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 	
-	t.Setenv("STRIPE_SECRET_KEY", "sk_test_123")
-	
 	router := gin.New()
 	api := router.Group("/api")
-	SetupPaymentRoutes(api)
+	SetupPaymentRoutes(api, payments.NewFakeProvider())
 
 	req, _ := http.NewRequest("GET", "/api/payment/status/pi_test_123", nil)
 	req.Header.Set("Authorization", "Bearer test-token")
@@ -111,69 +184,268 @@ func TestGetPaymentStatus(t *testing.T) {
 	w := httptest.NewRecorder()
 	router.ServeHTTP(w, req)
 
+	// Payment routes require a valid token
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	token := testAccessToken(t, "507f1f77bcf86cd799439012", "customer")
+
+	req, _ = http.NewRequest("GET", "/api/payment/status/pi_test_123", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
 	// Should return error in test environment due to invalid payment ID
 	assert.Equal(t, http.StatusNotFound, w.Code)
 }
 
-func TestPaymentRequestValidation(t *testing.T) {
-	tests := []struct {
-		name    string
-		request PaymentRequest
-		valid   bool
-	}{
-		{
-			name: "Valid request",
-			request: PaymentRequest{
-				Amount:   1000,
-				Currency: "usd",
-				OrderID:  "507f1f77bcf86cd799439011",
-			},
-			valid: true,
-		},
-		{
-			name: "Zero amount",
-			request: PaymentRequest{
-				Amount:   0,
-				Currency: "usd",
-				OrderID:  "507f1f77bcf86cd799439011",
-			},
-			valid: false,
-		},
-		{
-			name: "Negative amount",
-			request: PaymentRequest{
-				Amount:   -100,
-				Currency: "usd",
-				OrderID:  "507f1f77bcf86cd799439011",
-			},
-			valid: false,
-		},
-		{
-			name: "Empty currency",
-			request: PaymentRequest{
-				Amount:   1000,
-				Currency: "",
-				OrderID:  "507f1f77bcf86cd799439011",
-			},
-			valid: false,
-		},
-		{
-			name: "Empty order ID",
-			request: PaymentRequest{
-				Amount:   1000,
-				Currency: "usd",
-				OrderID:  "",
-			},
-			valid: false,
-		},
+func TestGetPaymentHistory(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	SetupPaymentRoutes(router.Group("/api"), payments.NewFakeProvider())
+
+	customerID := primitive.NewObjectID()
+	farmID, otherFarmID := primitive.NewObjectID(), primitive.NewObjectID()
+	order := &models.Order{
+		ID:         primitive.NewObjectID(),
+		CustomerID: customerID,
+		Items:      []models.OrderItem{{ProductID: primitive.NewObjectID(), Quantity: 1, FarmID: farmID}},
 	}
+	fake := useFakePayments(t, order)
+	require.NoError(t, createPaymentRecord(context.Background(), &models.Payment{
+		OrderID:         order.ID,
+		PaymentIntentID: "pi_1",
+		Status:          "pending",
+	}, "Payment intent created"))
+	_, err := setPaymentStatus(context.Background(), "pi_1", "completed", "Payment succeeded", nil)
+	require.NoError(t, err)
 
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			valid := tt.request.Amount > 0 && 
-					tt.request.Currency != "" && 
-					tt.request.OrderID != ""
-			assert.Equal(t, tt.valid, valid)
-		})
+	request := func(orderID, userID, role string, member *models.FarmMember) *httptest.ResponseRecorder {
+		token := testAccessToken(t, userID, role)
+		loadFarmMembership = func(ctx context.Context, userID string) (*models.FarmMember, error) {
+			return member, nil
+		}
+
+		req, _ := http.NewRequest("GET", "/api/payment/history/"+orderID, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("Customer sees the history of their order", func(t *testing.T) {
+		w := request(order.ID.Hex(), customerID.Hex(), models.RoleCustomer, nil)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var resp struct {
+			Payments []models.Payment        `json:"payments"`
+			History  []models.PaymentHistory `json:"history"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		require.Len(t, resp.Payments, 1)
+		assert.Equal(t, "completed", resp.Payments[0].Status)
+		require.Len(t, resp.History, 2)
+		assert.Equal(t, "pending", resp.History[0].Status)
+		assert.Equal(t, "completed", resp.History[1].Status)
+	})
+
+	t.Run("Farm members see orders with their farm's lines", func(t *testing.T) {
+		member := &models.FarmMember{FarmID: farmID, Role: models.FarmRolePacker}
+		assert.Equal(t, http.StatusOK, request(order.ID.Hex(), primitive.NewObjectID().Hex(), models.RoleStaff, member).Code)
+
+		other := &models.FarmMember{FarmID: otherFarmID, Role: models.FarmRoleOwner}
+		assert.Equal(t, http.StatusForbidden, request(order.ID.Hex(), primitive.NewObjectID().Hex(), models.RoleFarmer, other).Code)
+
+		// A member narrowed to no order permissions sees nothing
+		narrowed := &models.FarmMember{FarmID: farmID, Role: models.FarmRolePacker, Permissions: []string{}}
+		assert.Equal(t, http.StatusForbidden, request(order.ID.Hex(), primitive.NewObjectID().Hex(), models.RoleStaff, narrowed).Code)
+	})
+
+	t.Run("Others are turned away", func(t *testing.T) {
+		assert.Equal(t, http.StatusForbidden, request(order.ID.Hex(), primitive.NewObjectID().Hex(), models.RoleCustomer, nil).Code)
+		assert.Equal(t, http.StatusOK, request(order.ID.Hex(), primitive.NewObjectID().Hex(), models.RoleAdmin, nil).Code)
+		assert.Equal(t, http.StatusNotFound, request(primitive.NewObjectID().Hex(), customerID.Hex(), models.RoleCustomer, nil).Code)
+		assert.Equal(t, http.StatusBadRequest, request("not-an-id", customerID.Hex(), models.RoleCustomer, nil).Code)
+	})
+
+	assert.Len(t, fake.history, 2, "reading the history changes nothing")
+}
+
+func TestReusableIntent(t *testing.T) {
+	open := &payments.Intent{Amount: 2500, Currency: "usd", Status: payments.StatusRequiresPaymentMethod}
+	assert.True(t, reusableIntent(open, models.NewMoney(2500, "USD")))
+	assert.False(t, reusableIntent(open, models.NewMoney(3000, "USD")), "order total changed")
+	assert.False(t, reusableIntent(open, models.NewMoney(2500, "EUR")))
+
+	paid := &payments.Intent{Amount: 2500, Currency: "usd", Status: payments.StatusSucceeded}
+	assert.False(t, reusableIntent(paid, models.NewMoney(2500, "USD")))
+}
+
+func TestPaymentWebhookSignature(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	provider := payments.NewFakeProvider()
+	router := gin.New()
+	api := router.Group("/api")
+	SetupPaymentRoutes(api, provider)
+
+	payload, signature := provider.SignedEvent(payments.Event{
+		ID:     "evt_test_123",
+		Type:   payments.EventIntentSucceeded,
+		Intent: &payments.Intent{ID: "pi_test_123", Status: payments.StatusSucceeded},
+	})
+
+	t.Run("Rejects invalid signature", func(t *testing.T) {
+		req, _ := http.NewRequest("POST", "/api/payment/webhook", bytes.NewBuffer(payload))
+		req.Header.Set("Stripe-Signature", "t=1,v1=deadbeef")
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("Rejects tampered payload", func(t *testing.T) {
+		req, _ := http.NewRequest("POST", "/api/payment/webhook", bytes.NewBuffer(append(payload, ' ')))
+		req.Header.Set("Stripe-Signature", signature)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("Accepts valid signature once", func(t *testing.T) {
+		order := &models.Order{
+			ID:              primitive.NewObjectID(),
+			CustomerID:      primitive.NewObjectID(),
+			Status:          models.OrderStatusPending,
+			PaymentStatus:   "pending",
+			PaymentIntentID: "pi_test_123",
+			TotalAmount:     models.NewMoney(2500, "USD"),
+		}
+		fake := useFakePayments(t, order)
+		payment := &models.Payment{OrderID: order.ID, PaymentIntentID: "pi_test_123", Amount: order.TotalAmount, Status: "pending"}
+		require.NoError(t, createPaymentRecord(context.Background(), payment, "Payment intent created"))
+
+		deliver := func() *httptest.ResponseRecorder {
+			req, _ := http.NewRequest("POST", "/api/payment/webhook", bytes.NewBuffer(payload))
+			req.Header.Set("Stripe-Signature", signature)
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			return w
+		}
+
+		w := deliver()
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{"received": true}`, w.Body.String())
+		assert.True(t, fake.events["evt_test_123"])
+		assert.Equal(t, models.OrderStatusConfirmed, order.Status)
+		assert.Equal(t, "completed", order.PaymentStatus)
+		assert.Equal(t, "completed", fake.payments["pi_test_123"].Status)
+
+		// A redelivery is acknowledged without being applied again, which
+		// would complete the payment once more
+		order.PaymentStatus = "pending"
+		w = deliver()
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{"received": true, "duplicate": true}`, w.Body.String())
+		assert.Equal(t, "pending", order.PaymentStatus)
+		assert.Len(t, order.StatusHistory, 1)
+		assert.Equal(t, []string{"pending", "completed"}, fake.historyOf(payment.ID))
+	})
+}
+
+// postEvent delivers a signed webhook event through the router.
+func postEvent(router *gin.Engine, provider *payments.FakeProvider, event payments.Event) *httptest.ResponseRecorder {
+	payload, signature := provider.SignedEvent(event)
+	req, _ := http.NewRequest("POST", "/api/payment/webhook", bytes.NewBuffer(payload))
+	req.Header.Set("Stripe-Signature", signature)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestPaymentWebhookOutOfOrder(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	provider := payments.NewFakeProvider()
+	router := gin.New()
+	SetupPaymentRoutes(router.Group("/api"), provider)
+
+	order := &models.Order{
+		ID:              primitive.NewObjectID(),
+		CustomerID:      primitive.NewObjectID(),
+		Status:          models.OrderStatusConfirmed,
+		PaymentStatus:   "completed",
+		PaymentIntentID: "pi_test_1",
+		TotalAmount:     models.NewMoney(2500, "USD"),
+	}
+	fake := useFakePayments(t, order)
+	require.NoError(t, createPaymentRecord(context.Background(), &models.Payment{
+		OrderID:         order.ID,
+		PaymentIntentID: "pi_test_1",
+		Amount:          order.TotalAmount,
+		Status:          "completed",
+	}, "Payment succeeded"))
+
+	w := postEvent(router, provider, payments.Event{
+		ID:     "evt_refund",
+		Type:   payments.EventChargeRefunded,
+		Charge: &payments.Charge{ID: "ch_1", IntentID: "pi_test_1", Amount: 2500, AmountRefunded: 2500, Refunded: true},
+	})
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, models.OrderStatusRefunded, order.Status)
+	assert.Equal(t, "refunded", order.PaymentStatus)
+
+	// Events about the payment itself that arrive after the refund change nothing
+	late := []payments.Event{
+		{ID: "evt_succeeded", Type: payments.EventIntentSucceeded, Intent: &payments.Intent{ID: "pi_test_1", Amount: 2500, Currency: "usd", Status: payments.StatusSucceeded}},
+		{ID: "evt_authorized", Type: payments.EventIntentAuthorized, Intent: &payments.Intent{ID: "pi_test_1", Amount: 2500, Currency: "usd", Status: payments.StatusRequiresCapture}},
+		{ID: "evt_failed", Type: payments.EventIntentFailed, Intent: &payments.Intent{ID: "pi_test_1", Amount: 2500, Currency: "usd", Status: payments.StatusRequiresPaymentMethod}},
 	}
-}
\ No newline at end of file
+	for _, event := range late {
+		w := postEvent(router, provider, event)
+		assert.Equal(t, http.StatusOK, w.Code, event.Type)
+	}
+	assert.Equal(t, models.OrderStatusRefunded, order.Status)
+	assert.Equal(t, "refunded", order.PaymentStatus)
+	payment := fake.payments["pi_test_1"]
+	assert.Equal(t, "refunded", payment.Status)
+	assert.Equal(t, []string{"completed", "refunded"}, fake.historyOf(payment.ID))
+
+	// A partial refund reported late does not undo the full one either
+	w = postEvent(router, provider, payments.Event{
+		ID:     "evt_partial_refund",
+		Type:   payments.EventChargeRefunded,
+		Charge: &payments.Charge{ID: "ch_1", IntentID: "pi_test_1", Amount: 2500, AmountRefunded: 1000},
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "refunded", order.PaymentStatus)
+}
+
+func TestPaymentStatusBehind(t *testing.T) {
+	assert.True(t, paymentStatusBehind("completed", "authorized"))
+	assert.True(t, paymentStatusBehind("disputed", "completed"))
+	assert.True(t, paymentStatusBehind("partially_refunded", "failed"))
+	assert.False(t, paymentStatusBehind("failed", "completed"), "a retried payment goes through")
+	assert.False(t, paymentStatusBehind("failed", "pending"))
+	assert.False(t, paymentStatusBehind("refunded", "disputed"))
+	assert.False(t, paymentStatusBehind("", "pending"))
+}
+
+func TestChargeRefundStatus(t *testing.T) {
+	paymentStatus, orderStatus := chargeRefundStatus(&payments.Charge{Amount: 2500, AmountRefunded: 1000})
+	assert.Equal(t, "partially_refunded", paymentStatus)
+	assert.Equal(t, models.OrderStatusPartiallyRefunded, orderStatus)
+
+	paymentStatus, orderStatus = chargeRefundStatus(&payments.Charge{Amount: 2500, AmountRefunded: 2500, Refunded: true})
+	assert.Equal(t, "refunded", paymentStatus)
+	assert.Equal(t, models.OrderStatusRefunded, orderStatus)
+
+	// Refunds from the dashboard move delivered orders too
+	assert.NoError(t, checkOrderTransition(models.OrderStatusDelivered, orderStatus, roleSystem))
+}
@@ -0,0 +1,254 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"farmer-marketplace/models"
+	"farmer-marketplace/payments"
+)
+
+// maxWebhookBodyBytes mirrors the limit recommended by Stripe for event payloads.
+const maxWebhookBodyBytes = 65536
+
+func paymentWebhook(provider payments.Provider) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxWebhookBodyBytes)
+		payload, err := c.GetRawData()
+		if err != nil {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Failed to read request body"})
+			return
+		}
+
+		event, err := provider.VerifyWebhook(payload, c.GetHeader("Stripe-Signature"))
+		if errors.Is(err, payments.ErrNotConfigured) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Stripe webhook configuration missing"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook signature"})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		// Claim the event first so that redeliveries become no-ops
+		claimed, err := paymentRecords.claimEvent(ctx, models.WebhookEvent{
+			ID:         event.ID,
+			Type:       event.Type,
+			ReceivedAt: time.Now(),
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record event"})
+			return
+		}
+		if !claimed {
+			c.JSON(http.StatusOK, gin.H{"received": true, "duplicate": true})
+			return
+		}
+
+		if err := handlePaymentEvent(ctx, event); err != nil {
+			log.Printf("Failed to process payment event %s (%s): %v", event.ID, event.Type, err)
+			// Release the claim so the provider's retry gets processed
+			if delErr := paymentRecords.releaseEvent(ctx, event.ID); delErr != nil {
+				log.Printf("Failed to release payment event %s: %v", event.ID, delErr)
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process event"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"received": true})
+	}
+}
+
+func handlePaymentEvent(ctx context.Context, event *payments.Event) error {
+	switch event.Type {
+	case payments.EventIntentSucceeded, payments.EventIntentAuthorized, payments.EventIntentFailed:
+		if event.Intent == nil {
+			return errors.New("event has no payment intent")
+		}
+		switch event.Type {
+		case payments.EventIntentSucceeded:
+			return applyPaymentOutcome(ctx, event.Intent, "completed", models.OrderStatusConfirmed, "Payment succeeded (webhook)")
+		case payments.EventIntentAuthorized:
+			return applyPaymentOutcome(ctx, event.Intent, "authorized", models.OrderStatusConfirmed, "Payment authorized (webhook)")
+		}
+		return applyPaymentOutcome(ctx, event.Intent, "failed", models.OrderStatusPaymentFailed, paymentFailureMessage(event.Intent))
+
+	case payments.EventChargeRefunded:
+		charge := event.Charge
+		if charge == nil {
+			return errors.New("event has no charge")
+		}
+		paymentStatus, orderStatus := chargeRefundStatus(charge)
+		return applyChargeStatus(ctx, charge.IntentID, charge.ID, paymentStatus, orderStatus, "Charge refunded (webhook)")
+
+	case payments.EventDisputeCreated:
+		dispute := event.Dispute
+		if dispute == nil {
+			return errors.New("event has no dispute")
+		}
+		return applyChargeStatus(ctx, dispute.IntentID, dispute.ChargeID, "disputed", "", "Dispute opened: "+dispute.Reason)
+	}
+
+	// Other event types are acknowledged but ignored
+	return nil
+}
+
+// paymentStatusRanks orders the payment statuses by how far a payment has
+// got. Pending and failed rank alike, as a failed payment can be retried.
+// Refunds and disputes rank alike too, as either can follow the other.
+var paymentStatusRanks = map[string]int{
+	"pending":            1,
+	"failed":             1,
+	"processing":         2,
+	"authorized":         3,
+	"capturing":          4,
+	"completed":          5,
+	"partially_refunded": 6,
+	"refunded":           7,
+	"disputed":           7,
+}
+
+// paymentStatusBehind reports whether moving a payment from current to next
+// would take it back, as late or out of order provider events would, e.g. a
+// payment_intent.succeeded delivered after charge.refunded.
+func paymentStatusBehind(current, next string) bool {
+	return paymentStatusRanks[next] < paymentStatusRanks[current]
+}
+
+// applyPaymentOutcome records the state of a payment intent on the payment
+// record and, if orderStatus is set, moves the order through the status state
+// machine. Outcomes behind the order's payment status are ignored.
+func applyPaymentOutcome(ctx context.Context, pi *payments.Intent, paymentStatus, orderStatus, message string) error {
+	order, err := findOrderForIntent(ctx, pi.ID, pi.Metadata["order_id"])
+	if err != nil {
+		return err
+	}
+	if paymentStatusBehind(order.PaymentStatus, paymentStatus) {
+		log.Printf("Order %s stays %s after a late payment %s", order.ID.Hex(), order.PaymentStatus, paymentStatus)
+		return nil
+	}
+
+	// Manually captured intents may charge less than they authorized
+	amount := pi.Amount
+	if pi.AmountReceived > 0 {
+		amount = pi.AmountReceived
+	}
+	payment := bson.M{
+		"order_id": order.ID,
+		"user_id":  order.CustomerID,
+		"amount":   models.NewMoney(amount, pi.Currency),
+	}
+	if pi.ChargeID != "" {
+		payment["stripe_charge_id"] = pi.ChargeID
+	}
+	if _, err := setPaymentStatus(ctx, pi.ID, paymentStatus, message, payment); err != nil {
+		return err
+	}
+
+	err = paymentRecords.setOrderPayment(ctx, order.ID, bson.M{
+		"paymentStatus":   paymentStatus,
+		"paymentIntentId": pi.ID,
+	})
+	if err != nil {
+		return err
+	}
+
+	if orderStatus == "" || order.Status == orderStatus {
+		return nil
+	}
+	err = transitionOrderStatus(ctx, order, orderStatus, roleSystem, primitive.NilObjectID, message)
+	var transitionErr *TransitionError
+	if errors.As(err, &transitionErr) {
+		// The order has already moved on, e.g. it was cancelled meanwhile
+		log.Printf("Order %s stays %s after payment %s: %v", order.ID.Hex(), order.Status, paymentStatus, err)
+		return nil
+	}
+	return err
+}
+
+// chargeRefundStatus returns the payment and order statuses of a charge that
+// was refunded in full or in part, e.g. from the Stripe dashboard.
+func chargeRefundStatus(charge *payments.Charge) (paymentStatus, orderStatus string) {
+	if charge.Refunded || charge.AmountRefunded >= charge.Amount {
+		return "refunded", models.OrderStatusRefunded
+	}
+	return "partially_refunded", models.OrderStatusPartiallyRefunded
+}
+
+// applyChargeStatus records refund and dispute outcomes reported for a charge
+// and, if orderStatus is set, moves the order through the status state
+// machine. Outcomes behind the order's payment status are ignored.
+func applyChargeStatus(ctx context.Context, intentID, chargeID, paymentStatus, orderStatus, message string) error {
+	if intentID == "" {
+		return errors.New("charge has no payment intent")
+	}
+
+	order, err := findOrderForIntent(ctx, intentID, "")
+	if err != nil {
+		return err
+	}
+	if paymentStatusBehind(order.PaymentStatus, paymentStatus) {
+		log.Printf("Order %s stays %s after a late payment %s", order.ID.Hex(), order.PaymentStatus, paymentStatus)
+		return nil
+	}
+
+	payment := bson.M{
+		"order_id": order.ID,
+		"user_id":  order.CustomerID,
+	}
+	if chargeID != "" {
+		payment["stripe_charge_id"] = chargeID
+	}
+	if _, err := setPaymentStatus(ctx, intentID, paymentStatus, message, payment); err != nil {
+		return err
+	}
+
+	err = paymentRecords.setOrderPayment(ctx, order.ID, bson.M{"paymentStatus": paymentStatus})
+	if err != nil {
+		return err
+	}
+
+	if orderStatus == "" || order.Status == orderStatus {
+		return nil
+	}
+	err = transitionOrderStatus(ctx, order, orderStatus, roleSystem, primitive.NilObjectID, message)
+	var transitionErr *TransitionError
+	if errors.As(err, &transitionErr) {
+		// e.g. an order that was never paid, or is already fully refunded
+		log.Printf("Order %s stays %s after payment %s: %v", order.ID.Hex(), order.Status, paymentStatus, err)
+		return nil
+	}
+	return err
+}
+
+// findOrderForIntent finds the order an intent is attached to, or else the
+// order named by the intent's metadata.
+func findOrderForIntent(ctx context.Context, intentID, orderIDHex string) (*models.Order, error) {
+	order, err := paymentRecords.findOrderByIntent(ctx, intentID)
+	if err == mongo.ErrNoDocuments && orderIDHex != "" {
+		orderID, idErr := primitive.ObjectIDFromHex(orderIDHex)
+		if idErr != nil {
+			return nil, idErr
+		}
+		return paymentRecords.findOrder(ctx, orderID)
+	}
+	return order, err
+}
+
+func paymentFailureMessage(pi *payments.Intent) string {
+	if pi.LastError != "" {
+		return "Payment failed: " + pi.LastError
+	}
+	return "Payment failed"
+}
@@ -0,0 +1,169 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"farmer-marketplace/config"
+	"farmer-marketplace/models"
+)
+
+// PricingIssue describes why a single requested line item could not be priced.
+type PricingIssue struct {
+	Index     int    `json:"index"`
+	ProductID string `json:"productId"`
+	Reason    string `json:"reason"`
+}
+
+// PricingError is returned when one or more line items of an order request
+// are invalid. It lists every offending line so the client can fix them all
+// at once.
+type PricingError struct {
+	Issues []PricingIssue `json:"issues"`
+}
+
+func (e *PricingError) Error() string {
+	return fmt.Sprintf("%d order line(s) could not be priced", len(e.Issues))
+}
+
+// priceOrder loads the products referenced by the request from the catalog and
+// returns order lines carrying the current catalog price, name, unit and
+// farm, together with the recomputed order total. Lines of products with
+// variants take these from the chosen variant; catch-weight lines are priced
+// at their estimated weight.
+func priceOrder(ctx context.Context, req []models.OrderItemRequest) ([]models.OrderItem, models.Money, error) {
+	var ids []primitive.ObjectID
+	for _, item := range req {
+		if id, err := primitive.ObjectIDFromHex(item.ProductID); err == nil {
+			ids = append(ids, id)
+		}
+	}
+
+	catalog := make(map[primitive.ObjectID]models.Product)
+	if len(ids) > 0 {
+		collection := config.GetCollection("products")
+		cursor, err := collection.Find(ctx, bson.M{"_id": bson.M{"$in": ids}})
+		if err != nil {
+			return nil, models.Money{}, err
+		}
+		defer cursor.Close(ctx)
+
+		var products []models.Product
+		if err = cursor.All(ctx, &products); err != nil {
+			return nil, models.Money{}, err
+		}
+		for _, product := range products {
+			catalog[product.ID] = product
+		}
+	}
+
+	return priceOrderItems(req, catalog)
+}
+
+// priceOrderItems snapshots catalog data into order lines. Unknown or deleted
+// or expired products and non-positive quantities are collected into a *PricingError.
+func priceOrderItems(req []models.OrderItemRequest, catalog map[primitive.ObjectID]models.Product) ([]models.OrderItem, models.Money, error) {
+	var issues []PricingIssue
+	items := make([]models.OrderItem, 0, len(req))
+	var total models.Money
+
+	for i, line := range req {
+		productID, err := primitive.ObjectIDFromHex(line.ProductID)
+		if err != nil {
+			issues = append(issues, PricingIssue{Index: i, ProductID: line.ProductID, Reason: "invalid product ID"})
+			continue
+		}
+		if line.Quantity <= 0 {
+			issues = append(issues, PricingIssue{Index: i, ProductID: line.ProductID, Reason: "quantity must be greater than zero"})
+			continue
+		}
+
+		product, ok := catalog[productID]
+		if !ok {
+			issues = append(issues, PricingIssue{Index: i, ProductID: line.ProductID, Reason: "product not found"})
+			continue
+		}
+		if product.IsExpired(time.Now()) {
+			issues = append(issues, PricingIssue{Index: i, ProductID: line.ProductID, Reason: "product has expired"})
+			continue
+		}
+
+		item := models.OrderItem{
+			ProductID: product.ID,
+			Quantity:  line.Quantity,
+			Price:     product.Price,
+			Name:      product.Name,
+			Unit:      product.Unit,
+			FarmID:    product.FarmID,
+		}
+
+		var variant *models.ProductVariant
+		if len(product.Variants) > 0 || line.VariantID != "" {
+			var reason string
+			variant, reason = lineVariant(&product, line.VariantID)
+			if reason != "" {
+				issues = append(issues, PricingIssue{Index: i, ProductID: line.ProductID, Reason: reason})
+				continue
+			}
+			item.VariantID = &variant.ID
+			item.Price = variant.Price
+			item.Name = product.Name + " - " + variant.Name
+			item.Unit = variant.Unit
+			item.SKU = variant.SKU
+			item.WeightGrams = variant.WeightGrams
+		}
+
+		// Catch-weight products are charged at their estimated weight for now
+		if product.CatchWeight {
+			if reason := priceCatchWeight(&item, product.UnitWeightGrams(variant)); reason != "" {
+				issues = append(issues, PricingIssue{Index: i, ProductID: line.ProductID, Reason: reason})
+				continue
+			}
+			item.WeightGrams = product.UnitWeightGrams(variant)
+		}
+
+		lineTotal, err := item.Price.Mul(int64(line.Quantity))
+		if err == nil {
+			total, err = total.Add(lineTotal)
+		}
+		if errors.Is(err, models.ErrCurrencyMismatch) {
+			issues = append(issues, PricingIssue{Index: i, ProductID: line.ProductID, Reason: "product is priced in another currency"})
+			continue
+		}
+		if err != nil {
+			issues = append(issues, PricingIssue{Index: i, ProductID: line.ProductID, Reason: "line total is too large"})
+			continue
+		}
+
+		item.RefundedAmount = models.NewMoney(0, item.Price.Currency)
+		items = append(items, item)
+	}
+
+	if len(issues) > 0 {
+		return nil, models.Money{}, &PricingError{Issues: issues}
+	}
+
+	return items, total, nil
+}
+
+// lineVariant finds the variant an order line asks for, or returns why it
+// cannot be ordered.
+func lineVariant(product *models.Product, variantID string) (*models.ProductVariant, string) {
+	if variantID == "" {
+		return nil, "choose a variant"
+	}
+	id, err := primitive.ObjectIDFromHex(variantID)
+	if err != nil {
+		return nil, "invalid variant ID"
+	}
+	variant, ok := product.Variant(id)
+	if !ok {
+		return nil, "variant not found"
+	}
+	return variant, ""
+}
@@ -0,0 +1,126 @@
+package routes
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"farmer-marketplace/models"
+)
+
+func TestPriceOrderItems(t *testing.T) {
+	farmID := primitive.NewObjectID()
+	tomatoes := models.Product{
+		ID:     primitive.NewObjectID(),
+		Name:   "Tomatoes",
+		Price:  models.NewMoney(450, "USD"),
+		Unit:   "crate",
+		FarmID: farmID,
+	}
+	catalog := map[primitive.ObjectID]models.Product{tomatoes.ID: tomatoes}
+
+	t.Run("Uses catalog price and snapshots product data", func(t *testing.T) {
+		items, total, err := priceOrderItems([]models.OrderItemRequest{
+			{ProductID: tomatoes.ID.Hex(), Quantity: 3},
+		}, catalog)
+
+		require.NoError(t, err)
+		require.Len(t, items, 1)
+		assert.Equal(t, models.NewMoney(450, "USD"), items[0].Price)
+		assert.Equal(t, "Tomatoes", items[0].Name)
+		assert.Equal(t, "crate", items[0].Unit)
+		assert.Equal(t, farmID, items[0].FarmID)
+		assert.Equal(t, models.NewMoney(1350, "USD"), total)
+	})
+
+	t.Run("Lists every offending line", func(t *testing.T) {
+		_, _, err := priceOrderItems([]models.OrderItemRequest{
+			{ProductID: tomatoes.ID.Hex(), Quantity: 1},
+			{ProductID: "invalid-id", Quantity: 1},
+			{ProductID: primitive.NewObjectID().Hex(), Quantity: 1},
+			{ProductID: tomatoes.ID.Hex(), Quantity: 0},
+		}, catalog)
+
+		var pricingErr *PricingError
+		require.True(t, errors.As(err, &pricingErr))
+		require.Len(t, pricingErr.Issues, 3)
+		assert.Equal(t, 1, pricingErr.Issues[0].Index)
+		assert.Equal(t, "invalid product ID", pricingErr.Issues[0].Reason)
+		assert.Equal(t, 2, pricingErr.Issues[1].Index)
+		assert.Equal(t, "product not found", pricingErr.Issues[1].Reason)
+		assert.Equal(t, 3, pricingErr.Issues[2].Index)
+	})
+
+	t.Run("Rejects mixed currencies", func(t *testing.T) {
+		cheese := models.Product{ID: primitive.NewObjectID(), Price: models.NewMoney(900, "EUR")}
+		catalog[cheese.ID] = cheese
+
+		_, _, err := priceOrderItems([]models.OrderItemRequest{
+			{ProductID: tomatoes.ID.Hex(), Quantity: 1},
+			{ProductID: cheese.ID.Hex(), Quantity: 1},
+		}, catalog)
+
+		var pricingErr *PricingError
+		require.True(t, errors.As(err, &pricingErr))
+		assert.Equal(t, "product is priced in another currency", pricingErr.Issues[0].Reason)
+	})
+
+	t.Run("Prices the chosen variant", func(t *testing.T) {
+		dozen := models.ProductVariant{
+			ID:          primitive.NewObjectID(),
+			SKU:         "EGG-12",
+			Name:        "Dozen",
+			Unit:        "dozen",
+			Price:       models.NewMoney(600, "USD"),
+			WeightGrams: 720,
+		}
+		eggs := models.Product{
+			ID:       primitive.NewObjectID(),
+			Name:     "Eggs",
+			Price:    models.NewMoney(350, "USD"),
+			Unit:     "half-dozen",
+			FarmID:   farmID,
+			Variants: []models.ProductVariant{dozen},
+		}
+		catalog[eggs.ID] = eggs
+
+		items, total, err := priceOrderItems([]models.OrderItemRequest{
+			{ProductID: eggs.ID.Hex(), VariantID: dozen.ID.Hex(), Quantity: 2},
+		}, catalog)
+		require.NoError(t, err)
+		require.Len(t, items, 1)
+		assert.Equal(t, &dozen.ID, items[0].VariantID)
+		assert.Equal(t, "Eggs - Dozen", items[0].Name)
+		assert.Equal(t, "dozen", items[0].Unit)
+		assert.Equal(t, "EGG-12", items[0].SKU)
+		assert.Equal(t, 720, items[0].WeightGrams)
+		assert.Equal(t, models.NewMoney(1200, "USD"), total)
+
+		_, _, err = priceOrderItems([]models.OrderItemRequest{
+			{ProductID: eggs.ID.Hex(), Quantity: 1},
+			{ProductID: eggs.ID.Hex(), VariantID: primitive.NewObjectID().Hex(), Quantity: 1},
+			{ProductID: tomatoes.ID.Hex(), VariantID: dozen.ID.Hex(), Quantity: 1},
+		}, catalog)
+		var pricingErr *PricingError
+		require.True(t, errors.As(err, &pricingErr))
+		require.Len(t, pricingErr.Issues, 3)
+		assert.Equal(t, "choose a variant", pricingErr.Issues[0].Reason)
+		assert.Equal(t, "variant not found", pricingErr.Issues[1].Reason)
+		assert.Equal(t, "variant not found", pricingErr.Issues[2].Reason)
+	})
+
+	t.Run("Refuses expired products", func(t *testing.T) {
+		expiredAt := time.Now().Add(-time.Minute)
+		milk := models.Product{ID: primitive.NewObjectID(), Price: models.NewMoney(250, "USD"), ExpiryDate: &expiredAt}
+		catalog[milk.ID] = milk
+
+		_, _, err := priceOrderItems([]models.OrderItemRequest{{ProductID: milk.ID.Hex(), Quantity: 1}}, catalog)
+		var pricingErr *PricingError
+		require.True(t, errors.As(err, &pricingErr))
+		assert.Equal(t, "product has expired", pricingErr.Issues[0].Reason)
+	})
+}
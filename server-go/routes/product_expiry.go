@@ -0,0 +1,366 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"farmer-marketplace/config"
+	"farmer-marketplace/mail"
+	"farmer-marketplace/models"
+)
+
+// The expiry scheduler looks at the expiry dates of products in the
+// background. Expired products are left out of searches and checkout at query
+// time; the scheduler warns their farm ahead of time and, when configured,
+// marks them down shortly before they expire.
+
+const (
+	defaultExpiryCheckInterval = time.Hour
+	defaultExpiryNoticeDays    = 3
+	defaultMarkdownDays        = 2
+	maxMarkdownPercent         = 90
+)
+
+// expirySettings configure the expiry scheduler.
+type expirySettings struct {
+	Interval        time.Duration
+	NoticeDays      int   // 0 sends no notices
+	MarkdownPercent int64 // 0 marks nothing down
+	MarkdownDays    int
+}
+
+// expirySettingsFromEnv reads EXPIRY_CHECK_INTERVAL, EXPIRY_NOTICE_DAYS,
+// FRESHNESS_MARKDOWN_PERCENT and FRESHNESS_MARKDOWN_DAYS. Invalid values fall
+// back to the defaults: hourly checks, notices 3 days ahead and no markdown.
+func expirySettingsFromEnv() expirySettings {
+	settings := expirySettings{
+		Interval:        defaultExpiryCheckInterval,
+		NoticeDays:      envInt("EXPIRY_NOTICE_DAYS", defaultExpiryNoticeDays, 0, 365),
+		MarkdownPercent: int64(envInt("FRESHNESS_MARKDOWN_PERCENT", 0, 0, maxMarkdownPercent)),
+		MarkdownDays:    envInt("FRESHNESS_MARKDOWN_DAYS", defaultMarkdownDays, 1, 365),
+	}
+	if value := os.Getenv("EXPIRY_CHECK_INTERVAL"); value != "" {
+		if interval, err := time.ParseDuration(value); err == nil && interval >= time.Minute {
+			settings.Interval = interval
+		}
+	}
+	return settings
+}
+
+// envInt reads an integer between min and max from the environment.
+func envInt(name string, fallback, min, max int) int {
+	if value := os.Getenv(name); value != "" {
+		if n, err := strconv.Atoi(value); err == nil && n >= min && n <= max {
+			return n
+		}
+	}
+	return fallback
+}
+
+// RunExpiryScheduler checks the product expiry dates right away and then at
+// every interval, until ctx is done. Products are claimed before they are
+// changed, so several servers can run it at once.
+func RunExpiryScheduler(ctx context.Context, mailer mail.Mailer) {
+	settings := expirySettingsFromEnv()
+	log.Printf("Checking product expiry dates every %s", settings.Interval)
+
+	ticker := time.NewTicker(settings.Interval)
+	defer ticker.Stop()
+
+	for {
+		checkProductExpiry(ctx, mailer, settings, time.Now())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func checkProductExpiry(ctx context.Context, mailer mail.Mailer, settings expirySettings, now time.Time) {
+	runCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	if settings.NoticeDays > 0 {
+		if err := notifyExpiringProducts(runCtx, mailer, settings.NoticeDays, now); err != nil {
+			log.Printf("Failed to notify farms of expiring products: %v", err)
+		}
+	}
+	if settings.MarkdownPercent > 0 {
+		if err := markDownExpiringProducts(runCtx, settings.MarkdownPercent, settings.MarkdownDays, now); err != nil {
+			log.Printf("Failed to mark down expiring products: %v", err)
+		}
+	}
+}
+
+// expiringWithin matches the products that have not expired at now but will
+// within days.
+func expiringWithin(days int, now time.Time) bson.M {
+	return bson.M{"expiryDate": bson.M{"$gt": now, "$lte": now.AddDate(0, 0, days)}}
+}
+
+// notifyExpiringProducts warns every farm once about each of its products
+// that expires within days. A new expiry date is warned about again.
+func notifyExpiringProducts(ctx context.Context, mailer mail.Mailer, days int, now time.Time) error {
+	collection := config.GetCollection("products")
+	cursor, err := collection.Find(ctx, expiringWithin(days, now))
+	if err != nil {
+		return err
+	}
+	var products []models.Product
+	if err = cursor.All(ctx, &products); err != nil {
+		return err
+	}
+
+	byFarm := make(map[primitive.ObjectID][]models.Product)
+	for _, product := range products {
+		if product.ExpiryNoticeFor != nil && product.ExpiryNoticeFor.Equal(*product.ExpiryDate) {
+			continue
+		}
+		result, err := collection.UpdateOne(ctx,
+			bson.M{"_id": product.ID, "expiryDate": *product.ExpiryDate, "expiryNoticeFor": bson.M{"$ne": *product.ExpiryDate}},
+			bson.M{"$set": bson.M{"expiryNoticeFor": *product.ExpiryDate}},
+		)
+		if err != nil {
+			return err
+		}
+		if result.ModifiedCount > 0 {
+			byFarm[product.FarmID] = append(byFarm[product.FarmID], product)
+		}
+	}
+
+	for farmID, expiring := range byFarm {
+		if err := notifyFarmOfExpiry(ctx, mailer, farmID, expiring, now); err != nil {
+			log.Printf("Failed to notify farm %s of expiring products: %v", farmID.Hex(), err)
+		}
+	}
+	return nil
+}
+
+// notifyFarmOfExpiry tells the members of a farm who manage its products
+// which of them expire soon, in the app and by email.
+func notifyFarmOfExpiry(ctx context.Context, mailer mail.Mailer, farmID primitive.ObjectID, products []models.Product, now time.Time) error {
+	var farm models.Farm
+	if err := config.GetCollection("farms").FindOne(ctx, bson.M{"_id": farmID, "deletedAt": bson.M{"$exists": false}}).Decode(&farm); err != nil {
+		return err
+	}
+
+	pipeline := []bson.M{
+		{"$match": bson.M{
+			"farmId": farmID,
+			"role":   bson.M{"$in": farmRolesWith(models.PermProductWrite)},
+			"$or": bson.A{
+				bson.M{"permissions": nil},
+				bson.M{"permissions": models.PermProductWrite},
+			},
+		}},
+		{
+			"$lookup": bson.M{
+				"from":         "users",
+				"localField":   "userId",
+				"foreignField": "_id",
+				"as":           "user",
+			},
+		},
+		{"$unwind": "$user"},
+	}
+	cursor, err := config.GetCollection("farm_members").Aggregate(ctx, pipeline)
+	if err != nil {
+		return err
+	}
+	var members []models.FarmMember
+	if err = cursor.All(ctx, &members); err != nil {
+		return err
+	}
+
+	productIDs := make([]string, 0, len(products))
+	for _, product := range products {
+		productIDs = append(productIDs, product.ID.Hex())
+	}
+
+	for _, member := range members {
+		msg := expiryNoticeMessage(member.User.Email, &farm, products, now)
+		notification := Notification{
+			ID:      primitive.NewObjectID(),
+			UserID:  member.UserID,
+			Type:    "product_expiry",
+			Title:   msg.Subject,
+			Message: fmt.Sprintf("%d of your products expire soon", len(products)),
+			Data: map[string]interface{}{
+				"farmId":     farmID.Hex(),
+				"productIds": productIDs,
+			},
+			CreatedAt: now,
+		}
+		if _, err := config.GetCollection("notifications").InsertOne(ctx, notification); err != nil {
+			return err
+		}
+		if err := mailer.Send(ctx, msg); err != nil {
+			log.Printf("Failed to email expiry notice to user %s: %v", member.UserID.Hex(), err)
+		}
+	}
+	return nil
+}
+
+// farmRolesWith lists the farm member roles that grant perm.
+func farmRolesWith(perm string) []string {
+	var roles []string
+	for role, perms := range models.FarmRolePermissions {
+		for _, p := range perms {
+			if p == perm {
+				roles = append(roles, role)
+				break
+			}
+		}
+	}
+	sort.Strings(roles)
+	return roles
+}
+
+func expiryNoticeMessage(to string, farm *models.Farm, products []models.Product, now time.Time) mail.Message {
+	var lines strings.Builder
+	for _, product := range products {
+		days := int(math.Ceil(product.ExpiryDate.Sub(now).Hours() / 24))
+		fmt.Fprintf(&lines, "- %s, %d in stock, expires on %s (in %d day(s))\n",
+			product.Name, product.Stock, product.ExpiryDate.UTC().Format("2006-01-02"), days)
+	}
+	return mail.Message{
+		To:      to,
+		Subject: fmt.Sprintf("Products of %s expire soon", farm.Name),
+		Body: fmt.Sprintf("Hi,\n\nThese products of %s are about to expire:\n\n%s\n"+
+			"Expired products are no longer shown to customers. To update them, open:\n\n%s\n",
+			farm.Name, lines.String(), appURL()+"/farmer/products"),
+	}
+}
+
+// markDownExpiringProducts takes percent off the prices of the products that
+// expire within days and are not marked down yet. A product saved by its farm
+// in the meantime is left for the next run.
+func markDownExpiringProducts(ctx context.Context, percent int64, days int, now time.Time) error {
+	filter := expiringWithin(days, now)
+	filter["markdown"] = bson.M{"$exists": false}
+
+	collection := config.GetCollection("products")
+	cursor, err := collection.Find(ctx, filter)
+	if err != nil {
+		return err
+	}
+	var products []models.Product
+	if err = cursor.All(ctx, &products); err != nil {
+		return err
+	}
+
+	for _, product := range products {
+		updatedAt := product.UpdatedAt
+		if err := markDown(&product, percent, now); err != nil {
+			log.Printf("Cannot mark down product %s: %v", product.ID.Hex(), err)
+			continue
+		}
+
+		set := bson.M{"price": product.Price, "markdown": product.Markdown}
+		if product.MaxPrice != nil {
+			set["maxPrice"] = product.MaxPrice
+		}
+		if len(product.Variants) > 0 {
+			set["variants"] = product.Variants
+		}
+		if _, err := collection.UpdateOne(ctx,
+			bson.M{"_id": product.ID, "markdown": bson.M{"$exists": false}, "updatedAt": updatedAt},
+			bson.M{"$set": set},
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// markDown takes percent off the prices of a product and its variants,
+// keeping the regular prices.
+func markDown(product *models.Product, percent int64, now time.Time) error {
+	discount := func(price models.Money) (models.Money, error) {
+		marked, err := price.MulRatio(100-percent, 100)
+		if err == nil && !marked.IsPositive() {
+			err = errors.New("the price is too low to mark down")
+		}
+		return marked, err
+	}
+
+	markdown := &models.Markdown{
+		Percent:         percent,
+		RegularPrice:    product.Price,
+		RegularMaxPrice: product.MaxPrice,
+		AppliedAt:       now,
+	}
+
+	price, err := discount(product.Price)
+	if err != nil {
+		return err
+	}
+	var maxPrice *models.Money
+	if product.MaxPrice != nil {
+		marked, err := discount(*product.MaxPrice)
+		if err != nil {
+			return err
+		}
+		maxPrice = &marked
+	}
+	variants := make([]models.ProductVariant, len(product.Variants))
+	for i, variant := range product.Variants {
+		regular := variant.Price
+		if variant.Price, err = discount(regular); err != nil {
+			return err
+		}
+		variant.RegularPrice = &regular
+		variants[i] = variant
+	}
+
+	product.Price = price
+	product.MaxPrice = maxPrice
+	if len(variants) > 0 {
+		product.Variants = variants
+	}
+	product.Markdown = markdown
+	return nil
+}
+
+// unmarkPrices puts the regular prices back into an update of a marked down
+// product. Clients save a product as they fetched it, so a price that is still
+// the marked down one stands for the regular price; a changed price is taken
+// as the new regular price.
+func unmarkPrices(req *models.CreateProductRequest, current *models.Product) {
+	if current.Markdown == nil {
+		return
+	}
+
+	samePrice := func(a, b models.Money) bool {
+		cmp, err := a.Cmp(b)
+		return err == nil && cmp == 0
+	}
+
+	if samePrice(req.Price, current.Price) {
+		req.Price = current.Markdown.RegularPrice
+	}
+	marked := make(map[string]models.ProductVariant, len(current.Variants))
+	for _, variant := range current.Variants {
+		if variant.RegularPrice != nil {
+			marked[variant.ID.Hex()] = variant
+		}
+	}
+	for i, variant := range req.Variants {
+		if stored, ok := marked[variant.ID]; ok && samePrice(variant.Price, stored.Price) {
+			req.Variants[i].Price = *stored.RegularPrice
+		}
+	}
+}
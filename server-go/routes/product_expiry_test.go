@@ -0,0 +1,116 @@
+package routes
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"farmer-marketplace/models"
+)
+
+func TestExpirySettingsFromEnv(t *testing.T) {
+	settings := expirySettingsFromEnv()
+	assert.Equal(t, expirySettings{Interval: time.Hour, NoticeDays: 3, MarkdownDays: 2}, settings)
+
+	t.Setenv("EXPIRY_CHECK_INTERVAL", "15m")
+	t.Setenv("EXPIRY_NOTICE_DAYS", "0")
+	t.Setenv("FRESHNESS_MARKDOWN_PERCENT", "30")
+	t.Setenv("FRESHNESS_MARKDOWN_DAYS", "1")
+	assert.Equal(t, expirySettings{Interval: 15 * time.Minute, NoticeDays: 0, MarkdownPercent: 30, MarkdownDays: 1}, expirySettingsFromEnv())
+
+	// Out of range values keep the defaults
+	t.Setenv("EXPIRY_CHECK_INTERVAL", "1s")
+	t.Setenv("FRESHNESS_MARKDOWN_PERCENT", "100")
+	settings = expirySettingsFromEnv()
+	assert.Equal(t, time.Hour, settings.Interval)
+	assert.Zero(t, settings.MarkdownPercent)
+}
+
+func TestMarkDown(t *testing.T) {
+	now := time.Date(2024, 6, 1, 8, 0, 0, 0, time.UTC)
+
+	t.Run("Takes the percentage off every price", func(t *testing.T) {
+		maxPrice := models.NewMoney(1000, "USD")
+		half := models.ProductVariant{ID: primitive.NewObjectID(), Price: models.NewMoney(555, "USD")}
+		whole := models.ProductVariant{ID: primitive.NewObjectID(), Price: maxPrice}
+		product := models.Product{
+			Price:    half.Price,
+			MaxPrice: &maxPrice,
+			Variants: []models.ProductVariant{half, whole},
+		}
+
+		require.NoError(t, markDown(&product, 30, now))
+		assert.Equal(t, models.NewMoney(389, "USD"), product.Price)
+		assert.Equal(t, models.NewMoney(700, "USD"), *product.MaxPrice)
+		assert.Equal(t, models.NewMoney(389, "USD"), product.Variants[0].Price)
+		assert.Equal(t, models.NewMoney(555, "USD"), *product.Variants[0].RegularPrice)
+		assert.Equal(t, models.NewMoney(700, "USD"), product.Variants[1].Price)
+		assert.Equal(t, &models.Markdown{
+			Percent:         30,
+			RegularPrice:    models.NewMoney(555, "USD"),
+			RegularMaxPrice: &maxPrice,
+			AppliedAt:       now,
+		}, product.Markdown)
+	})
+
+	t.Run("Leaves prices that would drop to nothing", func(t *testing.T) {
+		product := models.Product{Price: models.NewMoney(1, "USD")}
+		assert.Error(t, markDown(&product, 90, now))
+		assert.Equal(t, models.NewMoney(1, "USD"), product.Price)
+		assert.Nil(t, product.Markdown)
+	})
+}
+
+func TestUnmarkPrices(t *testing.T) {
+	now := time.Date(2024, 6, 1, 8, 0, 0, 0, time.UTC)
+	small := models.ProductVariant{ID: primitive.NewObjectID(), Price: models.NewMoney(500, "USD")}
+	large := models.ProductVariant{ID: primitive.NewObjectID(), Price: models.NewMoney(1000, "USD")}
+	product := models.Product{Price: small.Price, Variants: []models.ProductVariant{small, large}}
+	require.NoError(t, markDown(&product, 20, now))
+
+	// Saving the product as fetched keeps the regular prices, a new price is kept as is
+	req := models.CreateProductRequest{
+		Price: models.NewMoney(400, "USD"),
+		Variants: []models.ProductVariantRequest{
+			{ID: small.ID.Hex(), Price: models.NewMoney(400, "USD")},
+			{ID: large.ID.Hex(), Price: models.NewMoney(900, "USD")},
+			{Price: models.NewMoney(800, "USD")},
+		},
+	}
+	unmarkPrices(&req, &product)
+	assert.Equal(t, models.NewMoney(500, "USD"), req.Price)
+	assert.Equal(t, models.NewMoney(500, "USD"), req.Variants[0].Price)
+	assert.Equal(t, models.NewMoney(900, "USD"), req.Variants[1].Price)
+	assert.Equal(t, models.NewMoney(800, "USD"), req.Variants[2].Price)
+
+	// Products at their regular prices are left alone
+	req = models.CreateProductRequest{Price: models.NewMoney(400, "USD")}
+	unmarkPrices(&req, &models.Product{Price: models.NewMoney(400, "USD")})
+	assert.Equal(t, models.NewMoney(400, "USD"), req.Price)
+}
+
+func TestExpiryNoticeMessage(t *testing.T) {
+	t.Setenv("APP_URL", "https://shop.example.com")
+
+	now := time.Date(2024, 6, 1, 8, 0, 0, 0, time.UTC)
+	soon, later := now.Add(20*time.Hour), now.Add(48*time.Hour)
+	farm := models.Farm{Name: "Green Acres"}
+
+	msg := expiryNoticeMessage("owner@example.com", &farm, []models.Product{
+		{Name: "Strawberries", Stock: 12, ExpiryDate: &soon},
+		{Name: "Milk", Stock: 3, ExpiryDate: &later},
+	}, now)
+	assert.Equal(t, "owner@example.com", msg.To)
+	assert.Equal(t, "Products of Green Acres expire soon", msg.Subject)
+	assert.Contains(t, msg.Body, "- Strawberries, 12 in stock, expires on 2024-06-02 (in 1 day(s))\n")
+	assert.Contains(t, msg.Body, "- Milk, 3 in stock, expires on 2024-06-03 (in 2 day(s))\n")
+	assert.Contains(t, msg.Body, "https://shop.example.com/farmer/products")
+}
+
+func TestFarmRolesWith(t *testing.T) {
+	assert.Equal(t, []string{models.FarmRoleManager, models.FarmRoleOwner}, farmRolesWith(models.PermProductWrite))
+	assert.Equal(t, []string{models.FarmRoleOwner}, farmRolesWith(models.PermFarmManage))
+}
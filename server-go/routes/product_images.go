@@ -0,0 +1,285 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"farmer-marketplace/config"
+	"farmer-marketplace/images"
+	"farmer-marketplace/models"
+	"farmer-marketplace/storage"
+)
+
+const (
+	defaultMaxUploadSize = 10 << 20
+	maxProductImages     = 8
+)
+
+// blobStore keeps uploaded files. It is set up with the routes.
+var blobStore storage.BlobStore
+
+func ImageRoutes(router *gin.RouterGroup) {
+	router.GET("/images/*key", serveImage)
+}
+
+// maxUploadSize is the largest accepted upload, MAX_FILE_SIZE or 10MB.
+func maxUploadSize() int64 {
+	if value := os.Getenv("MAX_FILE_SIZE"); value != "" {
+		if size, err := storage.ParseSize(value); err == nil {
+			return size
+		}
+	}
+	return defaultMaxUploadSize
+}
+
+// productImageKey is where a rendition of a product photo is stored.
+func productImageKey(productID, imageID primitive.ObjectID, size string) string {
+	return fmt.Sprintf("products/%s/%s/%s.jpg", productID.Hex(), imageID.Hex(), size)
+}
+
+func productImageKeys(productID, imageID primitive.ObjectID) []string {
+	keys := make([]string, 0, len(images.Sizes))
+	for _, size := range images.Sizes {
+		keys = append(keys, productImageKey(productID, imageID, size.Name))
+	}
+	return keys
+}
+
+// deleteBlobs removes stored files. Failures are logged; the documents that
+// referred to them are already gone.
+func deleteBlobs(ctx context.Context, keys []string) {
+	for _, key := range keys {
+		if err := blobStore.Delete(ctx, key); err != nil {
+			log.Printf("Failed to delete blob %s: %v", key, err)
+		}
+	}
+}
+
+// deleteProductBlobs removes every uploaded photo of the products.
+func deleteProductBlobs(ctx context.Context, products ...models.Product) {
+	for _, product := range products {
+		for _, photo := range product.Photos {
+			deleteBlobs(ctx, productImageKeys(product.ID, photo.ID))
+		}
+	}
+}
+
+// uploadProductImage takes a multipart "image" file, checks what it really
+// is and stores it in every size of images.Sizes.
+func uploadProductImage(c *gin.Context) {
+	productID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product ID"})
+		return
+	}
+
+	farmID, ok := actingFarmID(c)
+	if !ok {
+		return
+	}
+
+	// Leave room for the multipart framing around the file
+	limit := maxUploadSize()
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit+1<<20)
+
+	file, header, err := c.Request.FormFile("image")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Image must be at most %d bytes", limit)})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "An image file is required"})
+		return
+	}
+	defer file.Close()
+
+	if header.Size > limit {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Image must be at most %d bytes", limit)})
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(file, limit+1))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read image"})
+		return
+	}
+	if int64(len(data)) > limit {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Image must be at most %d bytes", limit)})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// Check the product before spending time on the image
+	collection := config.GetCollection("products")
+	var product models.Product
+	err = collection.FindOne(ctx, bson.M{"_id": productID, "farmId": farmID}).Decode(&product)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found or not owned by your farm"})
+		return
+	}
+	if len(product.Photos) >= maxProductImages {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("A product can have at most %d images", maxProductImages)})
+		return
+	}
+
+	renditions, err := images.Process(data)
+	switch {
+	case errors.Is(err, images.ErrUnsupportedType):
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Only JPEG, PNG and GIF images are accepted"})
+		return
+	case errors.Is(err, images.ErrTooLarge):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Image dimensions are too large"})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process image"})
+		return
+	}
+
+	photo := models.ProductImage{
+		ID:        primitive.NewObjectID(),
+		Width:     renditions[0].Width,
+		Height:    renditions[0].Height,
+		URLs:      map[string]string{},
+		CreatedAt: time.Now(),
+	}
+	var stored []string
+	for _, rendition := range renditions {
+		key := productImageKey(productID, photo.ID, rendition.Name)
+		if err := blobStore.Put(ctx, key, rendition.Data, images.ContentType); err != nil {
+			deleteBlobs(ctx, stored)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store image"})
+			return
+		}
+		stored = append(stored, key)
+		photo.URLs[rendition.Name] = "/api/images/" + key
+	}
+
+	// The count is checked again so that concurrent uploads cannot exceed it
+	result, err := collection.UpdateOne(ctx,
+		bson.M{
+			"_id":    productID,
+			"farmId": farmID,
+			fmt.Sprintf("photos.%d", maxProductImages-1): bson.M{"$exists": false},
+		},
+		bson.M{
+			"$push": bson.M{"photos": photo},
+			"$set":  bson.M{"updatedAt": time.Now()},
+		},
+	)
+	if err != nil || result.MatchedCount == 0 {
+		deleteBlobs(ctx, stored)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save image"})
+		} else {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("A product can have at most %d images", maxProductImages)})
+		}
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Image uploaded successfully",
+		"image":   photo,
+	})
+}
+
+func deleteProductImage(c *gin.Context) {
+	productID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product ID"})
+		return
+	}
+	imageID, err := primitive.ObjectIDFromHex(c.Param("imageId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid image ID"})
+		return
+	}
+
+	farmID, ok := actingFarmID(c)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	result, err := config.GetCollection("products").UpdateOne(ctx,
+		bson.M{"_id": productID, "farmId": farmID, "photos._id": imageID},
+		bson.M{
+			"$pull": bson.M{"photos": bson.M{"_id": imageID}},
+			"$set":  bson.M{"updatedAt": time.Now()},
+		},
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete image"})
+		return
+	}
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return
+	}
+
+	deleteBlobs(ctx, productImageKeys(productID, imageID))
+
+	c.JSON(http.StatusOK, gin.H{"message": "Image deleted successfully"})
+}
+
+// findProductsWithPhotos returns the uploaded photos of the products that
+// match filter, so that their blobs can be removed with them.
+func findProductsWithPhotos(ctx context.Context, filter bson.M) ([]models.Product, error) {
+	filter["photos.0"] = bson.M{"$exists": true}
+	opts := options.Find().SetProjection(bson.M{"photos": 1})
+	cursor, err := config.GetCollection("products").Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var products []models.Product
+	if err := cursor.All(ctx, &products); err != nil {
+		return nil, err
+	}
+	return products, nil
+}
+
+// serveImage streams a stored rendition. Keys are never reused, so clients
+// may cache them for good.
+func serveImage(c *gin.Context) {
+	key := strings.TrimPrefix(c.Param("key"), "/")
+	if !strings.HasPrefix(key, "products/") || !storage.ValidKey(key) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+
+	body, contentType, err := blobStore.Get(ctx, key)
+	if errors.Is(err, storage.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch image"})
+		return
+	}
+	defer body.Close()
+
+	c.DataFromReader(http.StatusOK, -1, contentType, body, map[string]string{
+		"Cache-Control":          "public, max-age=31536000, immutable",
+		"X-Content-Type-Options": "nosniff",
+	})
+}
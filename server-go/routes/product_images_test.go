@@ -0,0 +1,55 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"farmer-marketplace/storage"
+)
+
+func TestServeImage(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	original := blobStore
+	t.Cleanup(func() { blobStore = original })
+	blobStore = storage.NewDiskStore(t.TempDir())
+
+	key := productImageKey(primitive.NewObjectID(), primitive.NewObjectID(), "thumb")
+	require.True(t, storage.ValidKey(key))
+	require.NoError(t, blobStore.Put(context.Background(), key, []byte("jpeg"), "image/jpeg"))
+
+	router := gin.New()
+	ImageRoutes(router.Group("/api"))
+
+	request := func(path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request("/api/images/" + key)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "jpeg", w.Body.String())
+	assert.Equal(t, "image/jpeg", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Header().Get("Cache-Control"), "immutable")
+
+	assert.Equal(t, http.StatusNotFound, request("/api/images/products/missing.jpg").Code)
+	assert.Equal(t, http.StatusNotFound, request("/api/images/other/"+key).Code)
+	assert.Equal(t, http.StatusNotFound, request("/api/images/products/%2e%2e/secret").Code)
+}
+
+func TestMaxUploadSize(t *testing.T) {
+	t.Setenv("MAX_FILE_SIZE", "5MB")
+	assert.Equal(t, int64(5<<20), maxUploadSize())
+
+	t.Setenv("MAX_FILE_SIZE", "lots")
+	assert.Equal(t, int64(defaultMaxUploadSize), maxUploadSize())
+}
@@ -0,0 +1,361 @@
+package routes
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"farmer-marketplace/models"
+)
+
+const (
+	defaultProductPageSize = 20
+	maxProductPageSize     = 100
+	maxHarvestedWithinDays = 365
+)
+
+// harvestFacetDays are the "harvested in the last N days" windows counted
+// for every search.
+var harvestFacetDays = []int{1, 3, 7, 30}
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// productSort orders a product listing by one field, with the product ID as
+// tie-breaker so that cursors are stable.
+type productSort struct {
+	Field string
+	Order int // 1 ascending, -1 descending
+}
+
+// productSorts maps the sort query parameter to an order. Listings are
+// newest first unless asked otherwise.
+var productSorts = map[string]productSort{
+	"newest":     {Field: "createdAt", Order: -1},
+	"price_low":  {Field: "price.amount", Order: 1},
+	"price_high": {Field: "price.amount", Order: -1},
+	"rating":     {Field: "rating", Order: -1},
+	"popular":    {Field: "orders", Order: -1},
+}
+
+// productQuery is a parsed product search.
+type productQuery struct {
+	Text           string
+	Category       string
+	MinPrice       *models.Money
+	MaxPrice       *models.Money
+	IsOrganic      *bool
+	FarmerID       *primitive.ObjectID
+	FarmID         *primitive.ObjectID
+	InStock        bool
+	HarvestedAfter *time.Time
+	// HarvestedBefore is exclusive; a date-only parameter includes its day.
+	HarvestedBefore *time.Time
+	// Now is when the search runs; products that expired by then are hidden.
+	Now    time.Time
+	Sort   productSort
+	Limit  int
+	Cursor *productCursor
+}
+
+// productCursor points after the last product of a page.
+type productCursor struct {
+	Value interface{}
+	ID    primitive.ObjectID
+}
+
+// parseProductQuery reads the search, filter, sort and pagination parameters
+// of GET /products.
+func parseProductQuery(c *gin.Context) (productQuery, error) {
+	q := productQuery{
+		Text:     strings.TrimSpace(c.Query("q")),
+		Category: strings.TrimSpace(c.Query("category")),
+		InStock:  c.Query("inStock") == "true",
+		Sort:     productSorts["newest"],
+		Limit:    defaultProductPageSize,
+		Now:      time.Now(),
+	}
+
+	for param, target := range map[string]**models.Money{"minPrice": &q.MinPrice, "maxPrice": &q.MaxPrice} {
+		if value := c.Query(param); value != "" {
+			price, err := models.ParseMoney(value, models.DefaultCurrency)
+			if err != nil || price.IsNegative() {
+				return q, fmt.Errorf("invalid %s", param)
+			}
+			*target = &price
+		}
+	}
+
+	if value := c.Query("isOrganic"); value != "" {
+		organic, err := strconv.ParseBool(value)
+		if err != nil {
+			return q, errors.New("invalid isOrganic")
+		}
+		q.IsOrganic = &organic
+	}
+
+	for param, target := range map[string]**primitive.ObjectID{"farmer": &q.FarmerID, "farm": &q.FarmID} {
+		if value := c.Query(param); value != "" {
+			id, err := primitive.ObjectIDFromHex(value)
+			if err != nil {
+				return q, fmt.Errorf("invalid %s", param)
+			}
+			*target = &id
+		}
+	}
+
+	var err error
+	if q.HarvestedAfter, err = parseDateParam(c.Query("harvestedAfter"), false); err != nil {
+		return q, errors.New("invalid harvestedAfter")
+	}
+	if q.HarvestedBefore, err = parseDateParam(c.Query("harvestedBefore"), true); err != nil {
+		return q, errors.New("invalid harvestedBefore")
+	}
+	if value := c.Query("harvestedWithin"); value != "" {
+		days, err := strconv.Atoi(value)
+		if err != nil || days < 1 || days > maxHarvestedWithinDays {
+			return q, errors.New("invalid harvestedWithin")
+		}
+		if since := q.Now.AddDate(0, 0, -days); q.HarvestedAfter == nil || since.After(*q.HarvestedAfter) {
+			q.HarvestedAfter = &since
+		}
+	}
+
+	if value := c.Query("sort"); value != "" {
+		sort, ok := productSorts[value]
+		if !ok {
+			return q, errors.New("invalid sort")
+		}
+		q.Sort = sort
+	}
+
+	if value := c.Query("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			return q, errors.New("invalid limit")
+		}
+		if limit > maxProductPageSize {
+			limit = maxProductPageSize
+		}
+		q.Limit = limit
+	}
+
+	if value := c.Query("cursor"); value != "" {
+		cursor, err := decodeProductCursor(value, q.Sort)
+		if err != nil {
+			return q, err
+		}
+		q.Cursor = cursor
+	}
+
+	return q, nil
+}
+
+// parseDateParam accepts RFC 3339 timestamps and plain dates. With endOfDay,
+// a plain date stands for the end of that day.
+func parseDateParam(value string, endOfDay bool) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return &t, nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return nil, err
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return &t, nil
+}
+
+// filter returns the match of the query without the cursor, as used for the
+// total count. Farmer filters resolve to farms before this is called.
+func (q productQuery) filter() bson.M {
+	filter := bson.M{
+		// Products without an expiry date never expire
+		"expiryDate": bson.M{"$not": bson.M{"$lte": q.Now}},
+	}
+	if q.Text != "" {
+		filter["$text"] = bson.M{"$search": q.Text}
+	}
+	if q.Category != "" {
+		filter["category"] = primitive.Regex{Pattern: "^" + regexp.QuoteMeta(q.Category) + "$", Options: "i"}
+	}
+
+	price := bson.M{}
+	if q.MinPrice != nil {
+		price["$gte"] = q.MinPrice.Amount
+	}
+	if q.MaxPrice != nil {
+		price["$lte"] = q.MaxPrice.Amount
+	}
+	if len(price) > 0 {
+		filter["price.amount"] = price
+	}
+
+	if q.IsOrganic != nil {
+		filter["isOrganic"] = *q.IsOrganic
+	}
+	if q.FarmID != nil {
+		filter["farmId"] = *q.FarmID
+	}
+	if q.InStock {
+		filter["stock"] = bson.M{"$gt": 0}
+	}
+
+	harvest := bson.M{}
+	if q.HarvestedAfter != nil {
+		harvest["$gte"] = *q.HarvestedAfter
+	}
+	if q.HarvestedBefore != nil {
+		harvest["$lt"] = *q.HarvestedBefore
+	}
+	if len(harvest) > 0 {
+		filter["harvestDate"] = harvest
+	}
+	return filter
+}
+
+// pageFilter is filter narrowed to the products after the cursor.
+func (q productQuery) pageFilter() bson.M {
+	filter := q.filter()
+	if q.Cursor == nil {
+		return filter
+	}
+
+	op := "$gt"
+	if q.Sort.Order < 0 {
+		op = "$lt"
+	}
+	filter["$or"] = bson.A{
+		bson.M{q.Sort.Field: bson.M{op: q.Cursor.Value}},
+		bson.M{q.Sort.Field: q.Cursor.Value, "_id": bson.M{op: q.Cursor.ID}},
+	}
+	return filter
+}
+
+// harvestFacetPipeline counts the products matching the query without its
+// harvest dates that were harvested within each of harvestFacetDays.
+func (q productQuery) harvestFacetPipeline() []bson.M {
+	unbounded := q
+	unbounded.HarvestedAfter, unbounded.HarvestedBefore = nil, nil
+
+	group := bson.M{"_id": nil}
+	for _, days := range harvestFacetDays {
+		since := q.Now.AddDate(0, 0, -days)
+		group[fmt.Sprintf("within%d", days)] = bson.M{
+			"$sum": bson.M{"$cond": bson.A{bson.M{"$gte": bson.A{"$harvestDate", since}}, 1, 0}},
+		}
+	}
+	return []bson.M{{"$match": unbounded.filter()}, {"$group": group}}
+}
+
+// HarvestFacet is how many products of a search were harvested in the last
+// Days days.
+type HarvestFacet struct {
+	Days  int   `json:"days"`
+	Count int64 `json:"count"`
+}
+
+// harvestFacets reads the result of harvestFacetPipeline, which has no
+// document when nothing matches.
+func harvestFacets(counts bson.M) []HarvestFacet {
+	facets := make([]HarvestFacet, 0, len(harvestFacetDays))
+	for _, days := range harvestFacetDays {
+		facet := HarvestFacet{Days: days}
+		switch n := counts[fmt.Sprintf("within%d", days)].(type) {
+		case int32:
+			facet.Count = int64(n)
+		case int64:
+			facet.Count = n
+		}
+		facets = append(facets, facet)
+	}
+	return facets
+}
+
+// sortStage returns the $sort of the query.
+func (q productQuery) sortStage() bson.D {
+	return bson.D{{Key: q.Sort.Field, Value: q.Sort.Order}, {Key: "_id", Value: q.Sort.Order}}
+}
+
+type encodedCursor struct {
+	Value json.RawMessage `json:"v"`
+	ID    string          `json:"id"`
+}
+
+// encodeProductCursor points after product in a listing sorted by sort.
+func encodeProductCursor(product models.Product, sort productSort) (string, error) {
+	var value interface{}
+	switch sort.Field {
+	case "createdAt":
+		value = product.CreatedAt.UTC().Format(time.RFC3339Nano)
+	case "price.amount":
+		value = product.Price.Amount
+	case "rating":
+		value = product.Rating
+	case "orders":
+		value = product.Orders
+	}
+
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(encodedCursor{Value: raw, ID: product.ID.Hex()})
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// decodeProductCursor reads a cursor made by encodeProductCursor for the
+// same sort field.
+func decodeProductCursor(s string, sort productSort) (*productCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var encoded encodedCursor
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	id, err := primitive.ObjectIDFromHex(encoded.ID)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	cursor := &productCursor{ID: id}
+	switch sort.Field {
+	case "createdAt":
+		var s string
+		err = json.Unmarshal(encoded.Value, &s)
+		if err == nil {
+			var t time.Time
+			t, err = time.Parse(time.RFC3339Nano, s)
+			cursor.Value = t
+		}
+	case "price.amount", "orders":
+		var n int64
+		err = json.Unmarshal(encoded.Value, &n)
+		cursor.Value = n
+	default:
+		var f float64
+		err = json.Unmarshal(encoded.Value, &f)
+		cursor.Value = f
+	}
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return cursor, nil
+}
@@ -0,0 +1,134 @@
+package routes
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"farmer-marketplace/models"
+)
+
+func parseTestQuery(t *testing.T, rawQuery string) (productQuery, error) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/products?"+rawQuery, nil)
+	return parseProductQuery(c)
+}
+
+func TestParseProductQuery(t *testing.T) {
+	t.Run("Defaults to the newest products", func(t *testing.T) {
+		q, err := parseTestQuery(t, "")
+		require.NoError(t, err)
+		assert.Equal(t, productSorts["newest"], q.Sort)
+		assert.Equal(t, defaultProductPageSize, q.Limit)
+		assert.Equal(t, bson.M{"expiryDate": bson.M{"$not": bson.M{"$lte": q.Now}}}, q.filter())
+	})
+
+	t.Run("Builds the filter", func(t *testing.T) {
+		farmID := primitive.NewObjectID()
+		q, err := parseTestQuery(t, "q=tomato&minPrice=1.50&maxPrice=10&isOrganic=true&farm="+farmID.Hex()+
+			"&inStock=true&harvestedAfter=2024-06-01&harvestedBefore=2024-06-30&sort=price_low&limit=500")
+		require.NoError(t, err)
+		assert.Equal(t, maxProductPageSize, q.Limit)
+		assert.Equal(t, productSorts["price_low"], q.Sort)
+
+		filter := q.filter()
+		assert.Equal(t, bson.M{"$search": "tomato"}, filter["$text"])
+		assert.Equal(t, bson.M{"$gte": int64(150), "$lte": int64(1000)}, filter["price.amount"])
+		assert.Equal(t, true, filter["isOrganic"])
+		assert.Equal(t, farmID, filter["farmId"])
+		assert.Equal(t, bson.M{"$gt": 0}, filter["stock"])
+		assert.Equal(t, bson.M{
+			"$gte": time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC),
+			"$lt":  time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC),
+		}, filter["harvestDate"])
+	})
+
+	t.Run("Narrows harvest dates to the last days", func(t *testing.T) {
+		q, err := parseTestQuery(t, "harvestedWithin=7")
+		require.NoError(t, err)
+		assert.Equal(t, bson.M{"$gte": q.Now.AddDate(0, 0, -7)}, q.filter()["harvestDate"])
+
+		// The later of both bounds wins
+		q, err = parseTestQuery(t, "harvestedWithin=7&harvestedAfter=2024-06-01")
+		require.NoError(t, err)
+		assert.Equal(t, q.Now.AddDate(0, 0, -7), *q.HarvestedAfter)
+	})
+
+	t.Run("Matches categories whatever their case", func(t *testing.T) {
+		q, err := parseTestQuery(t, "category=Vegetables")
+		require.NoError(t, err)
+		assert.Equal(t, primitive.Regex{Pattern: "^Vegetables$", Options: "i"}, q.filter()["category"])
+	})
+
+	for _, rawQuery := range []string{"minPrice=abc", "maxPrice=-1", "isOrganic=maybe", "farmer=nope", "harvestedAfter=June", "harvestedWithin=0", "harvestedWithin=week", "sort=cheapest", "limit=0", "cursor=not-a-cursor"} {
+		t.Run("Refuses "+rawQuery, func(t *testing.T) {
+			_, err := parseTestQuery(t, rawQuery)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestProductCursor(t *testing.T) {
+	product := models.Product{
+		ID:        primitive.NewObjectID(),
+		Price:     models.NewMoney(499, models.DefaultCurrency),
+		Rating:    4.5,
+		Orders:    12,
+		CreatedAt: time.Date(2024, 6, 1, 12, 30, 0, 123000000, time.UTC),
+	}
+
+	expected := map[string]interface{}{
+		"newest":     product.CreatedAt,
+		"price_high": int64(499),
+		"rating":     4.5,
+		"popular":    int64(12),
+	}
+	for name, value := range expected {
+		t.Run(name, func(t *testing.T) {
+			sort := productSorts[name]
+			encoded, err := encodeProductCursor(product, sort)
+			require.NoError(t, err)
+
+			cursor, err := decodeProductCursor(encoded, sort)
+			require.NoError(t, err)
+			assert.Equal(t, product.ID, cursor.ID)
+			assert.Equal(t, value, cursor.Value)
+		})
+	}
+
+	t.Run("Pages past the cursor in sort order", func(t *testing.T) {
+		q := productQuery{Sort: productSorts["price_low"], Cursor: &productCursor{Value: int64(499), ID: product.ID}}
+		assert.Equal(t, bson.A{
+			bson.M{"price.amount": bson.M{"$gt": int64(499)}},
+			bson.M{"price.amount": int64(499), "_id": bson.M{"$gt": product.ID}},
+		}, q.pageFilter()["$or"])
+	})
+}
+
+func TestHarvestFacets(t *testing.T) {
+	q, err := parseTestQuery(t, "category=Fruit&harvestedWithin=3")
+	require.NoError(t, err)
+
+	pipeline := q.harvestFacetPipeline()
+	require.Len(t, pipeline, 2)
+	match := pipeline[0]["$match"].(bson.M)
+	assert.NotContains(t, match, "harvestDate", "counts ignore the harvest window being filtered on")
+	assert.Contains(t, match, "category")
+	assert.Contains(t, match, "expiryDate")
+
+	group := pipeline[1]["$group"].(bson.M)
+	assert.Equal(t, bson.M{"$sum": bson.M{"$cond": bson.A{bson.M{"$gte": bson.A{"$harvestDate", q.Now.AddDate(0, 0, -7)}}, 1, 0}}}, group["within7"])
+
+	assert.Equal(t, []HarvestFacet{{Days: 1, Count: 2}, {Days: 3, Count: 5}, {Days: 7, Count: 9}, {Days: 30, Count: 0}},
+		harvestFacets(bson.M{"_id": nil, "within1": int32(2), "within3": int32(5), "within7": int64(9)}))
+	assert.Len(t, harvestFacets(nil), len(harvestFacetDays))
+}
@@ -0,0 +1,104 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"farmer-marketplace/models"
+)
+
+var ErrInvalidVariants = errors.New("invalid variants")
+
+// applyVariants sets the variants of a product from a request. Variants that
+// name an existing ID keep it, so that carts and orders still refer to them.
+// The product's price becomes the lowest variant price, MaxPrice the highest
+// when they differ, and its stock the sum of the variant stocks, so that
+// listing, sorting and filtering work the same with or without variants.
+func applyVariants(product *models.Product, reqs []models.ProductVariantRequest) error {
+	invalid := func(format string, args ...interface{}) error {
+		return fmt.Errorf("%w: %s", ErrInvalidVariants, fmt.Sprintf(format, args...))
+	}
+
+	variants := make([]models.ProductVariant, 0, len(reqs))
+	ids := make(map[primitive.ObjectID]bool)
+	skus := make(map[string]bool)
+	var minPrice, maxPrice models.Money
+	stock := 0
+
+	for i, req := range reqs {
+		variant := models.ProductVariant{
+			ID:          primitive.NewObjectID(),
+			SKU:         strings.TrimSpace(req.SKU),
+			Name:        strings.TrimSpace(req.Name),
+			Unit:        strings.TrimSpace(req.Unit),
+			Price:       req.Price,
+			Stock:       req.Stock,
+			WeightGrams: req.WeightGrams,
+		}
+		if req.ID != "" {
+			id, err := primitive.ObjectIDFromHex(req.ID)
+			if err != nil {
+				return invalid("variant %d has an invalid ID", i)
+			}
+			variant.ID = id
+		}
+		if ids[variant.ID] {
+			return invalid("variant %d repeats the ID of another variant", i)
+		}
+		ids[variant.ID] = true
+
+		if variant.SKU == "" || variant.Name == "" || variant.Unit == "" {
+			return invalid("variant %d needs a SKU, name and unit", i)
+		}
+		sku := strings.ToUpper(variant.SKU)
+		if skus[sku] {
+			return invalid("SKU %q is used by more than one variant", variant.SKU)
+		}
+		skus[sku] = true
+
+		if !variant.Price.IsPositive() {
+			return invalid("the price of variant %q must be greater than zero", variant.SKU)
+		}
+		if variant.Stock < 0 || variant.WeightGrams < 0 {
+			return invalid("the stock and weight of variant %q cannot be negative", variant.SKU)
+		}
+
+		if i == 0 {
+			minPrice, maxPrice = variant.Price, variant.Price
+		} else {
+			lower, err := variant.Price.Cmp(minPrice)
+			if err != nil {
+				return invalid("all variants must be priced in the same currency")
+			}
+			higher, _ := variant.Price.Cmp(maxPrice)
+			if lower < 0 {
+				minPrice = variant.Price
+			}
+			if higher > 0 {
+				maxPrice = variant.Price
+			}
+		}
+		stock += variant.Stock
+
+		variants = append(variants, variant)
+	}
+
+	if len(variants) == 0 {
+		return invalid("at least one variant is required")
+	}
+
+	product.Variants = variants
+	product.Price = minPrice
+	product.MaxPrice = nil
+	if maxPrice.Amount != minPrice.Amount {
+		product.MaxPrice = &maxPrice
+	}
+	product.Stock = stock
+	if product.Unit == "" {
+		product.Unit = variants[0].Unit
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package routes
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"farmer-marketplace/models"
+)
+
+func TestApplyVariants(t *testing.T) {
+	variant := func(sku string, cents int64, stock int) models.ProductVariantRequest {
+		return models.ProductVariantRequest{SKU: sku, Name: sku, Unit: "pack", Price: models.NewMoney(cents, "USD"), Stock: stock}
+	}
+
+	t.Run("Sets the price range and total stock", func(t *testing.T) {
+		existing := primitive.NewObjectID()
+		half := variant("EGG-6", 350, 10)
+		half.ID = existing.Hex()
+
+		var product models.Product
+		require.NoError(t, applyVariants(&product, []models.ProductVariantRequest{
+			half, variant("EGG-12", 600, 4), variant("EGG-30", 1400, 1),
+		}))
+		require.Len(t, product.Variants, 3)
+		assert.Equal(t, existing, product.Variants[0].ID)
+		assert.False(t, product.Variants[1].ID.IsZero())
+		assert.Equal(t, models.NewMoney(350, "USD"), product.Price)
+		require.NotNil(t, product.MaxPrice)
+		assert.Equal(t, models.NewMoney(1400, "USD"), *product.MaxPrice)
+		assert.Equal(t, 15, product.Stock)
+		assert.Equal(t, "pack", product.Unit)
+	})
+
+	t.Run("Has no range when every variant costs the same", func(t *testing.T) {
+		product := models.Product{MaxPrice: &models.Money{}}
+		require.NoError(t, applyVariants(&product, []models.ProductVariantRequest{variant("A", 500, 1), variant("B", 500, 1)}))
+		assert.Nil(t, product.MaxPrice)
+	})
+
+	t.Run("Rejects invalid variants", func(t *testing.T) {
+		euro := variant("EUR-1", 500, 1)
+		euro.Price = models.NewMoney(500, "EUR")
+		free := variant("FREE", 0, 1)
+		badID := variant("ID", 100, 1)
+		badID.ID = "nope"
+
+		for name, reqs := range map[string][]models.ProductVariantRequest{
+			"duplicate SKU":  {variant("egg-6", 350, 1), variant("EGG-6", 360, 1)},
+			"mixed currency": {variant("USD-1", 500, 1), euro},
+			"free":           {free},
+			"invalid ID":     {badID},
+			"none":           {},
+		} {
+			var product models.Product
+			assert.ErrorIs(t, applyVariants(&product, reqs), ErrInvalidVariants, name)
+		}
+	})
+}
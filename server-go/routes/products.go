@@ -8,6 +8,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 
 	"farmer-marketplace/config"
@@ -19,25 +20,38 @@ func ProductRoutes(router *gin.RouterGroup) {
 	{
 		products.GET("", getProducts)
 		products.GET("/:id", getProduct)
-		products.POST("", authMiddleware(), createProduct)
-		products.PUT("/:id", authMiddleware(), updateProduct)
-		products.DELETE("/:id", authMiddleware(), deleteProduct)
+		products.POST("", authMiddleware(), requirePermission(models.PermProductWrite), createProduct)
+		products.PUT("/:id", authMiddleware(), requirePermission(models.PermProductWrite), updateProduct)
+		products.DELETE("/:id", authMiddleware(), requirePermission(models.PermProductWrite), deleteProduct)
+		products.POST("/:id/images", authMiddleware(), requirePermission(models.PermProductWrite), uploadProductImage)
+		products.DELETE("/:id/images/:imageId", authMiddleware(), requirePermission(models.PermProductWrite), deleteProductImage)
 		products.GET("/farmer/:farmerId", getFarmerProducts)
 		products.GET("/farmer", authMiddleware(), getMyProducts)
 	}
 }
 
-func getProducts(c *gin.Context) {
-	collection := config.GetCollection("products")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	// Build aggregation pipeline to populate farmer info
-	pipeline := []bson.M{
+// productFarmStages populate the farm selling a product and, as "farmer",
+// the farm's owner.
+func productFarmStages() []bson.M {
+	return []bson.M{
+		{
+			"$lookup": bson.M{
+				"from":         "farms",
+				"localField":   "farmId",
+				"foreignField": "_id",
+				"as":           "farm",
+			},
+		},
+		{
+			"$unwind": bson.M{
+				"path":                       "$farm",
+				"preserveNullAndEmptyArrays": true,
+			},
+		},
 		{
 			"$lookup": bson.M{
 				"from":         "users",
-				"localField":   "farmerId",
+				"localField":   "farm.ownerId",
 				"foreignField": "_id",
 				"as":           "farmer",
 			},
@@ -53,10 +67,69 @@ func getProducts(c *gin.Context) {
 				"farmer.password": 0,
 			},
 		},
-		{
-			"$sort": bson.M{"createdAt": -1},
-		},
 	}
+}
+
+// getProducts searches the catalog, leaving out expired products. It returns
+// a page of products, the total number of matches, how many of them were
+// harvested recently and, when there are more, the cursor of the next page.
+func getProducts(c *gin.Context) {
+	query, err := parseProductQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	collection := config.GetCollection("products")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Products belong to farms; a farmer stands for the farm they own
+	if query.FarmerID != nil {
+		farm, err := findOwnedFarm(ctx, *query.FarmerID)
+		if err == mongo.ErrNoDocuments {
+			c.JSON(http.StatusOK, gin.H{
+				"products": []models.Product{},
+				"total":    0,
+				"facets":   gin.H{"harvestedWithin": harvestFacets(nil)},
+			})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch products"})
+			return
+		}
+		query.FarmID = &farm.ID
+	}
+
+	total, err := collection.CountDocuments(ctx, query.filter())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count products"})
+		return
+	}
+
+	facetCursor, err := collection.Aggregate(ctx, query.harvestFacetPipeline())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count products"})
+		return
+	}
+	var counts []bson.M
+	if err = facetCursor.All(ctx, &counts); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count products"})
+		return
+	}
+	var harvestCounts bson.M
+	if len(counts) > 0 {
+		harvestCounts = counts[0]
+	}
+
+	// Fetch one more than a page to know whether another page follows, and
+	// populate farm and farmer info for the page only
+	pipeline := append([]bson.M{
+		{"$match": query.pageFilter()},
+		{"$sort": query.sortStage()},
+		{"$limit": query.Limit + 1},
+	}, productFarmStages()...)
 
 	cursor, err := collection.Aggregate(ctx, pipeline)
 	if err != nil {
@@ -65,13 +138,28 @@ func getProducts(c *gin.Context) {
 	}
 	defer cursor.Close(ctx)
 
-	var products []models.Product
+	products := []models.Product{}
 	if err = cursor.All(ctx, &products); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode products"})
 		return
 	}
 
-	c.JSON(http.StatusOK, products)
+	response := gin.H{
+		"total":  total,
+		"facets": gin.H{"harvestedWithin": harvestFacets(harvestCounts)},
+	}
+	if len(products) > query.Limit {
+		products = products[:query.Limit]
+		next, err := encodeProductCursor(products[len(products)-1], query.Sort)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch products"})
+			return
+		}
+		response["nextCursor"] = next
+	}
+	response["products"] = products
+
+	c.JSON(http.StatusOK, response)
 }
 
 func getProduct(c *gin.Context) {
@@ -86,29 +174,8 @@ func getProduct(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	// Aggregation pipeline to populate farmer info
-	pipeline := []bson.M{
-		{"$match": bson.M{"_id": objectID}},
-		{
-			"$lookup": bson.M{
-				"from":         "users",
-				"localField":   "farmerId",
-				"foreignField": "_id",
-				"as":           "farmer",
-			},
-		},
-		{
-			"$unwind": bson.M{
-				"path":                       "$farmer",
-				"preserveNullAndEmptyArrays": true,
-			},
-		},
-		{
-			"$project": bson.M{
-				"farmer.password": 0,
-			},
-		},
-	}
+	// Aggregation pipeline to populate farm and farmer info
+	pipeline := append([]bson.M{{"$match": bson.M{"_id": objectID}}}, productFarmStages()...)
 
 	cursor, err := collection.Aggregate(ctx, pipeline)
 	if err != nil {
@@ -138,17 +205,13 @@ func createProduct(c *gin.Context) {
 		return
 	}
 
-	userID := c.GetString("userID")
-	role := c.GetString("role")
-
-	if role != "farmer" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Only farmers can create products"})
+	if len(req.Variants) == 0 && !req.Price.IsPositive() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Price must be greater than zero"})
 		return
 	}
 
-	farmerID, err := primitive.ObjectIDFromHex(userID)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid farmer ID"})
+	farmID, ok := actingFarmID(c)
+	if !ok {
 		return
 	}
 
@@ -164,18 +227,35 @@ func createProduct(c *gin.Context) {
 		IsOrganic:   req.IsOrganic,
 		HarvestDate: req.HarvestDate,
 		ExpiryDate:  req.ExpiryDate,
-		FarmerID:    farmerID,
+		FarmID:      farmID,
+
+		CatchWeight:          req.CatchWeight,
+		EstimatedWeightGrams: req.EstimatedWeightGrams,
 		Rating:      4.5, // Default rating
 		Orders:      0,
 		CreatedAt:   time.Now(),
 		UpdatedAt:   time.Now(),
 	}
+	if len(req.Variants) > 0 {
+		if err := applyVariants(&product, req.Variants); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if err := checkCatchWeight(&product); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
 	collection := config.GetCollection("products")
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	_, err = collection.InsertOne(ctx, product)
+	_, err := collection.InsertOne(ctx, product)
+	if mongo.IsDuplicateKeyError(err) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Another product of your farm already uses one of these SKUs"})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create product"})
 		return
@@ -201,50 +281,97 @@ func updateProduct(c *gin.Context) {
 		return
 	}
 
-	userID := c.GetString("userID")
-	role := c.GetString("role")
-
-	if role != "farmer" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Only farmers can update products"})
+	farmID, ok := actingFarmID(c)
+	if !ok {
 		return
 	}
 
-	farmerID, err := primitive.ObjectIDFromHex(userID)
+	collection := config.GetCollection("products")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Check if product belongs to the farm
+	filter := bson.M{"_id": objectID, "farmId": farmID}
+	var current models.Product
+	err = collection.FindOne(ctx, filter).Decode(&current)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found or not owned by your farm"})
+		return
+	}
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid farmer ID"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch product"})
 		return
 	}
+	unmarkPrices(&req, &current)
 
-	collection := config.GetCollection("products")
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+	if len(req.Variants) == 0 && !req.Price.IsPositive() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Price must be greater than zero"})
+		return
+	}
 
-	// Check if product belongs to the farmer
-	filter := bson.M{"_id": objectID, "farmerId": farmerID}
-	update := bson.M{
-		"$set": bson.M{
-			"name":        req.Name,
-			"description": req.Description,
-			"price":       req.Price,
-			"category":    req.Category,
-			"stock":       req.Stock,
-			"unit":        req.Unit,
-			"images":      req.Images,
-			"isOrganic":   req.IsOrganic,
-			"harvestDate": req.HarvestDate,
-			"expiryDate":  req.ExpiryDate,
-			"updatedAt":   time.Now(),
-		},
+	// Variants replace the product's own price, stock and unit
+	priced := models.Product{
+		Price:                req.Price,
+		Stock:                req.Stock,
+		Unit:                 req.Unit,
+		CatchWeight:          req.CatchWeight,
+		EstimatedWeightGrams: req.EstimatedWeightGrams,
+	}
+	if len(req.Variants) > 0 {
+		if err := applyVariants(&priced, req.Variants); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if err := checkCatchWeight(&priced); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
+	set := bson.M{
+		"name":        req.Name,
+		"description": req.Description,
+		"price":       priced.Price,
+		"category":    req.Category,
+		"stock":       priced.Stock,
+		"unit":        priced.Unit,
+		"images":      req.Images,
+		"isOrganic":   req.IsOrganic,
+		"harvestDate": req.HarvestDate,
+		"expiryDate":  req.ExpiryDate,
+		"updatedAt":   time.Now(),
+
+		"catchWeight":          priced.CatchWeight,
+		"estimatedWeightGrams": priced.EstimatedWeightGrams,
+	}
+	update := bson.M{"$set": set}
+	// The prices are the regular ones now; the expiry scheduler marks them
+	// down again when the product is close to expiring
+	unset := bson.M{"markdown": ""}
+	if len(priced.Variants) > 0 {
+		set["variants"] = priced.Variants
+	} else {
+		unset["variants"] = ""
+	}
+	if priced.MaxPrice != nil {
+		set["maxPrice"] = priced.MaxPrice
+	} else {
+		unset["maxPrice"] = ""
+	}
+	update["$unset"] = unset
+
 	result, err := collection.UpdateOne(ctx, filter, update)
+	if mongo.IsDuplicateKeyError(err) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Another product of your farm already uses one of these SKUs"})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update product"})
 		return
 	}
 
 	if result.MatchedCount == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found or not owned by farmer"})
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found or not owned by your farm"})
 		return
 	}
 
@@ -259,17 +386,8 @@ func deleteProduct(c *gin.Context) {
 		return
 	}
 
-	userID := c.GetString("userID")
-	role := c.GetString("role")
-
-	if role != "farmer" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Only farmers can delete products"})
-		return
-	}
-
-	farmerID, err := primitive.ObjectIDFromHex(userID)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid farmer ID"})
+	farmID, ok := actingFarmID(c)
+	if !ok {
 		return
 	}
 
@@ -277,65 +395,31 @@ func deleteProduct(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	// Check if product belongs to the farmer
-	filter := bson.M{"_id": objectID, "farmerId": farmerID}
-	result, err := collection.DeleteOne(ctx, filter)
+	// Check if product belongs to the farm
+	filter := bson.M{"_id": objectID, "farmId": farmID}
+	var product models.Product
+	err = collection.FindOneAndDelete(ctx, filter).Decode(&product)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found or not owned by your farm"})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete product"})
 		return
 	}
 
-	if result.DeletedCount == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found or not owned by farmer"})
-		return
-	}
+	deleteProductBlobs(ctx, product)
 
 	c.JSON(http.StatusOK, gin.H{"message": "Product deleted successfully"})
 }
 
 func getFarmerProducts(c *gin.Context) {
-	farmerID := c.Param("farmerId")
-	objectID, err := primitive.ObjectIDFromHex(farmerID)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid farmer ID"})
-		return
-	}
-
-	collection := config.GetCollection("products")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	filter := bson.M{"farmerId": objectID}
-	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}})
-
-	cursor, err := collection.Find(ctx, filter, opts)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch products"})
-		return
-	}
-	defer cursor.Close(ctx)
-
-	var products []models.Product
-	if err = cursor.All(ctx, &products); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode products"})
-		return
-	}
-
-	c.JSON(http.StatusOK, products)
+	respondOwnedFarmProducts(c, c.Param("farmerId"))
 }
 
 func getMyProducts(c *gin.Context) {
-	userID := c.GetString("userID")
-	role := c.GetString("role")
-
-	if role != "farmer" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Only farmers can access this endpoint"})
-		return
-	}
-
-	farmerID, err := primitive.ObjectIDFromHex(userID)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid farmer ID"})
+	farmID, ok := actingFarmID(c)
+	if !ok {
 		return
 	}
 
@@ -343,7 +427,7 @@ func getMyProducts(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	filter := bson.M{"farmerId": farmerID}
+	filter := bson.M{"farmId": farmID}
 	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}})
 
 	cursor, err := collection.Find(ctx, filter, opts)
@@ -0,0 +1,323 @@
+package routes
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/crypto/bcrypt"
+
+	"farmer-marketplace/config"
+	"farmer-marketplace/models"
+)
+
+// openOrderStatuses are the order and fulfillment statuses that still need
+// the customer or the farmer.
+var openOrderStatuses = bson.A{
+	models.OrderStatusPending,
+	models.OrderStatusConfirmed,
+	models.OrderStatusPreparing,
+	models.OrderStatusReady,
+	models.OrderStatusOutForDelivery,
+}
+
+// validAvatarURL accepts absolute http(s) URLs and paths served by this API.
+func validAvatarURL(avatar string) bool {
+	if strings.HasPrefix(avatar, "/") && !strings.HasPrefix(avatar, "//") {
+		return true
+	}
+	u, err := url.Parse(avatar)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// anonymizedEmail is the placeholder address of a deleted account. It stays
+// unique so that the unique email index keeps working.
+func anonymizedEmail(userID primitive.ObjectID) string {
+	return fmt.Sprintf("deleted-%s@deleted.invalid", userID.Hex())
+}
+
+// loadCurrentUser returns the authenticated user, writing the error response
+// itself when it cannot.
+func loadCurrentUser(ctx context.Context, c *gin.Context) (*models.User, bool) {
+	userID, err := primitive.ObjectIDFromHex(c.GetString("userID"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return nil, false
+	}
+
+	var user models.User
+	err = config.GetCollection("users").FindOne(ctx, bson.M{"_id": userID, "deletedAt": bson.M{"$exists": false}}).Decode(&user)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return nil, false
+	}
+	return &user, true
+}
+
+func updateProfile(c *gin.Context) {
+	var req models.UpdateProfileRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	set := bson.M{"updatedAt": time.Now()}
+	if req.Name != nil {
+		name := strings.TrimSpace(*req.Name)
+		if name == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Name cannot be empty"})
+			return
+		}
+		set["name"] = name
+	}
+	if req.Phone != nil {
+		set["phone"] = strings.TrimSpace(*req.Phone)
+	}
+	if req.Location != nil {
+		set["location"] = strings.TrimSpace(*req.Location)
+	}
+	if req.Avatar != nil {
+		avatar := strings.TrimSpace(*req.Avatar)
+		if avatar != "" && !validAvatarURL(avatar) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Avatar must be an http(s) URL"})
+			return
+		}
+		set["avatar"] = avatar
+	}
+
+	userID, err := primitive.ObjectIDFromHex(c.GetString("userID"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var user models.User
+	err = config.GetCollection("users").FindOneAndUpdate(ctx,
+		bson.M{"_id": userID, "deletedAt": bson.M{"$exists": false}},
+		bson.M{"$set": set},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update profile"})
+		return
+	}
+
+	// Remove password from response
+	user.Password = ""
+
+	c.JSON(http.StatusOK, user)
+}
+
+// changePassword sets a new password and signs the user out everywhere. The
+// caller gets a fresh session so that only this device stays signed in.
+func changePassword(c *gin.Context) {
+	var req models.ChangePasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, ok := loadCurrentUser(ctx, c)
+	if !ok {
+		return
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.CurrentPassword)); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Current password is incorrect"})
+		return
+	}
+	if req.NewPassword == req.CurrentPassword {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "New password must be different from the current password"})
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to change password"})
+		return
+	}
+
+	_, err = config.GetCollection("users").UpdateOne(ctx,
+		bson.M{"_id": user.ID},
+		bson.M{"$set": bson.M{"password": string(hashedPassword), "updatedAt": time.Now()}},
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to change password"})
+		return
+	}
+
+	if err := revokeUserSessions(ctx, user.ID, "password change"); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Password changed, but other sessions could not be signed out"})
+		return
+	}
+
+	recordAudit(ctx, models.AuditEvent{
+		Type:    models.AuditPasswordChanged,
+		ActorID: &user.ID,
+		UserID:  &user.ID,
+		IP:      c.ClientIP(),
+	})
+
+	response, err := startSession(ctx, c, user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	response["message"] = "Password changed successfully"
+	c.JSON(http.StatusOK, response)
+}
+
+// deleteAccount anonymizes the user instead of removing the document, so
+// that orders keep pointing at a valid customer or farmer ID for the other
+// party's records. Personal data, the cart and notifications are removed,
+// and a farmer's farm is closed.
+func deleteAccount(c *gin.Context) {
+	var req models.DeleteAccountRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	user, ok := loadCurrentUser(ctx, c)
+	if !ok {
+		return
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Password is incorrect"})
+		return
+	}
+
+	// Orders in progress still need this account, and the farm it owns
+	var farm *models.Farm
+	if user.Role == models.RoleFarmer {
+		var err error
+		farm, err = findOwnedFarm(ctx, user.ID)
+		if err != nil && err != mongo.ErrNoDocuments {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete account"})
+			return
+		}
+	}
+
+	openOrders := bson.M{"customerId": user.ID, "status": bson.M{"$in": openOrderStatuses}}
+	if farm != nil {
+		openOrders = bson.M{"$or": bson.A{
+			bson.M{"fulfillments": bson.M{"$elemMatch": bson.M{"farmId": farm.ID, "status": bson.M{"$in": openOrderStatuses}}}},
+			bson.M{"fulfillments": bson.M{"$exists": false}, "items.farmId": farm.ID, "status": bson.M{"$in": openOrderStatuses}},
+		}}
+	}
+	count, err := config.GetCollection("orders").CountDocuments(ctx, openOrders)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete account"})
+		return
+	}
+	if count > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Account has orders in progress; cancel or complete them first"})
+		return
+	}
+
+	// Keep at least one admin
+	if user.Role == models.RoleAdmin {
+		admins, err := config.GetCollection("users").CountDocuments(ctx, bson.M{"role": models.RoleAdmin, "deletedAt": bson.M{"$exists": false}})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete account"})
+			return
+		}
+		if admins <= 1 {
+			c.JSON(http.StatusConflict, gin.H{"error": "The last admin account cannot be deleted"})
+			return
+		}
+	}
+
+	if err := anonymizeUser(ctx, user.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete account"})
+		return
+	}
+
+	if err := revokeUserSessions(ctx, user.ID, "account deleted"); err != nil {
+		log.Printf("Failed to revoke sessions of deleted user %s: %v", user.ID.Hex(), err)
+	}
+	if farm != nil {
+		closeFarm(ctx, farm.ID)
+	}
+	purgeUserData(ctx, user)
+
+	recordAudit(ctx, models.AuditEvent{
+		Type:    models.AuditAccountDeleted,
+		ActorID: &user.ID,
+		UserID:  &user.ID,
+		IP:      c.ClientIP(),
+	})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Account deleted"})
+}
+
+// anonymizeUser replaces the personal data of an account with placeholders
+// and marks it deleted.
+func anonymizeUser(ctx context.Context, userID primitive.ObjectID) error {
+	now := time.Now()
+	_, err := config.GetCollection("users").UpdateOne(ctx,
+		bson.M{"_id": userID},
+		bson.M{
+			"$set": bson.M{
+				"name":          "Deleted user",
+				"email":         anonymizedEmail(userID),
+				"password":      "",
+				"phone":         "",
+				"location":      "",
+				"avatar":        "",
+				"emailVerified": false,
+				"deletedAt":     now,
+				"updatedAt":     now,
+			},
+			"$unset": bson.M{"emailVerifiedAt": ""},
+		},
+	)
+	return err
+}
+
+// purgeUserData removes what a deleted account leaves behind besides orders
+// and payments. Failures are logged; the account is already anonymized.
+func purgeUserData(ctx context.Context, user *models.User) {
+	type deletion struct {
+		collection string
+		filter     bson.M
+	}
+	deletions := []deletion{
+		{"cart", bson.M{"userId": user.ID}},
+		{"notifications", bson.M{"userId": user.ID}},
+		{"account_tokens", bson.M{"userId": user.ID}},
+		{"login_attempts", bson.M{"_id": accountCounterID(user.Email)}},
+		{"farm_members", bson.M{"userId": user.ID}},
+		{"api_keys", bson.M{"userId": user.ID}},
+	}
+
+	for _, d := range deletions {
+		if _, err := config.GetCollection(d.collection).DeleteMany(ctx, d.filter); err != nil {
+			log.Printf("Failed to remove %s of deleted user %s: %v", d.collection, user.ID.Hex(), err)
+		}
+	}
+}
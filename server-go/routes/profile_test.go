@@ -0,0 +1,26 @@
+package routes
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestValidAvatarURL(t *testing.T) {
+	assert.True(t, validAvatarURL("https://cdn.example.com/a.png"))
+	assert.True(t, validAvatarURL("http://localhost:8080/a.png"))
+	assert.True(t, validAvatarURL("/uploads/avatars/a.png"))
+
+	assert.False(t, validAvatarURL("javascript:alert(1)"))
+	assert.False(t, validAvatarURL("//evil.example.com/a.png"))
+	assert.False(t, validAvatarURL("data:image/png;base64,AAAA"))
+	assert.False(t, validAvatarURL("https://"))
+}
+
+func TestAnonymizedEmail(t *testing.T) {
+	a, b := primitive.NewObjectID(), primitive.NewObjectID()
+	assert.NotEqual(t, anonymizedEmail(a), anonymizedEmail(b))
+	assert.Contains(t, anonymizedEmail(a), a.Hex())
+	assert.NotContains(t, anonymizedEmail(a), "@example")
+}
@@ -0,0 +1,414 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"farmer-marketplace/config"
+	"farmer-marketplace/models"
+	"farmer-marketplace/payments"
+)
+
+// refundLine is one order line to refund, with the quantity to restock and
+// the amount to give back.
+type refundLine struct {
+	Index    int
+	Item     models.OrderItem
+	Quantity int
+	Amount   models.Money
+}
+
+// RefundError lists the requested refund lines that cannot be honoured.
+type RefundError struct {
+	Issues []PricingIssue `json:"issues"`
+}
+
+func (e *RefundError) Error() string {
+	return fmt.Sprintf("%d refund line(s) are invalid", len(e.Issues))
+}
+
+var ErrNothingToRefund = errors.New("nothing left to refund")
+
+// planRefund works out which lines to refund. When no lines are requested
+// every remaining quantity the caller may act on is refunded. Farm members
+// (farmID set) are limited to their farm's lines.
+func planRefund(order *models.Order, req models.RefundRequest, farmID *primitive.ObjectID) ([]refundLine, error) {
+	mayRefund := func(item models.OrderItem) bool {
+		return farmID == nil || item.FarmID == *farmID
+	}
+
+	var lines []refundLine
+
+	if len(req.Items) == 0 {
+		for i, item := range order.Items {
+			remaining := item.Quantity - item.RefundedQuantity
+			if remaining <= 0 || !mayRefund(item) {
+				continue
+			}
+			lineTotal, err := item.Total()
+			if err != nil {
+				return nil, err
+			}
+			amount, err := lineTotal.Sub(item.RefundedAmount)
+			if err != nil {
+				return nil, err
+			}
+			lines = append(lines, refundLine{
+				Index:    i,
+				Item:     item,
+				Quantity: remaining,
+				Amount:   amount,
+			})
+		}
+		if len(lines) == 0 {
+			return nil, ErrNothingToRefund
+		}
+		return lines, nil
+	}
+
+	var issues []PricingIssue
+	planned := make(map[int]int)
+
+	for i, line := range req.Items {
+		issue := func(reason string) {
+			issues = append(issues, PricingIssue{Index: i, ProductID: line.ProductID, Reason: reason})
+		}
+
+		if line.Quantity <= 0 {
+			issue("quantity must be greater than zero")
+			continue
+		}
+
+		idx := -1
+		for j, item := range order.Items {
+			if isOrderLine(item, line.ProductID, line.VariantID) && item.Quantity-item.RefundedQuantity-planned[j] >= line.Quantity {
+				idx = j
+				break
+			}
+		}
+		if idx < 0 {
+			issue("no refundable line for this product, variant and quantity")
+			continue
+		}
+
+		item := order.Items[idx]
+		if !mayRefund(item) {
+			issue("line belongs to another farm")
+			continue
+		}
+
+		amount, err := item.AmountFor(line.Quantity)
+		if err != nil {
+			issue("line value is too large")
+			continue
+		}
+		if line.Amount != nil {
+			cmp, err := line.Amount.Cmp(amount)
+			if err != nil {
+				issue("amount is in another currency than the order")
+				continue
+			}
+			if !line.Amount.IsPositive() || cmp > 0 {
+				issue("amount must be positive and at most the line value")
+				continue
+			}
+			amount = *line.Amount
+		}
+
+		planned[idx] += line.Quantity
+		lines = append(lines, refundLine{Index: idx, Item: item, Quantity: line.Quantity, Amount: amount})
+	}
+
+	if len(issues) > 0 {
+		return nil, &RefundError{Issues: issues}
+	}
+
+	return lines, nil
+}
+
+// isOrderLine reports whether item is the line of the product and variant,
+// given as hex IDs; variantID is empty for products without variants.
+func isOrderLine(item models.OrderItem, productID, variantID string) bool {
+	if item.ProductID.Hex() != productID {
+		return false
+	}
+	if item.VariantID == nil {
+		return variantID == ""
+	}
+	return item.VariantID.Hex() == variantID
+}
+
+func refundTotal(lines []refundLine) (models.Money, error) {
+	var total models.Money
+	for _, line := range lines {
+		var err error
+		if total, err = total.Add(line.Amount); err != nil {
+			return models.Money{}, err
+		}
+	}
+	return total, nil
+}
+
+// orderFullyRefunded reports whether every unit of every line is refunded
+// once the planned lines are applied.
+func orderFullyRefunded(order *models.Order, lines []refundLine) bool {
+	refunded := make(map[int]int)
+	for _, line := range lines {
+		refunded[line.Index] += line.Quantity
+	}
+	for i, item := range order.Items {
+		if item.RefundedQuantity+refunded[i] < item.Quantity {
+			return false
+		}
+	}
+	return true
+}
+
+func refundOrder(provider payments.Provider) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		orderID, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid order ID"})
+			return
+		}
+
+		var req models.RefundRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		role := c.GetString("role")
+		actorID, err := primitive.ObjectIDFromHex(c.GetString("userID"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+			return
+		}
+
+		// Farm members may only refund their farm's own lines
+		var farmID *primitive.ObjectID
+		if role != models.RoleAdmin {
+			id, ok := actingFarmID(c)
+			if !ok {
+				return
+			}
+			farmID = &id
+			role = models.RoleFarmer // farm members refund with the farmer's rights
+		}
+
+		collection := config.GetCollection("orders")
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		var order models.Order
+		if err = collection.FindOne(ctx, bson.M{"_id": orderID}).Decode(&order); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+			return
+		}
+
+		if farmID != nil && !orderHasFarm(&order, *farmID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Order does not contain your products"})
+			return
+		}
+
+		if order.PaymentIntentID == "" || !paymentCaptured(order.PaymentStatus) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Order has no captured payment to refund"})
+			return
+		}
+
+		lines, err := planRefund(&order, req, farmID)
+		if err != nil {
+			var refundErr *RefundError
+			switch {
+			case errors.As(err, &refundErr):
+				c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Some refund lines are invalid", "issues": refundErr.Issues})
+			case errors.Is(err, ErrNothingToRefund):
+				c.JSON(http.StatusConflict, gin.H{"error": "Nothing left to refund"})
+			default:
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to plan refund"})
+			}
+			return
+		}
+
+		issued, err := issueRefund(ctx, provider, &order, lines, role, actorID, req.Reason)
+		if err != nil {
+			respondRefundError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message":  "Refund issued successfully",
+			"refundId": issued.ID,
+			"amount":   issued.Amount,
+			"status":   issued.Status,
+		})
+	}
+}
+
+var (
+	ErrRefundCurrencies = errors.New("refund lines use different currencies")
+	ErrRefundRefused    = errors.New("payment provider refused the refund")
+)
+
+// issuedRefund describes a refund the payment provider accepted and the order
+// status it left the order in.
+type issuedRefund struct {
+	ID     string
+	Amount models.Money
+	Status string
+}
+
+// issueRefund refunds the planned lines of an order through the provider,
+// restocks them and records the refund on the payment and the order.
+func issueRefund(ctx context.Context, provider payments.Provider, order *models.Order, lines []refundLine, role string, actorID primitive.ObjectID, reason string) (*issuedRefund, error) {
+	amount, err := refundTotal(lines)
+	if err != nil {
+		return nil, ErrRefundCurrencies
+	}
+
+	orderStatus := models.OrderStatusPartiallyRefunded
+	if orderFullyRefunded(order, lines) {
+		orderStatus = models.OrderStatusRefunded
+	}
+	if order.Status != orderStatus {
+		if err := checkOrderTransition(order.Status, orderStatus, role); err != nil {
+			return nil, err
+		}
+	}
+
+	// Claim the refunded quantities first so concurrent refunds of the same
+	// lines cannot both succeed
+	if err := paymentRecords.claimRefund(ctx, order, lines, 1); err != nil {
+		return nil, err
+	}
+
+	re, err := provider.Refund(ctx, order.PaymentIntentID, amount.Amount, reason, refundIdempotencyKey(order, amount))
+	if err != nil {
+		log.Printf("Refund for order %s failed: %v", order.ID.Hex(), err)
+		if rollbackErr := paymentRecords.claimRefund(ctx, order, lines, -1); rollbackErr != nil {
+			log.Printf("Failed to roll back refund claim for order %s: %v", order.ID.Hex(), rollbackErr)
+		}
+		return nil, ErrRefundRefused
+	}
+
+	if err := restockRefundedLines(ctx, order, lines); err != nil {
+		log.Printf("Failed to restock refunded lines of order %s: %v", order.ID.Hex(), err)
+	}
+
+	paymentStatus := "partially_refunded"
+	if orderStatus == models.OrderStatusRefunded {
+		paymentStatus = "refunded"
+	}
+	message := fmt.Sprintf("Refunded %s by %s", amount, role)
+	if reason != "" {
+		message += ": " + reason
+	}
+	if err := recordRefund(ctx, order.PaymentIntentID, paymentStatus, re.ID, amount, message); err != nil {
+		log.Printf("Failed to record refund %s: %v", re.ID, err)
+	}
+
+	if err := paymentRecords.setOrderPayment(ctx, order.ID, bson.M{"paymentStatus": paymentStatus}); err != nil {
+		log.Printf("Failed to update payment status of order %s: %v", order.ID.Hex(), err)
+	}
+
+	if order.Status != orderStatus {
+		fresh, err := paymentRecords.findOrder(ctx, order.ID)
+		if err == nil {
+			*order = *fresh
+			err = transitionOrderStatus(ctx, order, orderStatus, role, actorID, reason)
+		}
+		if err != nil {
+			log.Printf("Failed to move order %s to %s: %v", order.ID.Hex(), orderStatus, err)
+		}
+	}
+
+	return &issuedRefund{ID: re.ID, Amount: amount, Status: orderStatus}, nil
+}
+
+// paymentCaptured reports whether an order's payment was charged and not yet
+// refunded in full.
+func paymentCaptured(paymentStatus string) bool {
+	return paymentStatus == "completed" || paymentStatus == "partially_refunded"
+}
+
+// refundCancelledOrder refunds whatever is left of the captured payment of an
+// order that was just cancelled. The refund is made by the server on behalf
+// of the actor who cancelled.
+func refundCancelledOrder(ctx context.Context, provider payments.Provider, order *models.Order, actorID primitive.ObjectID, note string) error {
+	if order.PaymentIntentID == "" || !paymentCaptured(order.PaymentStatus) {
+		return nil
+	}
+	fresh, err := paymentRecords.findOrder(ctx, order.ID)
+	if err != nil {
+		return err
+	}
+	*order = *fresh
+
+	lines, err := planRefund(order, models.RefundRequest{}, nil)
+	if errors.Is(err, ErrNothingToRefund) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	reason := "Order cancelled"
+	if note != "" {
+		reason += ": " + note
+	}
+	_, err = issueRefund(ctx, provider, order, lines, roleSystem, actorID, reason)
+	return err
+}
+
+// respondRefundError maps refund failures to HTTP responses.
+func respondRefundError(c *gin.Context, err error) {
+	var transitionErr *TransitionError
+	switch {
+	case errors.As(err, &transitionErr):
+		respondTransitionError(c, err)
+	case errors.Is(err, ErrRefundCurrencies):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Refund lines use different currencies"})
+	case errors.Is(err, ErrStatusConflict):
+		c.JSON(http.StatusConflict, gin.H{"error": "Order was refunded concurrently, please retry"})
+	case errors.Is(err, ErrRefundRefused):
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Payment provider refused the refund"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record refund"})
+	}
+}
+
+// refundIdempotencyKey identifies a refund claim by its order and the refunded
+// total the claim was taken against. Retrying a refund whose outcome was lost
+// gets the same refund back; any later refund gets a key of its own.
+func refundIdempotencyKey(order *models.Order, amount models.Money) string {
+	return fmt.Sprintf("refund-%s-%d-%d", order.ID.Hex(), order.RefundedAmount.Amount, amount.Amount)
+}
+
+// restockRefundedLines puts returned quantities back into stock. They count
+// as given back on their lines, so cancelling the fulfillment later releases
+// only the rest. Lines of cancelled fulfillments already had their stock
+// released on cancellation.
+func restockRefundedLines(ctx context.Context, order *models.Order, lines []refundLine) error {
+	for _, line := range lines {
+		if idx := findFulfillment(order, line.Item.FarmID); idx >= 0 {
+			if !order.Fulfillments[idx].StockReserved && order.Fulfillments[idx].Status == models.OrderStatusCancelled {
+				continue
+			}
+		} else if order.Status == models.OrderStatusCancelled {
+			continue
+		}
+
+		if _, err := returnLineStock(ctx, order, line.Index, line.Quantity, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
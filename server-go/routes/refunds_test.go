@@ -0,0 +1,214 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"farmer-marketplace/models"
+	"farmer-marketplace/payments"
+)
+
+func TestPlanRefund(t *testing.T) {
+	alice := primitive.NewObjectID()
+	bob := primitive.NewObjectID()
+	eggs := primitive.NewObjectID()
+	honey := primitive.NewObjectID()
+
+	order := &models.Order{
+		Items: []models.OrderItem{
+			{ProductID: eggs, Quantity: 2, Price: models.NewMoney(350, "USD"), FarmID: alice},
+			{ProductID: honey, Quantity: 1, Price: models.NewMoney(1200, "USD"), FarmID: bob, RefundedQuantity: 1, RefundedAmount: models.NewMoney(1200, "USD")},
+		},
+	}
+
+	t.Run("Whole order refunds what is left", func(t *testing.T) {
+		lines, err := planRefund(order, models.RefundRequest{}, nil)
+		require.NoError(t, err)
+		require.Len(t, lines, 1)
+		assert.Equal(t, 2, lines[0].Quantity)
+		total, err := refundTotal(lines)
+		require.NoError(t, err)
+		assert.Equal(t, models.NewMoney(700, "USD"), total)
+		assert.True(t, orderFullyRefunded(order, lines))
+	})
+
+	t.Run("Farmer is limited to own lines", func(t *testing.T) {
+		_, err := planRefund(order, models.RefundRequest{}, &bob)
+		assert.ErrorIs(t, err, ErrNothingToRefund)
+
+		_, err = planRefund(order, models.RefundRequest{
+			Items: []models.RefundItemRequest{{ProductID: eggs.Hex(), Quantity: 1}},
+		}, &bob)
+		var refundErr *RefundError
+		require.True(t, errors.As(err, &refundErr))
+		assert.Equal(t, "line belongs to another farm", refundErr.Issues[0].Reason)
+	})
+
+	t.Run("Partial line amount", func(t *testing.T) {
+		amount := models.NewMoney(125, "USD")
+		lines, err := planRefund(order, models.RefundRequest{
+			Items: []models.RefundItemRequest{{ProductID: eggs.Hex(), Quantity: 1, Amount: &amount}},
+		}, &alice)
+		require.NoError(t, err)
+		total, err := refundTotal(lines)
+		require.NoError(t, err)
+		assert.Equal(t, models.NewMoney(125, "USD"), total)
+		assert.False(t, orderFullyRefunded(order, lines))
+	})
+
+	t.Run("Cannot refund more than was bought", func(t *testing.T) {
+		_, err := planRefund(order, models.RefundRequest{
+			Items: []models.RefundItemRequest{
+				{ProductID: eggs.Hex(), Quantity: 2},
+				{ProductID: eggs.Hex(), Quantity: 1},
+			},
+		}, nil)
+		var refundErr *RefundError
+		require.True(t, errors.As(err, &refundErr))
+		assert.Equal(t, 1, refundErr.Issues[0].Index)
+	})
+
+	t.Run("Lines of variants are told apart", func(t *testing.T) {
+		half, dozen := primitive.NewObjectID(), primitive.NewObjectID()
+		order := &models.Order{
+			Items: []models.OrderItem{
+				{ProductID: eggs, VariantID: &half, Quantity: 1, Price: models.NewMoney(350, "USD"), FarmID: alice},
+				{ProductID: eggs, VariantID: &dozen, Quantity: 1, Price: models.NewMoney(600, "USD"), FarmID: alice},
+			},
+		}
+
+		lines, err := planRefund(order, models.RefundRequest{
+			Items: []models.RefundItemRequest{{ProductID: eggs.Hex(), VariantID: dozen.Hex(), Quantity: 1}},
+		}, &alice)
+		require.NoError(t, err)
+		require.Len(t, lines, 1)
+		assert.Equal(t, 1, lines[0].Index)
+		assert.Equal(t, models.NewMoney(600, "USD"), lines[0].Amount)
+
+		_, err = planRefund(order, models.RefundRequest{
+			Items: []models.RefundItemRequest{{ProductID: eggs.Hex(), Quantity: 1}},
+		}, &alice)
+		var refundErr *RefundError
+		assert.True(t, errors.As(err, &refundErr))
+	})
+}
+
+func TestRefundIdempotencyKey(t *testing.T) {
+	order := &models.Order{ID: primitive.NewObjectID(), RefundedAmount: models.NewMoney(500, "USD")}
+	amount := models.NewMoney(1200, "USD")
+
+	key := refundIdempotencyKey(order, amount)
+	assert.Equal(t, key, refundIdempotencyKey(order, amount), "a retried refund reuses its key")
+
+	// Once the refund is recorded the next one is a new refund
+	order.RefundedAmount = models.NewMoney(1700, "USD")
+	assert.NotEqual(t, key, refundIdempotencyKey(order, amount))
+}
+
+func TestRefundCancelledOrder(t *testing.T) {
+	ctx := context.Background()
+	provider := payments.NewFakeProvider()
+	adminID := primitive.NewObjectID()
+
+	// A paid order that was just cancelled
+	newOrder := func() *models.Order {
+		pi, err := provider.CreateIntent(ctx, payments.IntentParams{Amount: 1900, Currency: "usd"})
+		require.NoError(t, err)
+		require.NoError(t, provider.SetIntentStatus(pi.ID, payments.StatusSucceeded))
+
+		return &models.Order{
+			ID: primitive.NewObjectID(),
+			Items: []models.OrderItem{
+				{ProductID: primitive.NewObjectID(), Quantity: 2, Price: models.NewMoney(350, "USD")},
+				{ProductID: primitive.NewObjectID(), Quantity: 1, Price: models.NewMoney(1200, "USD")},
+			},
+			TotalAmount:     models.NewMoney(1900, "USD"),
+			Status:          models.OrderStatusCancelled,
+			PaymentStatus:   "completed",
+			PaymentIntentID: pi.ID,
+			UpdatedAt:       time.Now().Truncate(time.Millisecond),
+		}
+	}
+	// An admin refunded the second line before cancelling
+	partiallyRefunded := func() *models.Order {
+		order := newOrder()
+		_, err := provider.Refund(ctx, order.PaymentIntentID, 1200, "", "")
+		require.NoError(t, err)
+		order.Items[1].RefundedQuantity, order.Items[1].RefundedAmount = 1, models.NewMoney(1200, "USD")
+		order.RefundedAmount, order.PaymentStatus = models.NewMoney(1200, "USD"), "partially_refunded"
+		return order
+	}
+
+	t.Run("Refunds the rest", func(t *testing.T) {
+		stored := partiallyRefunded()
+		fake := useFakePayments(t, stored)
+		paymentID := primitive.NewObjectID()
+		fake.payments[stored.PaymentIntentID] = &models.Payment{ID: paymentID, OrderID: stored.ID, PaymentIntentID: stored.PaymentIntentID, Status: "partially_refunded"}
+
+		order := *stored
+		require.NoError(t, refundCancelledOrder(ctx, provider, &order, adminID, "Farm closed"))
+
+		refunds := provider.Refunds()
+		assert.Equal(t, int64(700), refunds[len(refunds)-1].Amount)
+		assert.Equal(t, models.OrderStatusRefunded, stored.Status)
+		assert.Equal(t, "refunded", stored.PaymentStatus)
+		assert.Equal(t, 2, stored.Items[0].RefundedQuantity)
+		assert.Equal(t, models.NewMoney(1900, "USD"), stored.RefundedAmount)
+		assert.Equal(t, []string{"refunded"}, fake.historyOf(paymentID))
+
+		change := stored.StatusHistory[len(stored.StatusHistory)-1]
+		assert.Equal(t, models.OrderStatusCancelled, change.From)
+		assert.Equal(t, roleSystem, change.Role)
+		assert.Equal(t, adminID, change.ChangedBy)
+		assert.Equal(t, "Order cancelled: Farm closed", change.Note)
+
+		// Nothing is left to refund a second time
+		require.NoError(t, refundCancelledOrder(ctx, provider, &order, adminID, ""))
+		assert.Len(t, provider.Refunds(), len(refunds))
+	})
+
+	t.Run("Refunds a paid order its customer cancelled", func(t *testing.T) {
+		stored := newOrder()
+		useFakePayments(t, stored)
+		customerID := primitive.NewObjectID()
+
+		order := *stored
+		require.NoError(t, refundCancelledOrder(ctx, provider, &order, customerID, ""))
+
+		refunds := provider.Refunds()
+		assert.Equal(t, int64(1900), refunds[len(refunds)-1].Amount)
+		assert.Equal(t, models.OrderStatusRefunded, stored.Status)
+		assert.Equal(t, "refunded", stored.PaymentStatus)
+	})
+
+	t.Run("Unpaid orders have nothing to refund", func(t *testing.T) {
+		stored := newOrder()
+		stored.PaymentStatus = "pending"
+		useFakePayments(t, stored)
+		count := len(provider.Refunds())
+
+		order := *stored
+		require.NoError(t, refundCancelledOrder(ctx, provider, &order, adminID, ""))
+		assert.Len(t, provider.Refunds(), count)
+		assert.Equal(t, models.OrderStatusCancelled, stored.Status)
+	})
+
+	t.Run("Refused refund keeps the order cancelled", func(t *testing.T) {
+		stored := partiallyRefunded()
+		useFakePayments(t, stored)
+
+		provider.FailNext(errors.New("provider unavailable"))
+		order := *stored
+		assert.ErrorIs(t, refundCancelledOrder(ctx, provider, &order, adminID, ""), ErrRefundRefused)
+
+		assert.Equal(t, models.OrderStatusCancelled, stored.Status)
+		assert.Equal(t, 0, stored.Items[0].RefundedQuantity, "the claim is rolled back")
+		assert.Equal(t, models.NewMoney(1200, "USD"), stored.RefundedAmount)
+	})
+}
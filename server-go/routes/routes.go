@@ -2,30 +2,50 @@ package routes
 
 import (
 	"github.com/gin-gonic/gin"
+
+	"farmer-marketplace/auth"
+	"farmer-marketplace/mail"
+	"farmer-marketplace/payments"
+	"farmer-marketplace/storage"
 )
 
-func SetupRoutes(r *gin.Engine) {
+func SetupRoutes(r *gin.Engine, provider payments.Provider, keys *auth.Keyring, mailer mail.Mailer, store storage.BlobStore) {
+	tokenKeys = keys
+	blobStore = store
+
 	api := r.Group("/api")
 	{
 		// Auth routes
-		SetupAuthRoutes(api)
+		AuthRoutes(api, mailer)
 		
 		// Product routes
-		SetupProductRoutes(api)
+		ProductRoutes(api)
+		
+		// Uploaded image routes
+		ImageRoutes(api)
 		
 		// Order routes
-		SetupOrderRoutes(api)
+		OrderRoutes(api, provider)
 		
 		// Cart routes
-		SetupCartRoutes(api)
+		CartRoutes(api)
 		
 		// Farmer routes
-		SetupFarmerRoutes(api)
+		FarmerRoutes(api)
+		
+		// Farm and farm member routes
+		FarmRoutes(api, mailer)
+		
+		// API key routes
+		APIKeyRoutes(api)
 		
 		// Payment routes
-		SetupPaymentRoutes(api)
+		SetupPaymentRoutes(api, provider)
 		
 		// Notification routes
-		SetupNotificationRoutes(api)
+		NotificationRoutes(api)
+		
+		// Admin routes
+		AdminRoutes(api)
 	}
 }
\ No newline at end of file
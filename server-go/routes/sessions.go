@@ -0,0 +1,267 @@
+package routes
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"farmer-marketplace/auth"
+	"farmer-marketplace/config"
+	"farmer-marketplace/models"
+)
+
+// A session is a family of rotating refresh tokens started by one login.
+// Access tokens are short-lived and carry the family ID in their "sid" claim
+// so that revoking the family cuts off its access tokens too.
+const (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 30 * 24 * time.Hour
+)
+
+// tokenKeys signs and verifies access tokens; it is set by SetupRoutes.
+var tokenKeys *auth.Keyring
+
+var (
+	ErrRefreshTokenInvalid = errors.New("invalid or expired refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token reuse detected")
+)
+
+// isSessionRevoked reports whether a token family has been revoked. It is a
+// variable so that handler tests can run without a database.
+var isSessionRevoked = func(ctx context.Context, sessionID string) (bool, error) {
+	err := config.GetCollection("revoked_sessions").FindOne(ctx, bson.M{"_id": sessionID}).Err()
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// newOpaqueToken returns a random URL-safe token.
+func newOpaqueToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// hashToken hashes a high-entropy token for storage. A fast hash is enough
+// because the tokens are random, unlike passwords.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// startSession begins a new token family for the user and returns the
+// response fields carrying the tokens.
+func startSession(ctx context.Context, c *gin.Context, user *models.User) (gin.H, error) {
+	return issueSessionTokens(ctx, c, user, primitive.NewObjectID().Hex())
+}
+
+func issueSessionTokens(ctx context.Context, c *gin.Context, user *models.User, familyID string) (gin.H, error) {
+	refreshToken, err := newOpaqueToken()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	record := models.RefreshToken{
+		ID:        primitive.NewObjectID(),
+		UserID:    user.ID,
+		FamilyID:  familyID,
+		TokenHash: hashToken(refreshToken),
+		UserAgent: c.Request.UserAgent(),
+		IP:        c.ClientIP(),
+		ExpiresAt: now.Add(refreshTokenTTL),
+		CreatedAt: now,
+	}
+	if _, err := config.GetCollection("refresh_tokens").InsertOne(ctx, record); err != nil {
+		return nil, err
+	}
+
+	accessToken, err := generateAccessToken(user.ID.Hex(), user.Role, familyID)
+	if err != nil {
+		return nil, err
+	}
+
+	return gin.H{
+		"token":        accessToken,
+		"refreshToken": refreshToken,
+		"expiresIn":    int64(accessTokenTTL / time.Second),
+	}, nil
+}
+
+// rotateRefreshToken exchanges a refresh token for the next one in its
+// family. Presenting a token that was already exchanged means it was copied,
+// so the whole family is revoked.
+func rotateRefreshToken(ctx context.Context, c *gin.Context, raw string) (gin.H, error) {
+	collection := config.GetCollection("refresh_tokens")
+
+	var token models.RefreshToken
+	err := collection.FindOne(ctx, bson.M{"tokenHash": hashToken(raw)}).Decode(&token)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrRefreshTokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if token.RevokedAt != nil || time.Now().After(token.ExpiresAt) {
+		return nil, ErrRefreshTokenInvalid
+	}
+	if token.UsedAt != nil {
+		return nil, revokeReusedFamily(ctx, &token)
+	}
+
+	// Claim the token; losing the race means someone else used it first
+	result, err := collection.UpdateOne(ctx, bson.M{
+		"_id":       token.ID,
+		"usedAt":    bson.M{"$exists": false},
+		"revokedAt": bson.M{"$exists": false},
+	}, bson.M{"$set": bson.M{"usedAt": time.Now()}})
+	if err != nil {
+		return nil, err
+	}
+	if result.MatchedCount == 0 {
+		return nil, revokeReusedFamily(ctx, &token)
+	}
+
+	var user models.User
+	if err := config.GetCollection("users").FindOne(ctx, bson.M{"_id": token.UserID}).Decode(&user); err != nil {
+		return nil, ErrRefreshTokenInvalid
+	}
+
+	// Sessions from before 2FA became mandatory for the role end here
+	if mfaRequired(user.Role) && !user.MFA.Enabled {
+		return nil, ErrRefreshTokenInvalid
+	}
+
+	return issueSessionTokens(ctx, c, &user, token.FamilyID)
+}
+
+func revokeReusedFamily(ctx context.Context, token *models.RefreshToken) error {
+	log.Printf("Refresh token reuse for user %s, revoking session %s", token.UserID.Hex(), token.FamilyID)
+	if err := revokeSession(ctx, token.UserID, token.FamilyID, "refresh token reuse"); err != nil {
+		return err
+	}
+	return ErrRefreshTokenReused
+}
+
+// revokeSession revokes every refresh token of a family and puts the family
+// on the revocation list checked by authMiddleware.
+func revokeSession(ctx context.Context, userID primitive.ObjectID, familyID, reason string) error {
+	now := time.Now()
+
+	_, err := config.GetCollection("refresh_tokens").UpdateMany(ctx,
+		bson.M{"familyId": familyID, "revokedAt": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revokedAt": now}},
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = config.GetCollection("revoked_sessions").UpdateOne(ctx,
+		bson.M{"_id": familyID},
+		bson.M{"$setOnInsert": models.RevokedSession{
+			ID:        familyID,
+			UserID:    userID,
+			Reason:    reason,
+			RevokedAt: now,
+			ExpiresAt: now.Add(accessTokenTTL),
+		}},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+// revokeUserSessions signs a user out everywhere.
+func revokeUserSessions(ctx context.Context, userID primitive.ObjectID, reason string) error {
+	families, err := config.GetCollection("refresh_tokens").Distinct(ctx, "familyId", bson.M{
+		"userId":    userID,
+		"revokedAt": bson.M{"$exists": false},
+		"expiresAt": bson.M{"$gt": time.Now().Add(-accessTokenTTL)},
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, family := range families {
+		familyID, ok := family.(string)
+		if !ok {
+			continue
+		}
+		if err := revokeSession(ctx, userID, familyID, reason); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func refreshSession(c *gin.Context) {
+	var req models.RefreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tokens, err := rotateRefreshToken(ctx, c, req.RefreshToken)
+	switch {
+	case errors.Is(err, ErrRefreshTokenReused):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Refresh token was already used; all sessions of this login were signed out"})
+		return
+	case errors.Is(err, ErrRefreshTokenInvalid):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired refresh token"})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refresh session"})
+		return
+	}
+
+	c.JSON(http.StatusOK, tokens)
+}
+
+func logout(c *gin.Context) {
+	var req models.LogoutRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	userID, err := primitive.ObjectIDFromHex(c.GetString("userID"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if req.AllSessions {
+		err = revokeUserSessions(ctx, userID, "logout everywhere")
+	} else {
+		err = revokeSession(ctx, userID, c.GetString("sessionID"), "logout")
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out successfully"})
+}
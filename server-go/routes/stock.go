@@ -0,0 +1,330 @@
+package routes
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"farmer-marketplace/config"
+	"farmer-marketplace/models"
+)
+
+// StockShortage reports a product that does not have enough stock left to
+// cover the requested quantity.
+type StockShortage struct {
+	ProductID string `json:"productId"`
+	VariantID string `json:"variantId,omitempty"`
+	Name      string `json:"name"`
+	Requested int    `json:"requested"`
+	Available int    `json:"available"`
+}
+
+// StockError is returned by reserveStock when at least one line is short.
+type StockError struct {
+	Shortages []StockShortage `json:"shortages"`
+}
+
+func (e *StockError) Error() string {
+	return fmt.Sprintf("insufficient stock for %d product(s)", len(e.Shortages))
+}
+
+// stockStore persists stock changes of products and orders. It is a
+// variable so that tests can run without a database.
+var stocks stockStore = mongoStockStore{}
+
+type stockStore interface {
+	// take removes the quantity of an order line from stock if that much is
+	// left, reporting whether it did.
+	take(ctx context.Context, item models.OrderItem) (bool, error)
+	// put gives n units of an order line back and changes the product's
+	// order count by orders.
+	put(ctx context.Context, item models.OrderItem, n, orders int) error
+	// claimLine records n more units of line idx as given back, provided
+	// that released units were recorded so far.
+	claimLine(ctx context.Context, orderID primitive.ObjectID, idx, released, n int) (bool, error)
+	unclaimLine(ctx context.Context, orderID primitive.ObjectID, idx, n int) error
+	// clearReserved marks the stock of a farm's fulfillment, or of a legacy
+	// order when farmID is nil, as released.
+	clearReserved(ctx context.Context, orderID primitive.ObjectID, farmID *primitive.ObjectID) error
+	findOrder(ctx context.Context, id primitive.ObjectID) (*models.Order, error)
+	findProduct(ctx context.Context, id primitive.ObjectID) (*models.Product, error)
+}
+
+// reserveStock decrements stock for every order line using a conditional
+// $inc guarded by stock >= quantity, so stock can never go negative. If any
+// line cannot be reserved, the lines already reserved are released again and
+// a *StockError listing every short product is returned.
+func reserveStock(ctx context.Context, items []models.OrderItem) error {
+	var reserved []models.OrderItem
+	var shortages []StockShortage
+
+	for _, item := range items {
+		ok, err := stocks.take(ctx, item)
+		if err != nil {
+			releaseStockOrLog(ctx, reserved)
+			return err
+		}
+		if !ok {
+			shortages = append(shortages, stockShortage(ctx, item))
+			continue
+		}
+		reserved = append(reserved, item)
+	}
+
+	if len(shortages) > 0 {
+		releaseStockOrLog(ctx, reserved)
+		return &StockError{Shortages: shortages}
+	}
+
+	return nil
+}
+
+// releaseStockOrLog gives back the stock of lines reserved for an order that
+// was never saved. Every line is attempted even when some fail.
+func releaseStockOrLog(ctx context.Context, items []models.OrderItem) {
+	for _, item := range items {
+		if err := stocks.put(ctx, item, item.Quantity, -1); err != nil {
+			log.Printf("Failed to release reserved stock of product %s: %v", item.ProductID.Hex(), err)
+		}
+	}
+}
+
+// releaseOrderStock releases all stock still held by an order.
+func releaseOrderStock(ctx context.Context, orderID primitive.ObjectID) error {
+	order, err := stocks.findOrder(ctx, orderID)
+	if err != nil {
+		return err
+	}
+
+	// Legacy orders reserve stock at the order level
+	if order.StockReserved {
+		return releaseHeldStock(ctx, order, nil)
+	}
+
+	for _, f := range order.Fulfillments {
+		if !f.StockReserved {
+			continue
+		}
+		farmID := f.FarmID
+		if err := releaseHeldStock(ctx, order, &farmID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// releaseFulfillmentStock releases the stock held by one farm's part of an
+// order.
+func releaseFulfillmentStock(ctx context.Context, orderID, farmID primitive.ObjectID) error {
+	order, err := stocks.findOrder(ctx, orderID)
+	if err != nil {
+		return err
+	}
+	if idx := findFulfillment(order, farmID); idx < 0 || !order.Fulfillments[idx].StockReserved {
+		// Nothing reserved, or already released
+		return nil
+	}
+	return releaseHeldStock(ctx, order, &farmID)
+}
+
+// releaseHeldStock gives back what is left of the stock of an order's lines,
+// or of one farm's lines, and only then clears the reserved flag. A release
+// that fails partway can be retried: every unit is claimed on its line before
+// it goes back, so concurrent and retried releases give each unit back once.
+func releaseHeldStock(ctx context.Context, order *models.Order, farmID *primitive.ObjectID) error {
+	for i, item := range order.Items {
+		if farmID != nil && item.FarmID != *farmID {
+			continue
+		}
+		if _, err := returnLineStock(ctx, order, i, item.Quantity, true); err != nil {
+			return err
+		}
+	}
+	return stocks.clearReserved(ctx, order.ID, farmID)
+}
+
+// returnLineStock gives up to n more units of order line idx back to stock
+// and returns how many it gave. Releases of the whole line also take the
+// order off the product's order count.
+func returnLineStock(ctx context.Context, order *models.Order, idx, n int, release bool) (int, error) {
+	for attempt := 0; ; attempt++ {
+		item := order.Items[idx]
+		if left := item.Quantity - item.StockReleased; n > left {
+			n = left
+		}
+		if n <= 0 {
+			return 0, nil
+		}
+
+		claimed, err := stocks.claimLine(ctx, order.ID, idx, item.StockReleased, n)
+		if err != nil {
+			return 0, err
+		}
+		if !claimed {
+			// Another release or refund got there first
+			if attempt >= 2 {
+				return 0, ErrStatusConflict
+			}
+			fresh, err := stocks.findOrder(ctx, order.ID)
+			if err != nil {
+				return 0, err
+			}
+			*order = *fresh
+			continue
+		}
+
+		orders := 0
+		if release {
+			orders = -1
+		}
+		if err := stocks.put(ctx, item, n, orders); err != nil {
+			if unclaimErr := stocks.unclaimLine(ctx, order.ID, idx, n); unclaimErr != nil {
+				log.Printf("Failed to unclaim released stock of order %s: %v", order.ID.Hex(), unclaimErr)
+			}
+			return 0, err
+		}
+		order.Items[idx].StockReleased += n
+		return n, nil
+	}
+}
+
+func stockShortage(ctx context.Context, item models.OrderItem) StockShortage {
+	shortage := StockShortage{
+		ProductID: item.ProductID.Hex(),
+		Name:      item.Name,
+		Requested: item.Quantity,
+	}
+	if item.VariantID != nil {
+		shortage.VariantID = item.VariantID.Hex()
+	}
+
+	product, err := stocks.findProduct(ctx, item.ProductID)
+	if err != nil {
+		return shortage
+	}
+	available := product.Stock
+	if item.VariantID != nil {
+		available = 0
+		if variant, ok := product.Variant(*item.VariantID); ok {
+			available = variant.Stock
+		}
+	}
+	if available > 0 {
+		shortage.Available = available
+	}
+
+	return shortage
+}
+
+// mongoStockStore keeps stock in the products and orders collections.
+type mongoStockStore struct{}
+
+func (mongoStockStore) take(ctx context.Context, item models.OrderItem) (bool, error) {
+	filter := bson.M{
+		"_id":   item.ProductID,
+		"stock": bson.M{"$gte": item.Quantity},
+	}
+	if item.VariantID != nil {
+		filter["variants"] = bson.M{"$elemMatch": bson.M{
+			"_id":   *item.VariantID,
+			"stock": bson.M{"$gte": item.Quantity},
+		}}
+	}
+	inc := stockInc(item, -item.Quantity)
+	inc["orders"] = 1
+
+	result, err := config.GetCollection("products").UpdateOne(ctx, filter, bson.M{"$inc": inc})
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount > 0, nil
+}
+
+func (mongoStockStore) put(ctx context.Context, item models.OrderItem, n, orders int) error {
+	inc := stockInc(item, n)
+	if orders != 0 {
+		inc["orders"] = orders
+	}
+	_, err := config.GetCollection("products").UpdateOne(ctx, stockLineFilter(item), bson.M{"$inc": inc})
+	return err
+}
+
+func (mongoStockStore) claimLine(ctx context.Context, orderID primitive.ObjectID, idx, released, n int) (bool, error) {
+	key := fmt.Sprintf("items.%d.stockReleased", idx)
+	filter := bson.M{"_id": orderID, key: released}
+	if released == 0 {
+		filter[key] = bson.M{"$in": bson.A{0, nil}}
+	}
+
+	result, err := config.GetCollection("orders").UpdateOne(ctx, filter, bson.M{"$inc": bson.M{key: n}})
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount > 0, nil
+}
+
+func (mongoStockStore) unclaimLine(ctx context.Context, orderID primitive.ObjectID, idx, n int) error {
+	_, err := config.GetCollection("orders").UpdateOne(ctx,
+		bson.M{"_id": orderID},
+		bson.M{"$inc": bson.M{fmt.Sprintf("items.%d.stockReleased", idx): -n}},
+	)
+	return err
+}
+
+func (mongoStockStore) clearReserved(ctx context.Context, orderID primitive.ObjectID, farmID *primitive.ObjectID) error {
+	filter := bson.M{"_id": orderID, "stockReserved": true}
+	update := bson.M{"$set": bson.M{"stockReserved": false}}
+	if farmID != nil {
+		filter = bson.M{
+			"_id": orderID,
+			"fulfillments": bson.M{"$elemMatch": bson.M{
+				"farmId":        *farmID,
+				"stockReserved": true,
+			}},
+		}
+		update = bson.M{"$set": bson.M{"fulfillments.$.stockReserved": false}}
+	}
+	_, err := config.GetCollection("orders").UpdateOne(ctx, filter, update)
+	return err
+}
+
+func (mongoStockStore) findOrder(ctx context.Context, id primitive.ObjectID) (*models.Order, error) {
+	var order models.Order
+	if err := config.GetCollection("orders").FindOne(ctx, bson.M{"_id": id}).Decode(&order); err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+func (mongoStockStore) findProduct(ctx context.Context, id primitive.ObjectID) (*models.Product, error) {
+	var product models.Product
+	if err := config.GetCollection("products").FindOne(ctx, bson.M{"_id": id}).Decode(&product); err != nil {
+		return nil, err
+	}
+	return &product, nil
+}
+
+// stockLineFilter matches the product of an order line, and the variant so
+// that it can be updated with the positional operator. Stock of a variant
+// removed since the order is not given back.
+func stockLineFilter(item models.OrderItem) bson.M {
+	filter := bson.M{"_id": item.ProductID}
+	if item.VariantID != nil {
+		filter["variants._id"] = *item.VariantID
+	}
+	return filter
+}
+
+// stockInc changes the stock of an order line's product by n, and that of its
+// variant, whose stocks the product's stock sums up.
+func stockInc(item models.OrderItem, n int) bson.M {
+	inc := bson.M{"stock": n}
+	if item.VariantID != nil {
+		inc["variants.$.stock"] = n
+	}
+	return inc
+}
@@ -0,0 +1,199 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"farmer-marketplace/models"
+)
+
+// fakeStockStore keeps the stock of products and a single order in memory.
+type fakeStockStore struct {
+	stock  map[primitive.ObjectID]int
+	counts map[primitive.ObjectID]int // orders per product
+	order  *models.Order
+
+	puts      int
+	failPutAt int // the put that fails with errPutFailed, counted from 1
+}
+
+var errPutFailed = errors.New("put failed")
+
+func useFakeStocks(t *testing.T, stock map[primitive.ObjectID]int, order *models.Order) *fakeStockStore {
+	t.Helper()
+	fake := &fakeStockStore{stock: stock, counts: make(map[primitive.ObjectID]int), order: order}
+	original := stocks
+	stocks = fake
+	t.Cleanup(func() { stocks = original })
+	return fake
+}
+
+func (s *fakeStockStore) take(ctx context.Context, item models.OrderItem) (bool, error) {
+	if s.stock[item.ProductID] < item.Quantity {
+		return false, nil
+	}
+	s.stock[item.ProductID] -= item.Quantity
+	s.counts[item.ProductID]++
+	return true, nil
+}
+
+func (s *fakeStockStore) put(ctx context.Context, item models.OrderItem, n, orders int) error {
+	s.puts++
+	if s.puts == s.failPutAt {
+		return errPutFailed
+	}
+	s.stock[item.ProductID] += n
+	s.counts[item.ProductID] += orders
+	return nil
+}
+
+func (s *fakeStockStore) claimLine(ctx context.Context, orderID primitive.ObjectID, idx, released, n int) (bool, error) {
+	if s.order.Items[idx].StockReleased != released {
+		return false, nil
+	}
+	s.order.Items[idx].StockReleased += n
+	return true, nil
+}
+
+func (s *fakeStockStore) unclaimLine(ctx context.Context, orderID primitive.ObjectID, idx, n int) error {
+	s.order.Items[idx].StockReleased -= n
+	return nil
+}
+
+func (s *fakeStockStore) clearReserved(ctx context.Context, orderID primitive.ObjectID, farmID *primitive.ObjectID) error {
+	if farmID == nil {
+		s.order.StockReserved = false
+		return nil
+	}
+	if idx := findFulfillment(s.order, *farmID); idx >= 0 {
+		s.order.Fulfillments[idx].StockReserved = false
+	}
+	return nil
+}
+
+func (s *fakeStockStore) findOrder(ctx context.Context, id primitive.ObjectID) (*models.Order, error) {
+	order := *s.order
+	order.Items = append([]models.OrderItem(nil), s.order.Items...)
+	order.Fulfillments = append([]models.Fulfillment(nil), s.order.Fulfillments...)
+	return &order, nil
+}
+
+func (s *fakeStockStore) findProduct(ctx context.Context, id primitive.ObjectID) (*models.Product, error) {
+	return &models.Product{ID: id, Stock: s.stock[id]}, nil
+}
+
+func TestReserveStock(t *testing.T) {
+	ctx := context.Background()
+	apples, pears := primitive.NewObjectID(), primitive.NewObjectID()
+
+	t.Run("Reserves every line", func(t *testing.T) {
+		fake := useFakeStocks(t, map[primitive.ObjectID]int{apples: 5, pears: 2}, nil)
+		require.NoError(t, reserveStock(ctx, []models.OrderItem{
+			{ProductID: apples, Quantity: 3},
+			{ProductID: pears, Quantity: 2},
+		}))
+		assert.Equal(t, map[primitive.ObjectID]int{apples: 2, pears: 0}, fake.stock)
+		assert.Equal(t, 1, fake.counts[apples])
+	})
+
+	t.Run("Gives reserved lines back when one is short", func(t *testing.T) {
+		fake := useFakeStocks(t, map[primitive.ObjectID]int{apples: 5, pears: 1}, nil)
+		err := reserveStock(ctx, []models.OrderItem{
+			{ProductID: apples, Name: "Apples", Quantity: 3},
+			{ProductID: pears, Name: "Pears", Quantity: 2},
+		})
+
+		var stockErr *StockError
+		require.True(t, errors.As(err, &stockErr))
+		assert.Equal(t, []StockShortage{{ProductID: pears.Hex(), Name: "Pears", Requested: 2, Available: 1}}, stockErr.Shortages)
+		assert.Equal(t, map[primitive.ObjectID]int{apples: 5, pears: 1}, fake.stock)
+		assert.Zero(t, fake.counts[apples])
+	})
+}
+
+func TestReleaseStock(t *testing.T) {
+	ctx := context.Background()
+	apples, pears := primitive.NewObjectID(), primitive.NewObjectID()
+	alice, bob := primitive.NewObjectID(), primitive.NewObjectID()
+
+	newOrder := func() *models.Order {
+		return &models.Order{
+			ID: primitive.NewObjectID(),
+			Items: []models.OrderItem{
+				{ProductID: apples, Quantity: 3, FarmID: alice},
+				{ProductID: pears, Quantity: 2, FarmID: alice},
+				{ProductID: pears, Quantity: 4, FarmID: bob},
+			},
+			Fulfillments: []models.Fulfillment{
+				{FarmID: alice, StockReserved: true},
+				{FarmID: bob, StockReserved: true},
+			},
+		}
+	}
+
+	t.Run("Releases a fulfillment once", func(t *testing.T) {
+		fake := useFakeStocks(t, map[primitive.ObjectID]int{apples: 0, pears: 0}, newOrder())
+
+		require.NoError(t, releaseFulfillmentStock(ctx, fake.order.ID, alice))
+		require.NoError(t, releaseFulfillmentStock(ctx, fake.order.ID, alice))
+		assert.Equal(t, map[primitive.ObjectID]int{apples: 3, pears: 2}, fake.stock)
+		assert.False(t, fake.order.Fulfillments[0].StockReserved)
+		assert.True(t, fake.order.Fulfillments[1].StockReserved)
+
+		// Cancelling the whole order releases only what is still held
+		require.NoError(t, releaseOrderStock(ctx, fake.order.ID))
+		require.NoError(t, releaseOrderStock(ctx, fake.order.ID))
+		assert.Equal(t, map[primitive.ObjectID]int{apples: 3, pears: 6}, fake.stock)
+	})
+
+	t.Run("A failed release can be retried", func(t *testing.T) {
+		fake := useFakeStocks(t, map[primitive.ObjectID]int{apples: 0, pears: 0}, newOrder())
+
+		// The first line goes back, the second fails
+		fake.failPutAt = 2
+		assert.ErrorIs(t, releaseFulfillmentStock(ctx, fake.order.ID, alice), errPutFailed)
+		assert.Equal(t, map[primitive.ObjectID]int{apples: 3, pears: 0}, fake.stock)
+		assert.True(t, fake.order.Fulfillments[0].StockReserved, "the flag stays until every line is back")
+		assert.Zero(t, fake.order.Items[1].StockReleased)
+
+		require.NoError(t, releaseFulfillmentStock(ctx, fake.order.ID, alice))
+		assert.Equal(t, map[primitive.ObjectID]int{apples: 3, pears: 2}, fake.stock)
+		assert.False(t, fake.order.Fulfillments[0].StockReserved)
+	})
+
+	t.Run("Does not release refunded stock again", func(t *testing.T) {
+		fake := useFakeStocks(t, map[primitive.ObjectID]int{apples: 0, pears: 0}, newOrder())
+		order, _ := fake.findOrder(ctx, fake.order.ID)
+
+		require.NoError(t, restockRefundedLines(ctx, order, []refundLine{{Index: 1, Item: order.Items[1], Quantity: 1}}))
+		assert.Equal(t, 1, fake.stock[pears])
+		assert.Zero(t, fake.counts[pears], "the refunded order still counts")
+
+		require.NoError(t, releaseFulfillmentStock(ctx, order.ID, alice))
+		assert.Equal(t, map[primitive.ObjectID]int{apples: 3, pears: 2}, fake.stock)
+
+		// Refunding what was released on cancellation restocks nothing
+		order, _ = fake.findOrder(ctx, order.ID)
+		order.Fulfillments[0].Status = models.OrderStatusCancelled
+		require.NoError(t, restockRefundedLines(ctx, order, []refundLine{{Index: 1, Item: order.Items[1], Quantity: 1}}))
+		assert.Equal(t, 2, fake.stock[pears])
+	})
+
+	t.Run("Releases legacy orders", func(t *testing.T) {
+		order := newOrder()
+		order.Fulfillments = nil
+		order.StockReserved = true
+		fake := useFakeStocks(t, map[primitive.ObjectID]int{apples: 0, pears: 0}, order)
+
+		require.NoError(t, releaseOrderStock(ctx, order.ID))
+		require.NoError(t, releaseOrderStock(ctx, order.ID))
+		assert.Equal(t, map[primitive.ObjectID]int{apples: 3, pears: 6}, fake.stock)
+		assert.Equal(t, -1, fake.counts[apples])
+		assert.False(t, fake.order.StockReserved)
+	})
+}
@@ -0,0 +1,103 @@
+// Package storage keeps uploaded files, on local disk for development and
+// single-server setups and in an S3-compatible bucket, such as MinIO, for
+// everything else.
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrNotFound   = errors.New("blob not found")
+	ErrInvalidKey = errors.New("invalid blob key")
+)
+
+// BlobStore stores blobs under slash-separated keys such as
+// "products/<id>/<image>/small.jpg".
+type BlobStore interface {
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+	// Get returns the blob and its content type. The caller closes it.
+	Get(ctx context.Context, key string) (io.ReadCloser, string, error)
+	// Delete removes a blob; deleting a missing blob is not an error.
+	Delete(ctx context.Context, key string) error
+}
+
+// ValidKey reports whether key is a relative path without empty, "." or ".."
+// segments, so that it cannot escape the store.
+func ValidKey(key string) bool {
+	if key == "" || strings.ContainsAny(key, "\\\x00") {
+		return false
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// FromEnv returns an S3 store when S3_BUCKET is set, and otherwise a disk
+// store rooted at UPLOAD_PATH.
+func FromEnv() (BlobStore, error) {
+	bucket := os.Getenv("S3_BUCKET")
+	if bucket == "" {
+		root := os.Getenv("UPLOAD_PATH")
+		if root == "" {
+			root = "./uploads"
+		}
+		log.Printf("S3_BUCKET is not set, storing uploads in %s", root)
+		return NewDiskStore(root), nil
+	}
+
+	store := &S3Store{
+		Endpoint:        os.Getenv("S3_ENDPOINT"),
+		Region:          os.Getenv("S3_REGION"),
+		Bucket:          bucket,
+		AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+		// MinIO and most self-hosted stores only serve path-style URLs
+		PathStyle: os.Getenv("S3_ENDPOINT") != "",
+	}
+	if value := os.Getenv("S3_PATH_STYLE"); value != "" {
+		pathStyle, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, errors.New("S3_PATH_STYLE must be true or false")
+		}
+		store.PathStyle = pathStyle
+	}
+	if store.Region == "" {
+		store.Region = "us-east-1"
+	}
+	if store.AccessKeyID == "" || store.SecretAccessKey == "" {
+		return nil, errors.New("S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY must be set")
+	}
+	return store, nil
+}
+
+// ParseSize parses a byte size such as "10MB", "512KB" or "1048576".
+func ParseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(s, unit.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix))
+			multiplier = unit.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, errors.New("invalid size")
+	}
+	return n * multiplier, nil
+}